@@ -0,0 +1,372 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/sensor"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// queueSize is how many readings may wait for evaluation before new ones
+// are dropped.
+const queueSize = 64
+
+// Engine evaluates every rule against the readings it observes. Observe
+// only queues a reading; Run does the evaluation, so a slow database never
+// holds up sensor sampling.
+type Engine struct {
+	db *gorm.DB
+	in chan sensor.Observation
+
+	mu       sync.Mutex
+	rules    map[uint]*Rule
+	states   map[uint]*State
+	history  map[historyKey][]sample
+	handlers []func(Transition)
+	dropped  int
+}
+
+type historyKey struct {
+	sensorID int
+	quantity string
+}
+
+type sample struct {
+	at    time.Time
+	value float64
+}
+
+// NewEngine loads the rules and their state from db.
+func NewEngine(db *gorm.DB) (*Engine, error) {
+	if err := db.AutoMigrate(&Rule{}, &State{}); err != nil {
+		return nil, fmt.Errorf("migrate alert rules: %v", err)
+	}
+	e := &Engine{
+		db:      db,
+		in:      make(chan sensor.Observation, queueSize),
+		rules:   make(map[uint]*Rule),
+		states:  make(map[uint]*State),
+		history: make(map[historyKey][]sample),
+	}
+	var rules []Rule
+	if err := db.Find(&rules).Error; err != nil {
+		return nil, fmt.Errorf("load alert rules: %v", err)
+	}
+	var states []State
+	if err := db.Find(&states).Error; err != nil {
+		return nil, fmt.Errorf("load alert states: %v", err)
+	}
+	for i := range rules {
+		e.rules[rules[i].ID] = &rules[i]
+	}
+	for i := range states {
+		if _, ok := e.rules[states[i].RuleID]; ok {
+			e.states[states[i].RuleID] = &states[i]
+		}
+	}
+	for id := range e.rules {
+		if _, ok := e.states[id]; !ok {
+			e.states[id] = &State{RuleID: id, State: Inactive, Since: time.Now().UTC()}
+		}
+	}
+	return e, nil
+}
+
+// OnTransition calls fn with every phase change. Register handlers before
+// Run; they are called from Run's goroutine.
+func (e *Engine) OnTransition(fn func(Transition)) {
+	e.handlers = append(e.handlers, fn)
+}
+
+// Observe queues o for evaluation. It never blocks: when the queue is full
+// the reading is dropped and counted. It matches sensor.SensorStore.Observe.
+func (e *Engine) Observe(o sensor.Observation) {
+	select {
+	case e.in <- o:
+	default:
+		e.mu.Lock()
+		e.dropped++
+		e.mu.Unlock()
+	}
+}
+
+// Run evaluates queued readings until ctx is done. Every interval it also
+// fires pending alerts whose For has passed without a new reading.
+func (e *Engine) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case o := <-e.in:
+			e.notify(e.evaluate(o))
+		case now := <-t.C:
+			e.notify(e.tick(now.UTC()))
+			e.mu.Lock()
+			if e.dropped > 0 {
+				logger.Warn("alert queue full, readings dropped", "dropped", e.dropped)
+				e.dropped = 0
+			}
+			e.mu.Unlock()
+		}
+	}
+}
+
+func (e *Engine) evaluate(o sensor.Observation) []Transition {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for q, v := range o.Values {
+		e.record(historyKey{o.SensorID, q}, o.At, v)
+	}
+	var out []Transition
+	for _, r := range e.sorted() {
+		if r.Disabled || r.SensorID != o.SensorID {
+			continue
+		}
+		if _, ok := o.Values[r.Quantity]; !ok {
+			continue
+		}
+		v, ok := e.value(r, o.At)
+		if !ok {
+			continue
+		}
+		if t, ok := e.step(r, v, o.At); ok {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func (e *Engine) tick(now time.Time) []Transition {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var out []Transition
+	for _, r := range e.sorted() {
+		st := e.states[r.ID]
+		if r.Disabled || st.State != Pending || st.Value == nil || now.Sub(st.Since) < r.For.Duration {
+			continue
+		}
+		if t, ok := e.step(r, *st.Value, now); ok {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func (e *Engine) notify(transitions []Transition) {
+	for _, t := range transitions {
+		for _, fn := range e.handlers {
+			fn(t)
+		}
+	}
+}
+
+// record adds a sample, keeping what the longest rate window on the
+// quantity needs plus the sample just before it.
+func (e *Engine) record(key historyKey, at time.Time, v float64) {
+	var window time.Duration
+	for _, r := range e.rules {
+		if r.SensorID == key.sensorID && r.Quantity == key.quantity && r.Window.Duration > window {
+			window = r.Window.Duration
+		}
+	}
+	h := append(e.history[key], sample{at, v})
+	cutoff := at.Add(-window)
+	drop := 0
+	for drop+1 < len(h) && !h[drop+1].at.After(cutoff) {
+		drop++
+	}
+	e.history[key] = append(h[:0:0], h[drop:]...)
+}
+
+// value is what r compares with its threshold at now: the latest value, or
+// the change since the last sample at least Window old. There is no value
+// until enough history has been seen.
+func (e *Engine) value(r *Rule, now time.Time) (float64, bool) {
+	h := e.history[historyKey{r.SensorID, r.Quantity}]
+	if len(h) == 0 {
+		return 0, false
+	}
+	latest := h[len(h)-1].value
+	if r.Condition == Above || r.Condition == Below {
+		return latest, true
+	}
+	cutoff := now.Add(-r.Window.Duration)
+	for i := len(h) - 1; i >= 0; i-- {
+		if !h[i].at.After(cutoff) {
+			return latest - h[i].value, true
+		}
+	}
+	return 0, false
+}
+
+// step moves r to its next phase for v. It reports the transition, if
+// there was one.
+func (e *Engine) step(r *Rule, v float64, now time.Time) (Transition, bool) {
+	st := e.states[r.ID]
+	st.Value, st.EvaluatedAt = &v, &now
+
+	next := st.State
+	switch st.State {
+	case Inactive, Resolved:
+		if r.active(v) {
+			next = Pending
+			if r.For.Duration == 0 {
+				next = Firing
+			}
+		}
+	case Pending:
+		if !r.active(v) {
+			// It never fired, so there is nothing to resolve.
+			next = Inactive
+		} else if now.Sub(st.Since) >= r.For.Duration {
+			next = Firing
+		}
+	case Firing:
+		if r.cleared(v) {
+			next = Resolved
+		}
+	}
+	if next == st.State {
+		return Transition{}, false
+	}
+
+	from := st.State
+	st.State, st.Since = next, now
+	switch next {
+	case Firing:
+		st.FiredAt = &now
+	case Resolved:
+		st.ResolvedAt = &now
+	}
+	if err := e.saveState(st); err != nil {
+		logger.Error("save alert state", "rule_id", r.ID, "err", err)
+	}
+	logger.Info("alert state changed", "rule_id", r.ID, "rule", r.Name,
+		"sensor_id", r.SensorID, "from", from, "to", next, "value", v)
+	return Transition{Rule: *r, From: from, To: next, Value: v, At: now}, true
+}
+
+func (e *Engine) saveState(st *State) error {
+	return e.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(st).Error
+}
+
+// sorted returns the rules by ID, so evaluation order is stable.
+func (e *Engine) sorted() []*Rule {
+	rules := make([]*Rule, 0, len(e.rules))
+	for _, r := range e.rules {
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+	return rules
+}
+
+// Alerts returns every rule with its state, by ID. A non-empty phase only
+// returns rules in that phase.
+func (e *Engine) Alerts(phase Phase) []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	out := make([]Alert, 0, len(e.rules))
+	for _, r := range e.sorted() {
+		if st := e.states[r.ID]; phase == "" || st.State == phase {
+			out = append(out, Alert{*r, *st})
+		}
+	}
+	return out
+}
+
+// Alert returns rule id with its state.
+func (e *Engine) Alert(id uint) (Alert, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	r, ok := e.rules[id]
+	if !ok {
+		return Alert{}, fmt.Errorf("rule with id=%d: %w", id, ErrNotFound)
+	}
+	return Alert{*r, *e.states[id]}, nil
+}
+
+// Create adds r; its ID and timestamps are assigned.
+func (e *Engine) Create(r Rule) (Alert, error) {
+	if err := r.Validate(); err != nil {
+		return Alert{}, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	r.ID = 0
+	st := State{State: Inactive, Since: time.Now().UTC()}
+	err := e.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&r).Error; err != nil {
+			return err
+		}
+		st.RuleID = r.ID
+		return tx.Create(&st).Error
+	})
+	if err != nil {
+		return Alert{}, fmt.Errorf("save alert rule: %v", err)
+	}
+	e.rules[r.ID], e.states[r.ID] = &r, &st
+	return Alert{r, st}, nil
+}
+
+// Update replaces rule id with r. The rule starts over as inactive, since
+// its old state belonged to a different condition.
+func (e *Engine) Update(id uint, r Rule) (Alert, error) {
+	if err := r.Validate(); err != nil {
+		return Alert{}, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	old, ok := e.rules[id]
+	if !ok {
+		return Alert{}, fmt.Errorf("rule with id=%d: %w", id, ErrNotFound)
+	}
+	r.ID, r.CreatedAt = id, old.CreatedAt
+	st := State{RuleID: id, State: Inactive, Since: time.Now().UTC()}
+	err := e.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&r).Error; err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&st).Error
+	})
+	if err != nil {
+		return Alert{}, fmt.Errorf("save alert rule: %v", err)
+	}
+	e.rules[id], e.states[id] = &r, &st
+	return Alert{r, st}, nil
+}
+
+// Delete removes rule id and its state.
+func (e *Engine) Delete(id uint) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.rules[id]; !ok {
+		return fmt.Errorf("rule with id=%d: %w", id, ErrNotFound)
+	}
+	err := e.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&State{}, "rule_id = ?", id).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Rule{}, id).Error
+	})
+	if err != nil {
+		return fmt.Errorf("delete alert rule: %v", err)
+	}
+	delete(e.rules, id)
+	delete(e.states, id)
+	return nil
+}
@@ -0,0 +1,250 @@
+package alert
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/config"
+	"github.com/maskarb/skarbek-dev/internal/database"
+	"github.com/maskarb/skarbek-dev/internal/sensor"
+	"gorm.io/gorm"
+)
+
+var start = time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+
+func openDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := database.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close(db) })
+	return db
+}
+
+// newEngine returns an engine on db with r added.
+func newEngine(t *testing.T, db *gorm.DB, r Rule) (*Engine, uint) {
+	t.Helper()
+	e, err := NewEngine(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := e.Create(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e, a.ID
+}
+
+func minutes(n int) config.Duration {
+	return config.Duration{Duration: time.Duration(n) * time.Minute}
+}
+
+// reading is one temperature of sensor 1, n minutes after start.
+type reading struct {
+	min   int
+	value float64
+	// to is the phase the reading moves the rule to, or "" for none.
+	to Phase
+}
+
+// feed evaluates each reading and checks the transition it causes.
+func feed(t *testing.T, e *Engine, readings []reading) {
+	t.Helper()
+	for _, rd := range readings {
+		at := start.Add(time.Duration(rd.min) * time.Minute)
+		got := e.evaluate(sensor.Observation{SensorID: 1, At: at,
+			Values: map[string]float64{sensor.QuantityTemperature: rd.value}})
+		switch {
+		case rd.to == "" && len(got) != 0:
+			t.Fatalf("%v at +%dm: %s -> %s, want no transition", rd.value, rd.min, got[0].From, got[0].To)
+		case rd.to != "" && len(got) != 1:
+			t.Fatalf("%v at +%dm: %d transitions, want one to %s", rd.value, rd.min, len(got), rd.to)
+		case rd.to != "" && got[0].To != rd.to:
+			t.Fatalf("%v at +%dm: %s -> %s, want %s", rd.value, rd.min, got[0].From, got[0].To, rd.to)
+		}
+	}
+}
+
+func TestPendingClearsToInactive(t *testing.T) {
+	e, _ := newEngine(t, openDB(t), Rule{Name: "Attic heat", SensorID: 1, Quantity: sensor.QuantityTemperature,
+		Condition: Above, Threshold: 30, Hysteresis: 1, For: minutes(5)})
+
+	feed(t, e, []reading{
+		{0, 31, Pending},
+		{5, 31, Firing},
+		{6, 28, Resolved},
+		// A blip over the threshold after an earlier alert resolved never
+		// fires, so it must not be reported as resolved again.
+		{7, 31, Pending},
+		{8, 29, Inactive},
+	})
+}
+
+func TestHysteresis(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		rule     Rule
+		readings []reading
+	}{
+		{"above", Rule{Condition: Above, Threshold: 30, Hysteresis: 2}, []reading{
+			{0, 30, ""},
+			{1, 31, Firing},
+			// Under the threshold but not by the hysteresis.
+			{2, 29.5, ""},
+			{3, 31, ""},
+			{4, 28, Resolved},
+			{5, 30.5, Firing},
+		}},
+		{"below", Rule{Condition: Below, Threshold: 5, Hysteresis: 1}, []reading{
+			{0, 4, Firing},
+			{1, 5.5, ""},
+			{2, 6, Resolved},
+			{3, 6, ""},
+		}},
+		{"no hysteresis", Rule{Condition: Above, Threshold: 30}, []reading{
+			{0, 31, Firing},
+			{1, 30, Resolved},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := tc.rule
+			r.Name, r.SensorID, r.Quantity = tc.name, 1, sensor.QuantityTemperature
+			e, _ := newEngine(t, openDB(t), r)
+			feed(t, e, tc.readings)
+		})
+	}
+}
+
+func TestFor(t *testing.T) {
+	e, _ := newEngine(t, openDB(t), Rule{Name: "Attic heat", SensorID: 1, Quantity: sensor.QuantityTemperature,
+		Condition: Above, Threshold: 30, For: minutes(5)})
+
+	feed(t, e, []reading{
+		{0, 31, Pending},
+		{4, 32, ""},
+		{5, 31, Firing},
+		{6, 29, Resolved},
+		// Pending starts over rather than counting the earlier minutes.
+		{7, 31, Pending},
+		{11, 31, ""},
+		{12, 31, Firing},
+	})
+}
+
+func TestRates(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		rule     Rule
+		readings []reading
+	}{
+		{"rises", Rule{Condition: Rises, Threshold: 2, Hysteresis: 0.5, Window: minutes(10)}, []reading{
+			// No value until there is a sample a window old.
+			{0, 20, ""},
+			{5, 23, ""},
+			{10, 22.5, Firing},
+			// Up 1.8 since +5m: under the threshold, not by the hysteresis.
+			{15, 24.8, ""},
+			{20, 23.5, Resolved},
+			{25, 23.5, ""},
+		}},
+		{"falls", Rule{Condition: Falls, Threshold: 1, Window: minutes(10)}, []reading{
+			{0, 20, ""},
+			{10, 19.5, ""},
+			{20, 18, Firing},
+			{30, 18, Resolved},
+		}},
+		{"window", Rule{Condition: Rises, Threshold: 2, Window: minutes(10)}, []reading{
+			// A steady climb only counts over the window.
+			{0, 20, ""},
+			{10, 21, ""},
+			{20, 22, ""},
+			{30, 23, ""},
+			{40, 26, Firing},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := tc.rule
+			r.Name, r.SensorID, r.Quantity = tc.name, 1, sensor.QuantityTemperature
+			e, _ := newEngine(t, openDB(t), r)
+			feed(t, e, tc.readings)
+		})
+	}
+}
+
+// TestTick makes sure a pending alert fires once its For has passed even
+// when the sensor sends nothing new.
+func TestTick(t *testing.T) {
+	e, id := newEngine(t, openDB(t), Rule{Name: "Attic heat", SensorID: 1, Quantity: sensor.QuantityTemperature,
+		Condition: Above, Threshold: 30, For: minutes(5)})
+	feed(t, e, []reading{{0, 31, Pending}})
+
+	if got := e.tick(start.Add(4 * time.Minute)); len(got) != 0 {
+		t.Fatalf("tick before For: %d transitions", len(got))
+	}
+	got := e.tick(start.Add(5 * time.Minute))
+	if len(got) != 1 || got[0].To != Firing || got[0].Value != 31 {
+		t.Fatalf("tick after For: %+v, want firing at 31", got)
+	}
+	if got := e.tick(start.Add(6 * time.Minute)); len(got) != 0 {
+		t.Errorf("tick while firing: %d transitions", len(got))
+	}
+	a, err := e.Alert(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Status.FiredAt == nil || !a.Status.FiredAt.Equal(start.Add(5*time.Minute)) {
+		t.Errorf("fired at %v, want +5m", a.Status.FiredAt)
+	}
+}
+
+// TestRestart makes sure rules keep their phase across restarts, so a
+// firing alert resolves rather than firing again.
+func TestRestart(t *testing.T) {
+	db := openDB(t)
+	e, id := newEngine(t, db, Rule{Name: "Attic heat", SensorID: 1, Quantity: sensor.QuantityTemperature,
+		Condition: Above, Threshold: 30, Hysteresis: 1})
+	feed(t, e, []reading{{0, 31, Firing}})
+
+	e, err := NewEngine(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := e.Alert(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Status.State != Firing || a.Status.FiredAt == nil || a.Status.Value == nil || *a.Status.Value != 31 {
+		t.Fatalf("restored state = %+v, want firing at 31", a.Status)
+	}
+	feed(t, e, []reading{
+		{1, 31, ""},
+		{2, 28, Resolved},
+	})
+
+	e, err = NewEngine(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := e.Alert(id); a.Status.State != Resolved || a.Status.ResolvedAt == nil {
+		t.Errorf("restored state = %+v, want resolved", a.Status)
+	}
+}
+
+func TestDisabledAndOtherSensors(t *testing.T) {
+	e, id := newEngine(t, openDB(t), Rule{Name: "Attic heat", SensorID: 2, Quantity: sensor.QuantityTemperature,
+		Condition: Above, Threshold: 30})
+	// The readings are of sensor 1.
+	feed(t, e, []reading{{0, 31, ""}})
+
+	a, err := e.Alert(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Rule.SensorID, a.Rule.Disabled = 1, true
+	if _, err := e.Update(id, a.Rule); err != nil {
+		t.Fatal(err)
+	}
+	feed(t, e, []reading{{1, 31, ""}})
+}
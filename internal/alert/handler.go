@@ -0,0 +1,139 @@
+package alert
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/maskarb/skarbek-dev/internal/apierror"
+)
+
+type alertServer struct {
+	engine *Engine
+
+	// Protect, if set, guards the endpoints that change rules.
+	Protect func(http.Handler) http.Handler
+}
+
+// NewAlertServer serves the rules of engine and their state.
+func NewAlertServer(engine *Engine) *alertServer {
+	return &alertServer{engine: engine}
+}
+
+// Routes is mounted under /api/v1/alerts.
+func (as *alertServer) Routes() *chi.Mux {
+	router := chi.NewRouter()
+	router.Route("/rules", func(r chi.Router) {
+		r.Get("/", as.listRulesHandler)
+		r.With(as.protect).Post("/", as.postRuleHandler)
+		r.Get("/{ruleID}", as.getRuleHandler)
+		r.With(as.protect).Put("/{ruleID}", as.putRuleHandler)
+		r.With(as.protect).Delete("/{ruleID}", as.deleteRuleHandler)
+	})
+	return router
+}
+
+func (as *alertServer) protect(next http.Handler) http.Handler {
+	if as.Protect == nil {
+		return next
+	}
+	return as.Protect(next)
+}
+
+// listRulesHandler lists every rule, or with ?state= those in one phase.
+func (as *alertServer) listRulesHandler(w http.ResponseWriter, req *http.Request) {
+	phase := Phase(req.URL.Query().Get("state"))
+	switch phase {
+	case "", Inactive, Pending, Firing, Resolved:
+	default:
+		apierror.Write(w, req, apierror.BadRequest("invalid_state",
+			"state must be inactive, pending, firing or resolved"))
+		return
+	}
+	render.JSON(w, req, as.engine.Alerts(phase))
+}
+
+func (as *alertServer) getRuleHandler(w http.ResponseWriter, req *http.Request) {
+	id, ok := ruleID(w, req)
+	if !ok {
+		return
+	}
+	a, err := as.engine.Alert(id)
+	if err != nil {
+		apierror.Write(w, req, ruleError(err))
+		return
+	}
+	render.JSON(w, req, a)
+}
+
+func (as *alertServer) postRuleHandler(w http.ResponseWriter, req *http.Request) {
+	var r Rule
+	if !apierror.DecodeStrict(w, req, &r) {
+		return
+	}
+	a, err := as.engine.Create(r)
+	if err != nil {
+		apierror.Write(w, req, ruleError(err))
+		return
+	}
+	logger.Ctx(req.Context()).Info("alert rule created", "rule_id", a.ID, "rule", a.Name)
+	w.WriteHeader(http.StatusCreated)
+	render.JSON(w, req, a)
+}
+
+// putRuleHandler replaces a rule, which restarts it as inactive.
+func (as *alertServer) putRuleHandler(w http.ResponseWriter, req *http.Request) {
+	id, ok := ruleID(w, req)
+	if !ok {
+		return
+	}
+	var r Rule
+	if !apierror.DecodeStrict(w, req, &r) {
+		return
+	}
+	a, err := as.engine.Update(id, r)
+	if err != nil {
+		apierror.Write(w, req, ruleError(err))
+		return
+	}
+	logger.Ctx(req.Context()).Info("alert rule updated", "rule_id", a.ID, "rule", a.Name)
+	render.JSON(w, req, a)
+}
+
+func (as *alertServer) deleteRuleHandler(w http.ResponseWriter, req *http.Request) {
+	id, ok := ruleID(w, req)
+	if !ok {
+		return
+	}
+	if err := as.engine.Delete(id); err != nil {
+		apierror.Write(w, req, ruleError(err))
+		return
+	}
+	logger.Ctx(req.Context()).Info("alert rule deleted", "rule_id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ruleID parses the {ruleID} URL parameter, writing the error response
+// when it is not a number.
+func ruleID(w http.ResponseWriter, req *http.Request) (uint, bool) {
+	param := chi.URLParam(req, "ruleID")
+	id, err := strconv.ParseUint(param, 10, 32)
+	if err != nil {
+		apierror.Write(w, req, apierror.BadRequest("invalid_rule_id",
+			"rule id must be a positive integer").WithDetails(map[string]string{"rule_id": param}))
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func ruleError(err error) error {
+	switch {
+	case errors.Is(err, ErrInvalidRule):
+		return apierror.BadRequest("invalid_rule", err.Error())
+	case errors.Is(err, ErrNotFound):
+		return apierror.NotFound("rule_not_found", err.Error())
+	}
+	return err
+}
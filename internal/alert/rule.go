@@ -0,0 +1,234 @@
+// Package alert evaluates threshold and rate-of-change rules against sensor
+// readings. Each rule moves through inactive, pending, firing and resolved;
+// rules and their state are kept in SQLite so alerts survive restarts.
+package alert
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/config"
+	"github.com/maskarb/skarbek-dev/internal/logging"
+	"github.com/maskarb/skarbek-dev/internal/notify"
+	"github.com/maskarb/skarbek-dev/internal/sensor"
+	"github.com/maskarb/skarbek-dev/internal/units"
+)
+
+var logger = logging.For("alert")
+
+var (
+	// ErrNotFound is returned for rule IDs the engine does not know.
+	ErrNotFound = errors.New("alert rule not found")
+	// ErrInvalidRule is wrapped by errors caused by bad rule input.
+	ErrInvalidRule = errors.New("invalid alert rule")
+)
+
+// Condition is what a rule checks.
+type Condition string
+
+const (
+	// Above and Below compare the latest value with the threshold.
+	Above Condition = "above"
+	Below Condition = "below"
+	// Rises and Falls compare the change over the rule's window with the
+	// threshold.
+	Rises Condition = "rises"
+	Falls Condition = "falls"
+)
+
+// maxWindow bounds rate windows, and with them how much history the engine
+// keeps in memory.
+const maxWindow = 24 * time.Hour
+
+// Rule is one alert condition on one quantity of one sensor. Thresholds
+// are °C, %RH and Pa, like the SI readings; for Rises and Falls they are
+// the change over Window.
+type Rule struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Name      string    `json:"name"`
+	SensorID  int       `json:"sensor_id" gorm:"index"`
+	Quantity  string    `json:"quantity"`
+	Condition Condition `json:"condition"`
+	Threshold float64   `json:"threshold"`
+	// Hysteresis is how far back past the threshold the value has to go
+	// before a firing alert resolves, so a value hovering at the threshold
+	// does not flap.
+	Hysteresis float64 `json:"hysteresis"`
+	// For is how long the condition has to hold before the alert fires;
+	// until then it is pending.
+	For    config.Duration `json:"for" gorm:"type:integer"`
+	Window config.Duration `json:"window" gorm:"type:integer"`
+	// Disabled rules are not evaluated and stay inactive.
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName keeps the tables of this package together.
+func (Rule) TableName() string { return "alert_rules" }
+
+// Validate reports rules the engine cannot evaluate.
+func (r Rule) Validate() error {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s", ErrInvalidRule, fmt.Sprintf(format, args...))
+	}
+	if strings.TrimSpace(r.Name) == "" {
+		return invalid("name is required")
+	}
+	if r.SensorID <= 0 {
+		return invalid("sensor_id must be positive")
+	}
+	switch r.Quantity {
+	case sensor.QuantityTemperature, sensor.QuantityHumidity, sensor.QuantityPressure:
+	default:
+		return invalid("quantity %q must be temperature, humidity or pressure", r.Quantity)
+	}
+	switch r.Condition {
+	case Above, Below:
+		if r.Window.Duration != 0 {
+			return invalid("window only applies to rises and falls")
+		}
+	case Rises, Falls:
+		if r.Threshold <= 0 {
+			return invalid("threshold of %s must be a positive change", r.Condition)
+		}
+		if r.Window.Duration <= 0 || r.Window.Duration > maxWindow {
+			return invalid("window must be between 0 and %v", maxWindow)
+		}
+	default:
+		return invalid("condition %q must be above, below, rises or falls", r.Condition)
+	}
+	if r.Hysteresis < 0 {
+		return invalid("hysteresis must not be negative")
+	}
+	if r.For.Duration < 0 || r.For.Duration > maxWindow {
+		return invalid("for must be between 0 and %v", maxWindow)
+	}
+	return nil
+}
+
+// active reports whether v meets the condition.
+func (r Rule) active(v float64) bool {
+	switch r.Condition {
+	case Above, Rises:
+		return v > r.Threshold
+	case Below:
+		return v < r.Threshold
+	case Falls:
+		return -v > r.Threshold
+	}
+	return false
+}
+
+// cleared reports whether v is back past the threshold by the hysteresis.
+func (r Rule) cleared(v float64) bool {
+	switch r.Condition {
+	case Above, Rises:
+		return v <= r.Threshold-r.Hysteresis
+	case Below:
+		return v >= r.Threshold+r.Hysteresis
+	case Falls:
+		return -v <= r.Threshold-r.Hysteresis
+	}
+	return true
+}
+
+// Phase is where a rule is in its life cycle.
+type Phase string
+
+const (
+	// Inactive rules have not met their condition since they were created
+	// or changed.
+	Inactive Phase = "inactive"
+	// Pending rules meet their condition, but not yet for the rule's For.
+	Pending Phase = "pending"
+	Firing  Phase = "firing"
+	// Resolved rules fired and have since cleared.
+	Resolved Phase = "resolved"
+)
+
+// State is the persisted life cycle of a rule.
+type State struct {
+	RuleID uint  `json:"-" gorm:"primaryKey;autoIncrement:false"`
+	State  Phase `json:"state"`
+	// Since is when the rule entered State.
+	Since time.Time `json:"since"`
+	// Value is what the rule saw at its last evaluation: the reading, or
+	// the change over the window.
+	Value       *float64   `json:"value,omitempty"`
+	EvaluatedAt *time.Time `json:"evaluated_at,omitempty"`
+	FiredAt     *time.Time `json:"fired_at,omitempty"`
+	ResolvedAt  *time.Time `json:"resolved_at,omitempty"`
+}
+
+// TableName keeps the tables of this package together.
+func (State) TableName() string { return "alert_states" }
+
+// Alert is a rule with its state, as the API shows it.
+type Alert struct {
+	Rule
+	Status State `json:"status"`
+}
+
+// Transition is a change of a rule's phase.
+type Transition struct {
+	Rule  Rule
+	From  Phase
+	To    Phase
+	Value float64
+	At    time.Time
+}
+
+// quantityUnits are the units thresholds are given in.
+var quantityUnits = map[string]string{
+	sensor.QuantityTemperature: "°C",
+	sensor.QuantityHumidity:    "%RH",
+	sensor.QuantityPressure:    "Pa",
+}
+
+// Event describes t for notification channels.
+func (t Transition) Event() notify.Event {
+	r := t.Rule
+	unit := quantityUnits[r.Quantity]
+	num := func(v float64) string {
+		return strconv.FormatFloat(units.Round(v, 2), 'f', -1, 64) + " " + unit
+	}
+	subject := fmt.Sprintf("%s of sensor %d", r.Quantity, r.SensorID)
+
+	var msg string
+	switch {
+	case t.To == Resolved && (r.Condition == Above || r.Condition == Below):
+		msg = fmt.Sprintf("%s is back to %s.", subject, num(t.Value))
+	case t.To == Resolved:
+		msg = fmt.Sprintf("%s changed by %s over %v.", subject, num(t.Value), r.Window.Duration)
+	case r.Condition == Above || r.Condition == Below:
+		msg = fmt.Sprintf("%s is %s, %s %s", subject, num(t.Value), r.Condition, num(r.Threshold))
+		if r.For.Duration > 0 {
+			msg += fmt.Sprintf(" for %v", r.For.Duration)
+		}
+		msg += "."
+	default:
+		verb := "rose"
+		if r.Condition == Falls {
+			verb = "fell"
+		}
+		msg = fmt.Sprintf("%s %s by %s over %v, more than %s.", subject, verb, num(math.Abs(t.Value)), r.Window.Duration, num(r.Threshold))
+	}
+
+	v := t.Value
+	return notify.Event{
+		Kind:     "alert",
+		Status:   string(t.To),
+		Title:    fmt.Sprintf("[%s] %s", strings.ToUpper(string(t.To)), r.Name),
+		Message:  msg,
+		SensorID: r.SensorID,
+		Rule:     r.Name,
+		Quantity: r.Quantity,
+		Value:    &v,
+		At:       t.At,
+	}
+}
@@ -0,0 +1,168 @@
+// Package apierror is the single error type of the HTTP API. Every handler
+// reports failures through Write, so clients always get the same JSON
+// envelope:
+//
+//	{"error": {"status": 400, "code": "invalid_sensor_id",
+//	           "message": "...", "request_id": "...", "details": {...}}}
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
+	"github.com/maskarb/skarbek-dev/internal/logging"
+)
+
+var logger = logging.For("http")
+
+// Machine readable codes shared across packages. Packages may use their own
+// codes for errors only they produce.
+const (
+	CodeBadRequest       = "bad_request"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeConflict         = "conflict"
+	CodeInternal         = "internal_error"
+	CodeBadGateway       = "bad_gateway"
+	CodeUnavailable      = "unavailable"
+)
+
+// Error is an API error. Cause, if set, is logged but never sent to the
+// client.
+type Error struct {
+	Status    int         `json:"status"`
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	RequestID string      `json:"request_id,omitempty"`
+	Details   interface{} `json:"details,omitempty"`
+
+	Cause error `json:"-"`
+}
+
+// New returns an error with the given status, code and message.
+func New(status int, code, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+// Newf is New with a formatted message.
+func Newf(status int, code, format string, args ...interface{}) *Error {
+	return New(status, code, fmt.Sprintf(format, args...))
+}
+
+func (e *Error) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Message, e.Cause)
+	}
+	return e.Code + ": " + e.Message
+}
+
+func (e *Error) Unwrap() error { return e.Cause }
+
+// WithDetails returns a copy of e carrying details, e.g. the offending
+// field names of a validation failure.
+func (e *Error) WithDetails(details interface{}) *Error {
+	c := *e
+	c.Details = details
+	return &c
+}
+
+// WithCause returns a copy of e that logs err as the underlying cause.
+func (e *Error) WithCause(err error) *Error {
+	c := *e
+	c.Cause = err
+	return &c
+}
+
+// BadRequest is a 400 with a caller supplied code.
+func BadRequest(code, message string) *Error {
+	return New(http.StatusBadRequest, code, message)
+}
+
+// NotFound is a 404 with a caller supplied code.
+func NotFound(code, message string) *Error {
+	return New(http.StatusNotFound, code, message)
+}
+
+// Internal hides err behind a generic 500; err is only logged.
+func Internal(err error) *Error {
+	return New(http.StatusInternalServerError, CodeInternal, "internal server error").WithCause(err)
+}
+
+// envelope wraps the error so clients can tell errors from payloads.
+type envelope struct {
+	Error *Error `json:"error"`
+}
+
+// Write renders err as the JSON envelope. Errors that are not an *Error
+// anywhere in their chain become a 500. Server errors are logged with the
+// request ID so the response can be matched to the log record.
+func Write(w http.ResponseWriter, r *http.Request, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		e = Internal(err)
+	}
+	out := *e
+	out.RequestID = middleware.GetReqID(r.Context())
+
+	kv := []interface{}{"code", out.Code, "status", out.Status}
+	if out.Cause != nil {
+		kv = append(kv, "err", out.Cause)
+	}
+	if out.Status >= 500 {
+		logger.Ctx(r.Context()).Error(out.Message, kv...)
+	} else if out.Cause != nil {
+		logger.Ctx(r.Context()).Debug(out.Message, kv...)
+	}
+
+	render.Status(r, out.Status)
+	render.JSON(w, r, envelope{Error: &out})
+}
+
+// DecodeStrict reads the JSON body of r into v, rejecting unknown fields.
+// It writes the error response and returns false on failure.
+func DecodeStrict(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		Write(w, r, BadRequest(CodeBadRequest, "invalid JSON body").WithCause(err))
+		return false
+	}
+	return true
+}
+
+// Recoverer replaces middleware.Recoverer: a panicking handler is logged
+// with its stack and answered with a JSON 500.
+func Recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			logger.Ctx(r.Context()).Error("panic serving request",
+				"path", r.URL.Path, "panic", fmt.Sprint(rec), "stack", string(debug.Stack()))
+			Write(w, r, New(http.StatusInternalServerError, CodeInternal, "internal server error"))
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// NotFoundHandler answers unknown routes.
+func NotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	Write(w, r, Newf(http.StatusNotFound, CodeNotFound, "no route for %s", r.URL.Path))
+}
+
+// MethodNotAllowedHandler answers known routes called with the wrong method.
+func MethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	Write(w, r, Newf(http.StatusMethodNotAllowed, CodeMethodNotAllowed, "%s is not allowed on %s", r.Method, r.URL.Path))
+}
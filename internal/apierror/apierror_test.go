@@ -0,0 +1,161 @@
+package apierror
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/maskarb/skarbek-dev/internal/logging"
+)
+
+// serve runs h behind middleware.RequestID and returns the response and
+// the decoded envelope.
+func serve(t *testing.T, h http.Handler, req *http.Request) (*httptest.ResponseRecorder, map[string]interface{}) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	middleware.RequestID(h).ServeHTTP(w, req)
+	var env struct {
+		Error map[string]interface{} `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil || env.Error == nil {
+		t.Fatalf("body %q is not an error envelope: %v", w.Body, err)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	return w, env.Error
+}
+
+func writes(err error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { Write(w, r, err) })
+}
+
+func TestEnvelope(t *testing.T) {
+	err := BadRequest("invalid_units", "unknown unit \"psi\"").WithDetails(map[string]string{"units": "psi"})
+	w, got := serve(t, writes(err), httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+	id, _ := got["request_id"].(string)
+	delete(got, "request_id")
+	want := map[string]interface{}{
+		"status": 400.0, "code": "invalid_units", "message": "unknown unit \"psi\"",
+		"details": map[string]interface{}{"units": "psi"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("error = %v, want %v", got, want)
+	}
+	if id == "" {
+		t.Error("no request_id")
+	}
+
+	// Without details the field is left out.
+	_, got = serve(t, writes(NotFound("sensor_not_found", "no such sensor")), httptest.NewRequest(http.MethodGet, "/", nil))
+	if _, ok := got["details"]; ok || got["code"] != "sensor_not_found" || got["status"] != 404.0 {
+		t.Errorf("error = %v", got)
+	}
+}
+
+// TestWrapped makes sure an *Error anywhere in the chain is rendered, and
+// anything else is hidden behind a 500 but logged.
+func TestWrapped(t *testing.T) {
+	var log bytes.Buffer
+	logging.Setup(&log, logging.Options{Level: logging.LevelInfo})
+	t.Cleanup(func() { logging.Setup(os.Stderr, logging.Options{Level: logging.LevelInfo}) })
+
+	wrapped := fmt.Errorf("update alert: %w", New(http.StatusConflict, CodeConflict, "name taken"))
+	if w, got := serve(t, writes(wrapped), httptest.NewRequest(http.MethodGet, "/", nil)); w.Code != http.StatusConflict || got["code"] != CodeConflict {
+		t.Errorf("wrapped: %d %v, want 409 conflict", w.Code, got)
+	}
+
+	w, got := serve(t, writes(errors.New("database is locked")), httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusInternalServerError || got["code"] != CodeInternal || got["message"] != "internal server error" {
+		t.Errorf("plain error: %d %v, want 500 internal_error", w.Code, got)
+	}
+	if strings.Contains(w.Body.String(), "locked") {
+		t.Errorf("the cause reached the client: %s", w.Body)
+	}
+	if !strings.Contains(log.String(), `err="database is locked"`) || !strings.Contains(log.String(), "request_id="+got["request_id"].(string)) {
+		t.Errorf("log = %q, want the cause and the request id", log.String())
+	}
+}
+
+func TestErrorChain(t *testing.T) {
+	cause := errors.New("remote I/O error")
+	e := New(http.StatusServiceUnavailable, CodeUnavailable, "sensor read failed").WithCause(cause)
+	if !errors.Is(e, cause) || e.Error() != "unavailable: sensor read failed: remote I/O error" {
+		t.Errorf("error = %q", e)
+	}
+	// The With methods copy.
+	base := BadRequest(CodeBadRequest, "bad")
+	_ = base.WithDetails("x").WithCause(cause)
+	if base.Details != nil || base.Cause != nil {
+		t.Errorf("With changed the original: %+v", base)
+	}
+}
+
+func TestDecodeStrict(t *testing.T) {
+	var v struct {
+		Name string `json:"name"`
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if DecodeStrict(w, r, &v) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	for _, body := range []string{`{"name": "attic", "colour": "red"}`, `{"name": `, `[]`} {
+		w, got := serve(t, h, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest || got["code"] != CodeBadRequest {
+			t.Errorf("%s: %d %v, want 400 bad_request", body, w.Code, got)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"name": "attic"}`)))
+	if w.Code != http.StatusNoContent || v.Name != "attic" {
+		t.Errorf("valid body: %d, %+v", w.Code, v)
+	}
+}
+
+func TestRouterErrors(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(Recoverer)
+	r.NotFound(NotFoundHandler)
+	r.MethodNotAllowed(MethodNotAllowedHandler)
+	r.Get("/sensors", func(w http.ResponseWriter, r *http.Request) {})
+	r.Get("/panic", func(w http.ResponseWriter, r *http.Request) { panic("nil map") })
+
+	for _, tc := range []struct {
+		method, path string
+		status       int
+		code         string
+	}{
+		{http.MethodGet, "/nope", http.StatusNotFound, CodeNotFound},
+		{http.MethodDelete, "/sensors", http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+		{http.MethodGet, "/panic", http.StatusInternalServerError, CodeInternal},
+	} {
+		w, got := serve(t, r, httptest.NewRequest(tc.method, tc.path, nil))
+		if w.Code != tc.status || got["code"] != tc.code || got["status"] != float64(tc.status) {
+			t.Errorf("%s %s: %d %v, want %d %s", tc.method, tc.path, w.Code, got, tc.status, tc.code)
+		}
+	}
+}
+
+func TestRecovererAbort(t *testing.T) {
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler passed on", rec)
+		}
+	}()
+	Recoverer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
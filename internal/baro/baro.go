@@ -0,0 +1,41 @@
+// Package baro reduces station pressure to sea level and back, using the
+// ICAO standard atmosphere. Pressures are Pa, heights metres and
+// temperatures °C.
+package baro
+
+import "math"
+
+const (
+	// StandardPressure is the ICAO sea-level pressure.
+	StandardPressure = 101325.0
+	// standardTemperature is the ICAO sea-level temperature in kelvin.
+	standardTemperature = 288.15
+	// lapseRate is the temperature drop per metre in the troposphere.
+	lapseRate = 0.0065
+	// exponent is g·M / (R·L) for dry air.
+	exponent = 5.25588
+	// gravity and dryAirGasConstant are for the hypsometric equation.
+	gravity           = 9.80665
+	dryAirGasConstant = 287.05
+)
+
+// QNH reduces station pressure p measured at elevation h to sea level
+// through the standard atmosphere, as altimeter settings are.
+func QNH(p, h float64) float64 {
+	return p / math.Pow(1-lapseRate*h/standardTemperature, exponent)
+}
+
+// QFF reduces station pressure p measured at elevation h to sea level
+// using the measured temperature tC, as weather maps are. The air column
+// below the station is taken to warm at the standard lapse rate.
+func QFF(p, h, tC float64) float64 {
+	mean := tC + 273.15 + lapseRate*h/2
+	return p * math.Exp(gravity*h/(dryAirGasConstant*mean))
+}
+
+// Altitude is the height at which the standard atmosphere has pressure p
+// when the sea-level pressure is p0. With p0 set to the local QNH this is
+// the true altitude; with StandardPressure it is the pressure altitude.
+func Altitude(p, p0 float64) float64 {
+	return standardTemperature / lapseRate * (1 - math.Pow(p/p0, 1/exponent))
+}
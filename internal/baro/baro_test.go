@@ -0,0 +1,100 @@
+package baro
+
+import (
+	"math"
+	"testing"
+)
+
+// Pressure of the ICAO standard atmosphere by geopotential height, from
+// the ICAO Doc 7488 tables.
+var standardAtmosphere = []struct{ h, pa float64 }{
+	{-500, 107478},
+	{0, 101325},
+	{500, 95461},
+	{1000, 89875},
+	{2000, 79495},
+	{3000, 70108},
+	{5000, 54020},
+	{8000, 35600},
+	{11000, 22632},
+}
+
+func TestAltitudeTable(t *testing.T) {
+	for _, row := range standardAtmosphere {
+		if got := Altitude(row.pa, StandardPressure); math.Abs(got-row.h) > 2 {
+			t.Errorf("Altitude(%v) = %.1f m, want %v", row.pa, got, row.h)
+		}
+	}
+}
+
+func TestQNHTable(t *testing.T) {
+	for _, row := range standardAtmosphere {
+		if got := QNH(row.pa, row.h); math.Abs(got-StandardPressure) > 10 {
+			t.Errorf("QNH(%v, %v) = %.1f Pa, want %v", row.pa, row.h, got, StandardPressure)
+		}
+	}
+}
+
+// TestQNHAltitudeRoundTrip checks that QNH and Altitude are inverses: the
+// altitude of station pressure against its own QNH is the station
+// elevation, whatever the weather.
+func TestQNHAltitudeRoundTrip(t *testing.T) {
+	for _, p := range []float64{70000, 85000, 95000, 101325, 104000} {
+		for _, h := range []float64{-400, 0, 150, 1200, 3000} {
+			qnh := QNH(p, h)
+			if got := Altitude(p, qnh); math.Abs(got-h) > 1e-6 {
+				t.Errorf("Altitude(%v, QNH(%v, %v)) = %v", p, p, h, got)
+			}
+		}
+	}
+}
+
+func TestQNHProperties(t *testing.T) {
+	for _, p := range []float64{90000, 101325} {
+		if got := QNH(p, 0); got != p {
+			t.Errorf("QNH(%v, 0) = %v", p, got)
+		}
+		prev := p
+		for h := 100.0; h <= 4000; h += 100 {
+			q := QNH(p, h)
+			if q <= prev {
+				t.Fatalf("QNH(%v, %v) = %v not above %v", p, h, q, prev)
+			}
+			prev = q
+		}
+	}
+}
+
+// TestQFFStandardDay checks that on a standard day, with the station at
+// the standard temperature for its height, QFF matches QNH up to the
+// error of taking the column at its mean temperature.
+func TestQFFStandardDay(t *testing.T) {
+	for _, row := range standardAtmosphere {
+		if row.h < 0 || row.h > 3000 {
+			continue
+		}
+		tC := 15 - lapseRate*row.h
+		if got := QFF(row.pa, row.h, tC); math.Abs(got-StandardPressure) > 20 {
+			t.Errorf("QFF(%v, %v, %v) = %.1f Pa, want about %v", row.pa, row.h, tC, got, StandardPressure)
+		}
+	}
+}
+
+func TestQFFProperties(t *testing.T) {
+	const p, h = 95000.0, 500.0
+	if got := QFF(p, 0, 20); got != p {
+		t.Errorf("QFF(%v, 0) = %v", p, got)
+	}
+	// A colder, denser column adds more pressure.
+	prev := math.Inf(1)
+	for tC := -30.0; tC <= 40; tC += 5 {
+		q := QFF(p, h, tC)
+		if q >= prev {
+			t.Fatalf("QFF at %v °C = %v not below %v", tC, q, prev)
+		}
+		if q <= p {
+			t.Fatalf("QFF(%v, %v, %v) = %v not above station pressure", p, h, tC, q)
+		}
+		prev = q
+	}
+}
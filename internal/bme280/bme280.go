@@ -0,0 +1,273 @@
+// Package bme280 drives Bosch BME280 and BMP280 sensors over I2C with
+// control of oversampling, the IIR filter and the power mode, which the
+// general purpose go-bsbmp driver always fixes to forced mode with the
+// filter off. Compensation follows the floating point formulas of the
+// BME280 datasheet (section 8.1).
+package bme280
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	regCalib00  = 0x88
+	regChipID   = 0xD0
+	regCalib26  = 0xE1
+	regCtrlHum  = 0xF2
+	regStatus   = 0xF3
+	regCtrlMeas = 0xF4
+	regConfig   = 0xF5
+	regData     = 0xF7
+
+	statusMeasuring = 0x08
+
+	// ChipBME280 is the chip ID of the BME280; the BMP280 has no humidity
+	// element and reports 0x56 to 0x58.
+	ChipBME280 = 0x60
+
+	// skipped is what a data register holds for a quantity that was not
+	// measured.
+	skipped = 0x80000
+)
+
+// Bus is the register access the driver needs; *i2c.I2C implements it.
+type Bus interface {
+	ReadRegU8(reg byte) (byte, error)
+	WriteRegU8(reg byte, value byte) error
+	ReadRegBytes(reg byte, n int) ([]byte, int, error)
+}
+
+// Device is one chip. It is not safe for concurrent use.
+type Device struct {
+	bus      Bus
+	chipID   uint8
+	calib    calibration
+	settings Settings
+}
+
+// Measurement holds compensated values in °C, Pa and %RH. Quantities that
+// were skipped, or humidity on a BMP280, are nil.
+type Measurement struct {
+	Temperature *float32
+	Pressure    *float32
+	Humidity    *float32
+}
+
+// Open identifies the chip on bus, reads its trimming parameters and
+// applies settings.
+func Open(bus Bus, settings Settings) (*Device, error) {
+	id, err := bus.ReadRegU8(regChipID)
+	if err != nil {
+		return nil, fmt.Errorf("read chip id: %v", err)
+	}
+	if id != ChipBME280 && (id < 0x56 || id > 0x58) {
+		return nil, fmt.Errorf("chip id 0x%02x is not a BME280 or BMP280", id)
+	}
+	d := &Device{bus: bus, chipID: id}
+	if err := d.readCalibration(); err != nil {
+		return nil, err
+	}
+	if err := d.Configure(settings); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// ChipID is 0x60 for a BME280 and 0x56 to 0x58 for a BMP280.
+func (d *Device) ChipID() uint8 { return d.chipID }
+
+// HasHumidity reports whether the chip measures humidity.
+func (d *Device) HasHumidity() bool { return d.chipID == ChipBME280 }
+
+// Settings returns what was last passed to Configure.
+func (d *Device) Settings() Settings { return d.settings }
+
+// Configure writes s to the chip. The chip is put to sleep first, since
+// the config register is ignored in normal mode, and ctrl_hum is written
+// before ctrl_meas, which latches it.
+func (d *Device) Configure(s Settings) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	regs := s.Registers()
+	writes := []struct{ reg, value byte }{
+		{regCtrlMeas, byte(regs.CtrlMeas) &^ 0x03},
+		{regConfig, byte(regs.Config)},
+		{regCtrlHum, byte(regs.CtrlHum)},
+		{regCtrlMeas, byte(regs.CtrlMeas)},
+	}
+	if !d.HasHumidity() {
+		writes = append(writes[:2], writes[3])
+	}
+	if s.Mode == ModeForced {
+		// Forced mode measures when ctrl_meas is written; leave the chip
+		// asleep until the first read.
+		writes = writes[:len(writes)-1]
+	}
+	for _, w := range writes {
+		if err := d.bus.WriteRegU8(w.reg, w.value); err != nil {
+			return fmt.Errorf("write register 0x%02x: %v", w.reg, err)
+		}
+	}
+	d.settings = s
+	return nil
+}
+
+// Registers reads the control registers back from the chip.
+func (d *Device) Registers() (Registers, error) {
+	var r Registers
+	buf, _, err := d.bus.ReadRegBytes(regCtrlHum, 4)
+	if err != nil {
+		return r, fmt.Errorf("read control registers: %v", err)
+	}
+	r.CtrlHum = Register(buf[0])
+	r.CtrlMeas = Register(buf[2])
+	r.Config = Register(buf[3])
+	if !d.HasHumidity() {
+		r.CtrlHum = 0
+	}
+	return r, nil
+}
+
+// Read returns the latest measurement. In forced mode it triggers one and
+// waits for it; in normal mode it returns the result of the last cycle.
+func (d *Device) Read() (Measurement, error) {
+	if d.settings.Mode == ModeForced {
+		if err := d.measure(); err != nil {
+			return Measurement{}, err
+		}
+	}
+	buf, _, err := d.bus.ReadRegBytes(regData, 8)
+	if err != nil {
+		return Measurement{}, fmt.Errorf("read data registers: %v", err)
+	}
+	rawP := int32(buf[0])<<12 | int32(buf[1])<<4 | int32(buf[2])>>4
+	rawT := int32(buf[3])<<12 | int32(buf[4])<<4 | int32(buf[5])>>4
+	rawH := int32(buf[6])<<8 | int32(buf[7])
+
+	var m Measurement
+	if rawT == skipped {
+		return m, errors.New("temperature was not measured")
+	}
+	t, tFine := d.calib.temperature(rawT)
+	m.Temperature = &t
+	if rawP != skipped {
+		p := d.calib.pressure(rawP, tFine)
+		m.Pressure = &p
+	}
+	if d.HasHumidity() && rawH != skipped>>4 {
+		h := d.calib.humidity(rawH, tFine)
+		m.Humidity = &h
+	}
+	return m, nil
+}
+
+// measure starts a forced measurement and waits until it is done.
+func (d *Device) measure() error {
+	regs := d.settings.Registers()
+	if err := d.bus.WriteRegU8(regCtrlMeas, byte(regs.CtrlMeas)); err != nil {
+		return fmt.Errorf("start measurement: %v", err)
+	}
+	wait := time.Duration(d.settings.MeasurementTime() * float64(time.Millisecond))
+	time.Sleep(wait)
+	for deadline := time.Now().Add(wait + 50*time.Millisecond); ; {
+		status, err := d.bus.ReadRegU8(regStatus)
+		if err != nil {
+			return fmt.Errorf("read status: %v", err)
+		}
+		if status&statusMeasuring == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("measurement did not finish in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// calibration holds the chip's trimming parameters.
+type calibration struct {
+	T1                             uint16
+	T2, T3                         int16
+	P1                             uint16
+	P2, P3, P4, P5, P6, P7, P8, P9 int16
+	H1, H3                         uint8
+	H2, H4, H5                     int16
+	H6                             int8
+}
+
+func (d *Device) readCalibration() error {
+	b, _, err := d.bus.ReadRegBytes(regCalib00, 26)
+	if err != nil {
+		return fmt.Errorf("read calibration: %v", err)
+	}
+	u16 := func(i int) uint16 { return binary.LittleEndian.Uint16(b[i:]) }
+	s16 := func(i int) int16 { return int16(u16(i)) }
+	c := calibration{
+		T1: u16(0), T2: s16(2), T3: s16(4),
+		P1: u16(6), P2: s16(8), P3: s16(10), P4: s16(12), P5: s16(14),
+		P6: s16(16), P7: s16(18), P8: s16(20), P9: s16(22),
+		H1: b[25],
+	}
+	if d.HasHumidity() {
+		h, _, err := d.bus.ReadRegBytes(regCalib26, 7)
+		if err != nil {
+			return fmt.Errorf("read humidity calibration: %v", err)
+		}
+		c.H2 = int16(binary.LittleEndian.Uint16(h[0:]))
+		c.H3 = h[2]
+		// H4 and H5 are signed 12 bit values sharing the nibbles of 0xE5.
+		c.H4 = int16(int8(h[3]))<<4 | int16(h[4]&0x0F)
+		c.H5 = int16(int8(h[5]))<<4 | int16(h[4]>>4)
+		c.H6 = int8(h[6])
+	}
+	if c.T1 == 0 || c.P1 == 0 {
+		return errors.New("calibration data is blank; check the wiring")
+	}
+	d.calib = c
+	return nil
+}
+
+// temperature returns °C and the fine temperature the other quantities
+// are compensated with.
+func (c calibration) temperature(raw int32) (float32, float64) {
+	v1 := (float64(raw)/16384 - float64(c.T1)/1024) * float64(c.T2)
+	v2 := float64(raw)/131072 - float64(c.T1)/8192
+	v2 = v2 * v2 * float64(c.T3)
+	tFine := v1 + v2
+	return float32(tFine / 5120), tFine
+}
+
+func (c calibration) pressure(raw int32, tFine float64) float32 {
+	v1 := tFine/2 - 64000
+	v2 := v1 * v1 * float64(c.P6) / 32768
+	v2 += v1 * float64(c.P5) * 2
+	v2 = v2/4 + float64(c.P4)*65536
+	v1 = (float64(c.P3)*v1*v1/524288 + float64(c.P2)*v1) / 524288
+	v1 = (1 + v1/32768) * float64(c.P1)
+	if v1 == 0 {
+		return 0
+	}
+	p := 1048576 - float64(raw)
+	p = (p - v2/4096) * 6250 / v1
+	v1 = float64(c.P9) * p * p / 2147483648
+	v2 = p * float64(c.P8) / 32768
+	return float32(p + (v1+v2+float64(c.P7))/16)
+}
+
+func (c calibration) humidity(raw int32, tFine float64) float32 {
+	h := tFine - 76800
+	h = (float64(raw) - (float64(c.H4)*64 + float64(c.H5)/16384*h)) *
+		(float64(c.H2) / 65536 * (1 + float64(c.H6)/67108864*h*(1+float64(c.H3)/67108864*h)))
+	h *= 1 - float64(c.H1)*h/524288
+	switch {
+	case h > 100:
+		h = 100
+	case h < 0:
+		h = 0
+	}
+	return float32(h)
+}
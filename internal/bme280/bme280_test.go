@@ -0,0 +1,207 @@
+package bme280
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// bus is a chip's register file. It records writes so tests can check
+// their order.
+type bus struct {
+	regs   [256]byte
+	writes [][2]byte
+}
+
+// newBMP280 returns a BMP280 with the trimming parameters and readings of
+// the compensation example in the BMP280 datasheet (section 3.12).
+func newBMP280() *bus {
+	b := &bus{}
+	b.regs[regChipID] = 0x58
+	for i, v := range []uint16{27504, 26435, 0xFC18, 36477, 0xD643, 3024, 2855, 140, 0xFFF9, 15500, 0xC6F8, 6000} {
+		binary.LittleEndian.PutUint16(b.regs[regCalib00+2*i:], v)
+	}
+	// adc_P = 415148 and adc_T = 519888, 20 bits each.
+	copy(b.regs[regData:], []byte{0x65, 0x5A, 0xC0, 0x7E, 0xED, 0x00})
+	return b
+}
+
+// newBME280 is newBMP280 with a humidity element trimmed with typical
+// values: H1 75, H2 362, H3 0, H4 313, H5 50 and H6 30.
+func newBME280(adcH uint16) *bus {
+	b := newBMP280()
+	b.regs[regChipID] = ChipBME280
+	b.regs[regCalib00+25] = 75
+	binary.LittleEndian.PutUint16(b.regs[regCalib26:], 362)
+	b.regs[regCalib26+2] = 0
+	// H4 and H5 share the nibbles of 0xE5.
+	b.regs[regCalib26+3] = 313 >> 4
+	b.regs[regCalib26+4] = 313&0x0F | (50&0x0F)<<4
+	b.regs[regCalib26+5] = 50 >> 4
+	b.regs[regCalib26+6] = 30
+	binary.BigEndian.PutUint16(b.regs[regData+6:], adcH)
+	return b
+}
+
+func (b *bus) ReadRegU8(reg byte) (byte, error) { return b.regs[reg], nil }
+
+func (b *bus) WriteRegU8(reg byte, value byte) error {
+	b.regs[reg] = value
+	b.writes = append(b.writes, [2]byte{reg, value})
+	return nil
+}
+
+func (b *bus) ReadRegBytes(reg byte, n int) ([]byte, int, error) {
+	out := make([]byte, n)
+	copy(out, b.regs[reg:])
+	return out, n, nil
+}
+
+func open(t *testing.T, b *bus, s Settings) *Device {
+	t.Helper()
+	d, err := Open(b, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+var normal = Settings{Mode: ModeNormal, TemperatureOversampling: 1, PressureOversampling: 1, HumidityOversampling: 1, Standby: 1000}
+
+// TestCompensation checks the floating point formulas against the worked
+// example of the datasheet: 25.08 °C and 100653.27 Pa.
+func TestCompensation(t *testing.T) {
+	d := open(t, newBMP280(), normal)
+	m, err := d.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Temperature == nil || math.Abs(float64(*m.Temperature)-25.08) > 0.005 {
+		t.Errorf("temperature = %v, want 25.08", m.Temperature)
+	}
+	if m.Pressure == nil || math.Abs(float64(*m.Pressure)-100653.27) > 0.02 {
+		t.Errorf("pressure = %v, want 100653.27", m.Pressure)
+	}
+	if m.Humidity != nil {
+		t.Errorf("BMP280 humidity = %v, want none", *m.Humidity)
+	}
+}
+
+// TestHumidity checks the humidity compensation against the datasheet's
+// integer formula (section 4.2.3), which resolves 1/1024 %RH.
+func TestHumidity(t *testing.T) {
+	for _, c := range []struct {
+		adcH uint16
+		want float64
+	}{
+		{25000, 27.076},
+		{30000, 54.997},
+		// Clamped.
+		{40000, 100},
+	} {
+		d := open(t, newBME280(c.adcH), normal)
+		m, err := d.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Humidity == nil || math.Abs(float64(*m.Humidity)-c.want) > 0.01 {
+			t.Errorf("adc_H %d: humidity = %v, want %v", c.adcH, m.Humidity, c.want)
+		}
+	}
+}
+
+func TestSkipped(t *testing.T) {
+	b := newBME280(30000)
+	// Pressure and humidity were not measured.
+	copy(b.regs[regData:], []byte{0x80, 0x00, 0x00})
+	copy(b.regs[regData+6:], []byte{0x80, 0x00})
+	m, err := open(t, b, normal).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Temperature == nil || m.Pressure != nil || m.Humidity != nil {
+		t.Errorf("measurement = %+v, want only the temperature", m)
+	}
+
+	copy(b.regs[regData+3:], []byte{0x80, 0x00, 0x00})
+	if _, err := open(t, b, normal).Read(); err == nil {
+		t.Error("read without a temperature did not fail")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	b := newBMP280()
+	b.regs[regChipID] = 0x55
+	if _, err := Open(b, DefaultSettings); err == nil {
+		t.Error("opened chip 0x55")
+	}
+	b = newBMP280()
+	binary.LittleEndian.PutUint16(b.regs[regCalib00:], 0)
+	if _, err := Open(b, DefaultSettings); err == nil {
+		t.Error("opened a chip with blank calibration")
+	}
+	if _, err := Open(newBMP280(), Settings{Mode: ModeNormal}); err == nil {
+		t.Error("opened with invalid settings")
+	}
+}
+
+// TestConfigure checks the order of the register writes: sleep, config,
+// ctrl_hum, then ctrl_meas, which latches ctrl_hum and starts the mode.
+func TestConfigure(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		bus    *bus
+		s      Settings
+		writes [][2]byte
+	}{
+		{"BME280 normal", newBME280(30000), Settings{Mode: ModeNormal, TemperatureOversampling: 2,
+			PressureOversampling: 16, HumidityOversampling: 1, Filter: 16, Standby: 0.5}, [][2]byte{
+			{regCtrlMeas, 0x54}, {regConfig, 0x10}, {regCtrlHum, 0x01}, {regCtrlMeas, 0x57},
+		}},
+		// No ctrl_hum, and forced mode waits for the first read.
+		{"BMP280 forced", newBMP280(), DefaultSettings, [][2]byte{
+			{regCtrlMeas, 0x90}, {regConfig, 0xA0},
+		}},
+		{"BME280 forced", newBME280(30000), DefaultSettings, [][2]byte{
+			{regCtrlMeas, 0x90}, {regConfig, 0xA0}, {regCtrlHum, 0x01},
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			d := open(t, c.bus, DefaultSettings)
+			c.bus.writes = nil
+			if err := d.Configure(c.s); err != nil {
+				t.Fatal(err)
+			}
+			if len(c.bus.writes) != len(c.writes) {
+				t.Fatalf("writes = %x, want %x", c.bus.writes, c.writes)
+			}
+			for i := range c.writes {
+				if c.bus.writes[i] != c.writes[i] {
+					t.Fatalf("writes = %x, want %x", c.bus.writes, c.writes)
+				}
+			}
+			if d.Settings() != c.s {
+				t.Errorf("settings = %+v, want %+v", d.Settings(), c.s)
+			}
+		})
+	}
+}
+
+func TestForcedRead(t *testing.T) {
+	b := newBMP280()
+	d := open(t, b, DefaultSettings)
+	b.writes = nil
+	if _, err := d.Read(); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.writes) != 1 || b.writes[0] != [2]byte{regCtrlMeas, 0x91} {
+		t.Errorf("writes = %x, want a forced measurement", b.writes)
+	}
+	regs, err := d.Registers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regs.CtrlHum != 0 || regs.CtrlMeas != 0x91 || regs.Config != 0xA0 {
+		t.Errorf("registers = %+v", regs)
+	}
+}
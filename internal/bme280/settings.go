@@ -0,0 +1,176 @@
+package bme280
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Mode is the chip's power mode. In forced mode the chip measures once per
+// read and sleeps in between, which keeps self-heating lowest. In normal
+// mode it measures continuously, pausing Standby between cycles, and reads
+// return the latest result; only normal mode lets the IIR filter see a
+// steady stream of samples.
+type Mode string
+
+const (
+	ModeForced Mode = "forced"
+	ModeNormal Mode = "normal"
+	// ModeSleep is only ever reported back, while the chip is idle between
+	// forced measurements.
+	ModeSleep Mode = "sleep"
+)
+
+// Oversampling is how many samples the chip averages per measurement; 0
+// skips the quantity.
+type Oversampling int
+
+var oversamplingCodes = map[Oversampling]uint8{0: 0, 1: 1, 2: 2, 4: 3, 8: 4, 16: 5}
+
+// Filter is the IIR filter coefficient; 0 switches the filter off.
+type Filter int
+
+var filterCodes = map[Filter]uint8{0: 0, 2: 1, 4: 2, 8: 3, 16: 4}
+
+// Standby is the pause between measurements in normal mode, in
+// milliseconds.
+type Standby float64
+
+var standbyCodes = map[Standby]uint8{0.5: 0, 62.5: 1, 125: 2, 250: 3, 500: 4, 1000: 5, 10: 6, 20: 7}
+
+// Settings are the driver options of one chip.
+type Settings struct {
+	Mode                    Mode         `json:"mode"`
+	TemperatureOversampling Oversampling `json:"temperature_oversampling"`
+	PressureOversampling    Oversampling `json:"pressure_oversampling"`
+	HumidityOversampling    Oversampling `json:"humidity_oversampling"`
+	Filter                  Filter       `json:"iir_filter"`
+	Standby                 Standby      `json:"standby_ms"`
+}
+
+// DefaultSettings match what the server used before settings could be
+// changed: one forced measurement per read, 8x temperature and pressure
+// oversampling and no filter.
+var DefaultSettings = Settings{
+	Mode:                    ModeForced,
+	TemperatureOversampling: 8,
+	PressureOversampling:    8,
+	HumidityOversampling:    1,
+	Filter:                  0,
+	Standby:                 1000,
+}
+
+// Validate reports the first setting the chip cannot represent.
+func (s Settings) Validate() error {
+	if s.Mode != ModeForced && s.Mode != ModeNormal {
+		return fmt.Errorf("mode %q must be forced or normal", s.Mode)
+	}
+	for _, o := range []struct {
+		name string
+		v    Oversampling
+	}{
+		{"temperature_oversampling", s.TemperatureOversampling},
+		{"pressure_oversampling", s.PressureOversampling},
+		{"humidity_oversampling", s.HumidityOversampling},
+	} {
+		if _, ok := oversamplingCodes[o.v]; !ok {
+			return fmt.Errorf("%s %d must be one of 0, 1, 2, 4, 8 or 16", o.name, o.v)
+		}
+	}
+	if s.TemperatureOversampling == 0 {
+		// Pressure and humidity compensation need the temperature.
+		return fmt.Errorf("temperature_oversampling must not be 0")
+	}
+	if _, ok := filterCodes[s.Filter]; !ok {
+		return fmt.Errorf("iir_filter %d must be one of 0, 2, 4, 8 or 16", s.Filter)
+	}
+	if _, ok := standbyCodes[s.Standby]; !ok {
+		return fmt.Errorf("standby_ms %v must be one of 0.5, 10, 20, 62.5, 125, 250, 500 or 1000", s.Standby)
+	}
+	return nil
+}
+
+// Registers encodes s as the chip's control registers. s must be valid.
+func (s Settings) Registers() Registers {
+	mode := uint8(0x01)
+	if s.Mode == ModeNormal {
+		mode = 0x03
+	}
+	return Registers{
+		CtrlHum:  Register(oversamplingCodes[s.HumidityOversampling]),
+		CtrlMeas: Register(oversamplingCodes[s.TemperatureOversampling]<<5 | oversamplingCodes[s.PressureOversampling]<<2 | mode),
+		Config:   Register(standbyCodes[s.Standby]<<5 | filterCodes[s.Filter]<<2),
+	}
+}
+
+// MeasurementTime is the longest a measurement takes with s, in
+// milliseconds, per the datasheet (section 9.1).
+func (s Settings) MeasurementTime() float64 {
+	t := 1.25 + 2.3*float64(s.TemperatureOversampling)
+	if s.PressureOversampling > 0 {
+		t += 2.3*float64(s.PressureOversampling) + 0.575
+	}
+	if s.HumidityOversampling > 0 {
+		t += 2.3*float64(s.HumidityOversampling) + 0.575
+	}
+	return t
+}
+
+// Register is a register value, shown in hex.
+type Register uint8
+
+func (r Register) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("0x%02x", uint8(r)))
+}
+
+// Registers are the chip's control registers.
+type Registers struct {
+	CtrlHum  Register `json:"ctrl_hum"`
+	CtrlMeas Register `json:"ctrl_meas"`
+	Config   Register `json:"config"`
+}
+
+// Settings decodes r. Codes the datasheet marks as aliases (oversampling
+// codes above 5, filter codes above 4) decode to what the chip does with
+// them.
+func (r Registers) Settings() Settings {
+	s := Settings{
+		TemperatureOversampling: decodeOversampling(uint8(r.CtrlMeas) >> 5),
+		PressureOversampling:    decodeOversampling(uint8(r.CtrlMeas) >> 2 & 0x07),
+		HumidityOversampling:    decodeOversampling(uint8(r.CtrlHum) & 0x07),
+	}
+	switch r.CtrlMeas & 0x03 {
+	case 0x00:
+		s.Mode = ModeSleep
+	case 0x03:
+		s.Mode = ModeNormal
+	default:
+		s.Mode = ModeForced
+	}
+	code := uint8(r.Config) >> 2 & 0x07
+	if code > 4 {
+		code = 4
+	}
+	for f, c := range filterCodes {
+		if c == code {
+			s.Filter = f
+		}
+	}
+	for sb, c := range standbyCodes {
+		if c == uint8(r.Config)>>5 {
+			s.Standby = sb
+		}
+	}
+	return s
+}
+
+func decodeOversampling(code uint8) Oversampling {
+	if code > 5 {
+		code = 5
+	}
+	for o, c := range oversamplingCodes {
+		if c == code {
+			return o
+		}
+	}
+	return 0
+}
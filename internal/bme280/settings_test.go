@@ -0,0 +1,90 @@
+package bme280
+
+import (
+	"math"
+	"testing"
+)
+
+// Register values from the datasheet's register map (section 5.4) and its
+// recommended modes of operation (section 3.5).
+var registerTable = []struct {
+	name string
+	s    Settings
+	regs Registers
+}{
+	{"weather monitoring", Settings{Mode: ModeForced, TemperatureOversampling: 1, PressureOversampling: 1,
+		HumidityOversampling: 1, Filter: 0, Standby: 0.5}, Registers{CtrlHum: 0x01, CtrlMeas: 0x25, Config: 0x00}},
+	{"indoor navigation", Settings{Mode: ModeNormal, TemperatureOversampling: 2, PressureOversampling: 16,
+		HumidityOversampling: 1, Filter: 16, Standby: 0.5}, Registers{CtrlHum: 0x01, CtrlMeas: 0x57, Config: 0x10}},
+	{"gaming", Settings{Mode: ModeNormal, TemperatureOversampling: 1, PressureOversampling: 4,
+		HumidityOversampling: 0, Filter: 16, Standby: 0.5}, Registers{CtrlHum: 0x00, CtrlMeas: 0x2F, Config: 0x10}},
+	{"default", DefaultSettings, Registers{CtrlHum: 0x01, CtrlMeas: 0x91, Config: 0xA0}},
+	{"longest", Settings{Mode: ModeNormal, TemperatureOversampling: 16, PressureOversampling: 8,
+		HumidityOversampling: 2, Filter: 4, Standby: 20}, Registers{CtrlHum: 0x02, CtrlMeas: 0xB3, Config: 0xE8}},
+	{"10 ms", Settings{Mode: ModeNormal, TemperatureOversampling: 1, PressureOversampling: 2,
+		HumidityOversampling: 16, Filter: 2, Standby: 10}, Registers{CtrlHum: 0x05, CtrlMeas: 0x2B, Config: 0xC4}},
+}
+
+func TestRegisters(t *testing.T) {
+	for _, row := range registerTable {
+		if err := row.s.Validate(); err != nil {
+			t.Errorf("%s: %v", row.name, err)
+		}
+		if got := row.s.Registers(); got != row.regs {
+			t.Errorf("%s: registers = %+v, want %+v", row.name, got, row.regs)
+		}
+		if got := row.regs.Settings(); got != row.s {
+			t.Errorf("%s: settings = %+v, want %+v", row.name, got, row.s)
+		}
+	}
+}
+
+// TestAliases makes sure register values the server never writes decode
+// to what the chip does with them.
+func TestAliases(t *testing.T) {
+	got := Registers{CtrlHum: 0x07, CtrlMeas: 0xD8, Config: 0x1C}.Settings()
+	want := Settings{Mode: ModeSleep, TemperatureOversampling: 16, PressureOversampling: 16,
+		HumidityOversampling: 16, Filter: 16, Standby: 0.5}
+	if got != want {
+		t.Errorf("settings = %+v, want %+v", got, want)
+	}
+	// Both 01 and 10 are forced mode.
+	if got := (Registers{CtrlMeas: 0x22}).Settings().Mode; got != ModeForced {
+		t.Errorf("mode 10 = %s, want forced", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, s := range []Settings{
+		{Mode: ModeSleep, TemperatureOversampling: 1},
+		{Mode: ModeForced, TemperatureOversampling: 3, Standby: 0.5},
+		{Mode: ModeForced, TemperatureOversampling: 0, Standby: 0.5},
+		{Mode: ModeForced, TemperatureOversampling: 1, PressureOversampling: 32, Standby: 0.5},
+		{Mode: ModeForced, TemperatureOversampling: 1, Filter: 3, Standby: 0.5},
+		{Mode: ModeForced, TemperatureOversampling: 1, Standby: 100},
+	} {
+		if err := s.Validate(); err == nil {
+			t.Errorf("%+v is valid", s)
+		}
+	}
+}
+
+// TestMeasurementTime checks the maximum measurement times of the
+// datasheet (section 9.1).
+func TestMeasurementTime(t *testing.T) {
+	for _, c := range []struct {
+		t, p, h Oversampling
+		want    float64
+	}{
+		{1, 1, 1, 9.3},
+		{1, 0, 0, 3.55},
+		{2, 16, 1, 46.1},
+		{1, 4, 0, 13.33},
+		{16, 16, 16, 112.8},
+	} {
+		s := Settings{TemperatureOversampling: c.t, PressureOversampling: c.p, HumidityOversampling: c.h}
+		if got := s.MeasurementTime(); math.Abs(got-c.want) > 0.01 {
+			t.Errorf("MeasurementTime(%dx, %dx, %dx) = %v ms, want %v", c.t, c.p, c.h, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/maskarb/skarbek-dev/internal/config"
+)
+
+// ACME obtains and renews certificates from an ACME CA, answering both
+// HTTP-01 (through HTTPHandler) and TLS-ALPN-01 (through TLSConfig)
+// challenges. Account keys and certificates are cached in cfg.CacheDir.
+type ACME struct {
+	manager *autocert.Manager
+}
+
+func NewACME(cfg config.ACMEConfig) (*ACME, error) {
+	if err := os.MkdirAll(cfg.CacheDir, 0o700); err != nil {
+		return nil, fmt.Errorf("create acme cache directory: %v", err)
+	}
+
+	client := &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	if cfg.CACertFile != "" {
+		httpClient, err := trustingClient(cfg.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		client.HTTPClient = httpClient
+	}
+
+	return &ACME{manager: &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(cfg.CacheDir),
+		HostPolicy:  autocert.HostWhitelist(cfg.Domains...),
+		RenewBefore: cfg.RenewBefore.Duration,
+		Email:       cfg.Email,
+		Client:      client,
+	}}, nil
+}
+
+// TLSConfig serves managed certificates and advertises the acme-tls/1
+// protocol used by TLS-ALPN-01.
+func (a *ACME) TLSConfig() *tls.Config {
+	c := ServerConfig(a.manager.GetCertificate)
+	c.NextProtos = append(c.NextProtos, acme.ALPNProto)
+	return c
+}
+
+// HTTPHandler answers HTTP-01 challenges; any other request is a 404. It is
+// meant to be passed to RedirectHandler.
+func (a *ACME) HTTPHandler() http.Handler {
+	return a.manager.HTTPHandler(http.NotFoundHandler())
+}
+
+// trustingClient returns an HTTP client that trusts the system roots plus
+// the PEM certificates in caFile.
+func trustingClient(caFile string) (*http.Client, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read acme ca cert: %v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport, Timeout: time.Minute}, nil
+}
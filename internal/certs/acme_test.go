@@ -0,0 +1,388 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/config"
+)
+
+// pebbleBinary returns the Pebble binary, the test CA of Let's Encrypt,
+// that PEBBLE names, e.g. after
+//
+//	go install github.com/letsencrypt/pebble/v2/cmd/pebble@latest
+//	PEBBLE=$(go env GOPATH)/bin/pebble go test ./internal/certs
+//
+// The ACME tests are skipped without it.
+func pebbleBinary(t *testing.T) string {
+	t.Helper()
+	bin := os.Getenv("PEBBLE")
+	if bin == "" {
+		t.Skip("PEBBLE is not set to a pebble binary")
+	}
+	return bin
+}
+
+// pebble is a running Pebble. It validates challenges on 127.0.0.1, at
+// the HTTP and TLS ports it was started with.
+type pebble struct {
+	cmd *exec.Cmd
+	out bytes.Buffer
+	// directory is the ACME directory URL, management the URL of the
+	// interface the roots are fetched from.
+	directory  string
+	management string
+	// caFile is the certificate Pebble serves its API with, and client
+	// trusts it.
+	caFile string
+	client *http.Client
+}
+
+func startPebble(t *testing.T, bin string, httpPort, tlsPort int) *pebble {
+	t.Helper()
+	dir := t.TempDir()
+	p := &pebble{caFile: filepath.Join(dir, "cert.pem")}
+	keyFile := filepath.Join(dir, "key.pem")
+	writeSelfSigned(t, p.caFile, keyFile)
+	pool := x509.NewCertPool()
+	caPEM, err := os.ReadFile(p.caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.AppendCertsFromPEM(caPEM)
+	p.client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}, Timeout: 10 * time.Second}
+
+	listen, management := freeAddr(t), freeAddr(t)
+	p.directory, p.management = "https://"+listen+"/dir", "https://"+management
+	conf, err := json.Marshal(map[string]interface{}{"pebble": map[string]interface{}{
+		"listenAddress":           listen,
+		"managementListenAddress": management,
+		"certificate":             p.caFile,
+		"privateKey":              keyFile,
+		"httpPort":                httpPort,
+		"tlsPort":                 tlsPort,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	confFile := filepath.Join(dir, "pebble.json")
+	if err := os.WriteFile(confFile, conf, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p.cmd = exec.Command(bin, "-config", confFile, "-dnsserver", startResolver(t))
+	// No random sleeps before validating, and no nonces rejected to test
+	// the client's retries.
+	p.cmd.Env = append(os.Environ(), "PEBBLE_VA_NOSLEEP=1", "PEBBLE_WFE_NONCEREJECT=0")
+	p.cmd.Stdout, p.cmd.Stderr = &p.out, &p.out
+	if err := p.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		p.cmd.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		p.cmd.Process.Kill()
+		<-exited
+		if t.Failed() {
+			t.Logf("pebble:\n%s", p.out.String())
+		}
+	})
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		select {
+		case <-exited:
+			t.Fatalf("pebble exited:\n%s", p.out.String())
+		default:
+		}
+		resp, err := p.client.Get(p.directory)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return p
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pebble did not start: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// roots returns the roots Pebble issues certificates under.
+func (p *pebble) roots(t *testing.T) *x509.CertPool {
+	t.Helper()
+	resp, err := p.client.Get(p.management + "/roots/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		t.Fatalf("no root from pebble: %s", b)
+	}
+	return pool
+}
+
+// acmeConfig is an ACME config for domain against p, caching in dir.
+func (p *pebble) acmeConfig(domain, dir string) config.ACMEConfig {
+	cfg := config.Default().TLS.ACME
+	cfg.Enabled = true
+	cfg.DirectoryURL = p.directory
+	cfg.CACertFile = p.caFile
+	cfg.Email = "admin@example.com"
+	cfg.Domains = []string{domain}
+	cfg.CacheDir = dir
+	return cfg
+}
+
+// startResolver runs a DNS server that answers every A query with
+// 127.0.0.1 and every other query with no records, so Pebble validates
+// any domain against the listeners of the test.
+func startResolver(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := answer(buf[:n]); resp != nil {
+				pc.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// answer builds the response to the DNS query q.
+func answer(q []byte) []byte {
+	if len(q) < 12 {
+		return nil
+	}
+	// The question is the name's labels up to an empty one, then its type
+	// and class.
+	end := 12
+	for end < len(q) && q[end] != 0 {
+		end += int(q[end]) + 1
+	}
+	end += 5
+	if end > len(q) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(q[end-4:])
+	resp := append([]byte(nil), q[:end]...)
+	// A response, echoing the recursion desired flag, with recursion
+	// available and no error.
+	resp[2], resp[3] = 0x80|q[2]&0x01, 0x80
+	binary.BigEndian.PutUint16(resp[6:], 0)
+	binary.BigEndian.PutUint16(resp[8:], 0)
+	binary.BigEndian.PutUint16(resp[10:], 0)
+	if qtype == 1 {
+		resp[7] = 1
+		// The name is a pointer to the question's; class IN, a minute's
+		// TTL, four bytes of address.
+		resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1)
+	}
+	return resp
+}
+
+func writeSelfSigned(t *testing.T, certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "pebble"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// freeAddr returns a local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func listen(t *testing.T) (net.Listener, int) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln, ln.Addr().(*net.TCPAddr).Port
+}
+
+func port(t *testing.T, addr string) int {
+	t.Helper()
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.Atoi(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// serve serves h on ln until the test ends, over TLS with conf if set.
+func serve(t *testing.T, ln net.Listener, h http.Handler, conf *tls.Config) {
+	srv := &http.Server{Handler: h, TLSConfig: conf}
+	if conf != nil {
+		go srv.ServeTLS(ln, "", "")
+	} else {
+		go srv.Serve(ln)
+	}
+	t.Cleanup(func() { srv.Close() })
+}
+
+var hello = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "hello")
+})
+
+// leaf connects to addr for domain, which makes the ACME listener get its
+// certificate, and returns the certificate it serves.
+func leaf(t *testing.T, addr, domain string, roots *x509.CertPool) *x509.Certificate {
+	t.Helper()
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 2 * time.Minute}, "tcp", addr,
+		&tls.Config{ServerName: domain, RootCAs: roots})
+	if err != nil {
+		t.Fatalf("handshake for %s: %v", domain, err)
+	}
+	defer conn.Close()
+	cert := conn.ConnectionState().PeerCertificates[0]
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != domain {
+		t.Errorf("certificate names = %v, want %s", cert.DNSNames, domain)
+	}
+	return cert
+}
+
+// testACMECache makes sure the certificate with serial is served from the
+// cache after a restart, without the CA.
+func testACMECache(t *testing.T, cfg config.ACMEConfig, serial *big.Int, roots *x509.CertPool) {
+	t.Helper()
+	if _, err := os.Stat(filepath.Join(cfg.CacheDir, cfg.Domains[0])); err != nil {
+		t.Errorf("certificate not cached: %v", err)
+	}
+	restarted, err := NewACME(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, _ := listen(t)
+	serve(t, ln, hello, restarted.TLSConfig())
+	if got := leaf(t, ln.Addr().String(), cfg.Domains[0], roots); got.SerialNumber.Cmp(serial) != 0 {
+		t.Errorf("after a restart the serial is %x, want the cached %x", got.SerialNumber, serial)
+	}
+}
+
+func TestACMETLSALPN(t *testing.T) {
+	bin := pebbleBinary(t)
+	const domain = "alpn.example.test"
+	httpsLn, httpsPort := listen(t)
+	// Nothing answers HTTP-01: the certificate can only come through the
+	// HTTPS listener.
+	p := startPebble(t, bin, port(t, freeAddr(t)), httpsPort)
+	cfg := p.acmeConfig(domain, t.TempDir())
+	a, err := NewACME(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, httpsLn, hello, a.TLSConfig())
+
+	roots := p.roots(t)
+	cert := leaf(t, httpsLn.Addr().String(), domain, roots)
+	p.cmd.Process.Kill()
+	testACMECache(t, cfg, cert.SerialNumber, roots)
+}
+
+func TestACMEHTTP(t *testing.T) {
+	bin := pebbleBinary(t)
+	const domain = "http.example.test"
+	httpsLn, httpsPort := listen(t)
+	httpLn, httpPort := listen(t)
+	// Nothing answers TLS-ALPN-01 on the port Pebble tries, so the client
+	// falls back to HTTP-01 through the redirect listener.
+	p := startPebble(t, bin, httpPort, port(t, freeAddr(t)))
+	cfg := p.acmeConfig(domain, t.TempDir())
+	a, err := NewACME(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, httpsLn, hello, a.TLSConfig())
+	serve(t, httpLn, RedirectHandler(httpsPort, a.HTTPHandler()), nil)
+
+	roots := p.roots(t)
+	cert := leaf(t, httpsLn.Addr().String(), domain, roots)
+
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirect.Get(fmt.Sprintf("http://127.0.0.1:%d/sensors", httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if want := fmt.Sprintf("https://127.0.0.1:%d/sensors", httpsPort); resp.Header.Get("Location") != want {
+		t.Errorf("redirect to %q, want %q", resp.Header.Get("Location"), want)
+	}
+	p.cmd.Process.Kill()
+	testACMECache(t, cfg, cert.SerialNumber, roots)
+}
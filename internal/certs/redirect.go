@@ -0,0 +1,61 @@
+package certs
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChallengePath is the URL prefix used by ACME HTTP-01 validation.
+const ChallengePath = "/.well-known/acme-challenge/"
+
+// RedirectHandler sends every plain HTTP request to the same host and path
+// on HTTPS, on httpsPort. Requests under ChallengePath are passed to
+// challenge instead, so certificates can be issued and renewed while the
+// redirect is in place; a nil challenge answers them with 404.
+func RedirectHandler(httpsPort int, challenge http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, ChallengePath) {
+			if challenge == nil {
+				http.NotFound(w, r)
+				return
+			}
+			challenge.ServeHTTP(w, r)
+			return
+		}
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
+
+// WebrootChallenge serves HTTP-01 tokens written by an external ACME client
+// (e.g. certbot --webroot) below dir.
+func WebrootChallenge(dir string) http.Handler {
+	return http.FileServer(http.Dir(dir))
+}
+
+// HSTS sets Strict-Transport-Security on every response. It should only
+// wrap handlers served over TLS.
+func HSTS(maxAge time.Duration, includeSubdomains bool) func(http.Handler) http.Handler {
+	value := fmt.Sprintf("max-age=%d", int64(maxAge.Seconds()))
+	if includeSubdomains {
+		value += "; includeSubDomains"
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Strict-Transport-Security", value)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
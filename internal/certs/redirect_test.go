@@ -0,0 +1,70 @@
+package certs
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRedirect(t *testing.T) {
+	for _, tc := range []struct {
+		port   int
+		target string
+		want   string
+	}{
+		{443, "http://skarbek.dev/", "https://skarbek.dev/"},
+		{443, "http://skarbek.dev:8080/api/v1/sensors?units=imperial", "https://skarbek.dev/api/v1/sensors?units=imperial"},
+		{8443, "http://skarbek.dev:8080/login", "https://skarbek.dev:8443/login"},
+		{8443, "http://[::1]:8080/", "https://[::1]:8443/"},
+	} {
+		w := httptest.NewRecorder()
+		RedirectHandler(tc.port, nil).ServeHTTP(w, httptest.NewRequest(http.MethodPost, tc.target, nil))
+		// 308 keeps the method and body.
+		if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != tc.want {
+			t.Errorf("%s on port %d: %d to %q, want 308 to %q", tc.target, tc.port, w.Code, w.Header().Get("Location"), tc.want)
+		}
+	}
+}
+
+func TestRedirectChallenge(t *testing.T) {
+	path := ChallengePath + "token"
+	w := httptest.NewRecorder()
+	RedirectHandler(443, nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://skarbek.dev"+path, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("challenge without a handler: status %d, want 404", w.Code)
+	}
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, ChallengePath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, path), []byte("token.thumbprint"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	RedirectHandler(443, WebrootChallenge(dir)).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://skarbek.dev"+path, nil))
+	if body, _ := io.ReadAll(w.Body); w.Code != http.StatusOK || string(body) != "token.thumbprint" {
+		t.Errorf("webroot challenge: status %d, %q", w.Code, body)
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	for _, tc := range []struct {
+		maxAge     time.Duration
+		subdomains bool
+		want       string
+	}{
+		{365 * 24 * time.Hour, false, "max-age=31536000"},
+		{time.Hour, true, "max-age=3600; includeSubDomains"},
+	} {
+		w := httptest.NewRecorder()
+		HSTS(tc.maxAge, tc.subdomains)(hello).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://skarbek.dev/", nil))
+		if got := w.Header().Get("Strict-Transport-Security"); got != tc.want {
+			t.Errorf("HSTS(%v, %v) = %q, want %q", tc.maxAge, tc.subdomains, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// pair writes a new self-signed key pair to the files, dated at.
+func pair(t *testing.T, certFile, keyFile string, at time.Time) {
+	t.Helper()
+	writeSelfSigned(t, certFile, keyFile)
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func current(t *testing.T, r *Reloader) []byte {
+	t.Helper()
+	cert, err := r.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil || cert == nil {
+		t.Fatalf("GetCertificate = %v, %v", cert, err)
+	}
+	return cert.Certificate[0]
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "fullchain.pem"), filepath.Join(dir, "privkey.pem")
+	start := time.Now().Add(-time.Hour)
+	pair(t, certFile, keyFile, start)
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := current(t, r)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Watch(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Renewed files are picked up.
+	pair(t, certFile, keyFile, start.Add(time.Minute))
+	deadline := time.Now().Add(2 * time.Second)
+	for bytes.Equal(current(t, r), first) {
+		if time.Now().After(deadline) {
+			t.Fatal("renewed certificate was not loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	second := current(t, r)
+
+	// A half written renewal keeps the last good certificate.
+	if err := os.WriteFile(certFile, []byte("-----BEGIN CERTIFICATE-----\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later := start.Add(2 * time.Minute)
+	if err := os.Chtimes(certFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !bytes.Equal(current(t, r), second) {
+		t.Error("a broken certificate file replaced the served one")
+	}
+}
+
+func TestNewReloaderErrors(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if _, err := NewReloader(certFile, keyFile); err == nil {
+		t.Error("loaded missing files")
+	}
+
+	// A key that does not belong to the certificate.
+	writeSelfSigned(t, certFile, keyFile)
+	writeSelfSigned(t, filepath.Join(dir, "other.pem"), keyFile)
+	if _, err := NewReloader(certFile, keyFile); err == nil {
+		t.Error("loaded a mismatched key pair")
+	}
+}
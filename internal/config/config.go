@@ -0,0 +1,774 @@
+package config
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/bme280"
+	"github.com/maskarb/skarbek-dev/internal/filter"
+	"github.com/maskarb/skarbek-dev/internal/logging"
+	"github.com/maskarb/skarbek-dev/internal/units"
+)
+
+// quantityDimensions are the quantities readings have, by the dimension of
+// the units they can be given in. Humidity is always %RH.
+var quantityDimensions = map[string]units.Dimension{
+	"temperature": units.Temperature,
+	"humidity":    -1,
+	"pressure":    units.Pressure,
+}
+
+// EnvPrefix is prepended to every environment variable the config reads.
+const EnvPrefix = "SKARBEK_"
+
+// Config is the complete server configuration. It is built by Load from, in
+// increasing order of precedence: Default(), an optional JSON config file,
+// SKARBEK_* environment variables and command line flags.
+type Config struct {
+	Server   ServerConfig   `json:"server"`
+	TLS      TLSConfig      `json:"tls"`
+	Database DatabaseConfig `json:"database"`
+	OAuth    OAuthConfig    `json:"oauth"`
+	Session  SessionConfig  `json:"session"`
+	Sensor   SensorConfig   `json:"sensor"`
+	Alerts   AlertConfig    `json:"alerts"`
+	Notify   NotifyConfig   `json:"notify"`
+	Webhooks WebhookConfig  `json:"webhooks"`
+	Push     PushConfig     `json:"push"`
+	MQTT     MQTTConfig     `json:"mqtt"`
+	NodeTLS  NodeTLSConfig  `json:"node_tls"`
+	Features FeatureConfig  `json:"features"`
+	Log      LogConfig      `json:"log"`
+
+	// Warnings collects problems Validate worked around, for the caller
+	// to log once logging is set up.
+	Warnings []string `json:"-"`
+}
+
+type ServerConfig struct {
+	Addr         string `json:"addr"`
+	TemplatesDir string `json:"templates_dir"`
+	// ShutdownTimeout bounds draining requests and cleanup after SIGTERM.
+	// Keep it below the container stop timeout.
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+}
+
+// TLSConfig enables HTTPS. When enabled, server.addr only serves a redirect
+// to HTTPS (if Redirect is set) and the ACME HTTP-01 challenge path.
+type TLSConfig struct {
+	Enabled        bool     `json:"enabled"`
+	Addr           string   `json:"addr"`
+	CertFile       string   `json:"cert_file"`
+	KeyFile        string   `json:"key_file"`
+	ReloadInterval Duration `json:"reload_interval"`
+	// Redirect serves HTTP->HTTPS redirects on server.addr. RedirectPort is
+	// the public HTTPS port used in the redirect, which differs from the
+	// port in Addr when running behind Docker's port mapping.
+	Redirect     bool   `json:"redirect"`
+	RedirectPort int    `json:"redirect_port"`
+	ChallengeDir string `json:"challenge_dir"`
+	// HSTSMaxAge of zero disables the Strict-Transport-Security header.
+	HSTSMaxAge            Duration `json:"hsts_max_age"`
+	HSTSIncludeSubdomains bool     `json:"hsts_include_subdomains"`
+
+	ACME ACMEConfig `json:"acme"`
+}
+
+// ACMEConfig has the server obtain and renew its own certificates instead of
+// reading tls.cert_file and tls.key_file.
+type ACMEConfig struct {
+	Enabled      bool     `json:"enabled"`
+	DirectoryURL string   `json:"directory_url"`
+	Email        string   `json:"email"`
+	Domains      []string `json:"domains"`
+	CacheDir     string   `json:"cache_dir"`
+	// CACertFile is a PEM bundle trusted when talking to DirectoryURL, for
+	// test CAs such as Pebble that use a private root.
+	CACertFile  string   `json:"ca_cert_file"`
+	RenewBefore Duration `json:"renew_before"`
+}
+
+type DatabaseConfig struct {
+	Path string `json:"path"`
+}
+
+// OAuthConfig holds the Google OAuth client. The client id and secret may be
+// given directly or read from a Google "web" credentials file.
+type OAuthConfig struct {
+	CredentialsFile string `json:"credentials_file"`
+	ClientID        string `json:"client_id"`
+	ClientSecret    string `json:"client_secret"`
+	RedirectURL     string `json:"redirect_url"`
+}
+
+type SessionConfig struct {
+	IdleTimeout     Duration `json:"idle_timeout"`
+	AbsoluteTimeout Duration `json:"absolute_timeout"`
+	CleanupInterval Duration `json:"cleanup_interval"`
+	// Admins are the emails allowed to use admin endpoints, such as
+	// changing sensor driver settings.
+	Admins []string `json:"admins"`
+}
+
+// SensorConfig describes the BME280 attached to the Pi's I2C bus.
+type SensorConfig struct {
+	Enabled bool `json:"enabled"`
+	Bus     int  `json:"bus"`
+	Address int  `json:"address"`
+	// Driver holds the chip settings sensors start with, unless others
+	// were saved for them through the API.
+	Driver bme280.Settings `json:"driver"`
+	// Filters are the outlier and smoothing filters sensors start with,
+	// unless others were saved for them through the API.
+	Filters filter.Config `json:"filters"`
+	// Forecast controls the pressure history behind the forecast endpoint.
+	Forecast ForecastConfig `json:"forecast"`
+	// NodeTimeout is how long a remote node, which sends its readings
+	// rather than being read, may stay silent before it is offline.
+	NodeTimeout Duration `json:"node_timeout"`
+	// EnrollmentTTL is how long an enrollment code for a new node is
+	// valid.
+	EnrollmentTTL Duration `json:"enrollment_ttl"`
+}
+
+// ForecastConfig sets how pressure is sampled for the tendency and how the
+// forecast reads it.
+type ForecastConfig struct {
+	// Interval is how often every sensor's pressure is recorded.
+	Interval Duration `json:"interval"`
+	// Hemisphere is "north" or "south"; it decides which months are summer
+	// for the Zambretti seasonal correction.
+	Hemisphere string `json:"hemisphere"`
+	// StormDrop is the fall over 3 hours, in Pa, that raises the storm
+	// warning.
+	StormDrop float64 `json:"storm_drop"`
+}
+
+// AlertConfig tunes the alert engine. Rules themselves are managed
+// through the API.
+type AlertConfig struct {
+	// SampleInterval is how often the local sensors are read for the
+	// alert engine, webhooks and MQTT, so none of them hang on API
+	// traffic.
+	SampleInterval Duration `json:"sample_interval"`
+	// Interval is how often pending alerts are checked for having waited
+	// out their duration when no new reading arrives.
+	Interval Duration `json:"interval"`
+}
+
+// WebhookConfig tunes webhook delivery. Subscriptions themselves are
+// managed through the API.
+type WebhookConfig struct {
+	// Attempts is how often a delivery is tried before it is marked failed.
+	Attempts int `json:"attempts"`
+	// Backoff is the wait after the first failed attempt; it doubles with
+	// every further failure, up to an hour.
+	Backoff Duration `json:"backoff"`
+	// Timeout bounds each request.
+	Timeout Duration `json:"timeout"`
+	// Retention is how long finished deliveries stay in the log.
+	Retention Duration `json:"retention"`
+}
+
+// PushConfig tunes Web Push to the dashboard. The VAPID keys are
+// generated on first start and kept in the database.
+type PushConfig struct {
+	// Subject is the contact push services see in the VAPID token, a
+	// mailto: or https: URL.
+	Subject string `json:"subject"`
+	// TTL is how long push services keep a message for an unreachable
+	// device.
+	TTL Duration `json:"ttl"`
+	// AllowHTTP accepts http:// subscription endpoints, for testing
+	// against a local push service stand-in.
+	AllowHTTP bool `json:"allow_http"`
+}
+
+// MQTTConfig publishes readings to an MQTT broker, with Home Assistant
+// discovery, and takes readings of remote nodes from it. MQTT is off while
+// Broker is empty.
+type MQTTConfig struct {
+	// Broker is the broker URL: tcp:// or mqtt:// for plain connections,
+	// ssl://, tls:// or mqtts:// for TLS, ws:// or wss:// for websockets.
+	Broker   string `json:"broker"`
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// CACertFile is a PEM bundle trusted in addition to the system roots.
+	// CertFile and KeyFile are a client certificate, for brokers that
+	// authenticate clients by certificate.
+	CACertFile         string `json:"ca_cert_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	// BaseTopic prefixes every topic published: readings go to
+	// <base>/sensor/<id>/state, sensor health to
+	// <base>/sensor/<id>/availability and the server's own to
+	// <base>/status, which is also its last will.
+	BaseTopic string `json:"base_topic"`
+	// DiscoveryPrefix is where Home Assistant looks for discovery config;
+	// empty disables discovery.
+	DiscoveryPrefix string `json:"discovery_prefix"`
+	QoS             int    `json:"qos"`
+	// Retain keeps the latest reading on the broker for new subscribers.
+	Retain bool `json:"retain"`
+	// Interval is how often readings are expected. Home Assistant marks a
+	// value unavailable after three intervals without one; 0 never does.
+	// Local sensors are read every alerts.sample_interval.
+	Interval Duration `json:"interval"`
+	// Subscriptions are the topics remote nodes publish their readings
+	// to. They are only read from the config file.
+	Subscriptions []MQTTSubscription `json:"subscriptions"`
+}
+
+// MQTTSubscription maps the JSON messages remote nodes publish to
+// readings. Nodes are registered as sensors the first time they are heard.
+type MQTTSubscription struct {
+	// Topic is what the nodes publish to, with {node} standing for the
+	// level that names the node, e.g. "esp32/{node}/state". Other levels
+	// may be + wildcards, and the last may be #.
+	Topic string `json:"topic"`
+	// Values maps quantities (temperature, humidity, pressure) to the
+	// path of their value in the message, e.g. "bme280.temp" or
+	// "sensors.0.value", or "$" for a message that is just the number.
+	Values map[string]string `json:"values"`
+	// Units are the units of the values, for those not in °C, %RH and Pa,
+	// e.g. {"pressure": "hPa"}.
+	Units map[string]string `json:"units"`
+	// Timestamp is the path of the time the reading was taken, RFC 3339 or
+	// unix seconds. Without it the time the message arrived is used.
+	Timestamp string `json:"timestamp"`
+}
+
+// NodeTLSConfig runs a small CA for remote nodes and a listener where
+// nodes send readings authenticated by the client certificates it issued.
+type NodeTLSConfig struct {
+	Enabled bool `json:"enabled"`
+	// Addr is the mutual TLS listener.
+	Addr string `json:"addr"`
+	// Hosts are the names and IP addresses nodes reach Addr at; the CA
+	// issues the listener's own certificate for them.
+	Hosts []string `json:"hosts"`
+	// KeyFile holds the CA's private key, written with mode 0600 when the
+	// CA is generated; the database only keeps its certificate.
+	KeyFile string `json:"key_file"`
+	// CertValidity is how long node certificates are valid, and
+	// RenewBefore how long before they expire nodes are told to renew.
+	CertValidity Duration `json:"cert_validity"`
+	RenewBefore  Duration `json:"renew_before"`
+}
+
+// NotifyConfig lists where alerts are sent. Channels carry credentials
+// and are only read from the config file.
+type NotifyConfig struct {
+	Channels []ChannelConfig `json:"channels"`
+}
+
+// ChannelConfig is one notification channel.
+type ChannelConfig struct {
+	Name string `json:"name"`
+	// Type is smtp, ntfy, slack, discord or webhook.
+	Type string `json:"type"`
+	// URL is the ntfy topic, the Slack or Discord incoming webhook, or
+	// the webhook endpoint.
+	URL string `json:"url"`
+	// Token is sent as a bearer token to ntfy and webhooks.
+	Token   string            `json:"token"`
+	Headers map[string]string `json:"headers"`
+	SMTP    SMTPConfig        `json:"smtp"`
+
+	// Title and Template are text/template sources rendered with the
+	// event; empty uses the event's own title and message.
+	Title    string `json:"title"`
+	Template string `json:"template"`
+	// Events limits the channel to these event statuses, e.g. firing,
+	// resolved; empty sends everything.
+	Events []string `json:"events"`
+
+	RateLimit  RateLimitConfig  `json:"rate_limit"`
+	QuietHours QuietHoursConfig `json:"quiet_hours"`
+	Retry      RetryConfig      `json:"retry"`
+}
+
+// SMTPConfig is the mail server of an smtp channel.
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Security is starttls (the default), tls for implicit TLS, or none
+	// for local relays such as MailHog.
+	Security string   `json:"security"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+// RateLimitConfig allows at most Count messages per Per; more are
+// dropped. A zero Count is unlimited.
+type RateLimitConfig struct {
+	Count int      `json:"count"`
+	Per   Duration `json:"per"`
+}
+
+// QuietHoursConfig holds messages back between Start and End, "22:00"
+// style clock times in Timezone (default the server's), and sends them
+// once the quiet hours are over.
+type QuietHoursConfig struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone"`
+}
+
+// RetryConfig retries failed sends, doubling Backoff after each attempt.
+type RetryConfig struct {
+	Attempts int      `json:"attempts"`
+	Backoff  Duration `json:"backoff"`
+}
+
+type FeatureConfig struct {
+	// Auth enables Google login and sessions. It is switched off by Load
+	// when no OAuth client is configured.
+	Auth bool `json:"auth"`
+	// Profiler mounts net/http/pprof under /debug.
+	Profiler bool `json:"profiler"`
+	// ValidateAPI checks live traffic against the OpenAPI document and
+	// logs violations. It buffers every response body.
+	ValidateAPI bool `json:"validate_api"`
+}
+
+// LogConfig selects the log level and encoding. Components overrides the
+// level per component (sensor, http, auth, db, tls, i2c, ...).
+type LogConfig struct {
+	Level      string            `json:"level"`
+	Format     string            `json:"format"`
+	Components map[string]string `json:"components"`
+}
+
+// Options converts the config into logging options.
+func (l LogConfig) Options() (logging.Options, error) {
+	level, err := logging.ParseLevel(l.Level)
+	if err != nil {
+		return logging.Options{}, err
+	}
+	format, err := logging.ParseFormat(l.Format)
+	if err != nil {
+		return logging.Options{}, err
+	}
+	components := make(map[string]logging.Level, len(l.Components))
+	for name, s := range l.Components {
+		if components[name], err = logging.ParseLevel(s); err != nil {
+			return logging.Options{}, fmt.Errorf("component %s: %v", name, err)
+		}
+	}
+	return logging.Options{Level: level, Format: format, Components: components}, nil
+}
+
+// Credentials which stores google ids.
+type Credentials struct {
+	Cid     string `json:"client_id"`
+	Csecret string `json:"client_secret"`
+}
+
+type Web struct {
+	Creds Credentials `json:"web"`
+}
+
+// Default returns the configuration used when nothing else is specified.
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Addr:            ":8080",
+			TemplatesDir:    "web/templates",
+			ShutdownTimeout: Duration{25 * time.Second},
+		},
+		TLS: TLSConfig{
+			Addr:           ":8443",
+			CertFile:       "/etc/letsencrypt/live/skarbek.dev/fullchain.pem",
+			KeyFile:        "/etc/letsencrypt/live/skarbek.dev/privkey.pem",
+			ReloadInterval: Duration{time.Hour},
+			Redirect:       true,
+			RedirectPort:   443,
+			HSTSMaxAge:     Duration{365 * 24 * time.Hour},
+			ACME: ACMEConfig{
+				DirectoryURL: "https://acme-v02.api.letsencrypt.org/directory",
+				Domains:      []string{"skarbek.dev"},
+				CacheDir:     "db/acme",
+				RenewBefore:  Duration{30 * 24 * time.Hour},
+			},
+		},
+		Database: DatabaseConfig{
+			Path: "db/skarbek.db",
+		},
+		OAuth: OAuthConfig{
+			CredentialsFile: "/etc/oauth/creds.json",
+			RedirectURL:     "https://skarbek.dev/auth",
+		},
+		Session: SessionConfig{
+			IdleTimeout:     Duration{7 * 24 * time.Hour},
+			AbsoluteTimeout: Duration{30 * 24 * time.Hour},
+			CleanupInterval: Duration{15 * time.Minute},
+		},
+		Sensor: SensorConfig{
+			Enabled: true,
+			Bus:     1,
+			Address: 0x77,
+			Driver:  bme280.DefaultSettings,
+			Filters: filter.DefaultConfig,
+			Forecast: ForecastConfig{
+				Interval:   Duration{10 * time.Minute},
+				Hemisphere: "north",
+				StormDrop:  400,
+			},
+			NodeTimeout:   Duration{5 * time.Minute},
+			EnrollmentTTL: Duration{15 * time.Minute},
+		},
+		Alerts: AlertConfig{
+			SampleInterval: Duration{15 * time.Second},
+			Interval:       Duration{30 * time.Second},
+		},
+		Webhooks: WebhookConfig{
+			Attempts:  8,
+			Backoff:   Duration{30 * time.Second},
+			Timeout:   Duration{10 * time.Second},
+			Retention: Duration{7 * 24 * time.Hour},
+		},
+		Push: PushConfig{
+			TTL: Duration{6 * time.Hour},
+		},
+		MQTT: MQTTConfig{
+			ClientID:        "skarbek",
+			BaseTopic:       "skarbek",
+			DiscoveryPrefix: "homeassistant",
+			QoS:             1,
+			Retain:          true,
+			Interval:        Duration{time.Minute},
+		},
+		NodeTLS: NodeTLSConfig{
+			Addr:         ":9443",
+			Hosts:        []string{"localhost"},
+			KeyFile:      "db/node-ca.key",
+			CertValidity: Duration{90 * 24 * time.Hour},
+			RenewBefore:  Duration{30 * 24 * time.Hour},
+		},
+		Features: FeatureConfig{
+			Auth: true,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "logfmt",
+		},
+	}
+}
+
+// Load builds the configuration from args (normally os.Args[1:]) and the
+// process environment, then validates it.
+func Load(args []string) (*Config, error) {
+	c := Default()
+	settings := c.settings()
+
+	fs := flag.NewFlagSet("skarbek-dev", flag.ContinueOnError)
+	configFile := os.Getenv(EnvPrefix + "CONFIG")
+	fs.StringVar(&configFile, "config", configFile, "path to a JSON config file (env "+EnvPrefix+"CONFIG)")
+
+	// Flags are only recorded while parsing and applied last, so that they
+	// win over the config file and environment.
+	flagValues := make(map[string]string)
+	for _, s := range settings {
+		_, isBool := s.value.(*boolValue)
+		fs.Var(&flagRecorder{s.name, isBool, flagValues},
+			s.name, fmt.Sprintf("%s (env %s, default %q)", s.usage, s.env(), s.value.String()))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if configFile != "" {
+		if err := c.loadFile(configFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env()); ok {
+			if err := s.value.Set(v); err != nil {
+				return nil, fmt.Errorf("invalid %s=%q: %v", s.env(), v, err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if v, ok := flagValues[s.name]; ok {
+			if err := s.value.Set(v); err != nil {
+				return nil, fmt.Errorf("invalid -%s=%q: %v", s.name, v, err)
+			}
+		}
+	}
+
+	if err := c.loadCredentials(); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %v", err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// loadCredentials fills in the OAuth client from the credentials file unless
+// it was configured directly. A missing file only disables auth.
+func (c *Config) loadCredentials() error {
+	o := &c.OAuth
+	if o.ClientID != "" || o.ClientSecret != "" || o.CredentialsFile == "" {
+		return nil
+	}
+
+	file, err := os.ReadFile(o.CredentialsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("read oauth credentials: %v", err)
+	}
+
+	var web Web
+	if err := json.Unmarshal(file, &web); err != nil {
+		return fmt.Errorf("parse oauth credentials %s: %v", o.CredentialsFile, err)
+	}
+	o.ClientID = web.Creds.Cid
+	o.ClientSecret = web.Creds.Csecret
+	return nil
+}
+
+// Validate checks the configuration for consistency. Auth is switched off,
+// with a warning, when it is enabled but no OAuth client is available.
+func (c *Config) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+
+	_, _, err := net.SplitHostPort(c.Server.Addr)
+	check(err == nil, "server.addr %q: %v", c.Server.Addr, err)
+	check(c.Server.TemplatesDir != "", "server.templates_dir must be set")
+	check(c.Server.ShutdownTimeout.Duration > 0, "server.shutdown_timeout must be positive")
+
+	if c.TLS.Enabled {
+		_, _, err := net.SplitHostPort(c.TLS.Addr)
+		check(err == nil, "tls.addr %q: %v", c.TLS.Addr, err)
+		check(c.TLS.Addr != c.Server.Addr, "tls.addr and server.addr must differ")
+		if a := c.TLS.ACME; a.Enabled {
+			u, err := url.Parse(a.DirectoryURL)
+			check(err == nil && u.Scheme == "https", "tls.acme.directory_url %q must be an https URL", a.DirectoryURL)
+			check(len(a.Domains) > 0, "tls.acme.domains must not be empty")
+			check(a.CacheDir != "", "tls.acme.cache_dir must be set")
+			check(a.RenewBefore.Duration > 0, "tls.acme.renew_before must be positive")
+		} else {
+			check(c.TLS.CertFile != "" && c.TLS.KeyFile != "", "tls.cert_file and tls.key_file must be set")
+		}
+		check(c.TLS.ReloadInterval.Duration > 0, "tls.reload_interval must be positive")
+		check(c.TLS.RedirectPort > 0 && c.TLS.RedirectPort < 65536, "tls.redirect_port %d is out of range", c.TLS.RedirectPort)
+		check(c.TLS.HSTSMaxAge.Duration >= 0, "tls.hsts_max_age must not be negative")
+	}
+	check(c.Database.Path != "", "database.path must be set")
+
+	check(c.Session.IdleTimeout.Duration > 0, "session.idle_timeout must be positive")
+	check(c.Session.AbsoluteTimeout.Duration >= c.Session.IdleTimeout.Duration,
+		"session.absolute_timeout must not be shorter than session.idle_timeout")
+	check(c.Session.CleanupInterval.Duration > 0, "session.cleanup_interval must be positive")
+
+	if c.Sensor.Enabled {
+		check(c.Sensor.Bus >= 0, "sensor.bus must not be negative")
+		check(c.Sensor.Address > 0x02 && c.Sensor.Address < 0x78,
+			"sensor.address 0x%02x is not a valid 7-bit I2C address", c.Sensor.Address)
+		if err := c.Sensor.Driver.Validate(); err != nil {
+			check(false, "sensor.driver: %v", err)
+		}
+		if err := c.Sensor.Filters.Validate(); err != nil {
+			check(false, "sensor.filters: %v", err)
+		}
+	}
+	f := c.Sensor.Forecast
+	check(f.Interval.Duration >= time.Minute && f.Interval.Duration <= time.Hour,
+		"sensor.forecast.interval must be between 1m and 1h")
+	check(f.Hemisphere == "north" || f.Hemisphere == "south",
+		"sensor.forecast.hemisphere %q must be north or south", f.Hemisphere)
+	check(f.StormDrop > 0, "sensor.forecast.storm_drop must be positive")
+	check(c.Alerts.SampleInterval.Duration >= time.Second, "alerts.sample_interval must be at least 1s")
+	check(c.Alerts.Interval.Duration > 0, "alerts.interval must be positive")
+	w := c.Webhooks
+	check(w.Attempts > 0, "webhooks.attempts must be positive")
+	check(w.Backoff.Duration > 0, "webhooks.backoff must be positive")
+	check(w.Timeout.Duration > 0, "webhooks.timeout must be positive")
+	check(w.Retention.Duration >= time.Hour, "webhooks.retention must be at least 1h")
+	p := c.Push
+	check(p.Subject == "" || strings.HasPrefix(p.Subject, "mailto:") || strings.HasPrefix(p.Subject, "https:"),
+		"push.subject %q must be a mailto: or https: URL", p.Subject)
+	check(p.TTL.Duration >= 0 && p.TTL.Duration <= 28*24*time.Hour, "push.ttl must be between 0 and 28 days")
+	if m := c.MQTT; m.Broker != "" {
+		u, err := url.Parse(m.Broker)
+		check(err == nil && u.Host != "", "mqtt.broker %q must be a URL with a host", m.Broker)
+		if err == nil {
+			switch u.Scheme {
+			case "tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss":
+			default:
+				check(false, "mqtt.broker scheme %q must be tcp, mqtt, ssl, tls, mqtts, ws or wss", u.Scheme)
+			}
+		}
+		check(m.ClientID != "", "mqtt.client_id must be set")
+		check(m.BaseTopic != "" && !strings.ContainsAny(m.BaseTopic, "#+"),
+			"mqtt.base_topic %q must be set and free of wildcards", m.BaseTopic)
+		check(!strings.ContainsAny(m.DiscoveryPrefix, "#+"), "mqtt.discovery_prefix %q must be free of wildcards", m.DiscoveryPrefix)
+		check(m.QoS >= 0 && m.QoS <= 2, "mqtt.qos must be 0, 1 or 2")
+		check((m.CertFile == "") == (m.KeyFile == ""), "mqtt.cert_file and mqtt.key_file must be set together")
+		check(m.Interval.Duration == 0 || m.Interval.Duration >= time.Second, "mqtt.interval must be 0 or at least 1s")
+		if m.Password != "" && (err != nil || u.Scheme == "tcp" || u.Scheme == "mqtt" || u.Scheme == "ws") {
+			c.Warnings = append(c.Warnings, "mqtt.password is sent to the broker without TLS")
+		}
+		for i, sub := range m.Subscriptions {
+			levels := strings.Split(sub.Topic, "/")
+			nodes := 0
+			for j, l := range levels {
+				switch {
+				case l == "{node}":
+					nodes++
+				case l == "#":
+					check(j == len(levels)-1, "mqtt.subscriptions[%d].topic %q may only end in #", i, sub.Topic)
+				case l != "+" && strings.ContainsAny(l, "#+{}"):
+					check(false, "mqtt.subscriptions[%d].topic %q has an invalid level %q", i, sub.Topic, l)
+				}
+			}
+			check(nodes == 1, "mqtt.subscriptions[%d].topic %q must have one {node} level", i, sub.Topic)
+			check(!strings.HasPrefix(sub.Topic, m.BaseTopic+"/"),
+				"mqtt.subscriptions[%d].topic %q must not be under mqtt.base_topic, where readings are published", i, sub.Topic)
+			check(len(sub.Values) > 0, "mqtt.subscriptions[%d].values must map at least one quantity", i)
+			for q, path := range sub.Values {
+				_, ok := quantityDimensions[q]
+				check(ok && path != "", "mqtt.subscriptions[%d].values: %q must be temperature, humidity or pressure with a path", i, q)
+			}
+			for q, name := range sub.Units {
+				u, err := units.Parse(name)
+				d, ok := u.Dimension()
+				want, known := quantityDimensions[q]
+				check(err == nil && ok && known && d == want,
+					"mqtt.subscriptions[%d].units: %q is not a unit of %s", i, name, q)
+			}
+		}
+	}
+	check(c.Sensor.NodeTimeout.Duration >= 10*time.Second, "sensor.node_timeout must be at least 10s")
+	if n := c.NodeTLS; n.Enabled {
+		check(n.Addr != "", "node_tls.addr must be set")
+		check(n.Addr != c.Server.Addr && (!c.TLS.Enabled || n.Addr != c.TLS.Addr),
+			"node_tls.addr %q must differ from the other listeners", n.Addr)
+		check(len(n.Hosts) > 0, "node_tls.hosts must name at least one host")
+		check(n.KeyFile != "", "node_tls.key_file must be set")
+		check(n.CertValidity.Duration >= time.Hour && n.CertValidity.Duration <= 825*24*time.Hour,
+			"node_tls.cert_validity must be between 1h and 825 days")
+		check(n.RenewBefore.Duration > 0 && n.RenewBefore.Duration < n.CertValidity.Duration,
+			"node_tls.renew_before must be positive and shorter than node_tls.cert_validity")
+	}
+	check(c.Sensor.EnrollmentTTL.Duration >= time.Minute && c.Sensor.EnrollmentTTL.Duration <= 24*time.Hour,
+		"sensor.enrollment_ttl must be between 1m and 24h")
+	names := make(map[string]bool)
+	for i, ch := range c.Notify.Channels {
+		check(ch.Name != "" && !names[ch.Name], "notify.channels[%d].name must be set and unique", i)
+		names[ch.Name] = true
+		switch ch.Type {
+		case "smtp":
+			check(ch.SMTP.Host != "" && ch.SMTP.From != "" && len(ch.SMTP.To) > 0,
+				"notify.channels[%d]: smtp needs host, from and to", i)
+		case "ntfy", "slack", "discord", "webhook":
+			u, err := url.Parse(ch.URL)
+			check(err == nil && (u.Scheme == "http" || u.Scheme == "https"),
+				"notify.channels[%d].url %q must be an http(s) URL", i, ch.URL)
+		default:
+			check(false, "notify.channels[%d].type %q must be smtp, ntfy, slack, discord or webhook", i, ch.Type)
+		}
+		check(ch.RateLimit.Count >= 0 && (ch.RateLimit.Count == 0 || ch.RateLimit.Per.Duration > 0),
+			"notify.channels[%d].rate_limit needs a positive per", i)
+		check(ch.Retry.Attempts >= 0 && ch.Retry.Backoff.Duration >= 0, "notify.channels[%d].retry must not be negative", i)
+	}
+
+	if c.Features.Auth {
+		o := c.OAuth
+		if o.ClientID == "" || o.ClientSecret == "" {
+			c.Warnings = append(c.Warnings, "no oauth client configured, running with auth disabled")
+			c.Features.Auth = false
+		} else {
+			u, err := url.Parse(o.RedirectURL)
+			check(err == nil && u.IsAbs(), "oauth.redirect_url %q must be an absolute URL", o.RedirectURL)
+			if len(c.Session.Admins) == 0 {
+				c.Warnings = append(c.Warnings, "session.admins is empty, admin endpoints refuse everyone")
+			}
+			if c.Push.Subject == "" {
+				c.Warnings = append(c.Warnings, "push.subject is empty, some push services refuse notifications without a contact")
+			}
+		}
+	}
+
+	_, err = c.Log.Options()
+	check(err == nil, "log: %v", err)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// Duration is a time.Duration that reads and writes JSON as "15m" style
+// strings.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"15m\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// Value stores d in the database as nanoseconds.
+func (d Duration) Value() (driver.Value, error) {
+	return int64(d.Duration), nil
+}
+
+// Scan reads d back from its integer column.
+func (d *Duration) Scan(src interface{}) error {
+	v, ok := src.(int64)
+	if !ok {
+		return fmt.Errorf("cannot scan %T into config.Duration", src)
+	}
+	d.Duration = time.Duration(v)
+	return nil
+}
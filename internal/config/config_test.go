@@ -0,0 +1,179 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// isolate clears the SKARBEK_* environment for the test and points the
+// OAuth credentials at a file that does not exist.
+func isolate(t *testing.T) {
+	t.Helper()
+	for _, kv := range os.Environ() {
+		if name := strings.SplitN(kv, "=", 2)[0]; strings.HasPrefix(name, EnvPrefix) {
+			t.Setenv(name, "")
+			os.Unsetenv(name)
+		}
+	}
+	t.Setenv(EnvPrefix+"OAUTH_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "missing.json"))
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDefaults(t *testing.T) {
+	isolate(t)
+	c, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Default()
+	want.OAuth.CredentialsFile = c.OAuth.CredentialsFile
+	// Without an OAuth client auth is switched off with a warning.
+	want.Features.Auth = false
+	want.Warnings = []string{"no oauth client configured, running with auth disabled"}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("Load() = %+v, want %+v", c, want)
+	}
+}
+
+// TestPrecedence sets each field in every layer above the one that should
+// win: defaults, then the file, then the environment, then flags.
+func TestPrecedence(t *testing.T) {
+	isolate(t)
+	file := writeFile(t, "config.json", `{
+		"server": {"addr": ":8081", "templates_dir": "file/templates"},
+		"database": {"path": "file.db"},
+		"log": {"level": "debug", "format": "logfmt"}
+	}`)
+	t.Setenv(EnvPrefix+"CONFIG", file)
+	t.Setenv(EnvPrefix+"ADDR", ":8082")
+	t.Setenv(EnvPrefix+"DB_PATH", "env.db")
+	t.Setenv(EnvPrefix+"LOG_FORMAT", "json")
+
+	c, err := Load([]string{"-addr", ":8083"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []struct{ name, got, want string }{
+		{"server.addr", c.Server.Addr, ":8083"},
+		{"database.path", c.Database.Path, "env.db"},
+		{"log.format", c.Log.Format, "json"},
+		{"server.templates_dir", c.Server.TemplatesDir, "file/templates"},
+		{"log.level", c.Log.Level, "debug"},
+		{"tls.addr", c.TLS.Addr, ":8443"},
+	} {
+		if f.got != f.want {
+			t.Errorf("%s = %q, want %q", f.name, f.got, f.want)
+		}
+	}
+
+	// -config wins over SKARBEK_CONFIG.
+	other := writeFile(t, "other.json", `{"log": {"level": "warn"}}`)
+	c, err = Load([]string{"-config", other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Log.Level != "warn" || c.Server.TemplatesDir != "web/templates" || c.Server.Addr != ":8082" {
+		t.Errorf("with -config: level %q, templates %q, addr %q", c.Log.Level, c.Server.TemplatesDir, c.Server.Addr)
+	}
+}
+
+func TestFlagValues(t *testing.T) {
+	isolate(t)
+	c, err := Load([]string{
+		"-tls-enabled",
+		"-sensor-enabled=false",
+		"-sensor-address", "0x76",
+		"-session-admins", "ada@example.com, ,bob@example.com",
+		"-log-components", "sensor=debug,http=warn",
+		"-shutdown-timeout", "10s",
+		"-forecast-storm-drop", "250.5",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.TLS.Enabled || c.Sensor.Enabled || c.Sensor.Address != 0x76 {
+		t.Errorf("tls %v, sensor %v at 0x%02x", c.TLS.Enabled, c.Sensor.Enabled, c.Sensor.Address)
+	}
+	if want := []string{"ada@example.com", "bob@example.com"}; !reflect.DeepEqual(c.Session.Admins, want) {
+		t.Errorf("session.admins = %q, want %q", c.Session.Admins, want)
+	}
+	if want := map[string]string{"sensor": "debug", "http": "warn"}; !reflect.DeepEqual(c.Log.Components, want) {
+		t.Errorf("log.components = %v, want %v", c.Log.Components, want)
+	}
+	if c.Server.ShutdownTimeout.Duration != 10*time.Second || c.Sensor.Forecast.StormDrop != 250.5 {
+		t.Errorf("shutdown timeout %v, storm drop %v", c.Server.ShutdownTimeout, c.Sensor.Forecast.StormDrop)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		file string
+		args []string
+		want string
+	}{
+		{"unknown flag", nil, "", []string{"-no-such-flag"}, "no-such-flag"},
+		{"bad flag", nil, "", []string{"-sensor-bus", "one"}, "-sensor-bus"},
+		{"bad env", map[string]string{EnvPrefix + "SHUTDOWN_TIMEOUT": "soon"}, "", nil, EnvPrefix + "SHUTDOWN_TIMEOUT"},
+		{"unknown field", nil, `{"server": {"port": 8080}}`, nil, "port"},
+		{"missing file", nil, "", []string{"-config", "/nonexistent/config.json"}, "read config file"},
+		{"invalid", nil, "", []string{"-tls-enabled", "-tls-addr", ":8080"}, "tls.addr and server.addr must differ"},
+		{"bad level", map[string]string{EnvPrefix + "LOG_LEVEL": "loud"}, "", nil, "log:"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			isolate(t)
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			args := tc.args
+			if tc.file != "" {
+				args = append(args, "-config", writeFile(t, "config.json", tc.file))
+			}
+			_, err := Load(args)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Load(%q) = %v, want an error mentioning %q", args, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	isolate(t)
+	creds := writeFile(t, "creds.json", `{"web": {"client_id": "file-id", "client_secret": "file-secret"}}`)
+	t.Setenv(EnvPrefix+"OAUTH_CREDENTIALS_FILE", creds)
+
+	c, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Features.Auth || c.OAuth.ClientID != "file-id" || c.OAuth.ClientSecret != "file-secret" {
+		t.Errorf("auth %v with client %q/%q", c.Features.Auth, c.OAuth.ClientID, c.OAuth.ClientSecret)
+	}
+
+	// A client given directly is used instead of the file.
+	c, err = Load([]string{"-oauth-client-id", "flag-id", "-oauth-client-secret", "flag-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.OAuth.ClientID != "flag-id" || c.OAuth.ClientSecret != "flag-secret" {
+		t.Errorf("client %q/%q, want the one from flags", c.OAuth.ClientID, c.OAuth.ClientSecret)
+	}
+
+	t.Setenv(EnvPrefix+"OAUTH_CREDENTIALS_FILE", writeFile(t, "bad.json", "{"))
+	if _, err := Load(nil); err == nil || !strings.Contains(err.Error(), "parse oauth credentials") {
+		t.Errorf("bad credentials file: %v", err)
+	}
+}
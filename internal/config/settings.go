@@ -0,0 +1,225 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setting binds one config field to a flag name and an environment variable.
+type setting struct {
+	name  string
+	usage string
+	value flag.Value
+}
+
+// env returns the environment variable for s, e.g. "db-path" reads
+// SKARBEK_DB_PATH.
+func (s setting) env() string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(s.name, "-", "_"))
+}
+
+// settings lists every field that can be set from the environment or the
+// command line. Fields only make sense in the config file are left out.
+func (c *Config) settings() []setting {
+	return []setting{
+		{"addr", "HTTP listen address", (*stringValue)(&c.Server.Addr)},
+		{"templates-dir", "directory containing HTML templates", (*stringValue)(&c.Server.TemplatesDir)},
+		{"shutdown-timeout", "time allowed for draining requests and cleanup on shutdown", (*durationValue)(&c.Server.ShutdownTimeout.Duration)},
+		{"tls-enabled", "serve HTTPS", (*boolValue)(&c.TLS.Enabled)},
+		{"tls-addr", "HTTPS listen address", (*stringValue)(&c.TLS.Addr)},
+		{"tls-cert-file", "PEM certificate chain", (*stringValue)(&c.TLS.CertFile)},
+		{"tls-key-file", "PEM private key", (*stringValue)(&c.TLS.KeyFile)},
+		{"tls-reload-interval", "how often certificate files are checked for renewal", (*durationValue)(&c.TLS.ReloadInterval.Duration)},
+		{"tls-redirect", "redirect HTTP on -addr to HTTPS", (*boolValue)(&c.TLS.Redirect)},
+		{"tls-redirect-port", "public HTTPS port used in redirects", (*intValue)(&c.TLS.RedirectPort)},
+		{"tls-challenge-dir", "webroot serving ACME HTTP-01 challenges", (*stringValue)(&c.TLS.ChallengeDir)},
+		{"tls-hsts-max-age", "Strict-Transport-Security max-age, 0 to disable", (*durationValue)(&c.TLS.HSTSMaxAge.Duration)},
+		{"tls-hsts-include-subdomains", "add includeSubDomains to Strict-Transport-Security", (*boolValue)(&c.TLS.HSTSIncludeSubdomains)},
+		{"acme-enabled", "obtain certificates via ACME instead of tls-cert-file", (*boolValue)(&c.TLS.ACME.Enabled)},
+		{"acme-directory-url", "ACME directory URL", (*stringValue)(&c.TLS.ACME.DirectoryURL)},
+		{"acme-email", "contact email for the ACME account", (*stringValue)(&c.TLS.ACME.Email)},
+		{"acme-domains", "comma separated domains to request certificates for", (*stringsValue)(&c.TLS.ACME.Domains)},
+		{"acme-cache-dir", "directory storing the ACME account key and certificates", (*stringValue)(&c.TLS.ACME.CacheDir)},
+		{"acme-ca-cert-file", "extra root CA trusted for the ACME directory", (*stringValue)(&c.TLS.ACME.CACertFile)},
+		{"acme-renew-before", "renew certificates this long before they expire", (*durationValue)(&c.TLS.ACME.RenewBefore.Duration)},
+
+		{"db-path", "SQLite database file", (*stringValue)(&c.Database.Path)},
+
+		{"oauth-credentials-file", "Google OAuth web credentials JSON", (*stringValue)(&c.OAuth.CredentialsFile)},
+		{"oauth-client-id", "Google OAuth client id", (*stringValue)(&c.OAuth.ClientID)},
+		{"oauth-client-secret", "Google OAuth client secret", (*stringValue)(&c.OAuth.ClientSecret)},
+		{"oauth-redirect-url", "OAuth redirect URL, ending in /auth", (*stringValue)(&c.OAuth.RedirectURL)},
+
+		{"session-idle-timeout", "log out sessions idle for this long", (*durationValue)(&c.Session.IdleTimeout.Duration)},
+		{"session-absolute-timeout", "maximum session lifetime", (*durationValue)(&c.Session.AbsoluteTimeout.Duration)},
+		{"session-cleanup-interval", "how often expired sessions are purged", (*durationValue)(&c.Session.CleanupInterval.Duration)},
+		{"session-admins", "comma separated emails allowed to use admin endpoints", (*stringsValue)(&c.Session.Admins)},
+
+		{"sensor-enabled", "read the local BME280", (*boolValue)(&c.Sensor.Enabled)},
+		{"sensor-bus", "I2C bus number of the BME280", (*intValue)(&c.Sensor.Bus)},
+		{"sensor-address", "I2C address of the BME280", (*intValue)(&c.Sensor.Address)},
+		{"sensor-mode", "BME280 power mode, forced or normal", (*stringValue)(&c.Sensor.Driver.Mode)},
+		{"sensor-iir-filter", "BME280 IIR filter coefficient: 0 (off), 2, 4, 8 or 16", (*intValue)(&c.Sensor.Driver.Filter)},
+		{"sensor-standby", "BME280 standby between normal mode measurements, in ms", (*floatValue)(&c.Sensor.Driver.Standby)},
+		{"sensor-node-timeout", "how long a remote node may stay silent before it is offline", (*durationValue)(&c.Sensor.NodeTimeout.Duration)},
+		{"sensor-enrollment-ttl", "how long an enrollment code for a new node is valid", (*durationValue)(&c.Sensor.EnrollmentTTL.Duration)},
+		{"forecast-interval", "how often pressure is recorded for the forecast", (*durationValue)(&c.Sensor.Forecast.Interval.Duration)},
+		{"forecast-hemisphere", "north or south, for the forecast's seasons", (*stringValue)(&c.Sensor.Forecast.Hemisphere)},
+		{"forecast-storm-drop", "pressure fall over 3 hours, in Pa, that raises the storm warning", (*floatValue)(&c.Sensor.Forecast.StormDrop)},
+
+		{"alerts-sample-interval", "how often the local sensors are read for alerts, webhooks and MQTT", (*durationValue)(&c.Alerts.SampleInterval.Duration)},
+		{"alerts-interval", "how often pending alerts are checked without new readings", (*durationValue)(&c.Alerts.Interval.Duration)},
+		{"webhooks-attempts", "requests made for a webhook delivery before it fails", (*intValue)(&c.Webhooks.Attempts)},
+		{"webhooks-backoff", "wait after a failed webhook delivery, doubled on every retry", (*durationValue)(&c.Webhooks.Backoff.Duration)},
+		{"webhooks-timeout", "timeout of each webhook request", (*durationValue)(&c.Webhooks.Timeout.Duration)},
+		{"webhooks-retention", "how long finished webhook deliveries are logged", (*durationValue)(&c.Webhooks.Retention.Duration)},
+		{"push-subject", "VAPID contact for push services, a mailto: or https: URL", (*stringValue)(&c.Push.Subject)},
+		{"push-ttl", "how long push services keep undelivered notifications", (*durationValue)(&c.Push.TTL.Duration)},
+		{"push-allow-http", "accept http:// push endpoints, for a local push service stand-in", (*boolValue)(&c.Push.AllowHTTP)},
+		{"mqtt-broker", "MQTT broker URL to publish readings to, e.g. tcp://localhost:1883", (*stringValue)(&c.MQTT.Broker)},
+		{"mqtt-client-id", "MQTT client id, also used in Home Assistant unique ids", (*stringValue)(&c.MQTT.ClientID)},
+		{"mqtt-username", "MQTT username", (*stringValue)(&c.MQTT.Username)},
+		{"mqtt-password", "MQTT password", (*stringValue)(&c.MQTT.Password)},
+		{"mqtt-ca-cert-file", "extra root CA trusted for the MQTT broker", (*stringValue)(&c.MQTT.CACertFile)},
+		{"mqtt-cert-file", "PEM client certificate for the MQTT broker", (*stringValue)(&c.MQTT.CertFile)},
+		{"mqtt-key-file", "PEM private key of the MQTT client certificate", (*stringValue)(&c.MQTT.KeyFile)},
+		{"mqtt-insecure-skip-verify", "do not verify the MQTT broker's certificate", (*boolValue)(&c.MQTT.InsecureSkipVerify)},
+		{"mqtt-base-topic", "prefix of the topics readings and availability are published to", (*stringValue)(&c.MQTT.BaseTopic)},
+		{"mqtt-discovery-prefix", "Home Assistant discovery prefix, empty to disable discovery", (*stringValue)(&c.MQTT.DiscoveryPrefix)},
+		{"mqtt-qos", "QoS of published messages: 0, 1 or 2", (*intValue)(&c.MQTT.QoS)},
+		{"mqtt-retain", "retain the latest reading on the broker", (*boolValue)(&c.MQTT.Retain)},
+		{"mqtt-interval", "how often readings are expected; Home Assistant expires values after three, 0 never", (*durationValue)(&c.MQTT.Interval.Duration)},
+
+		{"node-tls-enabled", "issue client certificates to remote nodes and accept their readings over mutual TLS", (*boolValue)(&c.NodeTLS.Enabled)},
+		{"node-tls-addr", "mutual TLS listen address for remote nodes", (*stringValue)(&c.NodeTLS.Addr)},
+		{"node-tls-hosts", "comma separated names and IPs nodes reach the mutual TLS listener at", (*stringsValue)(&c.NodeTLS.Hosts)},
+		{"node-tls-key-file", "file holding the private key of the node CA", (*stringValue)(&c.NodeTLS.KeyFile)},
+		{"node-tls-cert-validity", "how long node certificates are valid", (*durationValue)(&c.NodeTLS.CertValidity.Duration)},
+		{"node-tls-renew-before", "how long before expiry nodes are told to renew their certificate", (*durationValue)(&c.NodeTLS.RenewBefore.Duration)},
+
+		{"log-level", "debug, info, warn or error", (*stringValue)(&c.Log.Level)},
+		{"log-format", "logfmt or json", (*stringValue)(&c.Log.Format)},
+		{"log-components", "per component levels, e.g. sensor=debug,http=warn", (*levelsValue)(&c.Log.Components)},
+
+		{"feature-auth", "enable Google login and sessions", (*boolValue)(&c.Features.Auth)},
+		{"feature-profiler", "serve pprof under /debug", (*boolValue)(&c.Features.Profiler)},
+		{"feature-validate-api", "log requests and responses that do not match the OpenAPI document", (*boolValue)(&c.Features.ValidateAPI)},
+	}
+}
+
+type stringValue string
+
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+func (v *stringValue) String() string     { return string(*v) }
+
+type stringsValue []string
+
+// Set splits a comma separated list, dropping empty entries.
+func (v *stringsValue) Set(s string) error {
+	var out []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			out = append(out, e)
+		}
+	}
+	*v = out
+	return nil
+}
+func (v *stringsValue) String() string { return strings.Join(*v, ",") }
+
+type intValue int
+
+// Set accepts decimal, 0x hex and 0o octal, so I2C addresses can be written
+// the way i2cdetect prints them.
+func (v *intValue) Set(s string) error {
+	n, err := strconv.ParseInt(s, 0, strconv.IntSize)
+	if err != nil {
+		return err
+	}
+	*v = intValue(n)
+	return nil
+}
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+type floatValue float64
+
+func (v *floatValue) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*v = floatValue(f)
+	return nil
+}
+func (v *floatValue) String() string { return strconv.FormatFloat(float64(*v), 'g', -1, 64) }
+
+type boolValue bool
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*v = boolValue(b)
+	return nil
+}
+func (v *boolValue) String() string { return strconv.FormatBool(bool(*v)) }
+
+type durationValue time.Duration
+
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*v = durationValue(d)
+	return nil
+}
+func (v *durationValue) String() string { return time.Duration(*v).String() }
+
+// flagRecorder is the flag.Value registered for each setting. It only
+// remembers what was passed so Load can apply flags after the environment.
+type flagRecorder struct {
+	name   string
+	isBool bool
+	values map[string]string
+}
+
+func (r *flagRecorder) Set(s string) error { r.values[r.name] = s; return nil }
+func (r *flagRecorder) String() string     { return "" }
+func (r *flagRecorder) IsBoolFlag() bool   { return r.isBool }
+
+type levelsValue map[string]string
+
+// Set parses "component=level" pairs separated by commas.
+func (v *levelsValue) Set(s string) error {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, level := pair, ""
+		if i := strings.Index(pair, "="); i >= 0 {
+			name, level = pair[:i], pair[i+1:]
+		}
+		if name == "" || level == "" {
+			return fmt.Errorf("expected component=level, got %q", pair)
+		}
+		m[name] = level
+	}
+	*v = m
+	return nil
+}
+
+func (v *levelsValue) String() string {
+	pairs := make([]string, 0, len(*v))
+	for name, level := range *v {
+		pairs = append(pairs, name+"="+level)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -4,4 +4,7 @@ type key int
 
 const (
 	SensorContextID key = iota
+	SessionContextID
+	LogContextID
+	NodeContextID
 )
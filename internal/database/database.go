@@ -0,0 +1,68 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/logging"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+var logger = logging.For("db")
+
+// Open opens (creating if needed) the SQLite database at path. The parent
+// directory is created so a fresh `db/` volume works out of the box.
+func Open(path string) (*gorm.DB, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("create database directory: %v", err)
+		}
+	}
+
+	// WAL lets the HTTP handlers read while background jobs write, and the
+	// busy timeout keeps those writers from failing with SQLITE_BUSY.
+	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=on", path)
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		// Slow queries and errors go to the "db" component; missing
+		// records are normal control flow for the stores.
+		Logger: gormlogger.New(logger.StdLogger(logging.LevelWarn), gormlogger.Config{
+			SlowThreshold:             200 * time.Millisecond,
+			LogLevel:                  gormlogger.Warn,
+			IgnoreRecordNotFoundError: true,
+		}),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("open database %s: %v", path, err)
+	}
+	return db, nil
+}
+
+// Close checkpoints the write-ahead log into the main database file and
+// closes the connection pool.
+func Close(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	if err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)").Error; err != nil {
+		logger.Warn("wal checkpoint failed", "err", err)
+	}
+	return sqlDB.Close()
+}
+
+// Ping checks that the database still answers queries.
+func Ping(ctx context.Context, db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return fmt.Errorf("database ping: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+// Package filter cleans up a stream of sensor samples: implausible values
+// and sudden jumps are rejected, and what is left can be smoothed with a
+// median, an exponential moving average or a one dimensional Kalman
+// filter. Each Chain handles one quantity of one sensor.
+package filter
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Smoothing selects the smoothing step after the median.
+type Smoothing string
+
+const (
+	SmoothingNone   Smoothing = ""
+	SmoothingEMA    Smoothing = "ema"
+	SmoothingKalman Smoothing = "kalman"
+)
+
+// Reason says why a sample was rejected.
+type Reason string
+
+const (
+	RejectRange Reason = "range"
+	RejectRate  Reason = "rate"
+)
+
+// maxConsecutiveRejects bounds how long a real step change, such as a
+// sensor carried to another room, can be locked out by the rate limit.
+// After this many rate rejections in a row the next sample starts over;
+// range rejections neither count nor break the run.
+const maxConsecutiveRejects = 5
+
+// Settings configure the chain of one quantity. Zero values switch a step
+// off.
+type Settings struct {
+	// Min and Max bound plausible values.
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+	// MaxRate is the largest believable change per second against the
+	// last accepted sample.
+	MaxRate float64 `json:"max_rate,omitempty"`
+	// Median is the window of accepted samples the median is taken over;
+	// 0 or 1 is off.
+	Median    int       `json:"median,omitempty"`
+	Smoothing Smoothing `json:"smoothing,omitempty"`
+	// Alpha is the EMA weight of a new sample, in (0, 1].
+	Alpha float64 `json:"alpha,omitempty"`
+	// ProcessNoise and MeasurementNoise are the Kalman variances: how much
+	// the true value drifts between samples and how noisy a sample is.
+	ProcessNoise     float64 `json:"process_noise,omitempty"`
+	MeasurementNoise float64 `json:"measurement_noise,omitempty"`
+}
+
+// Validate reports settings the chain cannot use.
+func (s Settings) Validate() error {
+	if s.Min != nil && s.Max != nil && *s.Min >= *s.Max {
+		return fmt.Errorf("min %v must be below max %v", *s.Min, *s.Max)
+	}
+	if s.MaxRate < 0 {
+		return errors.New("max_rate must not be negative")
+	}
+	if s.Median < 0 || s.Median > 31 {
+		return fmt.Errorf("median %d must be between 0 and 31", s.Median)
+	}
+	switch s.Smoothing {
+	case SmoothingNone:
+	case SmoothingEMA:
+		if s.Alpha <= 0 || s.Alpha > 1 {
+			return fmt.Errorf("alpha %v must be in (0, 1]", s.Alpha)
+		}
+	case SmoothingKalman:
+		if s.ProcessNoise <= 0 || s.MeasurementNoise <= 0 {
+			return errors.New("process_noise and measurement_noise must be positive")
+		}
+	default:
+		return fmt.Errorf("smoothing %q must be ema, kalman or empty", s.Smoothing)
+	}
+	return nil
+}
+
+// Config holds the settings of every quantity a sensor measures, in °C,
+// %RH and Pa.
+type Config struct {
+	Temperature Settings `json:"temperature"`
+	Humidity    Settings `json:"humidity"`
+	Pressure    Settings `json:"pressure"`
+}
+
+func float(v float64) *float64 { return &v }
+
+// DefaultConfig rejects values outside the BME280's operating range and
+// jumps no room sees between two reads: 1 °C, 5 %RH or 100 Pa per second.
+// Nothing is smoothed.
+var DefaultConfig = Config{
+	Temperature: Settings{Min: float(-40), Max: float(85), MaxRate: 1},
+	Humidity:    Settings{Min: float(0), Max: float(100), MaxRate: 5},
+	Pressure:    Settings{Min: float(30000), Max: float(110000), MaxRate: 100},
+}
+
+// Validate checks every quantity.
+func (c Config) Validate() error {
+	for name, s := range map[string]Settings{"temperature": c.Temperature, "humidity": c.Humidity, "pressure": c.Pressure} {
+		if err := s.Validate(); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Value stores c as JSON in the database.
+func (c Config) Value() (driver.Value, error) {
+	b, err := json.Marshal(c)
+	return string(b), err
+}
+
+// Scan reads c back from its JSON column.
+func (c *Config) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), c)
+	case []byte:
+		return json.Unmarshal(v, c)
+	}
+	return fmt.Errorf("cannot scan %T into filter.Config", src)
+}
+
+// Stats count what a chain did with its samples.
+type Stats struct {
+	Accepted int            `json:"accepted"`
+	Rejected map[Reason]int `json:"rejected"`
+	// Resets counts restarts after too many rejections in a row. The
+	// sample a chain restarts from counts as accepted.
+	Resets int `json:"resets"`
+}
+
+// Result is the outcome of one sample.
+type Result struct {
+	// Value is the filtered value. On rejection it is the previous output,
+	// if there was one.
+	Value float64
+	Valid bool
+	// Rejected is empty when the sample was accepted.
+	Rejected Reason
+}
+
+// Chain filters one quantity. It is not safe for concurrent use.
+type Chain struct {
+	settings Settings
+	stats    Stats
+
+	last        float64
+	lastAt      time.Time
+	started     bool
+	consecutive int
+
+	window []float64
+	out    float64
+	hasOut bool
+	// variance is the Kalman estimate's error variance.
+	variance float64
+}
+
+// NewChain starts a chain with s, which must be valid.
+func NewChain(s Settings) *Chain {
+	return &Chain{settings: s, stats: Stats{Rejected: make(map[Reason]int)}}
+}
+
+// Settings returns the chain's settings.
+func (c *Chain) Settings() Settings { return c.settings }
+
+// Stats returns a copy of the chain's counters.
+func (c *Chain) Stats() Stats {
+	st := c.stats
+	st.Rejected = make(map[Reason]int, len(c.stats.Rejected))
+	for k, v := range c.stats.Rejected {
+		st.Rejected[k] = v
+	}
+	return st
+}
+
+// Apply runs sample v taken at t through the chain.
+func (c *Chain) Apply(v float64, t time.Time) Result {
+	if reason := c.check(v, t); reason != "" {
+		if reason == RejectRate {
+			c.consecutive++
+		}
+		if reason == RejectRange || c.consecutive <= maxConsecutiveRejects {
+			c.stats.Rejected[reason]++
+			return Result{Value: c.out, Valid: c.hasOut, Rejected: reason}
+		}
+		// The jumps persist, so the world has probably changed rather
+		// than the sensor glitched; start over from this sample.
+		c.stats.Resets++
+		c.reset()
+	}
+	c.consecutive = 0
+	c.stats.Accepted++
+	c.last, c.lastAt, c.started = v, t, true
+
+	x := v
+	if n := c.settings.Median; n > 1 {
+		c.window = append(c.window, v)
+		if len(c.window) > n {
+			c.window = c.window[len(c.window)-n:]
+		}
+		x = median(c.window)
+	}
+	switch {
+	case !c.hasOut || c.settings.Smoothing == SmoothingNone:
+		c.out = x
+		c.variance = c.settings.MeasurementNoise
+	case c.settings.Smoothing == SmoothingEMA:
+		c.out += c.settings.Alpha * (x - c.out)
+	case c.settings.Smoothing == SmoothingKalman:
+		p := c.variance + c.settings.ProcessNoise
+		k := p / (p + c.settings.MeasurementNoise)
+		c.out += k * (x - c.out)
+		c.variance = (1 - k) * p
+	}
+	c.hasOut = true
+	return Result{Value: c.out, Valid: true}
+}
+
+// check returns why v should be rejected, or "".
+func (c *Chain) check(v float64, t time.Time) Reason {
+	s := c.settings
+	if math.IsNaN(v) || (s.Min != nil && v < *s.Min) || (s.Max != nil && v > *s.Max) {
+		return RejectRange
+	}
+	if s.MaxRate > 0 && c.started {
+		// Reads closer than a second apart are judged as a second apart,
+		// so back to back requests do not make every change look fast.
+		dt := math.Max(t.Sub(c.lastAt).Seconds(), 1)
+		if math.Abs(v-c.last)/dt > s.MaxRate {
+			return RejectRate
+		}
+	}
+	return ""
+}
+
+func (c *Chain) reset() {
+	c.started, c.hasOut = false, false
+	c.window = c.window[:0]
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
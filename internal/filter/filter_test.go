@@ -0,0 +1,183 @@
+package filter
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+
+// sample is one input of a chain, taken sec seconds after start, and what
+// the chain should make of it.
+type sample struct {
+	sec      float64
+	v        float64
+	want     float64
+	rejected Reason
+}
+
+func run(t *testing.T, c *Chain, samples []sample) {
+	t.Helper()
+	for i, s := range samples {
+		at := start.Add(time.Duration(s.sec * float64(time.Second)))
+		res := c.Apply(s.v, at)
+		if res.Rejected != s.rejected {
+			t.Fatalf("sample %d (%v): rejected %q, want %q", i, s.v, res.Rejected, s.rejected)
+		}
+		if math.Abs(res.Value-s.want) > 1e-9 {
+			t.Fatalf("sample %d (%v): value %v, want %v", i, s.v, res.Value, s.want)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	c := NewChain(Settings{Min: float(-40), Max: float(85)})
+	if res := c.Apply(90, start); res.Valid || res.Rejected != RejectRange {
+		t.Fatalf("first sample out of range: %+v, want invalid range rejection", res)
+	}
+	run(t, c, []sample{
+		{1, 20, 20, ""},
+		{2, -41, 20, RejectRange},
+		{3, math.NaN(), 20, RejectRange},
+		{4, 85, 85, ""},
+		{5, -40, -40, ""},
+	})
+	st := c.Stats()
+	if st.Accepted != 3 || st.Rejected[RejectRange] != 3 {
+		t.Errorf("stats = %+v, want 3 accepted and 3 out of range", st)
+	}
+}
+
+func TestRate(t *testing.T) {
+	c := NewChain(Settings{MaxRate: 1})
+	run(t, c, []sample{
+		{0, 20, 20, ""},
+		{1, 22, 20, RejectRate},
+		// Compared with the last accepted sample, 2 s before.
+		{2, 21.5, 21.5, ""},
+		// Reads closer than a second apart count as a second apart.
+		{2.1, 22.4, 22.4, ""},
+		{2.2, 23.5, 22.4, RejectRate},
+		{62.2, 50, 50, ""},
+	})
+}
+
+func TestResetAfterConsecutiveRejects(t *testing.T) {
+	c := NewChain(Settings{MaxRate: 1})
+	samples := []sample{{0, 20, 20, ""}}
+	for i := 1; i <= maxConsecutiveRejects; i++ {
+		samples = append(samples, sample{float64(i), 30, 20, RejectRate})
+	}
+	// The step persists, so the chain starts over from it.
+	samples = append(samples, sample{maxConsecutiveRejects + 1, 30, 30, ""}, sample{maxConsecutiveRejects + 2, 30.5, 30.5, ""})
+	run(t, c, samples)
+	if st := c.Stats(); st.Resets != 1 || st.Rejected[RejectRate] != maxConsecutiveRejects {
+		t.Errorf("stats = %+v, want 1 reset after %d rate rejections", st, maxConsecutiveRejects)
+	}
+}
+
+// TestRangeRejectsDoNotReset makes sure glitches out of range between
+// rate rejections do not cut the lock-out short.
+func TestRangeRejectsDoNotReset(t *testing.T) {
+	c := NewChain(Settings{Min: float(-40), Max: float(85), MaxRate: 1})
+	samples := []sample{{0, 20, 20, ""}}
+	for i := 1; i <= maxConsecutiveRejects; i++ {
+		samples = append(samples,
+			sample{float64(2 * i), 50, 20, RejectRate},
+			sample{float64(2*i + 1), 200, 20, RejectRange})
+	}
+	samples = append(samples, sample{2*maxConsecutiveRejects + 2, 50, 50, ""})
+	run(t, c, samples)
+	if st := c.Stats(); st.Resets != 1 {
+		t.Errorf("resets = %d, want 1", st.Resets)
+	}
+}
+
+// TestAcceptEndsRun makes sure only rejections in a row lead to a reset.
+func TestAcceptEndsRun(t *testing.T) {
+	c := NewChain(Settings{MaxRate: 1})
+	samples := []sample{{0, 20, 20, ""}}
+	for i := 1; i < 2*maxConsecutiveRejects; i++ {
+		samples = append(samples, sample{float64(2 * i), 30, 20, RejectRate}, sample{float64(2*i + 1), 20, 20, ""})
+	}
+	run(t, c, samples)
+	if st := c.Stats(); st.Resets != 0 {
+		t.Errorf("resets = %d, want 0", st.Resets)
+	}
+}
+
+func TestMedian(t *testing.T) {
+	run(t, NewChain(Settings{Median: 3}), []sample{
+		{0, 1, 1, ""},
+		{1, 10, 5.5, ""},
+		{2, 2, 2, ""},
+		{3, 3, 3, ""},
+		// The window holds the last three: 2, 3 and 100.
+		{4, 100, 3, ""},
+		{5, 4, 4, ""},
+	})
+	// Rejected samples stay out of the window.
+	run(t, NewChain(Settings{Max: float(50), Median: 3}), []sample{
+		{0, 1, 1, ""},
+		{1, 100, 1, RejectRange},
+		{2, 3, 2, ""},
+	})
+}
+
+func TestEMA(t *testing.T) {
+	run(t, NewChain(Settings{Smoothing: SmoothingEMA, Alpha: 0.5}), []sample{
+		// The first sample is taken as is.
+		{0, 10, 10, ""},
+		{1, 20, 15, ""},
+		{2, 20, 17.5, ""},
+		{3, 10, 13.75, ""},
+	})
+	run(t, NewChain(Settings{Smoothing: SmoothingEMA, Alpha: 1}), []sample{
+		{0, 10, 10, ""},
+		{1, 20, 20, ""},
+	})
+}
+
+func TestKalman(t *testing.T) {
+	// With process and measurement noise of 1 the gain goes 2/3, 5/8,
+	// 13/21, ... towards (√5-1)/2.
+	run(t, NewChain(Settings{Smoothing: SmoothingKalman, ProcessNoise: 1, MeasurementNoise: 1}), []sample{
+		{0, 10, 10, ""},
+		{1, 20, 10 + 10*2.0/3, ""},
+		{2, 20, 10 + 10*2.0/3 + 10.0/3*5/8, ""},
+	})
+
+	// A steady value seen through noise settles near it.
+	c := NewChain(Settings{Smoothing: SmoothingKalman, ProcessNoise: 0.001, MeasurementNoise: 0.25})
+	var res Result
+	for i := 0; i < 200; i++ {
+		noise := 0.5
+		if i%2 == 1 {
+			noise = -0.5
+		}
+		res = c.Apply(20+noise, start.Add(time.Duration(i)*time.Second))
+	}
+	if math.Abs(res.Value-20) > 0.1 {
+		t.Errorf("settled at %v, want 20 ±0.1", res.Value)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, s := range []Settings{
+		{Min: float(10), Max: float(10)},
+		{MaxRate: -1},
+		{Median: 32},
+		{Smoothing: SmoothingEMA},
+		{Smoothing: SmoothingEMA, Alpha: 1.5},
+		{Smoothing: SmoothingKalman, ProcessNoise: 1},
+		{Smoothing: "lowpass"},
+	} {
+		if err := s.Validate(); err == nil {
+			t.Errorf("%+v is valid", s)
+		}
+	}
+	if err := DefaultConfig.Validate(); err != nil {
+		t.Errorf("DefaultConfig: %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+// Package forecast turns a pressure history into a tendency and a short
+// term local forecast. Pressures are Pa throughout.
+package forecast
+
+import (
+	"math"
+	"time"
+)
+
+// Sample is one pressure reading.
+type Sample struct {
+	At       time.Time
+	Pressure float64
+}
+
+// Trend is the direction of a tendency.
+type Trend string
+
+const (
+	Rising  Trend = "rising"
+	Steady  Trend = "steady"
+	Falling Trend = "falling"
+)
+
+// Tendency is the pressure change over a period ending at the latest
+// sample.
+type Tendency struct {
+	Hours  float64 `json:"hours"`
+	Change float64 `json:"change"`
+	Trend  Trend   `json:"trend"`
+	// Description grades the change the way shipping forecasts do, e.g.
+	// "falling quickly".
+	Description string `json:"description"`
+	// Code and CodeDescription are the WMO pressure tendency (code table
+	// 0200); only set for the 3 hour tendency.
+	Code            *int   `json:"wmo_code,omitempty"`
+	CodeDescription string `json:"wmo_description,omitempty"`
+}
+
+// Met Office bands for the change over 3 hours, in Pa.
+const (
+	steadyBand = 10
+	slowlyBand = 150
+	plainBand  = 350
+	quickBand  = 600
+)
+
+// halfSteady is the change over half of the 3 hours below which a half
+// counts as steady when picking the WMO code.
+const halfSteady = 5
+
+var codeDescriptions = [...]string{
+	"increasing, then decreasing",
+	"increasing, then steady; or increasing, then increasing more slowly",
+	"increasing (steadily or unsteadily)",
+	"decreasing or steady, then increasing; or increasing, then increasing more rapidly",
+	"steady",
+	"decreasing, then increasing",
+	"decreasing, then steady; or decreasing, then decreasing more slowly",
+	"decreasing (steadily or unsteadily)",
+	"steady or increasing, then decreasing; or decreasing, then decreasing more rapidly",
+}
+
+// At computes the tendency over period from samples, which must be sorted
+// by time. It returns nil when no sample lies close enough to the start of
+// the period: within a tenth of it, or 20 minutes at most.
+func At(samples []Sample, period time.Duration) *Tendency {
+	if len(samples) < 2 {
+		return nil
+	}
+	end := samples[len(samples)-1]
+	start, ok := nearest(samples, end.At.Add(-period), period)
+	if !ok {
+		return nil
+	}
+	hours := end.At.Sub(start.At).Hours()
+	change := end.Pressure - start.Pressure
+	t := &Tendency{Hours: round(hours, 2), Change: change}
+	// Grade on the change scaled to 3 hours so every period uses the same
+	// bands.
+	t.Trend, t.Description = grade(change * 3 / hours)
+	return t
+}
+
+// At3h is At over 3 hours, with the WMO code from how the first and second
+// half of the period compare.
+func At3h(samples []Sample) *Tendency {
+	t := At(samples, 3*time.Hour)
+	if t == nil {
+		return nil
+	}
+	end := samples[len(samples)-1]
+	mid, ok := nearest(samples, end.At.Add(-90*time.Minute), 3*time.Hour)
+	if !ok {
+		return t
+	}
+	code := wmoCode(t.Change-(end.Pressure-mid.Pressure), end.Pressure-mid.Pressure)
+	t.Code, t.CodeDescription = &code, codeDescriptions[code]
+	return t
+}
+
+// nearest finds the sample closest to at, if one is within the tolerance
+// for period.
+func nearest(samples []Sample, at time.Time, period time.Duration) (Sample, bool) {
+	tolerance := period / 10
+	if tolerance > 20*time.Minute {
+		tolerance = 20 * time.Minute
+	}
+	best, bestDiff := Sample{}, time.Duration(math.MaxInt64)
+	for _, s := range samples {
+		diff := s.At.Sub(at)
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff < bestDiff {
+			best, bestDiff = s, diff
+		}
+	}
+	return best, bestDiff <= tolerance
+}
+
+func grade(change3h float64) (Trend, string) {
+	trend, abs := Rising, change3h
+	if change3h < 0 {
+		trend, abs = Falling, -change3h
+	}
+	switch {
+	case abs < steadyBand:
+		return Steady, "steady"
+	case abs < slowlyBand:
+		return trend, string(trend) + " slowly"
+	case abs < plainBand:
+		return trend, string(trend)
+	case abs < quickBand:
+		return trend, string(trend) + " quickly"
+	}
+	return trend, string(trend) + " very rapidly"
+}
+
+// wmoCode picks the code table 0200 characteristic from the change over
+// the first and second half of the 3 hours.
+func wmoCode(first, second float64) int {
+	dir := func(d float64) int {
+		switch {
+		case d >= halfSteady:
+			return 1
+		case d <= -halfSteady:
+			return -1
+		}
+		return 0
+	}
+	d1, d2 := dir(first), dir(second)
+	net := first + second
+	if math.Abs(net) < steadyBand && d1 == 0 && d2 == 0 {
+		return 4
+	}
+	if net >= 0 {
+		switch {
+		case d1 > 0 && d2 < 0:
+			return 0
+		case d1 > 0 && d2 == 0, d1 > 0 && d2 > 0 && second < first/2:
+			return 1
+		case d1 <= 0 && d2 > 0, d1 > 0 && d2 > 0 && second > first*2:
+			return 3
+		}
+		return 2
+	}
+	switch {
+	case d1 < 0 && d2 > 0:
+		return 5
+	case d1 < 0 && d2 == 0, d1 < 0 && d2 < 0 && second > first/2:
+		return 6
+	case d1 >= 0 && d2 < 0, d1 < 0 && d2 < 0 && second < first*2:
+		return 8
+	}
+	return 7
+}
+
+func round(v float64, decimals int) float64 {
+	p := math.Pow(10, float64(decimals))
+	return math.Round(v*p) / p
+}
@@ -0,0 +1,170 @@
+package forecast
+
+import (
+	"testing"
+	"time"
+)
+
+var end = time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+
+// series returns samples every step over span up to end, with pressure
+// p(h) at h hours before end.
+func series(span, step time.Duration, p func(h float64) float64) []Sample {
+	var out []Sample
+	for d := span; d >= 0; d -= step {
+		out = append(out, Sample{At: end.Add(-d), Pressure: p(d.Hours())})
+	}
+	return out
+}
+
+// linear changes by change Pa over every 3 hours up to end.
+func linear(change float64) func(h float64) float64 {
+	return func(h float64) float64 { return 101325 - change*h/3 }
+}
+
+// Met Office descriptions of the change over 3 hours.
+var gradeTable = []struct {
+	change3h    float64
+	trend       Trend
+	description string
+}{
+	{0, Steady, "steady"},
+	{9.9, Steady, "steady"},
+	{-9.9, Steady, "steady"},
+	{10, Rising, "rising slowly"},
+	{-10, Falling, "falling slowly"},
+	{149, Rising, "rising slowly"},
+	{150, Rising, "rising"},
+	{-349, Falling, "falling"},
+	{350, Rising, "rising quickly"},
+	{-599, Falling, "falling quickly"},
+	{600, Rising, "rising very rapidly"},
+	{-1200, Falling, "falling very rapidly"},
+}
+
+func TestAtGrades(t *testing.T) {
+	for _, row := range gradeTable {
+		got := At(series(3*time.Hour, 10*time.Minute, linear(row.change3h)), 3*time.Hour)
+		if got == nil {
+			t.Fatalf("At(%v Pa/3h) = nil", row.change3h)
+		}
+		if got.Hours != 3 || !near(got.Change, row.change3h, 1e-6) {
+			t.Errorf("At(%v Pa/3h) = %v Pa over %v h", row.change3h, got.Change, got.Hours)
+		}
+		if got.Trend != row.trend || got.Description != row.description {
+			t.Errorf("At(%v Pa/3h) = %s, %q; want %s, %q", row.change3h, got.Trend, got.Description, row.trend, row.description)
+		}
+		if got.Code != nil {
+			t.Errorf("At(%v Pa/3h) has WMO code %d", row.change3h, *got.Code)
+		}
+	}
+}
+
+// TestAtScales makes sure longer periods are graded on their change
+// scaled to 3 hours.
+func TestAtScales(t *testing.T) {
+	got := At(series(12*time.Hour, 10*time.Minute, linear(-100)), 12*time.Hour)
+	if got == nil || got.Hours != 12 || !near(got.Change, -400, 1e-6) {
+		t.Fatalf("At over 12 h = %+v, want -400 Pa over 12 h", got)
+	}
+	if got.Description != "falling slowly" {
+		t.Errorf("description = %q, want falling slowly", got.Description)
+	}
+}
+
+func TestAtTolerance(t *testing.T) {
+	for _, tc := range []struct {
+		period time.Duration
+		// first is how long before end the first sample is.
+		first time.Duration
+		ok    bool
+	}{
+		// A tenth of the period.
+		{3 * time.Hour, 3*time.Hour + 18*time.Minute, true},
+		{3 * time.Hour, 3*time.Hour - 18*time.Minute, true},
+		{3 * time.Hour, 3*time.Hour - 19*time.Minute, false},
+		{time.Hour, 54 * time.Minute, true},
+		{time.Hour, 53 * time.Minute, false},
+		// At most 20 minutes.
+		{12 * time.Hour, 12*time.Hour - 20*time.Minute, true},
+		{12 * time.Hour, 12*time.Hour - 21*time.Minute, false},
+	} {
+		samples := []Sample{{At: end.Add(-tc.first), Pressure: 101000}, {At: end, Pressure: 101200}}
+		got := At(samples, tc.period)
+		if (got != nil) != tc.ok {
+			t.Errorf("At(%v) with a sample %v before: %+v, want found %v", tc.period, tc.first, got, tc.ok)
+			continue
+		}
+		if got != nil && got.Hours != round(tc.first.Hours(), 2) {
+			t.Errorf("At(%v) over %v h, want the %v actually covered", tc.period, got.Hours, tc.first)
+		}
+	}
+	if got := At([]Sample{{At: end, Pressure: 101325}}, 3*time.Hour); got != nil {
+		t.Errorf("At with one sample = %+v, want nil", got)
+	}
+}
+
+// WMO code table 0200, characteristic of pressure tendency, from the
+// change over the first and second half of the 3 hours.
+var wmoTable = []struct {
+	first, second float64
+	code          int
+}{
+	{50, -20, 0},
+	{30, -30, 0},
+	{50, 0, 1},
+	{60, 20, 1},
+	{30, 30, 2},
+	{0, 50, 3},
+	{-20, 50, 3},
+	{10, 40, 3},
+	{2, -3, 4},
+	{0, 0, 4},
+	{-50, 20, 5},
+	{-50, 0, 6},
+	{-60, -20, 6},
+	{-30, -30, 7},
+	{0, -50, 8},
+	{20, -50, 8},
+	{-10, -40, 8},
+}
+
+func TestWMOCode(t *testing.T) {
+	for _, row := range wmoTable {
+		if got := wmoCode(row.first, row.second); got != row.code {
+			t.Errorf("wmoCode(%v, %v) = %d (%s), want %d (%s)", row.first, row.second,
+				got, codeDescriptions[got], row.code, codeDescriptions[row.code])
+		}
+	}
+}
+
+func TestAt3h(t *testing.T) {
+	// Up 50 Pa in the first 90 minutes, down 20 in the second.
+	peak := func(h float64) float64 {
+		if h >= 1.5 {
+			return 101325 + 50*(3-h)/1.5
+		}
+		return 101375 - 20*(1.5-h)/1.5
+	}
+	got := At3h(series(3*time.Hour, 10*time.Minute, peak))
+	if got == nil || got.Code == nil {
+		t.Fatalf("At3h = %+v, want a WMO code", got)
+	}
+	if *got.Code != 0 || got.CodeDescription != codeDescriptions[0] || !near(got.Change, 30, 1e-6) {
+		t.Errorf("At3h = code %d, %v Pa; want code 0, 30 Pa", *got.Code, got.Change)
+	}
+
+	// Without a sample near the middle there is a tendency but no code.
+	got = At3h([]Sample{{At: end.Add(-3 * time.Hour), Pressure: 101325}, {At: end, Pressure: 101000}})
+	if got == nil || got.Code != nil || got.Description != "falling" {
+		t.Errorf("At3h without a middle sample = %+v, want falling without a code", got)
+	}
+	if got := At3h(series(time.Hour, 10*time.Minute, linear(0))); got != nil {
+		t.Errorf("At3h over an hour of samples = %+v, want nil", got)
+	}
+}
+
+func near(got, want, tol float64) bool {
+	d := got - want
+	return d <= tol && d >= -tol
+}
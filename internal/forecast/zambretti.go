@@ -0,0 +1,103 @@
+package forecast
+
+import (
+	"math"
+	"time"
+)
+
+// Zambretti is a forecast from the Negretti & Zambra "Zambretti" dial,
+// valid for roughly the next 12 hours.
+type Zambretti struct {
+	// Letter is the dial window, A (settled fine) to Z (stormy, much rain).
+	Letter   string `json:"letter"`
+	Forecast string `json:"forecast"`
+	Trend    Trend  `json:"trend"`
+	Season   string `json:"season"`
+	// Exceptional is set when the pressure lies outside the dial's 950 to
+	// 1050 hPa range and the forecast is clamped to its end.
+	Exceptional bool `json:"exceptional,omitempty"`
+}
+
+// zambrettiTrendBand is the 3 hour change, in Pa, from which the dial
+// treats pressure as rising or falling.
+const zambrettiTrendBand = 160
+
+var zambrettiForecasts = [26]string{
+	"Settled fine", "Fine weather", "Becoming fine", "Fine, becoming less settled",
+	"Fine, possible showers", "Fairly fine, improving", "Fairly fine, possible showers early",
+	"Fairly fine, showery later", "Showery early, improving", "Changeable, mending",
+	"Fairly fine, showers likely", "Rather unsettled clearing later", "Unsettled, probably improving",
+	"Showery, bright intervals", "Showery, becoming less settled", "Changeable, some rain",
+	"Unsettled, short fine intervals", "Unsettled, rain later", "Unsettled, some rain",
+	"Mostly very unsettled", "Occasional rain, worsening", "Rain at times, very unsettled",
+	"Rain at frequent intervals", "Rain, very unsettled", "Stormy, may improve", "Stormy, much rain",
+}
+
+// The dial's 22 pressure bands from 950 hPa upwards, mapped to forecast
+// letters for each trend (after beteljuice's widely used rendering).
+var (
+	risingOptions  = [22]int{25, 25, 25, 24, 24, 19, 16, 12, 11, 9, 8, 6, 5, 2, 1, 1, 0, 0, 0, 0, 0, 0}
+	steadyOptions  = [22]int{25, 25, 25, 25, 25, 25, 23, 23, 22, 18, 15, 13, 10, 4, 1, 1, 0, 0, 0, 0, 0, 0}
+	fallingOptions = [22]int{25, 25, 25, 25, 25, 25, 25, 25, 23, 23, 21, 20, 17, 14, 7, 3, 1, 1, 1, 0, 0, 0}
+)
+
+const (
+	dialBottom = 95000.0
+	dialTop    = 105000.0
+)
+
+// ZambrettiTrend is the dial's trend for a 3 hour tendency: steady unless
+// the pressure moved by at least 1.6 hPa. A missing tendency counts as
+// steady.
+func ZambrettiTrend(t *Tendency) Trend {
+	switch {
+	case t == nil:
+		return Steady
+	case t.Change*3/t.Hours >= zambrettiTrendBand:
+		return Rising
+	case t.Change*3/t.Hours <= -zambrettiTrendBand:
+		return Falling
+	}
+	return Steady
+}
+
+// Forecast reads the dial for sea-level pressure p0 with trend in the
+// month of at. Summer, April to September in the north, is when rising
+// pressure means more; winter is when falling pressure does, and the dial
+// shifts the pressure by 7% of its range to match.
+func Forecast(p0 float64, trend Trend, at time.Time, southern bool) Zambretti {
+	summer := at.Month() >= time.April && at.Month() <= time.September
+	if southern {
+		summer = !summer
+	}
+	z := Zambretti{Trend: trend, Season: "winter"}
+	if summer {
+		z.Season = "summer"
+	}
+
+	const shift = 0.07 * (dialTop - dialBottom)
+	options := steadyOptions
+	switch trend {
+	case Rising:
+		options = risingOptions
+		if summer {
+			p0 += shift
+		}
+	case Falling:
+		options = fallingOptions
+		if !summer {
+			p0 -= shift
+		}
+	}
+
+	band := int(math.Floor((p0 - dialBottom) / ((dialTop - dialBottom) / 22)))
+	if band < 0 {
+		band, z.Exceptional = 0, true
+	} else if band > 21 {
+		band, z.Exceptional = 21, true
+	}
+	letter := options[band]
+	z.Letter = string(rune('A' + letter))
+	z.Forecast = zambrettiForecasts[letter]
+	return z
+}
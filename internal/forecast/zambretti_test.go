@@ -0,0 +1,104 @@
+package forecast
+
+import (
+	"testing"
+	"time"
+)
+
+var (
+	january = time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	july    = time.Date(2024, 7, 15, 12, 0, 0, 0, time.UTC)
+)
+
+// Dial readings from the beteljuice tables. Rising pressure is read 7% of
+// the dial higher in summer, falling pressure 7% lower in winter.
+var zambrettiTable = []struct {
+	p0     float64
+	trend  Trend
+	at     time.Time
+	letter string
+}{
+	{104000, Steady, january, "A"},
+	{100100, Steady, january, "N"},
+	{100100, Steady, july, "N"},
+	{100100, Rising, january, "G"},
+	{100100, Rising, july, "F"},
+	{100100, Falling, july, "U"},
+	{100100, Falling, january, "X"},
+	{96000, Falling, january, "Z"},
+	{102500, Falling, july, "B"},
+	{98000, Rising, july, "L"},
+}
+
+func TestForecastTable(t *testing.T) {
+	for _, row := range zambrettiTable {
+		got := Forecast(row.p0, row.trend, row.at, false)
+		if got.Letter != row.letter {
+			t.Errorf("Forecast(%v, %s, %s) = %s %q, want %s", row.p0, row.trend, row.at.Month(),
+				got.Letter, got.Forecast, row.letter)
+		}
+		if want := zambrettiForecasts[row.letter[0]-'A']; got.Forecast != want {
+			t.Errorf("Forecast(%v, %s, %s) = %q, want %q", row.p0, row.trend, row.at.Month(), got.Forecast, want)
+		}
+		if got.Trend != row.trend || got.Exceptional {
+			t.Errorf("Forecast(%v, %s, %s) = %+v", row.p0, row.trend, row.at.Month(), got)
+		}
+	}
+}
+
+func TestForecastSeason(t *testing.T) {
+	for _, tc := range []struct {
+		at       time.Time
+		southern bool
+		season   string
+	}{
+		{january, false, "winter"},
+		{july, false, "summer"},
+		{time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC), false, "summer"},
+		{time.Date(2024, 9, 30, 0, 0, 0, 0, time.UTC), false, "summer"},
+		{time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC), false, "winter"},
+		{january, true, "summer"},
+		{july, true, "winter"},
+	} {
+		if got := Forecast(101325, Steady, tc.at, tc.southern); got.Season != tc.season {
+			t.Errorf("season of %s, southern %v = %s, want %s", tc.at.Format("Jan 2"), tc.southern, got.Season, tc.season)
+		}
+	}
+	// The southern summer shifts rising pressure up like the northern one.
+	if n, s := Forecast(100100, Rising, july, false), Forecast(100100, Rising, january, true); n.Letter != s.Letter {
+		t.Errorf("rising in the summer: north %s, south %s", n.Letter, s.Letter)
+	}
+}
+
+func TestForecastExceptional(t *testing.T) {
+	if got := Forecast(94000, Steady, january, false); !got.Exceptional || got.Letter != "Z" {
+		t.Errorf("940 hPa = %+v, want exceptional Z", got)
+	}
+	if got := Forecast(106000, Steady, january, false); !got.Exceptional || got.Letter != "A" {
+		t.Errorf("1060 hPa = %+v, want exceptional A", got)
+	}
+	// The winter shift may take a reading off the dial.
+	if got := Forecast(95300, Falling, january, false); !got.Exceptional {
+		t.Errorf("953 hPa falling in winter = %+v, want exceptional", got)
+	}
+}
+
+func TestZambrettiTrend(t *testing.T) {
+	for _, tc := range []struct {
+		tendency *Tendency
+		want     Trend
+	}{
+		{nil, Steady},
+		{&Tendency{Hours: 3, Change: 160}, Rising},
+		{&Tendency{Hours: 3, Change: 159}, Steady},
+		{&Tendency{Hours: 3, Change: -160}, Falling},
+		{&Tendency{Hours: 3, Change: -159}, Steady},
+		// Scaled to 3 hours.
+		{&Tendency{Hours: 6, Change: 320}, Rising},
+		{&Tendency{Hours: 2.5, Change: -140}, Falling},
+	} {
+		if got := ZambrettiTrend(tc.tendency); got != tc.want {
+			t.Errorf("ZambrettiTrend(%+v) = %s, want %s", tc.tendency, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/maskarb/skarbek-dev/internal/constants"
+)
+
+// requestInfo is attached to each request by Middleware. Inner handlers fill
+// in the user once it is known, and both the access log line and
+// Logger.Ctx read it back.
+type requestInfo struct {
+	mu   sync.Mutex
+	user string
+}
+
+// SetUser records the authenticated user for the request in ctx, so every
+// later record for the request carries it.
+func SetUser(ctx context.Context, user string) {
+	if info, ok := ctx.Value(constants.LogContextID).(*requestInfo); ok {
+		info.mu.Lock()
+		info.user = user
+		info.mu.Unlock()
+	}
+}
+
+// Ctx returns a logger carrying the request ID and user of the request in
+// ctx, if any.
+func (l *Logger) Ctx(ctx context.Context) *Logger {
+	var kv []interface{}
+	if id := middleware.GetReqID(ctx); id != "" {
+		kv = append(kv, "request_id", id)
+	}
+	if info, ok := ctx.Value(constants.LogContextID).(*requestInfo); ok {
+		info.mu.Lock()
+		user := info.user
+		info.mu.Unlock()
+		if user != "" {
+			kv = append(kv, "user", user)
+		}
+	}
+	if len(kv) == 0 {
+		return l
+	}
+	return l.With(kv...)
+}
+
+// Middleware writes one access log record per request to the "http"
+// component. It must run after middleware.RequestID.
+func Middleware(next http.Handler) http.Handler {
+	logger := For("http")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{}
+		ctx := context.WithValue(r.Context(), constants.LogContextID, info)
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		defer func() {
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			level := LevelInfo
+			switch {
+			case status >= 500:
+				level = LevelError
+			case status >= 400:
+				level = LevelWarn
+			}
+			logger.Ctx(ctx).Log(level, "request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"proto", r.Proto,
+				"status", status,
+				"bytes", ww.BytesWritten(),
+				"duration_ms", float64(time.Since(start).Microseconds())/1000,
+				"remote", r.RemoteAddr,
+			)
+		}()
+
+		next.ServeHTTP(ww, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,25 @@
+package logging
+
+import (
+	golog "github.com/d2r2/go-logger"
+)
+
+// goLoggerPackages are the d2r2/go-logger package loggers used by the I2C
+// driver.
+var goLoggerPackages = []string{"i2c"}
+
+// routeGoLogger sets the level of the d2r2/go-logger package loggers from
+// the level of the component of the same name. The I2C driver only logs
+// every bus transfer at debug, so it is silent unless e.g.
+// log.components has i2c=debug; that output keeps go-logger's own format
+// on stdout, which the library offers no public way to redirect.
+func routeGoLogger() {
+	for _, name := range goLoggerPackages {
+		level := golog.InfoLevel
+		if For(name).Enabled(LevelDebug) {
+			level = golog.DebugLevel
+		}
+		// Not found only means the driver package is not linked in.
+		_ = golog.ChangePackageLogLevel(name, level)
+	}
+}
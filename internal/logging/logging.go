@@ -0,0 +1,302 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Level is the severity of a log record.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+}
+
+// ParseLevel accepts debug, info, warn (or warning) and error.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// Format is how records are encoded.
+type Format int
+
+const (
+	FormatLogfmt Format = iota
+	FormatJSON
+)
+
+// ParseFormat accepts logfmt and json.
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "logfmt", "text":
+		return FormatLogfmt, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return FormatLogfmt, fmt.Errorf("unknown log format %q", s)
+}
+
+// Options configures the process wide sink.
+type Options struct {
+	Level  Level
+	Format Format
+	// Components overrides Level for individual components, e.g. to get
+	// debug output from "sensor" only.
+	Components map[string]Level
+}
+
+// sink is where every Logger writes. There is one per process.
+type sink struct {
+	mu         sync.Mutex
+	w          io.Writer
+	level      Level
+	format     Format
+	components map[string]Level
+}
+
+var std = &sink{w: os.Stderr, level: LevelInfo, format: FormatLogfmt}
+
+// Setup replaces the sink configuration. Loggers created before Setup pick
+// up the new settings, so packages may create theirs at init time. The
+// standard library logger is redirected into the sink as component "std".
+func Setup(w io.Writer, opts Options) {
+	std.mu.Lock()
+	std.w = w
+	std.level = opts.Level
+	std.format = opts.Format
+	std.components = opts.Components
+	std.mu.Unlock()
+
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(For("std").Writer(LevelInfo))
+	routeGoLogger()
+}
+
+func (s *sink) enabled(component string, level Level) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l, ok := s.components[component]; ok {
+		return level >= l
+	}
+	return level >= s.level
+}
+
+func (s *sink) write(level Level, component, msg string, fields []interface{}) {
+	if !s.enabled(component, level) {
+		return
+	}
+
+	var buf bytes.Buffer
+	s.mu.Lock()
+	format := s.format
+	s.mu.Unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	switch format {
+	case FormatJSON:
+		buf.WriteString(`{"time":`)
+		writeJSON(&buf, now)
+		buf.WriteString(`,"level":`)
+		writeJSON(&buf, level.String())
+		buf.WriteString(`,"component":`)
+		writeJSON(&buf, component)
+		buf.WriteString(`,"msg":`)
+		writeJSON(&buf, msg)
+		for i := 0; i < len(fields); i += 2 {
+			buf.WriteByte(',')
+			writeJSON(&buf, fmt.Sprint(fields[i]))
+			buf.WriteByte(':')
+			writeJSON(&buf, jsonValue(fields[i+1]))
+		}
+		buf.WriteString("}\n")
+	default:
+		buf.WriteString("time=" + now)
+		buf.WriteString(" level=" + level.String())
+		buf.WriteString(" component=" + logfmtValue(component))
+		buf.WriteString(" msg=" + logfmtValue(msg))
+		for i := 0; i < len(fields); i += 2 {
+			buf.WriteString(" " + fmt.Sprint(fields[i]) + "=" + logfmtValue(textValue(fields[i+1])))
+		}
+		buf.WriteByte('\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Write(buf.Bytes())
+}
+
+// Logger writes records for one component, with optional bound fields.
+// Fields are alternating keys and values, as in Info("msg", "key", value).
+type Logger struct {
+	component string
+	fields    []interface{}
+}
+
+// For returns the logger for component, e.g. "sensor", "http", "auth" or
+// "db".
+func For(component string) *Logger {
+	return &Logger{component: component}
+}
+
+// With returns a logger that adds kv to every record.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv)+1)
+	fields = append(fields, l.fields...)
+	fields = append(fields, normalize(kv)...)
+	return &Logger{component: l.component, fields: fields}
+}
+
+// Enabled reports whether records at level would be written, for callers
+// that want to skip building expensive fields.
+func (l *Logger) Enabled(level Level) bool {
+	return std.enabled(l.component, level)
+}
+
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	fields := l.fields
+	if len(kv) > 0 {
+		fields = append(append([]interface{}{}, l.fields...), normalize(kv)...)
+	}
+	std.write(level, l.component, msg, fields)
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.Log(LevelDebug, msg, kv...) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.Log(LevelInfo, msg, kv...) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.Log(LevelWarn, msg, kv...) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.Log(LevelError, msg, kv...) }
+
+// Fatal logs at error level and exits the process.
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.Log(LevelError, msg, kv...)
+	os.Exit(1)
+}
+
+// Writer returns an io.Writer that logs each line written to it at level,
+// for APIs that want a *log.Logger such as http.Server.ErrorLog.
+func (l *Logger) Writer(level Level) io.Writer {
+	return &lineWriter{logger: l, level: level}
+}
+
+// StdLogger wraps Writer in a *log.Logger.
+func (l *Logger) StdLogger(level Level) *log.Logger {
+	return log.New(l.Writer(level), "", 0)
+}
+
+type lineWriter struct {
+	logger *Logger
+	level  Level
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if line != "" {
+			w.logger.Log(w.level, line)
+		}
+	}
+	return len(p), nil
+}
+
+// normalize pads a dangling key so keys and values stay paired.
+func normalize(kv []interface{}) []interface{} {
+	if len(kv)%2 == 1 {
+		kv = append(kv, "(MISSING)")
+	}
+	return kv
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case error:
+		return t.Error()
+	case time.Duration:
+		return t.String()
+	case time.Time:
+		return t.UTC().Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		return t.String()
+	}
+	return v
+}
+
+func textValue(v interface{}) string {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return "null"
+		}
+		// Errors such as those from fmt.Errorf are pointers too; keep
+		// them so their message is printed rather than their fields.
+		switch v.(type) {
+		case fmt.Stringer, error:
+		default:
+			v = rv.Elem().Interface()
+		}
+	}
+	switch t := v.(type) {
+	case string:
+		return t
+	case error:
+		return t.Error()
+	case time.Time:
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+func logfmtValue(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r == '"' || r == '=' || r == '\\' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
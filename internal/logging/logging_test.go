@@ -0,0 +1,211 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	golog "github.com/d2r2/go-logger"
+	"github.com/go-chi/chi/middleware"
+)
+
+// capture points the sink at a buffer for the rest of the test.
+func capture(t *testing.T, opts Options) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	Setup(&buf, opts)
+	t.Cleanup(func() { Setup(os.Stderr, Options{Level: LevelInfo}) })
+	return &buf
+}
+
+// lines returns the records written to buf without their timestamps.
+func lines(buf *bytes.Buffer) []string {
+	var out []string
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if l == "" {
+			continue
+		}
+		if i := strings.Index(l, " "); strings.HasPrefix(l, "time=") && i > 0 {
+			l = l[i+1:]
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+func TestLevels(t *testing.T) {
+	buf := capture(t, Options{Level: LevelWarn, Components: map[string]Level{
+		"sensor": LevelDebug,
+		"http":   LevelError,
+	}})
+	for _, c := range []string{"sensor", "http", "db"} {
+		l := For(c)
+		l.Debug("debug")
+		l.Info("info")
+		l.Warn("warn")
+		l.Error("error")
+	}
+	want := []string{
+		"level=debug component=sensor msg=debug",
+		"level=info component=sensor msg=info",
+		"level=warn component=sensor msg=warn",
+		"level=error component=sensor msg=error",
+		"level=error component=http msg=error",
+		"level=warn component=db msg=warn",
+		"level=error component=db msg=error",
+	}
+	if got := lines(buf); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("records:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if !For("sensor").Enabled(LevelDebug) || For("db").Enabled(LevelInfo) || !For("db").Enabled(LevelWarn) {
+		t.Error("Enabled disagrees with the configured levels")
+	}
+}
+
+// TestSetupUpdatesLoggers makes sure loggers created at init time, before
+// Setup, follow it.
+func TestSetupUpdatesLoggers(t *testing.T) {
+	early := For("sensor").With("bus", 1)
+	buf := capture(t, Options{Level: LevelError})
+	early.Info("dropped")
+	Setup(buf, Options{Level: LevelDebug})
+	early.Debug("kept")
+	if got := lines(buf); len(got) != 1 || got[0] != "level=debug component=sensor msg=kept bus=1" {
+		t.Errorf("records = %q", got)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for s, want := range map[string]Level{"debug": LevelDebug, "INFO": LevelInfo, "warn": LevelWarn, "warning": LevelWarn, "error": LevelError} {
+		if got, err := ParseLevel(s); err != nil || got != want {
+			t.Errorf("ParseLevel(%q) = %v, %v; want %v", s, got, err, want)
+		}
+	}
+	if _, err := ParseLevel("trace"); err == nil {
+		t.Error("ParseLevel(trace) did not fail")
+	}
+	for s, want := range map[string]Format{"logfmt": FormatLogfmt, "text": FormatLogfmt, "JSON": FormatJSON} {
+		if got, err := ParseFormat(s); err != nil || got != want {
+			t.Errorf("ParseFormat(%q) = %v, %v; want %v", s, got, err, want)
+		}
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("ParseFormat(xml) did not fail")
+	}
+}
+
+func TestLogfmt(t *testing.T) {
+	buf := capture(t, Options{Level: LevelInfo})
+	var nilTime *time.Time
+	n := 3
+	For("sensor").With("sensor", 1).Info("read failed",
+		"err", errors.New("remote I/O error"),
+		"path", "/dev/i2c-1",
+		"quote", `say "hi"`,
+		"empty", "",
+		"took", 1500*time.Millisecond,
+		"at", time.Date(2024, 1, 15, 12, 0, 0, 0, time.FixedZone("CET", 3600)),
+		"nil", nilTime,
+		"ptr", &n,
+		"dangling")
+	want := `level=info component=sensor msg="read failed" sensor=1 err="remote I/O error" path=/dev/i2c-1 ` +
+		`quote="say \"hi\"" empty="" took=1.5s at=2024-01-15T11:00:00Z nil=null ptr=3 dangling=(MISSING)`
+	if got := lines(buf); len(got) != 1 || got[0] != want {
+		t.Errorf("record:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	buf := capture(t, Options{Level: LevelInfo, Format: FormatJSON})
+	For("db").Warn("slow query", "err", errors.New("locked"), "took", 2*time.Second, "rows", 3)
+	var rec map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("%v: %s", err, buf)
+	}
+	for k, want := range map[string]interface{}{
+		"level": "warn", "component": "db", "msg": "slow query", "err": "locked", "took": "2s", "rows": 3.0,
+	} {
+		if rec[k] != want {
+			t.Errorf("%s = %v, want %v", k, rec[k], want)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, rec["time"].(string)); err != nil {
+		t.Errorf("time: %v", err)
+	}
+}
+
+// TestStdLogger makes sure the standard library logger and Writer log each
+// line as its own record.
+func TestStdLogger(t *testing.T) {
+	buf := capture(t, Options{Level: LevelInfo})
+	log.Print("from the standard library")
+	For("http").StdLogger(LevelWarn).Print("http: TLS handshake error\nsecond line\n")
+	want := []string{
+		`level=info component=std msg="from the standard library"`,
+		`level=warn component=http msg="http: TLS handshake error"`,
+		`level=warn component=http msg="second line"`,
+	}
+	if got := lines(buf); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	buf := capture(t, Options{Level: LevelInfo})
+	h := middleware.RequestID(Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetUser(r.Context(), "ada@example.com")
+		For("sensor").Ctx(r.Context()).Info("handling")
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+		} else if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})))
+	for _, path := range []string{"/ok", "/missing", "/broken"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	got := lines(buf)
+	if len(got) != 6 {
+		t.Fatalf("records = %q, want 6", got)
+	}
+	for i, want := range []struct{ level, status string }{{"info", "200"}, {"warn", "404"}, {"error", "500"}} {
+		inner, access := got[2*i], got[2*i+1]
+		if !strings.Contains(inner, "request_id=") || !strings.Contains(inner, "user=ada@example.com") {
+			t.Errorf("handler record %q lacks the request id or user", inner)
+		}
+		if !strings.HasPrefix(access, "level="+want.level+" component=http msg=request") ||
+			!strings.Contains(access, "status="+want.status) || !strings.Contains(access, "user=ada@example.com") {
+			t.Errorf("access record %q, want %s with status %s", access, want.level, want.status)
+		}
+		id := inner[strings.Index(inner, "request_id="):]
+		id = id[:strings.Index(id, " ")]
+		if !strings.Contains(access, id) {
+			t.Errorf("access record %q does not carry %s", access, id)
+		}
+	}
+}
+
+// i2cLog stands in for the I2C driver's logger. go-logger only changes the
+// first one registered under a name, so there is one per test binary.
+var i2cLog = golog.NewPackageLogger("i2c", golog.InfoLevel).(*golog.Package)
+
+// TestGoLogger makes sure the I2C driver's go-logger level follows the i2c
+// component.
+func TestGoLogger(t *testing.T) {
+	capture(t, Options{Level: LevelInfo, Components: map[string]Level{"i2c": LevelDebug}})
+	if got := i2cLog.GetLogLevel(); got != golog.DebugLevel {
+		t.Errorf("with i2c=debug: go-logger level %s, want debug", got)
+	}
+	capture(t, Options{Level: LevelDebug, Components: map[string]Level{"i2c": LevelWarn}})
+	if got := i2cLog.GetLogLevel(); got != golog.InfoLevel {
+		t.Errorf("with i2c=warn: go-logger level %s, want info", got)
+	}
+}
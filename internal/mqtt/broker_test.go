@@ -0,0 +1,384 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types.
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetUnsubscribe = 10
+	packetUnsuback    = 11
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+)
+
+// message is a PUBLISH as the broker got it.
+type message struct {
+	ClientID string
+	Topic    string
+	Payload  string
+	QoS      byte
+	Retain   bool
+}
+
+// broker is a minimal in-process MQTT 3.1.1 broker: enough of CONNECT,
+// PUBLISH at QoS 0 and 1, SUBSCRIBE with wildcards, retained messages,
+// last wills and PING for the client under test. Subscribers get every
+// message at QoS 0.
+type broker struct {
+	t  *testing.T
+	ln net.Listener
+
+	mu       sync.Mutex
+	conns    map[*brokerConn]bool
+	log      []message
+	retained map[string]message
+}
+
+type brokerConn struct {
+	net.Conn
+	clientID string
+	will     *message
+	// wmu serialises writes to the connection.
+	wmu  sync.Mutex
+	subs []string
+}
+
+func newBroker(t *testing.T) *broker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &broker{t: t, ln: ln, conns: map[*brokerConn]bool{}, retained: map[string]message{}}
+	go b.accept()
+	t.Cleanup(func() {
+		ln.Close()
+		b.kick()
+	})
+	return b
+}
+
+// URL is the broker URL clients connect to.
+func (b *broker) URL() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+func (b *broker) accept() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		go b.serve(&brokerConn{Conn: conn})
+	}
+}
+
+// kick drops every connection without a DISCONNECT, as a broker restart
+// or a network failure would, so the last wills are published.
+func (b *broker) kick() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		c.Close()
+	}
+}
+
+func (b *broker) serve(c *brokerConn) {
+	clean := false
+	defer func() {
+		c.Close()
+		b.mu.Lock()
+		delete(b.conns, c)
+		b.mu.Unlock()
+		if !clean && c.will != nil {
+			b.publish(*c.will)
+		}
+	}()
+	r := bufio.NewReader(c)
+	for {
+		typ, flags, body, err := readPacket(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				b.t.Logf("broker: %v", err)
+			}
+			return
+		}
+		switch typ {
+		case packetConnect:
+			if err := c.connect(body); err != nil {
+				b.t.Errorf("broker: CONNECT: %v", err)
+				return
+			}
+			b.mu.Lock()
+			b.conns[c] = true
+			b.mu.Unlock()
+			c.write(packetConnack<<4, []byte{0, 0})
+		case packetPublish:
+			m := message{ClientID: c.clientID, QoS: flags >> 1 & 3, Retain: flags&1 == 1}
+			var id []byte
+			m.Topic, body = readString(body)
+			if m.QoS > 0 {
+				id, body = body[:2], body[2:]
+			}
+			m.Payload = string(body)
+			b.publish(m)
+			if m.QoS == 1 {
+				c.write(packetPuback<<4, id)
+			}
+		case packetSubscribe:
+			id, rest := body[:2], body[2:]
+			granted := append([]byte(nil), id...)
+			var filters []string
+			for len(rest) > 0 {
+				var f string
+				f, rest = readString(rest)
+				rest = rest[1:]
+				filters = append(filters, f)
+				granted = append(granted, 0)
+			}
+			b.mu.Lock()
+			c.subs = append(c.subs, filters...)
+			var retained []message
+			for _, m := range b.retained {
+				for _, f := range filters {
+					if match(f, m.Topic) {
+						retained = append(retained, m)
+						break
+					}
+				}
+			}
+			b.mu.Unlock()
+			c.write(packetSuback<<4, granted)
+			for _, m := range retained {
+				c.deliver(m, true)
+			}
+		case packetUnsubscribe:
+			c.write(packetUnsuback<<4, body[:2])
+		case packetPingreq:
+			c.write(packetPingresp<<4, nil)
+		case packetDisconnect:
+			clean = true
+			return
+		default:
+			b.t.Errorf("broker: unexpected packet type %d", typ)
+			return
+		}
+	}
+}
+
+// publish records m, keeps it if it is retained and sends it to every
+// subscriber.
+func (b *broker) publish(m message) {
+	b.mu.Lock()
+	b.log = append(b.log, m)
+	if m.Retain {
+		if m.Payload == "" {
+			delete(b.retained, m.Topic)
+		} else {
+			b.retained[m.Topic] = m
+		}
+	}
+	var to []*brokerConn
+	for c := range b.conns {
+		for _, f := range c.subs {
+			if match(f, m.Topic) {
+				to = append(to, c)
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+	for _, c := range to {
+		c.deliver(m, false)
+	}
+}
+
+// messages returns what was published to topic so far.
+func (b *broker) messages(topic string) []message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []message
+	for _, m := range b.log {
+		if m.Topic == topic {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// waitFor waits until the latest message on topic satisfies ok and
+// returns it.
+func (b *broker) waitFor(t *testing.T, topic string, ok func(message) bool) message {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if ms := b.messages(topic); len(ms) > 0 && ok(ms[len(ms)-1]) {
+			return ms[len(ms)-1]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: got %+v", topic, b.messages(topic))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitSince waits for the first message on topic, from the from-th on,
+// that satisfies ok, and returns it with the count to resume from.
+func (b *broker) waitSince(t *testing.T, topic string, from int, ok func(message) bool) (message, int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ms := b.messages(topic)
+		for i := from; i < len(ms); i++ {
+			if ok(ms[i]) {
+				return ms[i], i + 1
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: got %+v after the first %d", topic, ms, from)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitPayload waits until the latest message on topic is payload.
+func (b *broker) waitPayload(t *testing.T, topic, payload string) message {
+	t.Helper()
+	return b.waitFor(t, topic, func(m message) bool { return m.Payload == payload })
+}
+
+// subscribed waits until some client subscribed to filter.
+func (b *broker) subscribed(t *testing.T, filter string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.mu.Lock()
+		for c := range b.conns {
+			for _, f := range c.subs {
+				if f == filter {
+					b.mu.Unlock()
+					return
+				}
+			}
+		}
+		b.mu.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatalf("nobody subscribed to %s", filter)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (c *brokerConn) connect(body []byte) error {
+	proto, body := readString(body)
+	if proto != "MQTT" || len(body) < 4 || body[0] != 4 {
+		return fmt.Errorf("not MQTT 3.1.1: %q", proto)
+	}
+	flags := body[1]
+	body = body[4:]
+	c.clientID, body = readString(body)
+	if flags&0x04 != 0 {
+		w := message{ClientID: c.clientID, QoS: flags >> 3 & 3, Retain: flags&0x20 != 0}
+		w.Topic, body = readString(body)
+		w.Payload, _ = readString(body)
+		c.will = &w
+	}
+	return nil
+}
+
+func (c *brokerConn) deliver(m message, retained bool) {
+	flags := byte(0)
+	if retained {
+		flags = 1
+	}
+	c.write(packetPublish<<4|flags, append(appendString(nil, m.Topic), m.Payload...))
+}
+
+func (c *brokerConn) write(header byte, body []byte) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	out := []byte{header}
+	n := len(body)
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		out = append(out, d)
+		if n == 0 {
+			break
+		}
+	}
+	c.Write(append(out, body...))
+}
+
+func readPacket(r *bufio.Reader) (typ, flags byte, body []byte, err error) {
+	h, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	n, mult := 0, 1
+	for {
+		d, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		n += int(d&0x7f) * mult
+		if d&0x80 == 0 {
+			break
+		}
+		mult *= 128
+	}
+	body = make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return h >> 4, h & 0x0f, body, nil
+}
+
+func readString(b []byte) (string, []byte) {
+	if len(b) < 2 {
+		return "", nil
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil
+	}
+	return string(b[2 : 2+n]), b[2+n:]
+}
+
+func appendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// match reports whether topic matches filter, with + and # wildcards.
+func match(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, l := range f {
+		if l == "#" {
+			return true
+		}
+		if i >= len(t) || l != "+" && l != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
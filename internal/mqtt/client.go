@@ -0,0 +1,207 @@
+// Package mqtt connects the server to an MQTT broker. Readings are
+// published to per-sensor topics with Home Assistant discovery config, and
+// availability topics follow the health of the server and of each sensor.
+// Readings that remote nodes publish are taken into the sensor store.
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/maskarb/skarbek-dev/internal/config"
+	"github.com/maskarb/skarbek-dev/internal/logging"
+)
+
+var logger = logging.For("mqtt")
+
+func init() {
+	paho.ERROR = logger.StdLogger(logging.LevelError)
+	paho.CRITICAL = logger.StdLogger(logging.LevelError)
+	paho.WARN = logger.StdLogger(logging.LevelWarn)
+}
+
+const (
+	// connectTimeout bounds one connection attempt, publishTimeout the
+	// wait for the broker to take a message.
+	connectTimeout = 10 * time.Second
+	publishTimeout = 10 * time.Second
+	// retryInterval is the wait between attempts at the first connection;
+	// maxReconnectInterval caps the backoff between reconnects after it.
+	retryInterval        = 5 * time.Second
+	maxReconnectInterval = 2 * time.Minute
+	// quiesce is how long Disconnect waits for work in flight, in ms.
+	quiesce = 250
+
+	payloadOnline  = "online"
+	payloadOffline = "offline"
+)
+
+// Client is the connection to the broker that the publisher and the
+// subscriber share. It reconnects on its own, backing off up to
+// maxReconnectInterval.
+type Client struct {
+	cfg  config.MQTTConfig
+	paho paho.Client
+	// onConnect are called after every (re)connect.
+	onConnect []func()
+}
+
+// NewClient sets up the connection to cfg.Broker; Run connects.
+func NewClient(cfg config.MQTTConfig) (*Client, error) {
+	opts, err := newClientOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{cfg: cfg}
+	// paho calls this in a goroutine of its own, so it may wait on the
+	// broker.
+	opts.SetOnConnectHandler(func(paho.Client) {
+		logger.Info("connected to broker", "broker", cfg.Broker)
+		if err := c.publish(statusTopic(cfg), payloadOnline, true); err != nil {
+			logger.Warn("publish status", "err", err)
+		}
+		for _, fn := range c.onConnect {
+			fn()
+		}
+	})
+	opts.SetConnectionLostHandler(func(_ paho.Client, err error) {
+		logger.Warn("connection to broker lost, reconnecting", "broker", cfg.Broker, "err", err)
+	})
+	c.paho = paho.NewClient(opts)
+	return c, nil
+}
+
+// OnConnect calls fn after every (re)connect, once the server's status is
+// published. Register it before Run.
+func (c *Client) OnConnect(fn func()) {
+	c.onConnect = append(c.onConnect, fn)
+}
+
+// Run connects to the broker and stays connected until ctx is done. On
+// the way out the status is set offline, as the last will would.
+func (c *Client) Run(ctx context.Context) {
+	// With connect retry on, the first connection is made in the
+	// background and the token is only done once it succeeded.
+	c.paho.Connect()
+	<-ctx.Done()
+	if err := c.publish(statusTopic(c.cfg), payloadOffline, true); err != nil {
+		logger.Warn("publish offline status", "err", err)
+	}
+	c.paho.Disconnect(quiesce)
+}
+
+// publish sends one message and waits for the broker to take it. While
+// disconnected nothing is sent: everything but readings is published
+// again on reconnect, and readings would be stale by then.
+func (c *Client) publish(topic string, payload interface{}, retain bool) error {
+	if !c.paho.IsConnectionOpen() {
+		return nil
+	}
+	return wait(c.paho.Publish(topic, byte(c.cfg.QoS), retain, payload), publishTimeout)
+}
+
+// subscribe has fn called with every message on topic. Subscriptions do
+// not outlive the connection, so subscribe from an OnConnect function.
+func (c *Client) subscribe(topic string, fn paho.MessageHandler) error {
+	return wait(c.paho.Subscribe(topic, byte(c.cfg.QoS), fn), publishTimeout)
+}
+
+// newClientOptions sets up the broker connection of cfg. The server's
+// status topic is its last will, so the broker marks it offline when the
+// connection drops without a clean disconnect.
+func newClientOptions(cfg config.MQTTConfig) (*paho.ClientOptions, error) {
+	u, err := url.Parse(cfg.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("parse mqtt broker: %v", err)
+	}
+	opts := paho.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetCleanSession(true).
+		SetOrderMatters(false).
+		SetConnectTimeout(connectTimeout).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(retryInterval).
+		SetMaxReconnectInterval(maxReconnectInterval).
+		SetWill(statusTopic(cfg), payloadOffline, byte(cfg.QoS), true)
+	switch u.Scheme {
+	case "ssl", "tls", "mqtts", "wss":
+		tlsConfig, err := newTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	return opts, nil
+}
+
+// newTLSConfig trusts the system roots plus cfg.CACertFile and presents
+// the client certificate, if there is one.
+func newTLSConfig(cfg config.MQTTConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CACertFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(cfg.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("read mqtt ca cert: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load mqtt client cert: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// wait waits for t and returns its error, or a timeout.
+func wait(t paho.Token, timeout time.Duration) error {
+	if !t.WaitTimeout(timeout) {
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+	return t.Error()
+}
+
+func statusTopic(cfg config.MQTTConfig) string {
+	return cfg.BaseTopic + "/status"
+}
+
+func stateTopic(cfg config.MQTTConfig, sensorID int) string {
+	return fmt.Sprintf("%s/sensor/%d/state", cfg.BaseTopic, sensorID)
+}
+
+func availabilityTopic(cfg config.MQTTConfig, sensorID int) string {
+	return fmt.Sprintf("%s/sensor/%d/availability", cfg.BaseTopic, sensorID)
+}
+
+// objectID makes s usable as a Home Assistant node or object id, which
+// only allow letters, digits, _ and -.
+func objectID(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,102 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/maskarb/skarbek-dev/internal/config"
+	"github.com/maskarb/skarbek-dev/internal/sensor"
+	"github.com/maskarb/skarbek-dev/internal/units"
+)
+
+// quantity is how Home Assistant should show one quantity of a reading.
+// Readings are published in the units the sensors report.
+type quantity struct {
+	name        string
+	deviceClass string
+	unit        units.Unit
+	// haUnit is the unit as Home Assistant spells it.
+	haUnit string
+}
+
+var quantities = map[string]quantity{
+	sensor.QuantityTemperature: {name: "Temperature", deviceClass: "temperature", unit: units.Celsius, haUnit: "°C"},
+	sensor.QuantityHumidity:    {name: "Humidity", deviceClass: "humidity", unit: units.Percent, haUnit: "%"},
+	sensor.QuantityPressure:    {name: "Pressure", deviceClass: "atmospheric_pressure", unit: units.Pascal, haUnit: "Pa"},
+}
+
+// discoveryConfig is a Home Assistant MQTT sensor.
+type discoveryConfig struct {
+	Name              string         `json:"name"`
+	UniqueID          string         `json:"unique_id"`
+	ObjectID          string         `json:"object_id"`
+	StateTopic        string         `json:"state_topic"`
+	ValueTemplate     string         `json:"value_template"`
+	DeviceClass       string         `json:"device_class"`
+	StateClass        string         `json:"state_class"`
+	UnitOfMeasurement string         `json:"unit_of_measurement"`
+	DisplayPrecision  int            `json:"suggested_display_precision"`
+	Availability      []availability `json:"availability"`
+	AvailabilityMode  string         `json:"availability_mode"`
+	// ExpireAfter marks the value unavailable when no reading came for
+	// that many seconds.
+	ExpireAfter int    `json:"expire_after,omitempty"`
+	Device      device `json:"device"`
+}
+
+type availability struct {
+	Topic string `json:"topic"`
+}
+
+type device struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model"`
+}
+
+// discovery returns the topic and config that make quantity q of sensor
+// id appear in Home Assistant. Every sensor is a device; the value is only
+// available while both the server and the sensor are.
+func discovery(cfg config.MQTTConfig, id int, q, source, nodeID string) (string, []byte, error) {
+	qd, ok := quantities[q]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown quantity %q", q)
+	}
+	node := fmt.Sprintf("%s_%d", objectID(cfg.ClientID), id)
+	c := discoveryConfig{
+		Name:              qd.name,
+		UniqueID:          node + "_" + q,
+		ObjectID:          node + "_" + q,
+		StateTopic:        stateTopic(cfg, id),
+		ValueTemplate:     fmt.Sprintf("{{ value_json.%s }}", q),
+		DeviceClass:       qd.deviceClass,
+		StateClass:        "measurement",
+		UnitOfMeasurement: qd.haUnit,
+		DisplayPrecision:  units.Decimals(qd.unit),
+		Availability: []availability{
+			{Topic: statusTopic(cfg)},
+			{Topic: availabilityTopic(cfg, id)},
+		},
+		AvailabilityMode: "all",
+		Device: device{
+			Identifiers:  []string{node},
+			Name:         fmt.Sprintf("Sensor %d", id),
+			Manufacturer: "Bosch",
+			Model:        "BME280",
+		},
+	}
+	if source != sensor.SourceLocal {
+		c.Device.Name = fmt.Sprintf("Sensor %d (%s)", id, nodeID)
+		c.Device.Manufacturer = ""
+		c.Device.Model = "Remote node via " + source
+	}
+	if i := cfg.Interval.Duration; i > 0 {
+		c.ExpireAfter = int(3 * i.Seconds())
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("%s/sensor/%s/%s/config", cfg.DiscoveryPrefix, node, q), payload, nil
+}
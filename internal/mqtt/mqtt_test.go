@@ -0,0 +1,315 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/config"
+	"github.com/maskarb/skarbek-dev/internal/database"
+	"github.com/maskarb/skarbek-dev/internal/sensor"
+)
+
+func newStore(t *testing.T) *sensor.SensorStore {
+	t.Helper()
+	db, err := database.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close(db) })
+	cfg := config.Default().Sensor
+	cfg.Enabled = false
+	ss, err := sensor.NewSensorStore(cfg, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ss
+}
+
+func testConfig(b *broker) config.MQTTConfig {
+	cfg := config.Default().MQTT
+	cfg.Broker = b.URL()
+	return cfg
+}
+
+// start runs fn until the returned stop is called or the test ends.
+func start(t *testing.T, fn func(context.Context)) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		fn(ctx)
+		close(done)
+	}()
+	stop = func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return stop
+}
+
+func float32p(f float32) *float32 { return &f }
+
+func TestPublisher(t *testing.T) {
+	b := newBroker(t)
+	cfg := testConfig(b)
+	ss := newStore(t)
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPublisher(client, ss)
+	ss.Observe(p.Observe)
+	ss.OnStatus(p.Status)
+	stopClient := start(t, client.Run)
+	start(t, p.Run)
+
+	if m := b.waitPayload(t, "skarbek/status", payloadOnline); !m.Retain {
+		t.Error("status is not retained")
+	}
+
+	at := time.Now().Add(-time.Minute).Truncate(time.Second).UTC()
+	res, err := ss.Ingest(Source, "kitchen", at, sensor.Raw{
+		Temperature: float32p(21.54), Humidity: float32p(40.26), Pressure: float32p(101325)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := res.SensorID
+
+	for _, want := range []struct {
+		quantity, name, class, unit string
+	}{
+		{"temperature", "Temperature", "temperature", "°C"},
+		{"humidity", "Humidity", "humidity", "%"},
+		{"pressure", "Pressure", "atmospheric_pressure", "Pa"},
+	} {
+		topic := fmt.Sprintf("homeassistant/sensor/skarbek_%d/%s/config", id, want.quantity)
+		m := b.waitFor(t, topic, func(message) bool { return true })
+		if !m.Retain {
+			t.Errorf("%s is not retained", topic)
+		}
+		var c discoveryConfig
+		if err := json.Unmarshal([]byte(m.Payload), &c); err != nil {
+			t.Fatalf("%s: %v", topic, err)
+		}
+		node := fmt.Sprintf("skarbek_%d", id)
+		if c.Name != want.name || c.DeviceClass != want.class || c.UnitOfMeasurement != want.unit ||
+			c.StateClass != "measurement" || c.UniqueID != node+"_"+want.quantity {
+			t.Errorf("%s: %+v", topic, c)
+		}
+		if c.StateTopic != stateTopic(cfg, id) || c.ValueTemplate != "{{ value_json."+want.quantity+" }}" {
+			t.Errorf("%s: state_topic %q, value_template %q", topic, c.StateTopic, c.ValueTemplate)
+		}
+		if len(c.Availability) != 2 || c.Availability[0].Topic != "skarbek/status" ||
+			c.Availability[1].Topic != availabilityTopic(cfg, id) || c.AvailabilityMode != "all" {
+			t.Errorf("%s: availability %+v, mode %q", topic, c.Availability, c.AvailabilityMode)
+		}
+		if c.ExpireAfter != 180 {
+			t.Errorf("%s: expire_after = %d, want 3 intervals", topic, c.ExpireAfter)
+		}
+		if c.Device.Name != fmt.Sprintf("Sensor %d (kitchen)", id) || c.Device.Model != "Remote node via mqtt" ||
+			len(c.Device.Identifiers) != 1 || c.Device.Identifiers[0] != node {
+			t.Errorf("%s: device %+v", topic, c.Device)
+		}
+	}
+
+	if m := b.waitPayload(t, availabilityTopic(cfg, id), payloadOnline); !m.Retain {
+		t.Error("availability is not retained")
+	}
+	m := b.waitFor(t, stateTopic(cfg, id), func(message) bool { return true })
+	if !m.Retain || m.QoS != 1 {
+		t.Errorf("state: retain %v, qos %d, want the configured true and 1", m.Retain, m.QoS)
+	}
+	var state struct {
+		SensorID    int       `json:"sensor_id"`
+		At          time.Time `json:"at"`
+		Temperature float64   `json:"temperature"`
+		Humidity    float64   `json:"humidity"`
+		Pressure    float64   `json:"pressure"`
+	}
+	if err := json.Unmarshal([]byte(m.Payload), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.SensorID != id || !state.At.Equal(at) || state.Temperature != 21.54 || state.Humidity != 40.26 || state.Pressure != 101325 {
+		t.Errorf("state = %s", m.Payload)
+	}
+
+	p.Status(sensor.StatusChange{SensorID: id, Online: false, At: time.Now()})
+	b.waitPayload(t, availabilityTopic(cfg, id), payloadOffline)
+
+	// A dropped connection makes the broker publish the last will; on
+	// reconnect the server announces itself and its sensors again.
+	configTopic := fmt.Sprintf("homeassistant/sensor/skarbek_%d/temperature/config", id)
+	configs := len(b.messages(configTopic))
+	availability := len(b.messages(availabilityTopic(cfg, id)))
+	status := len(b.messages("skarbek/status"))
+	b.kick()
+	m, status = b.waitSince(t, "skarbek/status", status, func(m message) bool { return m.Payload == payloadOffline })
+	if !m.Retain {
+		t.Error("last will is not retained")
+	}
+	_, status = b.waitSince(t, "skarbek/status", status, func(m message) bool { return m.Payload == payloadOnline })
+	b.waitSince(t, configTopic, configs, func(message) bool { return true })
+	b.waitSince(t, availabilityTopic(cfg, id), availability, func(m message) bool { return m.Payload == payloadOffline })
+
+	stopClient()
+	b.waitSince(t, "skarbek/status", status, func(m message) bool { return m.Payload == payloadOffline })
+}
+
+func TestPublisherWithoutDiscovery(t *testing.T) {
+	b := newBroker(t)
+	cfg := testConfig(b)
+	cfg.DiscoveryPrefix = ""
+	ss := newStore(t)
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPublisher(client, ss)
+	ss.Observe(p.Observe)
+	start(t, client.Run)
+	start(t, p.Run)
+	b.waitPayload(t, "skarbek/status", payloadOnline)
+
+	res, err := ss.Ingest(Source, "kitchen", time.Now(), sensor.Raw{Temperature: float32p(20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.waitFor(t, stateTopic(cfg, res.SensorID), func(message) bool { return true })
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, m := range b.log {
+		if match("homeassistant/#", m.Topic) {
+			t.Errorf("published discovery %s with discovery off", m.Topic)
+		}
+	}
+}
+
+func TestSubscriber(t *testing.T) {
+	b := newBroker(t)
+	cfg := testConfig(b)
+	cfg.Subscriptions = []config.MQTTSubscription{{
+		Topic:     "esp32/{node}/state",
+		Values:    map[string]string{"temperature": "bme280.temp", "humidity": "bme280.hum", "pressure": "bme280.press"},
+		Units:     map[string]string{"pressure": "hPa"},
+		Timestamp: "ts",
+	}, {
+		Topic:  "tele/{node}/SENSOR",
+		Values: map[string]string{"temperature": "AM2301.Temperature"},
+	}}
+	ss := newStore(t)
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSubscriber(client, ss); err != nil {
+		t.Fatal(err)
+	}
+	// Retained before the server subscribed, without a timestamp: its
+	// age is unknown, so it is skipped.
+	b.publish(message{Topic: "tele/old/SENSOR", Payload: `{"AM2301":{"Temperature":5}}`, Retain: true})
+	start(t, client.Run)
+	b.subscribed(t, "esp32/+/state")
+	b.subscribed(t, "tele/+/SENSOR")
+
+	at := time.Now().Add(-time.Minute).Truncate(time.Second).UTC()
+	b.publish(message{Topic: "esp32/garage/state",
+		Payload: fmt.Sprintf(`{"ts":%d,"bme280":{"temp":12.5,"hum":"55","press":1013.25}}`, at.Unix())})
+	b.publish(message{Topic: "tele/attic/SENSOR", Payload: `{"AM2301":{"Temperature":18}}`})
+	// Not JSON, and no values: both ignored.
+	b.publish(message{Topic: "esp32/broken/state", Payload: `nope`})
+	b.publish(message{Topic: "esp32/empty/state", Payload: `{"ts":1}`})
+
+	byID := map[string]sensor.Node{}
+	for _, n := range waitNodes(t, ss, 2) {
+		byID[n.NodeID] = n
+	}
+	garage, ok := byID["garage"]
+	if _, attic := byID["attic"]; !ok || !attic || garage.Source != Source {
+		t.Fatalf("nodes = %+v, want garage and attic over mqtt", byID)
+	}
+	samples, err := ss.Samples(garage.SensorID, time.Time{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 || !samples[0].At.Equal(at) {
+		t.Fatalf("samples = %+v, want one taken at %v", samples, at)
+	}
+	s := samples[0]
+	if s.Temperature == nil || *s.Temperature != 12.5 || s.Humidity == nil || *s.Humidity != 55 ||
+		s.Pressure == nil || math.Abs(*s.Pressure-101325) > 0.01 {
+		t.Errorf("sample = %+v, want 12.5 °C, 55 %%RH, 101325 Pa", s)
+	}
+}
+
+// waitNodes waits until the store knows n nodes and returns them.
+func waitNodes(t *testing.T, ss *sensor.SensorStore, n int) []sensor.Node {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		nodes := ss.Nodes()
+		if len(nodes) >= n {
+			if len(nodes) > n {
+				t.Fatalf("nodes = %+v, want %d", nodes, n)
+			}
+			return nodes
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nodes = %+v, want %d", nodes, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewSubscriberRejectsTopicsWithoutNode(t *testing.T) {
+	cfg := config.Default().MQTT
+	cfg.Broker = "tcp://127.0.0.1:1"
+	cfg.Subscriptions = []config.MQTTSubscription{{Topic: "esp32/+/state", Values: map[string]string{"temperature": "$"}}}
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSubscriber(client, nil); err == nil {
+		t.Error("subscription without {node} accepted")
+	}
+}
+
+func TestParse(t *testing.T) {
+	sub := &subscription{MQTTSubscription: config.MQTTSubscription{
+		Values:    map[string]string{"temperature": "$.sensors.0.value", "pressure": "p"},
+		Timestamp: "t",
+	}}
+	for _, tc := range []struct {
+		payload string
+		at      time.Time
+		temp    float32
+		ok      bool
+	}{
+		{`{"sensors":[{"value":21.5}],"t":"2026-10-19T12:00:00Z"}`, time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC), 21.5, true},
+		{`{"sensors":[{"value":"21.5"}],"t":1792411200}`, time.Unix(1792411200, 0), 21.5, true},
+		{`{"sensors":[{"value":21.5}],"t":1792411200500}`, time.UnixMilli(1792411200500), 21.5, true},
+		{`{"sensors":[{"value":21.5}]}`, time.Time{}, 0, false},
+		{`{"sensors":[{"value":true}],"t":1}`, time.Time{}, 0, false},
+		{`{"sensors":[],"t":1}`, time.Time{}, 0, false},
+		{`{"sensors":[{"value":21.5}],"t":"yesterday"}`, time.Time{}, 0, false},
+	} {
+		at, raw, err := sub.parse([]byte(tc.payload))
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v, want ok %v", tc.payload, err, tc.ok)
+			continue
+		}
+		if !tc.ok {
+			continue
+		}
+		if !at.Equal(tc.at) || raw.Temperature == nil || *raw.Temperature != tc.temp || raw.Pressure != nil {
+			t.Errorf("%s: got %v %+v", tc.payload, at, raw)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/maskarb/skarbek-dev/internal/config"
+	"github.com/maskarb/skarbek-dev/internal/sensor"
+	"github.com/maskarb/skarbek-dev/internal/units"
+)
+
+// queueSize is how many readings and status changes may wait to be
+// published before new ones are dropped.
+const queueSize = 64
+
+// Publisher publishes readings and sensor health to the broker. Observe
+// and Status only queue; Run publishes, so a slow or unreachable broker
+// never holds up sampling.
+type Publisher struct {
+	cfg     config.MQTTConfig
+	client  *Client
+	sensors *sensor.SensorStore
+	in      chan interface{}
+	// connected is poked on every (re)connect to the broker.
+	connected chan struct{}
+
+	mu      sync.Mutex
+	dropped int
+
+	// seen holds the quantities every sensor has reported and online its
+	// last known health; only Run uses them.
+	seen   map[int]map[string]bool
+	online map[int]bool
+}
+
+// NewPublisher publishes over client; the client's Run connects.
+func NewPublisher(client *Client, sensors *sensor.SensorStore) *Publisher {
+	p := &Publisher{
+		cfg:       client.cfg,
+		client:    client,
+		sensors:   sensors,
+		in:        make(chan interface{}, queueSize),
+		connected: make(chan struct{}, 1),
+		seen:      make(map[int]map[string]bool),
+		online:    make(map[int]bool),
+	}
+	client.OnConnect(func() {
+		select {
+		case p.connected <- struct{}{}:
+		default:
+		}
+	})
+	return p
+}
+
+// Observe queues a reading. It matches sensor.SensorStore.Observe.
+func (p *Publisher) Observe(o sensor.Observation) {
+	p.queue(o)
+}
+
+// Status queues a sensor going offline or coming back. It matches
+// sensor.SensorStore.OnStatus.
+func (p *Publisher) Status(c sensor.StatusChange) {
+	p.queue(c)
+}
+
+// queue never blocks: when the queue is full the message is dropped and
+// counted.
+func (p *Publisher) queue(m interface{}) {
+	select {
+	case p.in <- m:
+	default:
+		p.mu.Lock()
+		p.dropped++
+		p.mu.Unlock()
+	}
+}
+
+// Run publishes until ctx is done. Readings arrive through Observe, from
+// the store's sampling of the local sensors and from remote nodes. On
+// every connect the discovery config and the availability of the sensors
+// seen so far are published again.
+func (p *Publisher) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.connected:
+			p.announce()
+		case m := <-p.in:
+			switch m := m.(type) {
+			case sensor.Observation:
+				p.publishReading(m)
+			case sensor.StatusChange:
+				p.online[m.SensorID] = m.Online
+				p.publishAvailability(m.SensorID)
+			}
+		}
+
+		p.mu.Lock()
+		if p.dropped > 0 {
+			logger.Warn("mqtt queue full, messages dropped", "dropped", p.dropped)
+			p.dropped = 0
+		}
+		p.mu.Unlock()
+	}
+}
+
+// announce publishes what a broker or Home Assistant that lost track of
+// the server needs: the discovery config and availability of every sensor
+// seen.
+func (p *Publisher) announce() {
+	ids := make([]int, 0, len(p.seen))
+	for id := range p.seen {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		for q := range p.seen[id] {
+			p.publishDiscovery(id, q)
+		}
+		p.publishAvailability(id)
+	}
+}
+
+// publishReading publishes o as JSON to the sensor's state topic, after
+// the discovery config of quantities the sensor had not reported before.
+func (p *Publisher) publishReading(o sensor.Observation) {
+	seen := p.seen[o.SensorID]
+	if seen == nil {
+		seen = make(map[string]bool)
+		p.seen[o.SensorID] = seen
+	}
+	for q := range o.Values {
+		if _, ok := quantities[q]; ok && !seen[q] {
+			seen[q] = true
+			p.publishDiscovery(o.SensorID, q)
+		}
+	}
+	if online, ok := p.online[o.SensorID]; !ok || !online {
+		p.online[o.SensorID] = true
+		p.publishAvailability(o.SensorID)
+	}
+
+	state := map[string]interface{}{"sensor_id": o.SensorID, "at": o.At}
+	for q, v := range o.Values {
+		if qd, ok := quantities[q]; ok {
+			state[q] = units.Round(v, units.Decimals(qd.unit))
+		}
+	}
+	payload, err := json.Marshal(state)
+	if err != nil {
+		logger.Error("encode reading", "sensor_id", o.SensorID, "err", err)
+		return
+	}
+	if err := p.client.publish(stateTopic(p.cfg, o.SensorID), payload, p.cfg.Retain); err != nil {
+		logger.Warn("publish reading", "sensor_id", o.SensorID, "err", err)
+	}
+}
+
+func (p *Publisher) publishAvailability(id int) {
+	payload := payloadOffline
+	if p.online[id] {
+		payload = payloadOnline
+	}
+	if err := p.client.publish(availabilityTopic(p.cfg, id), payload, true); err != nil {
+		logger.Warn("publish sensor availability", "sensor_id", id, "err", err)
+	}
+}
+
+func (p *Publisher) publishDiscovery(id int, q string) {
+	if p.cfg.DiscoveryPrefix == "" {
+		return
+	}
+	source, nodeID, err := p.sensors.Source(id)
+	if err != nil {
+		logger.Warn("look up sensor for discovery", "sensor_id", id, "err", err)
+		return
+	}
+	topic, payload, err := discovery(p.cfg, id, q, source, nodeID)
+	if err != nil {
+		logger.Error("encode discovery config", "sensor_id", id, "quantity", q, "err", err)
+		return
+	}
+	if err := p.client.publish(topic, payload, true); err != nil {
+		logger.Warn("publish discovery config", "sensor_id", id, "quantity", q, "err", err)
+	}
+}
@@ -0,0 +1,230 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/maskarb/skarbek-dev/internal/config"
+	"github.com/maskarb/skarbek-dev/internal/sensor"
+	"github.com/maskarb/skarbek-dev/internal/units"
+)
+
+// Source is the sensor.Node source of nodes heard over MQTT.
+const Source = "mqtt"
+
+// baseUnits are the units the sensor store takes readings in.
+var baseUnits = map[string]units.Unit{
+	sensor.QuantityTemperature: units.Celsius,
+	sensor.QuantityPressure:    units.Pascal,
+}
+
+// Subscriber takes the readings remote nodes publish into the sensor
+// store, where they show up like the local sensor's.
+type Subscriber struct {
+	client  *Client
+	sensors *sensor.SensorStore
+	subs    []*subscription
+}
+
+// subscription is a config.MQTTSubscription ready to match messages.
+type subscription struct {
+	config.MQTTSubscription
+	// filter is Topic with {node} replaced by +, and level the index of
+	// that level.
+	filter string
+	level  int
+	units  map[string]units.Unit
+}
+
+// NewSubscriber subscribes client to the configured topics on every
+// connect.
+func NewSubscriber(client *Client, sensors *sensor.SensorStore) (*Subscriber, error) {
+	s := &Subscriber{client: client, sensors: sensors}
+	for i, c := range client.cfg.Subscriptions {
+		sub := &subscription{MQTTSubscription: c, level: -1, units: make(map[string]units.Unit)}
+		levels := strings.Split(c.Topic, "/")
+		for j, l := range levels {
+			if l == "{node}" {
+				sub.level = j
+				levels[j] = "+"
+			}
+		}
+		if sub.level < 0 {
+			return nil, fmt.Errorf("mqtt subscription %d: topic %q has no {node} level", i, c.Topic)
+		}
+		sub.filter = strings.Join(levels, "/")
+		for q, name := range c.Units {
+			u, err := units.Parse(name)
+			if err != nil {
+				return nil, fmt.Errorf("mqtt subscription %d: %v", i, err)
+			}
+			sub.units[q] = u
+		}
+		s.subs = append(s.subs, sub)
+	}
+	client.OnConnect(s.subscribe)
+	return s, nil
+}
+
+func (s *Subscriber) subscribe() {
+	for _, sub := range s.subs {
+		sub := sub
+		err := s.client.subscribe(sub.filter, func(_ paho.Client, m paho.Message) {
+			s.handle(sub, m)
+		})
+		if err != nil {
+			logger.Error("subscribe", "topic", sub.filter, "err", err)
+			continue
+		}
+		logger.Info("subscribed", "topic", sub.filter)
+	}
+}
+
+// handle ingests one message. Retained messages without a timestamp are
+// skipped: they are as old as the broker's copy, which is unknown.
+func (s *Subscriber) handle(sub *subscription, m paho.Message) {
+	levels := strings.Split(m.Topic(), "/")
+	if sub.level >= len(levels) {
+		return
+	}
+	node := levels[sub.level]
+	log := logger.With("topic", m.Topic(), "node", node)
+	if m.Retained() && sub.Timestamp == "" {
+		log.Debug("skipping retained message without timestamp")
+		return
+	}
+	t, raw, err := sub.parse(m.Payload())
+	if err != nil {
+		log.Warn("ignoring message", "err", err)
+		return
+	}
+	res, err := s.sensors.Ingest(Source, node, t, raw)
+	if errors.Is(err, sensor.ErrNodeRevoked) || errors.Is(err, sensor.ErrNodePending) {
+		log.Debug("ignoring reading", "err", err)
+	} else if errors.Is(err, sensor.ErrInvalidReading) {
+		log.Warn("ignoring message", "err", err)
+	} else if err != nil {
+		log.Error("ingest node reading", "err", err)
+	} else if res.Accepted == 0 {
+		log.Debug("kept reading older than the latest", "late", res.Late, "duplicates", res.Duplicates)
+	}
+}
+
+// parse reads the values and timestamp out of payload. Quantities missing
+// from it are left out of the reading, but it must have at least one.
+func (sub *subscription) parse(payload []byte) (time.Time, sensor.Raw, error) {
+	var doc interface{}
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return time.Time{}, sensor.Raw{}, fmt.Errorf("invalid JSON: %v", err)
+	}
+	var raw sensor.Raw
+	for q, path := range sub.Values {
+		v, ok := lookup(doc, path)
+		if !ok || v == nil {
+			continue
+		}
+		f, err := number(v)
+		if err != nil {
+			return time.Time{}, sensor.Raw{}, fmt.Errorf("%s at %q: %v", q, path, err)
+		}
+		if u, ok := sub.units[q]; ok {
+			if f, err = units.Convert(f, u, baseUnits[q]); err != nil {
+				return time.Time{}, sensor.Raw{}, fmt.Errorf("%s: %v", q, err)
+			}
+		}
+		v32 := float32(f)
+		switch q {
+		case sensor.QuantityTemperature:
+			raw.Temperature = &v32
+		case sensor.QuantityHumidity:
+			raw.Humidity = &v32
+		case sensor.QuantityPressure:
+			raw.Pressure = &v32
+		}
+	}
+	if raw == (sensor.Raw{}) {
+		return time.Time{}, sensor.Raw{}, errors.New("no values at the configured paths")
+	}
+
+	var t time.Time
+	if sub.Timestamp != "" {
+		v, ok := lookup(doc, sub.Timestamp)
+		if !ok {
+			return time.Time{}, sensor.Raw{}, fmt.Errorf("no timestamp at %q", sub.Timestamp)
+		}
+		var err error
+		if t, err = timestamp(v); err != nil {
+			return time.Time{}, sensor.Raw{}, err
+		}
+	}
+	return t, raw, nil
+}
+
+// lookup follows a dotted path of object keys and array indexes through
+// doc. "$" is the whole document, and a leading "$." is optional.
+func lookup(doc interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return doc, true
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			next, ok := v[key]
+			if !ok {
+				return nil, false
+			}
+			doc = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// number accepts JSON numbers and numeric strings, which some firmware
+// sends.
+func number(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a number", v)
+		}
+		return f, nil
+	}
+	return 0, fmt.Errorf("%v is not a number", v)
+}
+
+// timestamp reads RFC 3339 strings or unix times, in seconds or, for
+// values too large to be seconds, milliseconds.
+func timestamp(v interface{}) (time.Time, error) {
+	if s, ok := v.(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return t, nil
+		}
+	}
+	f, err := number(v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("timestamp %v is neither RFC 3339 nor a unix time", v)
+	}
+	if f > 1e11 {
+		return time.UnixMilli(int64(f)), nil
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)), nil
+}
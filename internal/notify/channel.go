@@ -0,0 +1,251 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/config"
+)
+
+const (
+	// queueSize is how many events a channel holds while it is sending,
+	// retrying or in quiet hours.
+	queueSize = 32
+
+	defaultAttempts = 3
+	defaultBackoff  = 5 * time.Second
+	maxBackoff      = 5 * time.Minute
+)
+
+// channel delivers events to one notifier, one at a time.
+type channel struct {
+	name     string
+	kind     string
+	notifier Notifier
+	title    *template.Template
+	body     *template.Template
+	events   map[string]bool
+	limit    config.RateLimitConfig
+	quiet    *quietHours
+	attempts int
+	backoff  time.Duration
+
+	queue chan Event
+	// sent holds the send times within the rate limit window.
+	sent []time.Time
+}
+
+func newChannel(c config.ChannelConfig) (*channel, error) {
+	n, err := newNotifier(c)
+	if err != nil {
+		return nil, err
+	}
+	ch := &channel{
+		name:     c.Name,
+		kind:     c.Type,
+		notifier: n,
+		limit:    c.RateLimit,
+		attempts: c.Retry.Attempts,
+		backoff:  c.Retry.Backoff.Duration,
+		queue:    make(chan Event, queueSize),
+	}
+	if ch.attempts == 0 {
+		ch.attempts = defaultAttempts
+	}
+	if ch.backoff == 0 {
+		ch.backoff = defaultBackoff
+	}
+	title, body := c.Title, c.Template
+	if title == "" {
+		title = "{{.Title}}"
+	}
+	if body == "" {
+		body = "{{.Message}}"
+	}
+	// Parse errors already name the template, e.g. "template: title:1: ...".
+	if ch.title, err = template.New("title").Option("missingkey=error").Parse(title); err != nil {
+		return nil, err
+	}
+	if ch.body, err = template.New("template").Option("missingkey=error").Parse(body); err != nil {
+		return nil, err
+	}
+	if len(c.Events) > 0 {
+		ch.events = make(map[string]bool, len(c.Events))
+		for _, e := range c.Events {
+			ch.events[e] = true
+		}
+	}
+	if c.QuietHours.Start != "" || c.QuietHours.End != "" {
+		if ch.quiet, err = parseQuietHours(c.QuietHours); err != nil {
+			return nil, fmt.Errorf("quiet_hours: %v", err)
+		}
+	}
+	return ch, nil
+}
+
+// wants reports whether the channel's event filter lets e through.
+func (ch *channel) wants(e Event) bool {
+	return ch.events == nil || ch.events[e.Status]
+}
+
+// render fills the channel's templates with e.
+func (ch *channel) render(e Event) (Message, error) {
+	var title, body strings.Builder
+	if err := ch.title.Execute(&title, e); err != nil {
+		return Message{}, fmt.Errorf("render title: %v", err)
+	}
+	if err := ch.body.Execute(&body, e); err != nil {
+		return Message{}, fmt.Errorf("render template: %v", err)
+	}
+	return Message{Title: strings.TrimSpace(title.String()), Body: body.String(), Event: e}, nil
+}
+
+func (ch *channel) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-ch.queue:
+			ch.deliver(ctx, e)
+		}
+	}
+}
+
+// deliver waits out quiet hours, applies the rate limit and sends e with
+// retries.
+func (ch *channel) deliver(ctx context.Context, e Event) {
+	log := logger.With("channel", ch.name, "title", e.Title)
+	if wait := ch.quiet.remaining(time.Now()); wait > 0 {
+		log.Info("holding notification for quiet hours", "for", wait.Round(time.Minute))
+		if !sleep(ctx, wait) {
+			return
+		}
+	}
+	if !ch.allow(time.Now()) {
+		log.Warn("notification rate limit reached, event dropped",
+			"count", ch.limit.Count, "per", ch.limit.Per.Duration)
+		return
+	}
+	m, err := ch.render(e)
+	if err != nil {
+		log.Error("notification not sent", "err", err)
+		return
+	}
+
+	backoff := ch.backoff
+	for attempt := 1; ; attempt++ {
+		a, cancel := context.WithTimeout(ctx, sendTimeout)
+		err := ch.notifier.Notify(a, m)
+		cancel()
+		if err == nil {
+			log.Debug("notification sent", "attempt", attempt)
+			return
+		}
+		var permanent permanentError
+		if errors.As(err, &permanent) || attempt >= ch.attempts {
+			log.Error("notification failed", "attempt", attempt, "err", err)
+			return
+		}
+		log.Warn("notification failed, retrying", "attempt", attempt, "in", backoff, "err", err)
+		if !sleep(ctx, backoff) {
+			return
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// allow records a send at now unless the rate limit is used up.
+func (ch *channel) allow(now time.Time) bool {
+	if ch.limit.Count == 0 {
+		return true
+	}
+	cutoff := now.Add(-ch.limit.Per.Duration)
+	kept := ch.sent[:0]
+	for _, t := range ch.sent {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	ch.sent = kept
+	if len(ch.sent) >= ch.limit.Count {
+		return false
+	}
+	ch.sent = append(ch.sent, now)
+	return true
+}
+
+// sleep waits for d, returning false if ctx ended first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// quietHours is a daily period, possibly spanning midnight.
+type quietHours struct {
+	start, end int // minutes after midnight
+	loc        *time.Location
+}
+
+func parseQuietHours(c config.QuietHoursConfig) (*quietHours, error) {
+	q := &quietHours{loc: time.Local}
+	var err error
+	if q.start, err = clock(c.Start); err != nil {
+		return nil, fmt.Errorf("start: %v", err)
+	}
+	if q.end, err = clock(c.End); err != nil {
+		return nil, fmt.Errorf("end: %v", err)
+	}
+	if q.start == q.end {
+		return nil, errors.New("start and end must differ")
+	}
+	if c.Timezone != "" {
+		if q.loc, err = time.LoadLocation(c.Timezone); err != nil {
+			return nil, fmt.Errorf("timezone: %v", err)
+		}
+	}
+	return q, nil
+}
+
+// clock parses "22:00" into minutes after midnight.
+func clock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a HH:MM time", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// remaining is how long the quiet hours around now still last; 0 outside
+// them.
+func (q *quietHours) remaining(now time.Time) time.Duration {
+	if q == nil {
+		return 0
+	}
+	local := now.In(q.loc)
+	m := local.Hour()*60 + local.Minute()
+	at := func(days, minutes int) time.Time {
+		y, mo, d := local.Date()
+		return time.Date(y, mo, d+days, minutes/60, minutes%60, 0, 0, q.loc)
+	}
+	switch {
+	case q.start < q.end && m >= q.start && m < q.end:
+		return at(0, q.end).Sub(now)
+	case q.start > q.end && m >= q.start:
+		return at(1, q.end).Sub(now)
+	case q.start > q.end && m < q.end:
+		return at(0, q.end).Sub(now)
+	}
+	return 0
+}
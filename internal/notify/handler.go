@@ -0,0 +1,77 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/maskarb/skarbek-dev/internal/apierror"
+)
+
+type notifyServer struct {
+	dispatcher *Dispatcher
+
+	// Protect, if set, guards sending test messages.
+	Protect func(http.Handler) http.Handler
+}
+
+// NewNotifyServer serves test sends through the channels of d.
+func NewNotifyServer(d *Dispatcher) *notifyServer {
+	return &notifyServer{dispatcher: d}
+}
+
+// Routes is mounted under /api/v1/notify.
+func (ns *notifyServer) Routes() *chi.Mux {
+	router := chi.NewRouter()
+	if ns.Protect != nil {
+		router.Use(ns.Protect)
+	}
+	router.Post("/test", ns.postTestHandler)
+	return router
+}
+
+// postTestHandler sends a test message to one channel, or all of them,
+// and reports how each fared. An empty body is allowed.
+func (ns *notifyServer) postTestHandler(w http.ResponseWriter, req *http.Request) {
+	body := struct {
+		Channel string `json:"channel"`
+		Title   string `json:"title"`
+		Message string `json:"message"`
+	}{}
+	dec := json.NewDecoder(req.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		apierror.Write(w, req, apierror.BadRequest(apierror.CodeBadRequest, "invalid JSON body").WithCause(err))
+		return
+	}
+	e := Event{
+		Kind:    "test",
+		Status:  "test",
+		Title:   body.Title,
+		Message: body.Message,
+		At:      time.Now().UTC(),
+	}
+	if e.Title == "" {
+		e.Title = "Test notification from skarbek.dev"
+	}
+	if e.Message == "" {
+		e.Message = "If you can read this, the channel works."
+	}
+	results, err := ns.dispatcher.Test(req.Context(), body.Channel, e)
+	if errors.Is(err, ErrNotFound) {
+		apierror.Write(w, req, apierror.NotFound("channel_not_found", err.Error()))
+		return
+	} else if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	for _, r := range results {
+		logger.Ctx(req.Context()).Info("test notification", "channel", r.Channel,
+			"delivered", r.Delivered, "err", r.Error)
+	}
+	render.JSON(w, req, results)
+}
@@ -0,0 +1,165 @@
+// Package notify tells people about events, such as firing alerts, through
+// channels: email, ntfy, Slack, Discord and generic webhooks. Every channel
+// renders its own message and has its own rate limit, quiet hours and
+// retries, so a slow or failing channel does not hold up the others.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/config"
+	"github.com/maskarb/skarbek-dev/internal/logging"
+)
+
+var logger = logging.For("notify")
+
+// ErrNotFound is returned for channel names that are not configured.
+var ErrNotFound = errors.New("notification channel not found")
+
+// Event is something worth telling people about.
+type Event struct {
+	// Kind is what produced the event, e.g. "alert" or "test".
+	Kind string `json:"kind"`
+	// Status is e.g. "firing" or "resolved"; channels can filter on it.
+	Status   string    `json:"status"`
+	Title    string    `json:"title"`
+	Message  string    `json:"message"`
+	SensorID int       `json:"sensor_id,omitempty"`
+	Rule     string    `json:"rule,omitempty"`
+	Quantity string    `json:"quantity,omitempty"`
+	Value    *float64  `json:"value,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// Message is an event rendered for one channel.
+type Message struct {
+	Title string
+	Body  string
+	Event Event
+}
+
+// Notifier sends messages over one transport.
+type Notifier interface {
+	Notify(ctx context.Context, m Message) error
+}
+
+// permanentError marks failures retrying cannot fix, such as a request the
+// receiver rejected.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// sendTimeout bounds a single attempt.
+const sendTimeout = 15 * time.Second
+
+var httpClient = &http.Client{Timeout: sendTimeout}
+
+// newNotifier builds the transport of c.
+func newNotifier(c config.ChannelConfig) (Notifier, error) {
+	switch c.Type {
+	case "smtp":
+		return newSMTP(c.SMTP)
+	case "ntfy":
+		return &ntfy{url: c.URL, token: c.Token, client: httpClient}, nil
+	case "slack":
+		return &webhook{url: c.URL, headers: c.Headers, client: httpClient, payload: slackPayload}, nil
+	case "discord":
+		return &webhook{url: c.URL, headers: c.Headers, client: httpClient, payload: discordPayload}, nil
+	case "webhook":
+		return &webhook{url: c.URL, token: c.Token, headers: c.Headers, client: httpClient, payload: jsonPayload}, nil
+	}
+	return nil, fmt.Errorf("unknown channel type %q", c.Type)
+}
+
+// Dispatcher fans events out to the configured channels.
+type Dispatcher struct {
+	channels []*channel
+}
+
+// NewDispatcher builds a channel for every entry of cfg.
+func NewDispatcher(cfg config.NotifyConfig) (*Dispatcher, error) {
+	d := &Dispatcher{}
+	for _, c := range cfg.Channels {
+		ch, err := newChannel(c)
+		if err != nil {
+			return nil, fmt.Errorf("notify channel %s: %v", c.Name, err)
+		}
+		d.channels = append(d.channels, ch)
+	}
+	return d, nil
+}
+
+// Notify queues e on every channel that wants it. It never blocks; a
+// channel with a full queue drops the event.
+func (d *Dispatcher) Notify(e Event) {
+	if e.At.IsZero() {
+		e.At = time.Now().UTC()
+	}
+	for _, ch := range d.channels {
+		if !ch.wants(e) {
+			continue
+		}
+		select {
+		case ch.queue <- e:
+		default:
+			logger.Warn("notification queue full, event dropped", "channel", ch.name, "title", e.Title)
+		}
+	}
+}
+
+// Run delivers queued events until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, ch := range d.channels {
+		wg.Add(1)
+		go func(ch *channel) {
+			defer wg.Done()
+			ch.run(ctx)
+		}(ch)
+	}
+	wg.Wait()
+}
+
+// Result is the outcome of a test message on one channel.
+type Result struct {
+	Channel   string `json:"channel"`
+	Type      string `json:"type"`
+	Delivered bool   `json:"delivered"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Test sends e right away to the channel called name, or to every channel
+// when name is empty. It makes a single attempt and ignores rate limits,
+// quiet hours and event filters, so the result shows whether the channel
+// works at all.
+func (d *Dispatcher) Test(ctx context.Context, name string, e Event) ([]Result, error) {
+	results := []Result{}
+	for _, ch := range d.channels {
+		if name != "" && ch.name != name {
+			continue
+		}
+		r := Result{Channel: ch.name, Type: ch.kind}
+		m, err := ch.render(e)
+		if err == nil {
+			attempt, cancel := context.WithTimeout(ctx, sendTimeout)
+			err = ch.notifier.Notify(attempt, m)
+			cancel()
+		}
+		if err != nil {
+			r.Error = err.Error()
+		} else {
+			r.Delivered = true
+		}
+		results = append(results, r)
+	}
+	if name != "" && len(results) == 0 {
+		return nil, fmt.Errorf("channel %q: %w", name, ErrNotFound)
+	}
+	return results, nil
+}
@@ -0,0 +1,446 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/config"
+)
+
+var testEvent = Event{
+	Kind:     "alert",
+	Status:   "firing",
+	Title:    "Too warm",
+	Message:  "Temperature is 31.2 °C",
+	SensorID: 119,
+	At:       time.Date(2026, 7, 1, 14, 0, 0, 0, time.UTC),
+}
+
+// received is one request a stand-in receiver got.
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+// receiver is a local stand-in for ntfy, Slack, Discord or a webhook
+// endpoint. It answers with the given statuses in turn, then 200.
+func receiver(t *testing.T, statuses ...int) (*httptest.Server, <-chan received) {
+	t.Helper()
+	got := make(chan received, 16)
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- received{header: r.Header.Clone(), body: body}
+		mu.Lock()
+		status := http.StatusOK
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, got
+}
+
+func next(t *testing.T, got <-chan received) received {
+	t.Helper()
+	select {
+	case r := <-got:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing received")
+		return received{}
+	}
+}
+
+func testChannel(t *testing.T, c config.ChannelConfig) *Dispatcher {
+	t.Helper()
+	if c.Name == "" {
+		c.Name = c.Type
+	}
+	d, err := NewDispatcher(config.NotifyConfig{Channels: []config.ChannelConfig{c}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func testOne(t *testing.T, d *Dispatcher) Result {
+	t.Helper()
+	results, err := d.Test(context.Background(), "", testEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d results", len(results))
+	}
+	return results[0]
+}
+
+func TestNtfy(t *testing.T) {
+	srv, got := receiver(t)
+	d := testChannel(t, config.ChannelConfig{Type: "ntfy", URL: srv.URL + "/alerts", Token: "tk_secret"})
+	if r := testOne(t, d); !r.Delivered {
+		t.Fatalf("not delivered: %s", r.Error)
+	}
+	r := next(t, got)
+	if string(r.body) != testEvent.Message {
+		t.Errorf("body %q", r.body)
+	}
+	for k, want := range map[string]string{
+		"Title":         testEvent.Title,
+		"Priority":      "high",
+		"Tags":          "warning",
+		"Authorization": "Bearer tk_secret",
+	} {
+		if v := r.header.Get(k); v != want {
+			t.Errorf("%s = %q, want %q", k, v, want)
+		}
+	}
+}
+
+func TestSlack(t *testing.T) {
+	srv, got := receiver(t)
+	d := testChannel(t, config.ChannelConfig{Type: "slack", URL: srv.URL})
+	if r := testOne(t, d); !r.Delivered {
+		t.Fatalf("not delivered: %s", r.Error)
+	}
+	var payload map[string]string
+	if err := json.Unmarshal(next(t, got).body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if want := "*Too warm*\nTemperature is 31.2 °C"; payload["text"] != want {
+		t.Errorf("text %q, want %q", payload["text"], want)
+	}
+}
+
+func TestDiscord(t *testing.T) {
+	srv, got := receiver(t)
+	d := testChannel(t, config.ChannelConfig{Type: "discord", URL: srv.URL, Template: strings.Repeat("x", 3000)})
+	if r := testOne(t, d); !r.Delivered {
+		t.Fatalf("not delivered: %s", r.Error)
+	}
+	var payload map[string]string
+	if err := json.Unmarshal(next(t, got).body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	content := []rune(payload["content"])
+	if len(content) != discordLimit || !strings.HasPrefix(string(content), "**Too warm**\n") ||
+		content[len(content)-1] != '…' {
+		t.Errorf("content of %d runes: %.40q...", len(content), string(content))
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	srv, got := receiver(t)
+	d := testChannel(t, config.ChannelConfig{
+		Type:     "webhook",
+		URL:      srv.URL,
+		Token:    "hook",
+		Headers:  map[string]string{"X-Env": "test"},
+		Title:    "[{{.Status}}] {{.Title}}",
+		Template: "sensor {{.SensorID}}: {{.Message}}",
+	})
+	if r := testOne(t, d); !r.Delivered {
+		t.Fatalf("not delivered: %s", r.Error)
+	}
+	r := next(t, got)
+	if r.header.Get("Authorization") != "Bearer hook" || r.header.Get("X-Env") != "test" {
+		t.Errorf("headers %v", r.header)
+	}
+	var payload struct {
+		Title   string `json:"title"`
+		Message string `json:"message"`
+		Event   Event  `json:"event"`
+	}
+	if err := json.Unmarshal(r.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Title != "[firing] Too warm" || payload.Message != "sensor 119: Temperature is 31.2 °C" {
+		t.Errorf("payload %+v", payload)
+	}
+	if payload.Event.SensorID != 119 || !payload.Event.At.Equal(testEvent.At) {
+		t.Errorf("event %+v", payload.Event)
+	}
+}
+
+func TestTestReportsFailures(t *testing.T) {
+	srv, _ := receiver(t, http.StatusForbidden)
+	d := testChannel(t, config.ChannelConfig{Type: "webhook", URL: srv.URL})
+	r := testOne(t, d)
+	if r.Delivered || !strings.Contains(r.Error, "403") {
+		t.Errorf("got %+v, want a 403 failure", r)
+	}
+	if _, err := d.Test(context.Background(), "missing", testEvent); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown channel: %v", err)
+	}
+}
+
+// runDispatcher runs d until the test ends.
+func runDispatcher(t *testing.T, d *Dispatcher) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestRetry(t *testing.T) {
+	srv, got := receiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	d := testChannel(t, config.ChannelConfig{
+		Type:  "webhook",
+		URL:   srv.URL,
+		Retry: config.RetryConfig{Attempts: 3, Backoff: config.Duration{Duration: time.Millisecond}},
+	})
+	runDispatcher(t, d)
+	d.Notify(testEvent)
+	for i := 0; i < 3; i++ {
+		next(t, got)
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	srv, got := receiver(t, http.StatusBadRequest)
+	d := testChannel(t, config.ChannelConfig{
+		Type:  "webhook",
+		URL:   srv.URL,
+		Retry: config.RetryConfig{Attempts: 3, Backoff: config.Duration{Duration: time.Millisecond}},
+	})
+	runDispatcher(t, d)
+	d.Notify(testEvent)
+	next(t, got)
+	select {
+	case <-got:
+		t.Fatal("a 400 was retried")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestEventFilterAndRateLimit(t *testing.T) {
+	srv, got := receiver(t)
+	d := testChannel(t, config.ChannelConfig{
+		Type:      "webhook",
+		URL:       srv.URL,
+		Events:    []string{"firing"},
+		RateLimit: config.RateLimitConfig{Count: 2, Per: config.Duration{Duration: time.Hour}},
+	})
+	runDispatcher(t, d)
+	resolved := testEvent
+	resolved.Status = "resolved"
+	d.Notify(resolved)
+	for i := 0; i < 3; i++ {
+		d.Notify(testEvent)
+	}
+	for i := 0; i < 2; i++ {
+		var payload struct{ Event Event }
+		json.Unmarshal(next(t, got).body, &payload)
+		if payload.Event.Status != "firing" {
+			t.Errorf("sent a %s event past the filter", payload.Event.Status)
+		}
+	}
+	select {
+	case <-got:
+		t.Fatal("sent past the rate limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	q, err := parseQuietHours(config.QuietHoursConfig{Start: "22:00", End: "07:00", Timezone: "UTC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := func(h, m int) time.Time { return time.Date(2026, 7, 1, h, m, 0, 0, time.UTC) }
+	tests := []struct {
+		now  time.Time
+		want time.Duration
+	}{
+		{day(12, 0), 0},
+		{day(21, 59), 0},
+		{day(22, 0), 9 * time.Hour},
+		{day(23, 30), 7*time.Hour + 30*time.Minute},
+		{day(3, 15), 3*time.Hour + 45*time.Minute},
+		{day(7, 0), 0},
+	}
+	for _, tt := range tests {
+		if got := q.remaining(tt.now); got != tt.want {
+			t.Errorf("remaining at %s = %v, want %v", tt.now.Format("15:04"), got, tt.want)
+		}
+	}
+	if _, err := parseQuietHours(config.QuietHoursConfig{Start: "22:00", End: "22:00"}); err == nil {
+		t.Error("equal start and end accepted")
+	}
+}
+
+// smtpServer is a local stand-in mail server speaking just enough SMTP
+// for net/smtp, without STARTTLS. It records the last message sent.
+type smtpServer struct {
+	addr string
+
+	mu   sync.Mutex
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &smtpServer{addr: l.Addr().String()}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+	reply("220 localhost ESMTP stand-in")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		s.mu.Lock()
+		switch verb {
+		case "EHLO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			s.auth = strings.TrimPrefix(line, "AUTH PLAIN ")
+			reply("235 2.7.0 Authentication successful")
+		case "MAIL":
+			s.from = line
+			reply("250 OK")
+		case "RCPT":
+			s.to = append(s.to, line)
+			reply("250 OK")
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					s.mu.Unlock()
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.data = data.String()
+			reply("250 OK queued")
+		case "QUIT":
+			reply("221 Bye")
+			s.mu.Unlock()
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+		s.mu.Unlock()
+	}
+}
+
+func smtpChannel(t *testing.T, s *smtpServer, security string) *Dispatcher {
+	host, port, _ := net.SplitHostPort(s.addr)
+	p, _ := strconv.Atoi(port)
+	return testChannel(t, config.ChannelConfig{Type: "smtp", SMTP: config.SMTPConfig{
+		Host:     host,
+		Port:     p,
+		Username: "alerts",
+		Password: "hunter2",
+		Security: security,
+		From:     "sensors@example.com",
+		To:       []string{"a@example.com", "b@example.com"},
+	}})
+}
+
+func TestSMTP(t *testing.T) {
+	s := newSMTPServer(t)
+	d := smtpChannel(t, s, "none")
+	if r := testOne(t, d); !r.Delivered {
+		t.Fatalf("not delivered: %s", r.Error)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	auth, _ := base64.StdEncoding.DecodeString(s.auth)
+	if string(auth) != "\x00alerts\x00hunter2" {
+		t.Errorf("auth %q", auth)
+	}
+	if !strings.HasPrefix(s.from, "MAIL FROM:<sensors@example.com>") {
+		t.Errorf("from %q", s.from)
+	}
+	if len(s.to) != 2 || !strings.Contains(s.to[1], "<b@example.com>") {
+		t.Errorf("recipients %q", s.to)
+	}
+	for _, want := range []string{
+		"From: sensors@example.com\r\n",
+		"To: a@example.com, b@example.com\r\n",
+		"Subject: Too warm\r\n",
+		"Content-Type: text/plain; charset=utf-8\r\n",
+		"\r\n\r\nTemperature is 31.2 °C\r\n",
+	} {
+		if !strings.Contains(s.data, want) {
+			t.Errorf("message lacks %q:\n%s", want, s.data)
+		}
+	}
+}
+
+func TestSMTPWithoutSTARTTLS(t *testing.T) {
+	s := newSMTPServer(t)
+	d := smtpChannel(t, s, "starttls")
+	r := testOne(t, d)
+	if r.Delivered || !strings.Contains(r.Error, "STARTTLS") {
+		t.Fatalf("got %+v, want STARTTLS refusal", r)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data != "" {
+		t.Error("mail sent without STARTTLS")
+	}
+}
+
+func TestSMTPEncodesSubject(t *testing.T) {
+	m := &mailer{cfg: config.SMTPConfig{From: "a@example.com", To: []string{"b@example.com"}}}
+	msg := string(m.compose(Message{Title: "Über 30 °C", Body: "one\ntwo"}))
+	if !strings.Contains(msg, "Subject: =?utf-8?q?") {
+		t.Errorf("subject not encoded:\n%s", msg)
+	}
+	if !strings.HasSuffix(msg, "\r\n\r\none\r\ntwo\r\n") {
+		t.Errorf("body line endings:\n%q", msg)
+	}
+}
@@ -0,0 +1,120 @@
+package notify
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/config"
+)
+
+// mailer sends plain text email.
+type mailer struct {
+	cfg  config.SMTPConfig
+	addr string
+}
+
+func newSMTP(c config.SMTPConfig) (*mailer, error) {
+	if c.Security == "" {
+		c.Security = "starttls"
+	}
+	port := c.Port
+	switch c.Security {
+	case "starttls":
+		if port == 0 {
+			port = 587
+		}
+	case "tls":
+		if port == 0 {
+			port = 465
+		}
+	case "none":
+		if port == 0 {
+			port = 25
+		}
+	default:
+		return nil, fmt.Errorf("smtp.security %q must be starttls, tls or none", c.Security)
+	}
+	return &mailer{cfg: c, addr: net.JoinHostPort(c.Host, strconv.Itoa(port))}, nil
+}
+
+func (m *mailer) Notify(ctx context.Context, msg Message) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	tlsConfig := &tls.Config{ServerName: m.cfg.Host}
+	if m.cfg.Security == "tls" {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	c, err := smtp.NewClient(conn, m.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if m.cfg.Security == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return permanentError{errors.New("server does not offer STARTTLS; set smtp.security to none to send in the clear")}
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if m.cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.cfg.Host)); err != nil {
+			return permanentError{fmt.Errorf("auth: %v", err)}
+		}
+	}
+	if err := c.Mail(m.cfg.From); err != nil {
+		return err
+	}
+	for _, to := range m.cfg.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(m.compose(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// compose writes the headers and body of msg.
+func (m *mailer) compose(msg Message) []byte {
+	var b strings.Builder
+	header := func(k, v string) { b.WriteString(k + ": " + v + "\r\n") }
+	header("From", m.cfg.From)
+	header("To", strings.Join(m.cfg.To, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Title))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "8bit")
+	b.WriteString("\r\n")
+	body := strings.ReplaceAll(msg.Body, "\r\n", "\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	if !strings.HasSuffix(body, "\n") {
+		b.WriteString("\r\n")
+	}
+	return []byte(b.String())
+}
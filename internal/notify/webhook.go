@@ -0,0 +1,109 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// webhook posts a JSON payload: Slack and Discord incoming webhooks or a
+// generic receiver.
+type webhook struct {
+	url     string
+	token   string
+	headers map[string]string
+	client  *http.Client
+	payload func(Message) interface{}
+}
+
+func (w *webhook) Notify(ctx context.Context, m Message) error {
+	body, err := json.Marshal(w.payload(m))
+	if err != nil {
+		return permanentError{fmt.Errorf("encode payload: %v", err)}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	if w.token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	}
+	return do(w.client, req)
+}
+
+func slackPayload(m Message) interface{} {
+	return map[string]string{"text": "*" + m.Title + "*\n" + m.Body}
+}
+
+// discordLimit is the most characters Discord accepts in content.
+const discordLimit = 2000
+
+func discordPayload(m Message) interface{} {
+	content := "**" + m.Title + "**\n" + m.Body
+	if r := []rune(content); len(r) > discordLimit {
+		content = string(r[:discordLimit-1]) + "…"
+	}
+	return map[string]string{"content": content}
+}
+
+func jsonPayload(m Message) interface{} {
+	return struct {
+		Title   string `json:"title"`
+		Message string `json:"message"`
+		Event   Event  `json:"event"`
+	}{m.Title, m.Body, m.Event}
+}
+
+// ntfy publishes to an ntfy topic URL, e.g. https://ntfy.sh/my-topic.
+type ntfy struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (n *ntfy) Notify(ctx context.Context, m Message) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, strings.NewReader(m.Body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Title", m.Title)
+	switch m.Event.Status {
+	case "firing":
+		req.Header.Set("Priority", "high")
+		req.Header.Set("Tags", "warning")
+	case "resolved":
+		req.Header.Set("Tags", "white_check_mark")
+	}
+	if n.token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.token)
+	}
+	return do(n.client, req)
+}
+
+// do sends req and turns error statuses into errors. Client errors other
+// than timeouts and rate limiting are permanent.
+func do(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(snippet)))
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
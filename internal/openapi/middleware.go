@@ -0,0 +1,41 @@
+package openapi
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/maskarb/skarbek-dev/internal/logging"
+)
+
+var logger = logging.For("openapi")
+
+// Middleware validates live traffic against the spec and logs every
+// violation as a warning. Responses are not changed. It buffers response
+// bodies, so it is meant for development and staging.
+func (s *Spec) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, err := s.find(r.Method, r.URL.Path); err != nil {
+			logger.Ctx(r.Context()).Debug("request not covered by spec", "method", r.Method, "path", r.URL.Path)
+			next.ServeHTTP(w, r)
+			return
+		}
+		log := logger.Ctx(r.Context()).With("method", r.Method, "path", r.URL.Path)
+		if err := s.ValidateRequest(r); err != nil {
+			log.Warn("request violates spec", "err", err)
+		}
+
+		var body bytes.Buffer
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		ww.Tee(&body)
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if err := s.ValidateResponse(r, status, ww.Header(), body.Bytes()); err != nil {
+			log.Warn("response violates spec", "status", status, "err", err)
+		}
+	})
+}
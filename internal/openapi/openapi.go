@@ -0,0 +1,78 @@
+// Package openapi holds the OpenAPI document of the server, serves it with
+// an API explorer, and checks requests and responses against it so the
+// handlers and the document cannot drift apart.
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed openapi.yaml
+var document []byte
+
+//go:embed explorer.html
+var explorerPage []byte
+
+// Spec is a parsed OpenAPI 3 document. Nodes are kept in the generic form
+// produced by the YAML decoder, which is also what gets served as JSON.
+type Spec struct {
+	doc  map[string]interface{}
+	json []byte
+
+	operations []*operation
+}
+
+var (
+	loadOnce sync.Once
+	loaded   *Spec
+	loadErr  error
+)
+
+// Load returns the embedded document. It is parsed once.
+func Load() (*Spec, error) {
+	loadOnce.Do(func() {
+		loaded, loadErr = Parse(document)
+	})
+	return loaded, loadErr
+}
+
+// Parse reads an OpenAPI 3 document in YAML or JSON.
+func Parse(data []byte) (*Spec, error) {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parse openapi document: %v", err)
+	}
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("encode openapi document: %v", err)
+	}
+	s := &Spec{doc: doc, json: out}
+	if err := s.index(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// JSON returns the document encoded as JSON.
+func (s *Spec) JSON() []byte {
+	return s.json
+}
+
+// ServeJSON serves the document at /api/openapi.json.
+func (s *Spec) ServeJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(s.json)
+}
+
+// ServeExplorer serves the API explorer page, which renders the document
+// and sends requests from the browser.
+func (s *Spec) ServeExplorer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(explorerPage)
+}
@@ -0,0 +1,585 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// operation is one method of one path, with the path template compiled to
+// a regular expression.
+type operation struct {
+	method   string
+	template string
+	pattern  *regexp.Regexp
+	params   []string // path parameter names in template order
+	node     map[string]interface{}
+	shared   []interface{} // path level parameters
+}
+
+var paramPattern = regexp.MustCompile(`\{([^}/]+)\}`)
+
+var methods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+func (s *Spec) index() error {
+	paths, _ := s.doc["paths"].(map[string]interface{})
+	templates := make([]string, 0, len(paths))
+	for t := range paths {
+		templates = append(templates, t)
+	}
+	// Literal segments win over parameters: /sessions/current before
+	// /sessions/{id}.
+	sort.Slice(templates, func(i, j int) bool {
+		ci, cj := strings.Count(templates[i], "{"), strings.Count(templates[j], "{")
+		if ci != cj {
+			return ci < cj
+		}
+		return templates[i] < templates[j]
+	})
+
+	for _, t := range templates {
+		item, ok := paths[t].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("openapi: path %s is not an object", t)
+		}
+		var names []string
+		expr, last := "^", 0
+		for _, m := range paramPattern.FindAllStringSubmatchIndex(t, -1) {
+			expr += regexp.QuoteMeta(t[last:m[0]]) + "([^/]+)"
+			names = append(names, t[m[2]:m[3]])
+			last = m[1]
+		}
+		expr += regexp.QuoteMeta(t[last:]) + "$"
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("openapi: path %s: %v", t, err)
+		}
+		shared, _ := item["parameters"].([]interface{})
+		for _, m := range methods {
+			node, ok := item[m].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			s.operations = append(s.operations, &operation{
+				method:   strings.ToUpper(m),
+				template: t,
+				pattern:  pattern,
+				params:   names,
+				node:     node,
+				shared:   shared,
+			})
+		}
+	}
+	return nil
+}
+
+// find returns the operation for method and path, and the path parameter
+// values.
+func (s *Spec) find(method, path string) (*operation, map[string]string, error) {
+	pathKnown := false
+	for _, op := range s.operations {
+		m := op.pattern.FindStringSubmatch(path)
+		if m == nil {
+			continue
+		}
+		pathKnown = true
+		if op.method != method {
+			continue
+		}
+		values := make(map[string]string, len(op.params))
+		for i, name := range op.params {
+			values[name] = m[i+1]
+		}
+		return op, values, nil
+	}
+	if pathKnown {
+		return nil, nil, fmt.Errorf("%s %s: method not in spec", method, path)
+	}
+	return nil, nil, fmt.Errorf("%s %s: path not in spec", method, path)
+}
+
+// Violations lists every way a request or response differs from the spec.
+type Violations []string
+
+func (v Violations) Error() string {
+	return strings.Join(v, "; ")
+}
+
+func (v *Violations) add(format string, args ...interface{}) {
+	*v = append(*v, fmt.Sprintf(format, args...))
+}
+
+func (v Violations) err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+// ValidateRequest checks the path, method, parameters and JSON body of r.
+// The body is read and replaced, so r can still be served afterwards.
+func (s *Spec) ValidateRequest(r *http.Request) error {
+	op, pathValues, err := s.find(r.Method, r.URL.Path)
+	if err != nil {
+		return err
+	}
+	var v Violations
+	where := r.Method + " " + op.template
+
+	for _, p := range s.parameters(op) {
+		name, _ := p["name"].(string)
+		in, _ := p["in"].(string)
+		required, _ := p["required"].(bool)
+		var (
+			value   string
+			present bool
+		)
+		switch in {
+		case "path":
+			value, present = pathValues[name]
+		case "query":
+			_, present = r.URL.Query()[name]
+			value = r.URL.Query().Get(name)
+		case "header":
+			value = r.Header.Get(name)
+			present = value != ""
+		case "cookie":
+			if c, err := r.Cookie(name); err == nil {
+				value, present = c.Value, true
+			}
+		}
+		if !present {
+			if required {
+				v.add("%s: missing required %s parameter %s", where, in, name)
+			}
+			continue
+		}
+		schema, _ := p["schema"].(map[string]interface{})
+		decoded, err := s.parseParameter(value, schema)
+		if err != nil {
+			v.add("%s: %s parameter %s: %v", where, in, name, err)
+			continue
+		}
+		s.validate(&v, where+" "+in+" "+name, decoded, schema)
+	}
+
+	body, _ := s.resolve(op.node["requestBody"])
+	if body != nil {
+		data, err := readAndRestore(&r.Body)
+		if err != nil {
+			return err
+		}
+		required, _ := body["required"].(bool)
+		if len(data) == 0 {
+			if required {
+				v.add("%s: missing required request body", where)
+			}
+			return v.err()
+		}
+		s.validateContent(&v, where+" request", body, r.Header.Get("Content-Type"), data)
+	} else if r.ContentLength > 0 {
+		v.add("%s: request body not in spec", where)
+	}
+	return v.err()
+}
+
+// ValidateResponse checks a response given to req against the spec.
+func (s *Spec) ValidateResponse(req *http.Request, status int, header http.Header, body []byte) error {
+	op, _, err := s.find(req.Method, req.URL.Path)
+	if err != nil {
+		return err
+	}
+	where := fmt.Sprintf("%s %s -> %d", req.Method, op.template, status)
+
+	responses, _ := op.node["responses"].(map[string]interface{})
+	node, ok := responses[strconv.Itoa(status)]
+	if !ok {
+		node, ok = responses[fmt.Sprintf("%dXX", status/100)]
+	}
+	if !ok {
+		node, ok = responses["default"]
+	}
+	if !ok {
+		return fmt.Errorf("%s: status not in spec", where)
+	}
+	response, err := s.resolve(node)
+	if err != nil {
+		return fmt.Errorf("%s: %v", where, err)
+	}
+
+	var v Violations
+	if _, ok := response["content"]; !ok {
+		if len(body) > 0 {
+			v.add("%s: spec has no body but response has %d bytes", where, len(body))
+		}
+		return v.err()
+	}
+	s.validateContent(&v, where, response, header.Get("Content-Type"), body)
+	return v.err()
+}
+
+// validateContent matches contentType against the content map of node
+// (a request body or response) and validates JSON bodies.
+func (s *Spec) validateContent(v *Violations, where string, node map[string]interface{}, contentType string, body []byte) {
+	content, _ := node["content"].(map[string]interface{})
+	if contentType == "" && len(body) > 0 {
+		// net/http sniffs the type after the handler's headers are captured.
+		contentType = http.DetectContentType(body)
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		v.add("%s: bad content type %q", where, contentType)
+		return
+	}
+	media, ok := content[mediaType].(map[string]interface{})
+	if !ok {
+		var want []string
+		for k := range content {
+			want = append(want, k)
+		}
+		sort.Strings(want)
+		v.add("%s: content type %s not in spec (want %s)", where, mediaType, strings.Join(want, ", "))
+		return
+	}
+	schema, _ := media["schema"].(map[string]interface{})
+	if schema == nil {
+		return
+	}
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		v.add("%s: invalid JSON: %v", where, err)
+		return
+	}
+	s.validate(v, where+" $", value, schema)
+}
+
+// parameters merges path level and operation level parameters, the latter
+// overriding the former by name and location.
+func (s *Spec) parameters(op *operation) []map[string]interface{} {
+	var out []map[string]interface{}
+	seen := make(map[string]int)
+	for _, list := range [][]interface{}{op.shared, paramList(op.node)} {
+		for _, raw := range list {
+			p, err := s.resolve(raw)
+			if err != nil || p == nil {
+				continue
+			}
+			key := fmt.Sprint(p["in"], ":", p["name"])
+			if i, ok := seen[key]; ok {
+				out[i] = p
+				continue
+			}
+			seen[key] = len(out)
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func paramList(node map[string]interface{}) []interface{} {
+	l, _ := node["parameters"].([]interface{})
+	return l
+}
+
+// parseParameter turns the raw text of a parameter into the JSON type its
+// schema expects.
+func (s *Spec) parseParameter(value string, schema map[string]interface{}) (interface{}, error) {
+	schema, err := s.resolve(schema)
+	if err != nil || schema == nil {
+		return value, err
+	}
+	switch schema["type"] {
+	case "integer", "number":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return nil, fmt.Errorf("%q is not a number", value)
+		}
+		return json.Number(value), nil
+	case "boolean":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", value)
+		}
+		return b, nil
+	case "array":
+		var items []interface{}
+		itemSchema, _ := schema["items"].(map[string]interface{})
+		for _, part := range strings.Split(value, ",") {
+			item, err := s.parseParameter(part, itemSchema)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return value, nil
+}
+
+// resolve follows a local $ref ("#/components/...") if node has one.
+func (s *Spec) resolve(node interface{}) (map[string]interface{}, error) {
+	m, _ := node.(map[string]interface{})
+	for depth := 0; m != nil; depth++ {
+		ref, ok := m["$ref"].(string)
+		if !ok {
+			return m, nil
+		}
+		if depth > 32 || !strings.HasPrefix(ref, "#/") {
+			return nil, fmt.Errorf("cannot resolve $ref %s", ref)
+		}
+		var cur interface{} = s.doc
+		for _, part := range strings.Split(ref[2:], "/") {
+			part = strings.NewReplacer("~1", "/", "~0", "~").Replace(part)
+			parent, _ := cur.(map[string]interface{})
+			cur = parent[part]
+		}
+		if cur == nil {
+			return nil, fmt.Errorf("dangling $ref %s", ref)
+		}
+		m, _ = cur.(map[string]interface{})
+	}
+	return m, nil
+}
+
+// validate checks value against the subset of JSON Schema used by the
+// document: type, nullable, enum, required, properties,
+// additionalProperties, items, min/max bounds, allOf/anyOf/oneOf and the
+// date-time format.
+func (s *Spec) validate(v *Violations, at string, value interface{}, node map[string]interface{}) {
+	schema, err := s.resolve(node)
+	if err != nil {
+		v.add("%s: %v", at, err)
+		return
+	}
+	if schema == nil {
+		return
+	}
+
+	if value == nil {
+		if nullable, _ := schema["nullable"].(bool); !nullable && schema["type"] != nil {
+			v.add("%s: null is not allowed", at)
+		}
+		return
+	}
+
+	for _, sub := range list(schema["allOf"]) {
+		s.validate(v, at, value, asMap(sub))
+	}
+	if alts := list(schema["anyOf"]); len(alts) > 0 && s.matching(value, alts, at) == 0 {
+		v.add("%s: matches none of anyOf", at)
+	}
+	if alts := list(schema["oneOf"]); len(alts) > 0 {
+		if n := s.matching(value, alts, at); n != 1 {
+			v.add("%s: matches %d of oneOf, want 1", at, n)
+		}
+	}
+
+	if enum := list(schema["enum"]); len(enum) > 0 {
+		found := false
+		for _, e := range enum {
+			if equalJSON(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.add("%s: %v is not one of %v", at, value, enum)
+		}
+	}
+
+	typ, _ := schema["type"].(string)
+	switch typ {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			v.add("%s: want object, got %s", at, jsonType(value))
+			return
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		for _, r := range list(schema["required"]) {
+			name, _ := r.(string)
+			if _, ok := obj[name]; !ok {
+				v.add("%s: missing required property %s", at, name)
+			}
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if p, ok := props[k]; ok {
+				s.validate(v, at+"."+k, obj[k], asMap(p))
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					v.add("%s: unexpected property %s", at, k)
+				}
+			case map[string]interface{}:
+				s.validate(v, at+"."+k, obj[k], extra)
+			}
+		}
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			v.add("%s: want array, got %s", at, jsonType(value))
+			return
+		}
+		if min, ok := number(schema["minItems"]); ok && float64(len(arr)) < min {
+			v.add("%s: %d items, want at least %v", at, len(arr), min)
+		}
+		if max, ok := number(schema["maxItems"]); ok && float64(len(arr)) > max {
+			v.add("%s: %d items, want at most %v", at, len(arr), max)
+		}
+		items := asMap(schema["items"])
+		for i, item := range arr {
+			s.validate(v, fmt.Sprintf("%s[%d]", at, i), item, items)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			v.add("%s: want string, got %s", at, jsonType(value))
+			return
+		}
+		if min, ok := number(schema["minLength"]); ok && float64(len([]rune(str))) < min {
+			v.add("%s: shorter than %v", at, min)
+		}
+		if max, ok := number(schema["maxLength"]); ok && float64(len([]rune(str))) > max {
+			v.add("%s: longer than %v", at, max)
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				v.add("%s: %q is not a date-time", at, str)
+			}
+		}
+	case "integer", "number":
+		f, ok := number(value)
+		if !ok {
+			v.add("%s: want %s, got %s", at, typ, jsonType(value))
+			return
+		}
+		if typ == "integer" && f != float64(int64(f)) {
+			v.add("%s: %v is not an integer", at, f)
+		}
+		if min, ok := number(schema["minimum"]); ok && f < min {
+			v.add("%s: %v is below minimum %v", at, f, min)
+		}
+		if max, ok := number(schema["maximum"]); ok && f > max {
+			v.add("%s: %v is above maximum %v", at, f, max)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			v.add("%s: want boolean, got %s", at, jsonType(value))
+		}
+	}
+}
+
+// matching counts the alternatives value satisfies.
+func (s *Spec) matching(value interface{}, alts []interface{}, at string) int {
+	n := 0
+	for _, alt := range alts {
+		var sub Violations
+		s.validate(&sub, at, value, asMap(alt))
+		if len(sub) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func list(v interface{}) []interface{} {
+	l, _ := v.([]interface{})
+	return l
+}
+
+func asMap(v interface{}) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	return m
+}
+
+// number accepts the numeric types of both decoders: json.Number from
+// bodies and int/float64 from the YAML document.
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func equalJSON(a, b interface{}) bool {
+	if fa, ok := number(a); ok {
+		fb, ok := number(b)
+		return ok && fa == fb
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number, float64, int:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func readAndRestore(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+	data, err := ioutil.ReadAll(*body)
+	(*body).Close()
+	*body = ioutil.NopCloser(bytes.NewReader(data))
+	return data, err
+}
+
+// Check serves req with h through httptest and validates both the request
+// and the response. It returns the recorded response so callers can make
+// further assertions, e.g. in a _test.go file:
+//
+//	rec, err := spec.Check(router, httptest.NewRequest("GET", "/api/v1/sensor/abc", nil))
+func (s *Spec) Check(h http.Handler, req *http.Request) (*httptest.ResponseRecorder, error) {
+	var v Violations
+	if err := s.ValidateRequest(req); err != nil {
+		v = append(v, "request: "+err.Error())
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if err := s.ValidateResponse(req, rec.Code, rec.Header(), rec.Body.Bytes()); err != nil {
+		v = append(v, "response: "+err.Error())
+	}
+	return rec, v.err()
+}
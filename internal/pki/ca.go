@@ -0,0 +1,557 @@
+// Package pki is the small certificate authority behind mutual TLS for
+// remote nodes. It issues client certificates to enrolled nodes, and the
+// certificate of the listener they connect to, keeps every certificate it
+// issued and the revocations in the database, and publishes a CRL. Its own
+// key is kept apart, in a file only its owner can read. A node is known
+// by the sensor ID in its certificate's subject, "sensor-<id>".
+package pki
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/maskarb/skarbek-dev/internal/config"
+	"github.com/maskarb/skarbek-dev/internal/constants"
+	"github.com/maskarb/skarbek-dev/internal/logging"
+)
+
+var logger = logging.For("pki")
+
+const (
+	// SubjectPrefix precedes the sensor ID in the common name of node
+	// certificates.
+	SubjectPrefix = "sensor-"
+	organization  = "skarbek.dev nodes"
+
+	caValidity     = 10 * 365 * 24 * time.Hour
+	serverValidity = 30 * 24 * time.Hour
+	// backdate allows for nodes whose clocks run a little behind.
+	backdate = 5 * time.Minute
+	// crlValidity is how long a CRL is current; it is rebuilt on every
+	// request.
+	crlValidity = 24 * time.Hour
+)
+
+var (
+	// ErrNotFound is returned for serials the CA did not issue.
+	ErrNotFound = errors.New("certificate not found")
+	// ErrRevoked is returned for revoked certificates.
+	ErrRevoked = errors.New("certificate is revoked")
+	// ErrInvalidCSR is wrapped by errors caused by bad signing requests.
+	ErrInvalidCSR = errors.New("invalid certificate signing request")
+)
+
+// authority is the CA's own certificate, generated on first use. Its key
+// is in the key file; KeyPEM is only set by versions that kept the key in
+// the database, and New moves it to the file.
+type authority struct {
+	ID        uint `gorm:"primaryKey"`
+	CertPEM   string
+	KeyPEM    string
+	CreatedAt time.Time
+}
+
+// TableName keeps the tables of this package together.
+func (authority) TableName() string { return "pki_authorities" }
+
+// Certificate is a node certificate the CA issued.
+type Certificate struct {
+	// Serial is the certificate's serial number in hex.
+	Serial    string    `json:"serial" gorm:"primaryKey"`
+	SensorID  int       `json:"sensor_id" gorm:"index;not null"`
+	Subject   string    `json:"subject"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	CertPEM   string    `json:"-"`
+	// RevokedAt is set once the certificate is revoked, for
+	// RevokeReason.
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	RevokeReason string     `json:"revoke_reason,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// TableName keeps the tables of this package together.
+func (Certificate) TableName() string { return "pki_certificates" }
+
+// Issued is a new certificate in PEM, with its key when the CA generated
+// it. RenewAfter is when the node should ask for the next one.
+type Issued struct {
+	Certificate
+	CertificatePEM string    `json:"certificate"`
+	KeyPEM         string    `json:"key,omitempty"`
+	CAPEM          string    `json:"ca"`
+	RenewAfter     time.Time `json:"renew_after"`
+}
+
+// CA issues and checks node certificates.
+type CA struct {
+	db          *gorm.DB
+	cert        *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certPEM     []byte
+	validity    time.Duration
+	renewBefore time.Duration
+	hosts       []string
+
+	mu     sync.Mutex
+	server *tls.Certificate
+}
+
+// New loads the CA from db and its key from cfg.KeyFile, generating both
+// on first use.
+func New(db *gorm.DB, cfg config.NodeTLSConfig) (*CA, error) {
+	if err := db.AutoMigrate(&authority{}, &Certificate{}); err != nil {
+		return nil, fmt.Errorf("migrate pki: %v", err)
+	}
+	ca := &CA{db: db, validity: cfg.CertValidity.Duration, renewBefore: cfg.RenewBefore.Duration, hosts: cfg.Hosts}
+
+	var a authority
+	err := db.First(&a).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		// A key file without a certificate, left by a first start that
+		// failed to save it, is used again.
+		key, err := loadKey(cfg.KeyFile)
+		if errors.Is(err, os.ErrNotExist) {
+			key, err = newKey(cfg.KeyFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if a, err = newAuthority(key); err != nil {
+			return nil, err
+		}
+		if err := db.Create(&a).Error; err != nil {
+			return nil, fmt.Errorf("save node ca: %v", err)
+		}
+		logger.Info("generated node ca", "key_file", cfg.KeyFile)
+	case err != nil:
+		return nil, fmt.Errorf("load node ca: %v", err)
+	case a.KeyPEM != "":
+		if err := writeKey(cfg.KeyFile, []byte(a.KeyPEM)); err != nil && !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if err := db.Model(&a).Update("key_pem", "").Error; err != nil {
+			return nil, fmt.Errorf("remove node ca key from the database: %v", err)
+		}
+		logger.Info("moved node ca key out of the database", "key_file", cfg.KeyFile)
+	}
+
+	certBlock, _ := pem.Decode([]byte(a.CertPEM))
+	if certBlock == nil {
+		return nil, errors.New("stored node ca is corrupt")
+	}
+	if ca.cert, err = x509.ParseCertificate(certBlock.Bytes); err != nil {
+		return nil, fmt.Errorf("parse node ca certificate: %v", err)
+	}
+	if ca.key, err = loadKey(cfg.KeyFile); err != nil {
+		return nil, err
+	}
+	if !ca.key.PublicKey.Equal(ca.cert.PublicKey) {
+		return nil, fmt.Errorf("node ca key %s does not match the stored node ca", cfg.KeyFile)
+	}
+	ca.certPEM = []byte(a.CertPEM)
+	if time.Until(ca.cert.NotAfter) < cfg.CertValidity.Duration {
+		logger.Warn("node ca expires before the certificates it issues", "not_after", ca.cert.NotAfter)
+	}
+	return ca, nil
+}
+
+// newKey generates a CA key and writes it to path.
+func newKey(path string) (*ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate node ca key: %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("encode node ca key: %v", err)
+	}
+	if err := writeKey(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// writeKey creates path, readable by the owner only, with keyPEM. It
+// never replaces an existing file.
+func writeKey(path string, keyPEM []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("create node ca key directory: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("write node ca key: %w", err)
+	}
+	if _, err := f.Write(keyPEM); err != nil {
+		f.Close()
+		return fmt.Errorf("write node ca key: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write node ca key: %v", err)
+	}
+	return nil
+}
+
+func loadKey(path string) (*ecdsa.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read node ca key: %w", err)
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Mode().Perm()&0o077 != 0 {
+		logger.Warn("node ca key is readable by other users", "key_file", path, "mode", fi.Mode().Perm())
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "EC PRIVATE KEY" {
+		return nil, fmt.Errorf("node ca key %s is not a PEM EC private key", path)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse node ca key: %v", err)
+	}
+	return key, nil
+}
+
+func newAuthority(key *ecdsa.PrivateKey) (authority, error) {
+	serial, err := newSerial()
+	if err != nil {
+		return authority{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "skarbek.dev node CA", Organization: []string{organization}},
+		NotBefore:             now.Add(-backdate),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return authority{}, fmt.Errorf("create node ca certificate: %v", err)
+	}
+	return authority{CertPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))}, nil
+}
+
+// CertPEM is the CA certificate nodes trust the listener by.
+func (ca *CA) CertPEM() []byte {
+	return ca.certPEM
+}
+
+// Pool holds just the CA certificate.
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// Issue signs a client certificate for the node of sensor id. csrPEM is
+// the node's PKCS #10 request; its subject is replaced. Without one the CA
+// generates the key and returns it, for nodes that cannot make a CSR.
+func (ca *CA) Issue(id int, csrPEM []byte) (Issued, error) {
+	var (
+		pub    interface{}
+		keyPEM []byte
+	)
+	if len(csrPEM) > 0 {
+		block, _ := pem.Decode(csrPEM)
+		if block == nil || block.Type != "CERTIFICATE REQUEST" {
+			return Issued{}, fmt.Errorf("%w: expected a PEM CERTIFICATE REQUEST", ErrInvalidCSR)
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			return Issued{}, fmt.Errorf("%w: %v", ErrInvalidCSR, err)
+		}
+		if err := csr.CheckSignature(); err != nil {
+			return Issued{}, fmt.Errorf("%w: %v", ErrInvalidCSR, err)
+		}
+		pub = csr.PublicKey
+	} else {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return Issued{}, fmt.Errorf("generate node key: %v", err)
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return Issued{}, fmt.Errorf("encode node key: %v", err)
+		}
+		pub, keyPEM = &key.PublicKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return Issued{}, err
+	}
+	now := time.Now().UTC()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: SubjectPrefix + strconv.Itoa(id), Organization: []string{organization}},
+		NotBefore:    now.Add(-backdate),
+		NotAfter:     now.Add(ca.validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, pub, ca.key)
+	if err != nil {
+		return Issued{}, fmt.Errorf("%w: %v", ErrInvalidCSR, err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	c := Certificate{
+		Serial:    serialHex(serial),
+		SensorID:  id,
+		Subject:   tmpl.Subject.String(),
+		NotBefore: tmpl.NotBefore,
+		NotAfter:  tmpl.NotAfter,
+		CertPEM:   string(certPEM),
+		CreatedAt: now,
+	}
+	if err := ca.db.Create(&c).Error; err != nil {
+		return Issued{}, fmt.Errorf("save node certificate: %v", err)
+	}
+	logger.Info("node certificate issued", "sensor_id", id, "serial", c.Serial, "not_after", c.NotAfter)
+	return Issued{
+		Certificate:    c,
+		CertificatePEM: string(certPEM),
+		KeyPEM:         string(keyPEM),
+		CAPEM:          string(ca.certPEM),
+		RenewAfter:     c.NotAfter.Add(-ca.renewBefore),
+	}, nil
+}
+
+// Certificates lists the certificates issued to sensor id, or to every
+// node for 0, newest first.
+func (ca *CA) Certificates(id int) ([]Certificate, error) {
+	certs := []Certificate{}
+	q := ca.db.Order("created_at desc")
+	if id != 0 {
+		q = q.Where("sensor_id = ?", id)
+	}
+	if err := q.Find(&certs).Error; err != nil {
+		return nil, fmt.Errorf("load node certificates: %v", err)
+	}
+	return certs, nil
+}
+
+// Revoke revokes the certificate with serial, given in hex. Revoking it
+// again keeps the first time and reason.
+func (ca *CA) Revoke(serial, reason string) (Certificate, error) {
+	var c Certificate
+	err := ca.db.First(&c, "serial = ?", strings.ToLower(serial)).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c, fmt.Errorf("serial %s: %w", serial, ErrNotFound)
+	} else if err != nil {
+		return c, fmt.Errorf("load node certificate: %v", err)
+	}
+	if c.RevokedAt != nil {
+		return c, nil
+	}
+	now := time.Now().UTC()
+	c.RevokedAt, c.RevokeReason = &now, reason
+	if err := ca.db.Model(&c).Select("revoked_at", "revoke_reason").Updates(&c).Error; err != nil {
+		return c, fmt.Errorf("revoke node certificate: %v", err)
+	}
+	logger.Info("node certificate revoked", "sensor_id", c.SensorID, "serial", c.Serial, "reason", reason)
+	return c, nil
+}
+
+// RevokeSensor revokes every certificate of sensor id that is still
+// valid, and returns how many it revoked.
+func (ca *CA) RevokeSensor(id int, reason string) (int, error) {
+	now := time.Now().UTC()
+	res := ca.db.Model(&Certificate{}).
+		Where("sensor_id = ? AND revoked_at IS NULL AND not_after > ?", id, now).
+		Updates(map[string]interface{}{"revoked_at": now, "revoke_reason": reason})
+	if res.Error != nil {
+		return 0, fmt.Errorf("revoke node certificates: %v", res.Error)
+	}
+	if res.RowsAffected > 0 {
+		logger.Info("node certificates revoked", "sensor_id", id, "count", res.RowsAffected, "reason", reason)
+	}
+	return int(res.RowsAffected), nil
+}
+
+// CRL returns the DER certificate revocation list of the certificates
+// revoked before they expired.
+func (ca *CA) CRL(now time.Time) ([]byte, error) {
+	var revoked []Certificate
+	err := ca.db.Where("revoked_at IS NOT NULL AND not_after > ?", now).Order("revoked_at").Find(&revoked).Error
+	if err != nil {
+		return nil, fmt.Errorf("load revoked certificates: %v", err)
+	}
+	entries := make([]pkix.RevokedCertificate, 0, len(revoked))
+	for _, c := range revoked {
+		serial, ok := new(big.Int).SetString(c.Serial, 16)
+		if !ok {
+			logger.Error("skipping corrupt serial in crl", "serial", c.Serial)
+			continue
+		}
+		entries = append(entries, pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: *c.RevokedAt})
+	}
+	tmpl := &x509.RevocationList{
+		RevokedCertificates: entries,
+		Number:              big.NewInt(now.Unix()),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(crlValidity),
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.cert, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("create crl: %v", err)
+	}
+	return der, nil
+}
+
+// Identify maps a verified client certificate to its sensor ID. The
+// certificate must be one the CA issued to that sensor, unexpired and not
+// revoked.
+func (ca *CA) Identify(cert *x509.Certificate) (int, error) {
+	cn := cert.Subject.CommonName
+	id, err := strconv.Atoi(strings.TrimPrefix(cn, SubjectPrefix))
+	if !strings.HasPrefix(cn, SubjectPrefix) || err != nil {
+		return 0, fmt.Errorf("subject %q does not name a sensor", cn)
+	}
+	var c Certificate
+	err = ca.db.First(&c, "serial = ?", serialHex(cert.SerialNumber)).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, fmt.Errorf("serial %s: %w", serialHex(cert.SerialNumber), ErrNotFound)
+	} else if err != nil {
+		return 0, fmt.Errorf("load node certificate: %v", err)
+	}
+	switch {
+	case c.SensorID != id:
+		return 0, fmt.Errorf("serial %s was issued to sensor %d, not %d", c.Serial, c.SensorID, id)
+	case c.RevokedAt != nil:
+		return 0, fmt.Errorf("serial %s: %w", c.Serial, ErrRevoked)
+	case time.Now().After(c.NotAfter):
+		return 0, fmt.Errorf("serial %s expired at %s", c.Serial, c.NotAfter.Format(time.RFC3339))
+	}
+	return id, nil
+}
+
+// VerifyConnection rejects handshakes whose client certificate Identify
+// does not accept, so revoked certificates are refused before any request
+// is read. It is meant for tls.Config.VerifyConnection.
+func (ca *CA) VerifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no client certificate")
+	}
+	if _, err := ca.Identify(cs.PeerCertificates[0]); err != nil {
+		logger.Warn("client certificate refused", "subject", cs.PeerCertificates[0].Subject.CommonName, "err", err)
+		return err
+	}
+	return nil
+}
+
+// ServerTLSConfig is the config of the listener nodes connect to: it
+// serves a certificate from the CA and requires a client certificate from
+// it. Every handshake gets its config from GetConfigForClient, so
+// certificates added to the returned config, as httptest.Server.StartTLS
+// does, are not served instead.
+func (ca *CA) ServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: ca.configForClient,
+		NextProtos:         []string{"h2", "http/1.1"},
+	}
+}
+
+func (ca *CA) configForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	cert, err := ca.serverCertificate(hello)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		Certificates:     []tls.Certificate{*cert},
+		ClientAuth:       tls.RequireAndVerifyClientCert,
+		ClientCAs:        ca.Pool(),
+		VerifyConnection: ca.VerifyConnection,
+		NextProtos:       []string{"h2", "http/1.1"},
+	}, nil
+}
+
+// serverCertificate returns the listener's certificate for the configured
+// hosts, issuing a new one when a third of its lifetime is left. It is
+// kept in memory only.
+func (ca *CA) serverCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if c := ca.server; c != nil && time.Until(c.Leaf.NotAfter) > serverValidity/3 {
+		return c, nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate listener key: %v", err)
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: ca.hosts[0], Organization: []string{organization}},
+		NotBefore:    now.Add(-backdate),
+		NotAfter:     now.Add(serverValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range ca.hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("create listener certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	ca.server = &tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key, Leaf: leaf}
+	logger.Info("issued listener certificate", "hosts", strings.Join(ca.hosts, ","), "not_after", leaf.NotAfter)
+	return ca.server, nil
+}
+
+// SensorFromContext returns the sensor ID Middleware identified the
+// caller as.
+func SensorFromContext(ctx context.Context) (int, bool) {
+	id, ok := ctx.Value(constants.NodeContextID).(int)
+	return id, ok
+}
+
+func newSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generate serial: %v", err)
+	}
+	return serial, nil
+}
+
+func serialHex(serial *big.Int) string {
+	return hex.EncodeToString(serial.Bytes())
+}
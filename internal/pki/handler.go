@@ -0,0 +1,193 @@
+package pki
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/maskarb/skarbek-dev/internal/apierror"
+	"github.com/maskarb/skarbek-dev/internal/constants"
+)
+
+type pkiServer struct {
+	ca *CA
+
+	// Redeem checks a node's device token and uses it up if issue
+	// succeeds, so a token gets a node one certificate and a node with a
+	// certificate no longer pushes with its token. Without it
+	// certificates can only be renewed.
+	Redeem func(sensorID int, token string, issue func() error) error
+	// Admin guards listing and revoking certificates. Without it those
+	// endpoints are not served.
+	Admin func(http.Handler) http.Handler
+}
+
+// NewPKIServer serves the CA's certificate, CRL and certificates.
+func NewPKIServer(ca *CA) *pkiServer {
+	return &pkiServer{ca: ca}
+}
+
+// Routes is mounted under /api/v1/pki.
+func (ps *pkiServer) Routes() *chi.Mux {
+	router := chi.NewRouter()
+	router.Get("/ca.pem", ps.getCAHandler)
+	router.Get("/crl", ps.getCRLHandler)
+	router.Post("/certificates", ps.postCertificateHandler)
+	if ps.Admin != nil {
+		router.Group(func(r chi.Router) {
+			r.Use(ps.Admin)
+			r.Get("/certificates", ps.listCertificatesHandler)
+			r.Post("/certificates/{serial}/revoke", ps.revokeHandler)
+		})
+	}
+	return router
+}
+
+// NodeRoutes adds the endpoints of the mutual TLS listener, under
+// /api/v1/node, to r. Requests must have passed through Middleware.
+func (ps *pkiServer) NodeRoutes(r chi.Router) {
+	r.Post("/certificate", ps.renewHandler)
+	r.Get("/ca.pem", ps.getCAHandler)
+}
+
+// Middleware identifies the node by its client certificate. The handshake
+// already checked the certificate; this puts its sensor ID in the request
+// context for SensorFromContext.
+func (ca *CA) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			apierror.Write(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized,
+				"client certificate required"))
+			return
+		}
+		id, err := ca.Identify(r.TLS.PeerCertificates[0])
+		if err != nil {
+			apierror.Write(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, err.Error()))
+			return
+		}
+		ctx := context.WithValue(r.Context(), constants.NodeContextID, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (ps *pkiServer) getCAHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(ps.ca.CertPEM())
+}
+
+func (ps *pkiServer) getCRLHandler(w http.ResponseWriter, req *http.Request) {
+	crl, err := ps.ca.CRL(time.Now().UTC())
+	if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crl)
+}
+
+// postCertificateHandler issues a node its first certificate, in exchange
+// for its device token, which is then used up. The body is
+// {"sensor_id":...,"csr":...}; without a CSR the key is generated and
+// returned.
+func (ps *pkiServer) postCertificateHandler(w http.ResponseWriter, req *http.Request) {
+	body := struct {
+		SensorID int    `json:"sensor_id"`
+		CSR      string `json:"csr"`
+	}{}
+	if !apierror.DecodeStrict(w, req, &body) {
+		return
+	}
+	if ps.Redeem == nil {
+		apierror.Write(w, req, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized,
+			"certificates are only renewed"))
+		return
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	var (
+		issued   Issued
+		issueErr error
+	)
+	err := ps.Redeem(body.SensorID, token, func() error {
+		issued, issueErr = ps.ca.Issue(body.SensorID, []byte(body.CSR))
+		return issueErr
+	})
+	if err != nil && issueErr == nil {
+		apierror.Write(w, req, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, err.Error()))
+		return
+	}
+	ps.respond(w, req, issued, err)
+}
+
+// renewHandler issues a node, identified by its current certificate, the
+// next one. The old certificate stays valid until it expires.
+func (ps *pkiServer) renewHandler(w http.ResponseWriter, req *http.Request) {
+	id, ok := SensorFromContext(req.Context())
+	if !ok {
+		apierror.Write(w, req, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized,
+			"client certificate required"))
+		return
+	}
+	body := struct {
+		CSR string `json:"csr"`
+	}{}
+	if !apierror.DecodeStrict(w, req, &body) {
+		return
+	}
+	issued, err := ps.ca.Issue(id, []byte(body.CSR))
+	ps.respond(w, req, issued, err)
+}
+
+func (ps *pkiServer) respond(w http.ResponseWriter, req *http.Request, issued Issued, err error) {
+	if errors.Is(err, ErrInvalidCSR) {
+		apierror.Write(w, req, apierror.BadRequest("invalid_csr", err.Error()))
+		return
+	} else if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	render.JSON(w, req, issued)
+}
+
+// listCertificatesHandler lists the certificates issued, to one sensor
+// with ?sensor_id=.
+func (ps *pkiServer) listCertificatesHandler(w http.ResponseWriter, req *http.Request) {
+	id := 0
+	if v := req.URL.Query().Get("sensor_id"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			apierror.Write(w, req, apierror.BadRequest("invalid_sensor_id", "sensor_id must be a positive integer"))
+			return
+		}
+		id = n
+	}
+	certs, err := ps.ca.Certificates(id)
+	if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	render.JSON(w, req, certs)
+}
+
+func (ps *pkiServer) revokeHandler(w http.ResponseWriter, req *http.Request) {
+	body := struct {
+		Reason string `json:"reason"`
+	}{}
+	if req.ContentLength != 0 && !apierror.DecodeStrict(w, req, &body) {
+		return
+	}
+	c, err := ps.ca.Revoke(chi.URLParam(req, "serial"), body.Reason)
+	if errors.Is(err, ErrNotFound) {
+		apierror.Write(w, req, apierror.NotFound("certificate_not_found", err.Error()))
+		return
+	} else if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	render.JSON(w, req, c)
+}
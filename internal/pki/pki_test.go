@@ -0,0 +1,383 @@
+package pki
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"gorm.io/gorm"
+
+	"github.com/maskarb/skarbek-dev/internal/config"
+	"github.com/maskarb/skarbek-dev/internal/database"
+)
+
+func openDB(t *testing.T, dir string) *gorm.DB {
+	t.Helper()
+	db, err := database.Open(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close(db) })
+	return db
+}
+
+func testConfig(dir string) config.NodeTLSConfig {
+	cfg := config.Default().NodeTLS
+	cfg.Enabled = true
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.KeyFile = filepath.Join(dir, "ca", "node-ca.key")
+	return cfg
+}
+
+func newCA(t *testing.T) *CA {
+	t.Helper()
+	dir := t.TempDir()
+	ca, err := New(openDB(t, dir), testConfig(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+// nodeServer is the mutual TLS listener: it answers with the sensor ID
+// the client certificate names, and serves the node routes of ps.
+func nodeServer(t *testing.T, ps *pkiServer) *httptest.Server {
+	router := chi.NewRouter()
+	router.Use(ps.ca.Middleware)
+	router.Get("/whoami", func(w http.ResponseWriter, req *http.Request) {
+		id, _ := SensorFromContext(req.Context())
+		fmt.Fprint(w, id)
+	})
+	router.Route("/api/v1/node", ps.NodeRoutes)
+	srv := httptest.NewUnstartedServer(router)
+	srv.TLS = ps.ca.ServerTLSConfig()
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// client trusts ca and presents issued, if it has a key.
+func client(t *testing.T, ca *CA, issued *Issued, key []byte) *http.Client {
+	t.Helper()
+	conf := &tls.Config{RootCAs: ca.Pool()}
+	if issued != nil {
+		if key == nil {
+			key = []byte(issued.KeyPEM)
+		}
+		cert, err := tls.X509KeyPair([]byte(issued.CertificatePEM), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: conf, DisableKeepAlives: true}}
+}
+
+func whoami(c *http.Client, srv *httptest.Server) (string, error) {
+	resp, err := c.Get(srv.URL + "/whoami")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return string(b), err
+}
+
+func newCSR(t *testing.T) (csrPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader,
+		&x509.CertificateRequest{Subject: pkix.Name{CommonName: "sensor-1"}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	db, cfg := openDB(t, dir), testConfig(dir)
+	ca, err := New(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(cfg.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("key file mode = %v, want 0600", fi.Mode().Perm())
+	}
+	var a authority
+	if err := db.First(&a).Error; err != nil {
+		t.Fatal(err)
+	}
+	if a.KeyPEM != "" || strings.Contains(a.CertPEM, "PRIVATE KEY") {
+		t.Error("the ca key is in the database")
+	}
+
+	again, err := New(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.CertPEM(), ca.CertPEM()) {
+		t.Error("the ca changed when it was loaded again")
+	}
+
+	// Older versions kept the key in the database.
+	key, err := os.ReadFile(cfg.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(cfg.KeyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&a).Update("key_pem", string(key)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(db, cfg); err != nil {
+		t.Fatal(err)
+	}
+	moved, err := os.ReadFile(cfg.KeyFile)
+	if err != nil || !bytes.Equal(moved, key) {
+		t.Errorf("key file after moving the key out of the database = %q, %v", moved, err)
+	}
+	if err := db.First(&a).Error; err != nil {
+		t.Fatal(err)
+	}
+	if a.KeyPEM != "" {
+		t.Error("the ca key was left in the database")
+	}
+
+	other := t.TempDir()
+	if _, err := New(openDB(t, other), testConfig(other)); err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := os.ReadFile(testConfig(other).KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cfg.KeyFile, otherKey, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(db, cfg); err == nil {
+		t.Error("loaded the ca with the key of another")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newCA(t)
+	srv := nodeServer(t, NewPKIServer(ca))
+
+	generated, err := ca.Issue(7, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := whoami(client(t, ca, &generated, nil), srv); err != nil || got != "7" {
+		t.Errorf("with a generated key: %q, %v, want sensor 7", got, err)
+	}
+
+	csr, key := newCSR(t)
+	requested, err := ca.Issue(8, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requested.KeyPEM != "" {
+		t.Error("the key of a CSR was returned")
+	}
+	if requested.Subject != "CN=sensor-8,O=skarbek.dev nodes" {
+		t.Errorf("subject = %q, want the CSR's replaced", requested.Subject)
+	}
+	if got, err := whoami(client(t, ca, &requested, key), srv); err != nil || got != "8" {
+		t.Errorf("with a CSR: %q, %v, want sensor 8", got, err)
+	}
+
+	if _, err := ca.Issue(9, []byte("not a csr")); !errors.Is(err, ErrInvalidCSR) {
+		t.Errorf("bad CSR: err = %v, want ErrInvalidCSR", err)
+	}
+	if _, err := whoami(client(t, ca, nil, nil), srv); err == nil {
+		t.Error("handshake without a client certificate succeeded")
+	}
+	stranger := newCA(t)
+	foreign, err := stranger.Issue(7, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := whoami(client(t, ca, &foreign, nil), srv); err == nil {
+		t.Error("handshake with a certificate of another ca succeeded")
+	}
+
+	if _, err := ca.Revoke(generated.Serial, "lost"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := whoami(client(t, ca, &generated, nil), srv); err == nil {
+		t.Error("handshake with a revoked certificate succeeded")
+	}
+	if n, err := ca.RevokeSensor(8, "node revoked"); err != nil || n != 1 {
+		t.Fatalf("RevokeSensor = %d, %v, want 1", n, err)
+	}
+	if _, err := whoami(client(t, ca, &requested, key), srv); err == nil {
+		t.Error("handshake with a certificate of a revoked node succeeded")
+	}
+
+	der, err := ca.CRL(generated.NotBefore.Add(backdate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseDERCRL(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.cert.CheckCRLSignature(crl); err != nil {
+		t.Error(err)
+	}
+	if n := len(crl.TBSCertList.RevokedCertificates); n != 2 {
+		t.Errorf("crl lists %d certificates, want 2", n)
+	}
+}
+
+func postJSON(t *testing.T, c *http.Client, url, token string, body interface{}) (*http.Response, Issued) {
+	t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var issued Issued
+	if resp.StatusCode == http.StatusCreated {
+		if err := json.NewDecoder(resp.Body).Decode(&issued); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp, issued
+}
+
+// TestTokenGetsOneCertificate trades a device token for a certificate,
+// which the node then renews over mutual TLS.
+func TestTokenGetsOneCertificate(t *testing.T) {
+	ca := newCA(t)
+	ps := NewPKIServer(ca)
+	tokens := map[int]string{7: "skd_secret"}
+	ps.Redeem = func(id int, token string, issue func() error) error {
+		if tokens[id] == "" || tokens[id] != token {
+			return errors.New("invalid device token")
+		}
+		if err := issue(); err != nil {
+			return err
+		}
+		delete(tokens, id)
+		return nil
+	}
+	api := httptest.NewServer(ps.Routes())
+	t.Cleanup(api.Close)
+	srv := nodeServer(t, ps)
+	url := api.URL + "/certificates"
+
+	if resp, _ := postJSON(t, api.Client(), url, "skd_wrong", map[string]interface{}{"sensor_id": 7}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong token: status = %d, want 401", resp.StatusCode)
+	}
+	resp, _ := postJSON(t, api.Client(), url, "skd_secret", map[string]interface{}{"sensor_id": 7, "csr": "nope"})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad CSR: status = %d, want 400", resp.StatusCode)
+	}
+	resp, issued := postJSON(t, api.Client(), url, "skd_secret", map[string]interface{}{"sensor_id": 7})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want 201", resp.StatusCode)
+	}
+	if issued.CAPEM != string(ca.CertPEM()) || issued.KeyPEM == "" || !issued.RenewAfter.Before(issued.NotAfter) {
+		t.Errorf("issued = %+v", issued.Certificate)
+	}
+	if resp, _ := postJSON(t, api.Client(), url, "skd_secret", map[string]interface{}{"sensor_id": 7}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("token used twice: status = %d, want 401", resp.StatusCode)
+	}
+
+	csr, key := newCSR(t)
+	resp, renewed := postJSON(t, client(t, ca, &issued, nil), srv.URL+"/api/v1/node/certificate", "",
+		map[string]interface{}{"csr": string(csr)})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("renew: status = %d, want 201", resp.StatusCode)
+	}
+	if renewed.SensorID != 7 || renewed.Serial == issued.Serial {
+		t.Errorf("renewed = %+v, want a new certificate for sensor 7", renewed.Certificate)
+	}
+	if got, err := whoami(client(t, ca, &renewed, key), srv); err != nil || got != "7" {
+		t.Errorf("with the renewed certificate: %q, %v, want sensor 7", got, err)
+	}
+	certs, err := ca.Certificates(7)
+	if err != nil || len(certs) != 2 {
+		t.Errorf("certificates of sensor 7 = %d, %v, want 2", len(certs), err)
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	ca := newCA(t)
+	issued, err := ca.Issue(7, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := NewPKIServer(ca)
+	open := httptest.NewServer(ps.Routes())
+	t.Cleanup(open.Close)
+	resp, err := http.Get(open.URL + "/certificates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Error("certificates listed without an admin guard")
+	}
+	resp, _ = postJSON(t, open.Client(), open.URL+"/certificates/"+issued.Serial+"/revoke", "", map[string]string{})
+	if resp.StatusCode == http.StatusOK {
+		t.Error("certificate revoked without an admin guard")
+	}
+
+	ps.Admin = func(next http.Handler) http.Handler { return next }
+	guarded := httptest.NewServer(ps.Routes())
+	t.Cleanup(guarded.Close)
+	resp, err = http.Get(guarded.URL + "/certificates?sensor_id=7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var certs []Certificate
+	err = json.NewDecoder(resp.Body).Decode(&certs)
+	resp.Body.Close()
+	if err != nil || len(certs) != 1 || certs[0].Serial != issued.Serial {
+		t.Errorf("certificates = %+v, %v, want the one issued", certs, err)
+	}
+}
@@ -0,0 +1,89 @@
+package preferences
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/maskarb/skarbek-dev/internal/apierror"
+	"github.com/maskarb/skarbek-dev/internal/logging"
+	"github.com/maskarb/skarbek-dev/internal/session"
+	"github.com/maskarb/skarbek-dev/internal/units"
+)
+
+var logger = logging.For("auth")
+
+type preferenceServer struct {
+	store *PreferenceStore
+}
+
+// NewPreferenceServer serves the caller's preferences.
+func NewPreferenceServer(store *PreferenceStore) *preferenceServer {
+	return &preferenceServer{store: store}
+}
+
+// Routes is mounted under /api/v1/preferences.
+func (ps *preferenceServer) Routes() *chi.Mux {
+	router := chi.NewRouter()
+	router.Use(session.RequireSession)
+	router.Get("/", ps.getPreferencesHandler)
+	router.Put("/", ps.putPreferencesHandler)
+	return router
+}
+
+// preferencesResponse shows the stored units string next to what it
+// resolves to.
+type preferencesResponse struct {
+	Preference
+	UnitSystem units.System `json:"unit_system"`
+}
+
+func (ps *preferenceServer) getPreferencesHandler(w http.ResponseWriter, req *http.Request) {
+	p, _, err := ps.store.Get(session.FromContext(req.Context()).Email)
+	if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	render.JSON(w, req, preferencesResponse{p, p.UnitSystem()})
+}
+
+func (ps *preferenceServer) putPreferencesHandler(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Units string `json:"units"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		apierror.Write(w, req, apierror.BadRequest(apierror.CodeBadRequest, "invalid JSON body").WithCause(err))
+		return
+	}
+	sys, err := units.ParseSystem(body.Units)
+	if err != nil {
+		apierror.Write(w, req, apierror.BadRequest("invalid_units", err.Error()).
+			WithDetails(map[string]string{"units": body.Units}))
+		return
+	}
+	p, err := ps.store.SetUnits(session.FromContext(req.Context()).Email, sys)
+	if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	render.JSON(w, req, preferencesResponse{p, sys})
+}
+
+// Units returns the unit system saved by the logged in caller of r. It
+// matches sensor.UnitsPreference.
+func (ps *PreferenceStore) Units(r *http.Request) (units.System, bool) {
+	s := session.FromContext(r.Context())
+	if s == nil {
+		return units.System{}, false
+	}
+	p, found, err := ps.Get(s.Email)
+	if err != nil {
+		logger.Ctx(r.Context()).Error("load unit preference", "err", err)
+		return units.System{}, false
+	}
+	if !found {
+		return units.System{}, false
+	}
+	return p.UnitSystem(), true
+}
@@ -0,0 +1,65 @@
+package preferences
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/units"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Preference holds the display settings of one user.
+type Preference struct {
+	Email string `json:"-" gorm:"primaryKey"`
+	// Units is a units.ParseSystem string, e.g. "F,inHg,ft".
+	Units     string    `json:"units"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// UnitSystem parses Units, falling back to SI for empty or stale values.
+func (p Preference) UnitSystem() units.System {
+	sys, err := units.ParseSystem(p.Units)
+	if err != nil {
+		return units.SI
+	}
+	return sys
+}
+
+// PreferenceStore persists preferences in SQLite.
+type PreferenceStore struct {
+	db *gorm.DB
+}
+
+func NewPreferenceStore(db *gorm.DB) (*PreferenceStore, error) {
+	if err := db.AutoMigrate(&Preference{}); err != nil {
+		return nil, fmt.Errorf("migrate preferences: %v", err)
+	}
+	return &PreferenceStore{db: db}, nil
+}
+
+// Get returns the preferences of email. Users who never saved any get the
+// defaults and found is false.
+func (ps *PreferenceStore) Get(email string) (p Preference, found bool, err error) {
+	err = ps.db.Where("email = ?", email).First(&p).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Preference{Email: email, Units: units.SI.String()}, false, nil
+	} else if err != nil {
+		return Preference{}, false, fmt.Errorf("load preferences: %v", err)
+	}
+	return p, true, nil
+}
+
+// SetUnits saves the unit system of email.
+func (ps *PreferenceStore) SetUnits(email string, sys units.System) (Preference, error) {
+	p := Preference{Email: email, Units: sys.String(), UpdatedAt: time.Now().UTC()}
+	err := ps.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "email"}},
+		DoUpdates: clause.AssignmentColumns([]string{"units", "updated_at"}),
+	}).Create(&p).Error
+	if err != nil {
+		return Preference{}, fmt.Errorf("save preferences: %v", err)
+	}
+	return p, nil
+}
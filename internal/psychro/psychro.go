@@ -0,0 +1,100 @@
+// Package psychro derives moist air metrics from temperature, relative
+// humidity and pressure. Temperatures are °C, humidity %RH and pressures
+// Pa throughout, matching what the sensors report.
+package psychro
+
+import "math"
+
+const (
+	// Magnus coefficients over water (Alduchov & Eskridge 1996), valid
+	// from -40 to 50 °C.
+	magnusA = 6.1094 // hPa
+	magnusB = 17.625
+	magnusC = 243.04 // °C
+
+	// waterVapourGasConstant is R_v in J/(kg·K).
+	waterVapourGasConstant = 461.5
+	// molarMassRatio is M_water / M_dry_air.
+	molarMassRatio = 0.62198
+)
+
+// SaturationVapourPressure is the saturation vapour pressure over water at
+// tC, in Pa.
+func SaturationVapourPressure(tC float64) float64 {
+	return magnusA * math.Exp(magnusB*tC/(tC+magnusC)) * 100
+}
+
+// enhancement corrects the pure water vapour pressure for moist air at
+// pressure p in Pa (Buck 1981). It is about 1.004 at sea level.
+func enhancement(p float64) float64 {
+	if p <= 0 {
+		return 1
+	}
+	return 1.0007 + 3.46e-6*p/100
+}
+
+// VapourPressure is the partial pressure of water vapour in Pa at tC and
+// rh. p is the air pressure in Pa, or 0 when unknown.
+func VapourPressure(tC, rh, p float64) float64 {
+	return rh / 100 * SaturationVapourPressure(tC) * enhancement(p)
+}
+
+// DewPoint is the temperature in °C at which the air at tC and rh would
+// saturate.
+func DewPoint(tC, rh float64) float64 {
+	if rh <= 0 {
+		return math.Inf(-1)
+	}
+	g := math.Log(rh/100) + magnusB*tC/(magnusC+tC)
+	return magnusC * g / (magnusB - g)
+}
+
+// AbsoluteHumidity is the water vapour density in g/m³.
+func AbsoluteHumidity(tC, rh, p float64) float64 {
+	e := VapourPressure(tC, rh, p)
+	return e / (waterVapourGasConstant * (tC + 273.15)) * 1000
+}
+
+// MixingRatio is grams of water vapour per kilogram of dry air at pressure
+// p in Pa.
+func MixingRatio(tC, rh, p float64) float64 {
+	e := VapourPressure(tC, rh, p)
+	if p <= e {
+		return math.NaN()
+	}
+	return molarMassRatio * e / (p - e) * 1000
+}
+
+// VapourPressureDeficit is how far the air is from saturation, in Pa,
+// assuming leaf temperature equals air temperature.
+func VapourPressureDeficit(tC, rh float64) float64 {
+	return SaturationVapourPressure(tC) * (1 - rh/100)
+}
+
+// HeatIndex is the apparent temperature in °C by the US National Weather
+// Service algorithm: Steadman's simple formula, the Rothfusz regression
+// above 80 °F and the NWS low and high humidity adjustments.
+func HeatIndex(tC, rh float64) float64 {
+	t := tC*9/5 + 32
+	hi := 0.5 * (t + 61 + (t-68)*1.2 + rh*0.094)
+	if (hi+t)/2 >= 80 {
+		hi = -42.379 + 2.04901523*t + 10.14333127*rh -
+			0.22475541*t*rh - 6.83783e-3*t*t - 5.481717e-2*rh*rh +
+			1.22874e-3*t*t*rh + 8.5282e-4*t*rh*rh - 1.99e-6*t*t*rh*rh
+		switch {
+		case rh < 13 && t >= 80 && t <= 112:
+			hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+		case rh > 85 && t >= 80 && t <= 87:
+			hi += (rh - 85) / 10 * (87 - t) / 5
+		}
+	}
+	return (hi - 32) * 5 / 9
+}
+
+// Humidex is the Canadian humidity index, a dimensionless number on the
+// °C scale, computed from the dew point (Masterton & Richardson 1979).
+func Humidex(tC, rh float64) float64 {
+	td := DewPoint(tC, rh)
+	e := 6.11 * math.Exp(5417.7530*(1/273.16-1/(273.15+td)))
+	return tC + 0.5555*(e-10)
+}
@@ -0,0 +1,190 @@
+package psychro
+
+import (
+	"math"
+	"testing"
+)
+
+func near(got, want, tol float64) bool {
+	return math.Abs(got-want) <= tol
+}
+
+// Saturation vapour pressure over liquid water, Pa, from the IAPWS
+// formulation as tabulated in the CRC Handbook (supercooled water below
+// 0 °C).
+var saturationTable = []struct{ tC, pa float64 }{
+	{-20, 125.6},
+	{-10, 286.5},
+	{0, 611.2},
+	{10, 1228.1},
+	{20, 2339.2},
+	{25, 3169.9},
+	{30, 4246.0},
+	{40, 7384.9},
+	{50, 12352},
+}
+
+func TestSaturationVapourPressureTable(t *testing.T) {
+	for _, row := range saturationTable {
+		got := SaturationVapourPressure(row.tC)
+		// Magnus is good to a few tenths of a percent over its range.
+		if !near(got, row.pa, row.pa*0.005) {
+			t.Errorf("SaturationVapourPressure(%v) = %.1f Pa, want %.1f ±0.5%%", row.tC, got, row.pa)
+		}
+	}
+}
+
+func TestSaturationVapourPressureIncreasing(t *testing.T) {
+	prev := SaturationVapourPressure(-40)
+	for tC := -39.5; tC <= 50; tC += 0.5 {
+		cur := SaturationVapourPressure(tC)
+		if cur <= prev {
+			t.Fatalf("not increasing at %v °C: %v <= %v", tC, cur, prev)
+		}
+		prev = cur
+	}
+}
+
+// Dew points from the NOAA dew point calculator.
+var dewPointTable = []struct{ tC, rh, dew float64 }{
+	{20, 50, 9.3},
+	{25, 60, 16.7},
+	{30, 80, 26.2},
+	{10, 90, 8.4},
+	{0, 70, -4.8},
+	{35, 20, 8.7},
+}
+
+func TestDewPointTable(t *testing.T) {
+	for _, row := range dewPointTable {
+		if got := DewPoint(row.tC, row.rh); !near(got, row.dew, 0.2) {
+			t.Errorf("DewPoint(%v, %v) = %.2f, want %.1f", row.tC, row.rh, got, row.dew)
+		}
+	}
+}
+
+// TestDewPointProperties checks that the air saturates at its dew point,
+// that the dew point never exceeds the temperature and equals it at
+// 100 %RH, over the range Magnus covers.
+func TestDewPointProperties(t *testing.T) {
+	for tC := -40.0; tC <= 50; tC += 2.5 {
+		for rh := 1.0; rh <= 100; rh += 3 {
+			dp := DewPoint(tC, rh)
+			if dp > tC+1e-9 {
+				t.Fatalf("DewPoint(%v, %v) = %v above the temperature", tC, rh, dp)
+			}
+			want := rh / 100 * SaturationVapourPressure(tC)
+			if got := SaturationVapourPressure(dp); !near(got, want, want*1e-9) {
+				t.Fatalf("saturation at DewPoint(%v, %v) = %v Pa, want %v", tC, rh, got, want)
+			}
+		}
+		if dp := DewPoint(tC, 100); !near(dp, tC, 1e-9) {
+			t.Errorf("DewPoint(%v, 100) = %v", tC, dp)
+		}
+	}
+	if !math.IsInf(DewPoint(20, 0), -1) {
+		t.Error("DewPoint at 0 %RH is not -Inf")
+	}
+}
+
+// Moist air at sea level, from the ASHRAE psychrometric chart.
+var moistAirTable = []struct {
+	tC, rh           float64
+	absolute, mixing float64 // g/m³, g/kg
+}{
+	{20, 50, 8.65, 7.3},
+	{25, 50, 11.5, 9.9},
+	{30, 100, 30.4, 27.3},
+	{10, 80, 7.5, 6.1},
+}
+
+func TestMoistAirTable(t *testing.T) {
+	for _, row := range moistAirTable {
+		if got := AbsoluteHumidity(row.tC, row.rh, 101325); !near(got, row.absolute, row.absolute*0.02) {
+			t.Errorf("AbsoluteHumidity(%v, %v) = %.2f g/m³, want %.2f", row.tC, row.rh, got, row.absolute)
+		}
+		if got := MixingRatio(row.tC, row.rh, 101325); !near(got, row.mixing, row.mixing*0.02) {
+			t.Errorf("MixingRatio(%v, %v) = %.2f g/kg, want %.2f", row.tC, row.rh, got, row.mixing)
+		}
+	}
+}
+
+func TestMixingRatioProperties(t *testing.T) {
+	for tC := -20.0; tC <= 40; tC += 5 {
+		prev := 0.0
+		for rh := 5.0; rh <= 100; rh += 5 {
+			w := MixingRatio(tC, rh, 101325)
+			if w <= prev {
+				t.Fatalf("MixingRatio(%v, %v) = %v not above %v", tC, rh, w, prev)
+			}
+			prev = w
+			// Lower pressure holds more vapour per kilogram of dry air.
+			if high := MixingRatio(tC, rh, 70000); high <= w {
+				t.Fatalf("MixingRatio(%v, %v) at 700 hPa = %v, not above %v", tC, rh, high, w)
+			}
+		}
+	}
+	if w := MixingRatio(20, 50, 1000); !math.IsNaN(w) {
+		t.Errorf("MixingRatio below the vapour pressure = %v, want NaN", w)
+	}
+}
+
+func TestVapourPressureDeficit(t *testing.T) {
+	for tC := 0.0; tC <= 40; tC += 5 {
+		if vpd := VapourPressureDeficit(tC, 100); vpd != 0 {
+			t.Errorf("VapourPressureDeficit(%v, 100) = %v", tC, vpd)
+		}
+		es := SaturationVapourPressure(tC)
+		if vpd := VapourPressureDeficit(tC, 0); vpd != es {
+			t.Errorf("VapourPressureDeficit(%v, 0) = %v, want %v", tC, vpd, es)
+		}
+	}
+}
+
+// Heat index chart of the US National Weather Service, °F.
+var heatIndexTable = []struct{ tF, rh, hiF float64 }{
+	{80, 40, 80},
+	{86, 90, 105},
+	{90, 70, 106},
+	{96, 65, 121},
+	{100, 50, 118},
+	{110, 40, 136},
+}
+
+func TestHeatIndexTable(t *testing.T) {
+	for _, row := range heatIndexTable {
+		tC := (row.tF - 32) * 5 / 9
+		got := HeatIndex(tC, row.rh)*9/5 + 32
+		// The chart is rounded to whole degrees.
+		if !near(got, row.hiF, 1.5) {
+			t.Errorf("HeatIndex(%v °F, %v) = %.1f °F, want %v", row.tF, row.rh, got, row.hiF)
+		}
+	}
+}
+
+func TestHeatIndexMild(t *testing.T) {
+	// Below about 80 °F the simple formula keeps the index near the
+	// temperature.
+	for tC := 10.0; tC <= 25; tC++ {
+		if hi := HeatIndex(tC, 50); !near(hi, tC, 2.5) {
+			t.Errorf("HeatIndex(%v, 50) = %.2f", tC, hi)
+		}
+	}
+}
+
+// Humidex from Environment Canada's table, by dew point.
+var humidexTable = []struct{ tC, dew, humidex float64 }{
+	{30, 15, 34},
+	{30, 20, 37},
+	{30, 25, 42},
+	{25, 20, 33},
+}
+
+func TestHumidexTable(t *testing.T) {
+	for _, row := range humidexTable {
+		rh := 100 * SaturationVapourPressure(row.dew) / SaturationVapourPressure(row.tC)
+		if got := Humidex(row.tC, rh); !near(got, row.humidex, 0.6) {
+			t.Errorf("Humidex(%v, dew point %v) = %.2f, want %v", row.tC, row.dew, got, row.humidex)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package sensor
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Quantities that can be calibrated.
+const (
+	QuantityTemperature = "temperature"
+	QuantityHumidity    = "humidity"
+	QuantityPressure    = "pressure"
+)
+
+// ErrCalibration is wrapped by errors caused by bad calibration input.
+var ErrCalibration = errors.New("invalid calibration")
+
+// Linear corrects a raw value as Gain*raw + Offset.
+type Linear struct {
+	Gain   float64 `json:"gain"`
+	Offset float64 `json:"offset"`
+}
+
+var identity = Linear{Gain: 1}
+
+func (l Linear) apply(raw float32) float32 {
+	return float32(l.Gain*float64(raw) + l.Offset)
+}
+
+// Calibration is one version of a sensor's coefficients. Versions are never
+// changed once written; a new calibration adds a version, so the history
+// shows which coefficients applied to readings taken at any time.
+type Calibration struct {
+	ID       uint `json:"-" gorm:"primaryKey"`
+	SensorID int  `json:"sensor_id" gorm:"uniqueIndex:idx_calibration_version;not null"`
+	// Version counts up from 1 per sensor; 0 means uncalibrated.
+	Version     int    `json:"version" gorm:"uniqueIndex:idx_calibration_version;not null"`
+	Temperature Linear `json:"temperature" gorm:"embedded;embeddedPrefix:temperature_"`
+	Humidity    Linear `json:"humidity" gorm:"embedded;embeddedPrefix:humidity_"`
+	Pressure    Linear `json:"pressure" gorm:"embedded;embeddedPrefix:pressure_"`
+	// Method is "manual" or "two-point".
+	Method    string    `json:"method"`
+	Note      string    `json:"note,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	ValidFrom time.Time `json:"valid_from"`
+	// ValidUntil is when the next version replaced this one.
+	ValidUntil *time.Time `json:"valid_until,omitempty" gorm:"-"`
+}
+
+// uncalibrated is what sensors without any version use.
+func uncalibrated(sensorID int) Calibration {
+	return Calibration{SensorID: sensorID, Temperature: identity, Humidity: identity, Pressure: identity}
+}
+
+func (c *Calibration) quantity(name string) *Linear {
+	switch name {
+	case QuantityTemperature:
+		return &c.Temperature
+	case QuantityHumidity:
+		return &c.Humidity
+	case QuantityPressure:
+		return &c.Pressure
+	}
+	return nil
+}
+
+// offsetLimits bound the correction per quantity, in °C, %RH and Pa. A
+// board off by more than this needs replacing, not calibrating.
+var offsetLimits = map[string]float64{
+	QuantityTemperature: 10,
+	QuantityHumidity:    20,
+	QuantityPressure:    2000,
+}
+
+// Validate rejects coefficients outside what a working sensor needs.
+func (c Calibration) Validate() error {
+	for name, limit := range offsetLimits {
+		l := *c.quantity(name)
+		if math.IsNaN(l.Gain) || l.Gain < 0.5 || l.Gain > 1.5 {
+			return fmt.Errorf("%w: %s gain %v is outside 0.5..1.5", ErrCalibration, name, l.Gain)
+		}
+		if math.IsNaN(l.Offset) || math.Abs(l.Offset) > limit {
+			return fmt.Errorf("%w: %s offset %v is outside ±%v", ErrCalibration, name, l.Offset, limit)
+		}
+	}
+	return nil
+}
+
+// Raw are values before calibration.
+type Raw struct {
+	Temperature *float32
+	Humidity    *float32
+	Pressure    *float32
+}
+
+func (r Raw) quantity(name string) *float32 {
+	switch name {
+	case QuantityTemperature:
+		return r.Temperature
+	case QuantityHumidity:
+		return r.Humidity
+	case QuantityPressure:
+		return r.Pressure
+	}
+	return nil
+}
+
+// calibrate fills the sensor's values from raw using its calibration.
+func (s *Sensor) calibrate(raw Raw) {
+	c := s.Calibration
+	if c.Version == 0 {
+		c = uncalibrated(c.SensorID)
+	}
+	s.Temperature = applyTo(raw.Temperature, c.Temperature)
+	s.Pressue = applyTo(raw.Pressure, c.Pressure)
+	s.Humidity = applyTo(raw.Humidity, c.Humidity)
+	if h := s.Humidity; h != nil {
+		*h = float32(math.Max(0, math.Min(100, float64(*h))))
+	}
+}
+
+func applyTo(raw *float32, l Linear) *float32 {
+	if raw == nil {
+		return nil
+	}
+	v := l.apply(*raw)
+	return &v
+}
+
+// CalibrationPoint is a reference value observed at one condition, paired
+// with what the sensor read at the same time. Two points of a quantity
+// make a two-point calibration.
+type CalibrationPoint struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	SensorID  int       `json:"sensor_id" gorm:"index;not null"`
+	Quantity  string    `json:"quantity" gorm:"not null"`
+	Reference float64   `json:"reference"`
+	Raw       float64   `json:"raw"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TwoPoint solves reference = Gain*raw + Offset through p1 and p2.
+func TwoPoint(p1, p2 CalibrationPoint) (Linear, error) {
+	if math.Abs(p2.Raw-p1.Raw) < 1e-3 {
+		return Linear{}, fmt.Errorf("%w: the two points were read at the same raw value %v; take them at different conditions", ErrCalibration, p1.Raw)
+	}
+	gain := (p2.Reference - p1.Reference) / (p2.Raw - p1.Raw)
+	return Linear{Gain: gain, Offset: p1.Reference - gain*p1.Raw}, nil
+}
+
+func (ss *SensorStore) loadCalibrations() error {
+	if err := ss.db.AutoMigrate(&Calibration{}, &CalibrationPoint{}); err != nil {
+		return fmt.Errorf("migrate sensor calibrations: %v", err)
+	}
+	for id, s := range ss.sensors {
+		c, err := ss.currentCalibration(id)
+		if err != nil {
+			return err
+		}
+		s.Calibration = c
+	}
+	return nil
+}
+
+func (ss *SensorStore) currentCalibration(id int) (Calibration, error) {
+	var c Calibration
+	err := ss.db.Where("sensor_id = ?", id).Order("version desc").First(&c).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return uncalibrated(id), nil
+	} else if err != nil {
+		return Calibration{}, fmt.Errorf("load calibration of sensor %d: %v", id, err)
+	}
+	return c, nil
+}
+
+// Calibration returns the coefficients sensor id currently uses.
+func (ss *SensorStore) Calibration(id int) (Calibration, error) {
+	ss.Lock()
+	defer ss.Unlock()
+	s, ok := ss.sensors[id]
+	if !ok {
+		return Calibration{}, fmt.Errorf("sensor with id=%d: %w", id, ErrNotFound)
+	}
+	return s.Calibration, nil
+}
+
+// CalibrationHistory returns every version for sensor id, newest first,
+// with ValidUntil filled in.
+func (ss *SensorStore) CalibrationHistory(id int) ([]Calibration, error) {
+	var all []Calibration
+	if err := ss.db.Where("sensor_id = ?", id).Order("version desc").Find(&all).Error; err != nil {
+		return nil, fmt.Errorf("load calibration history: %v", err)
+	}
+	for i := 1; i < len(all); i++ {
+		until := all[i-1].ValidFrom
+		all[i].ValidUntil = &until
+	}
+	return all, nil
+}
+
+// AddCalibration stores c as the next version for its sensor and applies
+// it from the next reading.
+func (ss *SensorStore) AddCalibration(c Calibration) (Calibration, error) {
+	if err := c.Validate(); err != nil {
+		return Calibration{}, err
+	}
+	ss.Lock()
+	defer ss.Unlock()
+	return ss.addCalibrationLocked(ss.db, c)
+}
+
+func (ss *SensorStore) addCalibrationLocked(tx *gorm.DB, c Calibration) (Calibration, error) {
+	s, ok := ss.sensors[c.SensorID]
+	if !ok {
+		return Calibration{}, fmt.Errorf("sensor with id=%d: %w", c.SensorID, ErrNotFound)
+	}
+	c.ID = 0
+	c.Version = s.Calibration.Version + 1
+	c.ValidFrom = time.Now().UTC()
+	c.ValidUntil = nil
+	if err := tx.Create(&c).Error; err != nil {
+		return Calibration{}, fmt.Errorf("save calibration: %v", err)
+	}
+	s.Calibration = c
+	return c, nil
+}
+
+// AddCalibrationPoint records a reference observation for a two-point
+// calibration.
+func (ss *SensorStore) AddCalibrationPoint(p CalibrationPoint) (CalibrationPoint, error) {
+	if _, ok := offsetLimits[p.Quantity]; !ok {
+		return CalibrationPoint{}, fmt.Errorf("%w: unknown quantity %q", ErrCalibration, p.Quantity)
+	}
+	p.ID = 0
+	p.CreatedAt = time.Now().UTC()
+	if err := ss.db.Create(&p).Error; err != nil {
+		return CalibrationPoint{}, fmt.Errorf("save calibration point: %v", err)
+	}
+	return p, nil
+}
+
+// CalibrationPoints lists the points not yet used by a calibration.
+func (ss *SensorStore) CalibrationPoints(id int) ([]CalibrationPoint, error) {
+	var points []CalibrationPoint
+	if err := ss.db.Where("sensor_id = ?", id).Order("created_at").Find(&points).Error; err != nil {
+		return nil, fmt.Errorf("load calibration points: %v", err)
+	}
+	return points, nil
+}
+
+// CalibrateTwoPoint fits quantity of sensor id through its two most recent
+// points, stores the result as a new version keeping the other
+// quantities, and discards the points of that quantity.
+func (ss *SensorStore) CalibrateTwoPoint(id int, quantity, note, user string) (Calibration, error) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	s, ok := ss.sensors[id]
+	if !ok {
+		return Calibration{}, fmt.Errorf("sensor with id=%d: %w", id, ErrNotFound)
+	}
+	var points []CalibrationPoint
+	err := ss.db.Where("sensor_id = ? AND quantity = ?", id, quantity).
+		Order("created_at desc").Limit(2).Find(&points).Error
+	if err != nil {
+		return Calibration{}, fmt.Errorf("load calibration points: %v", err)
+	}
+	if len(points) < 2 {
+		return Calibration{}, fmt.Errorf("%w: %s needs two points, have %d", ErrCalibration, quantity, len(points))
+	}
+	fit, err := TwoPoint(points[1], points[0])
+	if err != nil {
+		return Calibration{}, err
+	}
+
+	next := s.Calibration
+	*next.quantity(quantity) = fit
+	next.Method = "two-point"
+	next.Note = note
+	next.CreatedBy = user
+	if err := next.Validate(); err != nil {
+		return Calibration{}, err
+	}
+
+	var out Calibration
+	err = ss.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if out, err = ss.addCalibrationLocked(tx, next); err != nil {
+			return err
+		}
+		return tx.Where("sensor_id = ? AND quantity = ?", id, quantity).Delete(&CalibrationPoint{}).Error
+	})
+	if err != nil {
+		s.Calibration, _ = ss.currentCalibration(id)
+		return Calibration{}, err
+	}
+	return out, nil
+}
@@ -0,0 +1,158 @@
+package sensor
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/bme280"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Driver is the saved driver settings of a sensor, overriding the
+// configured sensor.driver defaults.
+type Driver struct {
+	SensorID        int `gorm:"primaryKey"`
+	bme280.Settings `gorm:"embedded"`
+	UpdatedAt       time.Time
+}
+
+// DriverStatus shows the settings a sensor was asked for next to what the
+// chip's registers hold. Effective differs from Settings when the chip
+// ignored a write; in forced mode its mode reads "sleep" between
+// measurements.
+type DriverStatus struct {
+	SensorID int             `json:"sensor_id"`
+	Settings bme280.Settings `json:"settings"`
+	// Source is "config" for the configured defaults or "saved" for
+	// settings set through the API.
+	Source    string     `json:"source"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+
+	Registers *bme280.Registers `json:"registers,omitempty"`
+	Effective *bme280.Settings  `json:"effective,omitempty"`
+	// MeasurementTime is the longest one measurement takes. In normal mode
+	// a new sample is ready every SamplePeriod.
+	MeasurementTime float64 `json:"measurement_time_ms"`
+	SamplePeriod    float64 `json:"sample_period_ms,omitempty"`
+}
+
+func (ss *SensorStore) loadDrivers() error {
+	if err := ss.db.AutoMigrate(&Driver{}); err != nil {
+		return fmt.Errorf("migrate sensor drivers: %v", err)
+	}
+	var drivers []Driver
+	if err := ss.db.Find(&drivers).Error; err != nil {
+		return fmt.Errorf("load sensor drivers: %v", err)
+	}
+	for _, d := range drivers {
+		s, ok := ss.sensors[d.SensorID]
+		if !ok || s.dev == nil {
+			continue
+		}
+		if err := s.configure(d.Settings); err != nil {
+			// A bad row must not keep the sensor offline; it stays on the
+			// configured defaults.
+			logger.Error("apply saved driver settings", "sensor_id", d.SensorID, "err", err)
+		}
+	}
+	return nil
+}
+
+// DriverStatus reads the driver settings of sensor id back from the chip.
+func (ss *SensorStore) DriverStatus(id int) (DriverStatus, error) {
+	ss.Lock()
+	defer ss.Unlock()
+	return ss.driverStatusLocked(id)
+}
+
+func (ss *SensorStore) driverStatusLocked(id int) (DriverStatus, error) {
+	s, ok := ss.sensors[id]
+	if !ok {
+		return DriverStatus{}, fmt.Errorf("sensor with id=%d: %w", id, ErrNotFound)
+	}
+	st := DriverStatus{SensorID: id, Settings: ss.driverDefaults, Source: "config"}
+	var saved Driver
+	err := ss.db.First(&saved, "sensor_id = ?", id).Error
+	if err == nil {
+		st.Settings, st.Source, st.UpdatedAt = saved.Settings, "saved", &saved.UpdatedAt
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return DriverStatus{}, fmt.Errorf("load sensor driver: %v", err)
+	}
+	if s.dev != nil {
+		st.Settings = s.dev.Settings()
+		regs, err := s.dev.Registers()
+		if err != nil {
+			return DriverStatus{}, err
+		}
+		effective := regs.Settings()
+		st.Registers, st.Effective = &regs, &effective
+	}
+	st.MeasurementTime = st.Settings.MeasurementTime()
+	if st.Settings.Mode == bme280.ModeNormal {
+		st.SamplePeriod = st.MeasurementTime + float64(st.Settings.Standby)
+	}
+	return st, nil
+}
+
+// SetDriver applies settings to the chip of sensor id and saves them so
+// they survive restarts.
+func (ss *SensorStore) SetDriver(id int, settings bme280.Settings) (DriverStatus, error) {
+	if err := settings.Validate(); err != nil {
+		return DriverStatus{}, err
+	}
+	ss.Lock()
+	defer ss.Unlock()
+
+	s, ok := ss.sensors[id]
+	if !ok {
+		return DriverStatus{}, fmt.Errorf("sensor with id=%d: %w", id, ErrNotFound)
+	}
+	if s.dev != nil {
+		if err := s.configure(settings); err != nil {
+			return DriverStatus{}, err
+		}
+	}
+	d := Driver{SensorID: id, Settings: settings, UpdatedAt: time.Now().UTC()}
+	if err := ss.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&d).Error; err != nil {
+		return DriverStatus{}, fmt.Errorf("save sensor driver: %v", err)
+	}
+	return ss.driverStatusLocked(id)
+}
+
+// ResetDriver forgets the saved settings of sensor id and returns it to
+// the configured defaults.
+func (ss *SensorStore) ResetDriver(id int) (DriverStatus, error) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	s, ok := ss.sensors[id]
+	if !ok {
+		return DriverStatus{}, fmt.Errorf("sensor with id=%d: %w", id, ErrNotFound)
+	}
+	if err := ss.db.Delete(&Driver{}, "sensor_id = ?", id).Error; err != nil {
+		return DriverStatus{}, fmt.Errorf("delete sensor driver: %v", err)
+	}
+	if s.dev != nil {
+		if err := s.configure(ss.driverDefaults); err != nil {
+			return DriverStatus{}, err
+		}
+	}
+	return ss.driverStatusLocked(id)
+}
+
+// configure applies settings to the chip of s. Configure puts the chip to
+// sleep before writing, so when a write fails the previous settings are
+// written back rather than leaving it asleep on the same bus handle.
+func (s *Sensor) configure(settings bme280.Settings) error {
+	prev := s.dev.Settings()
+	err := s.dev.Configure(settings)
+	if err == nil {
+		return nil
+	}
+	if rerr := s.dev.Configure(prev); rerr != nil {
+		logger.Error("restore driver settings", "err", rerr)
+	}
+	return err
+}
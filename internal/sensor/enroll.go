@@ -0,0 +1,308 @@
+package sensor
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// codeAlphabet leaves out letters and digits that are easily confused
+// when a code is typed from a screen: 0/O, 1/I/L and U.
+const codeAlphabet = "23456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var (
+	// ErrBadEnrollment is returned for enrollment codes that are unknown,
+	// expired or already used.
+	ErrBadEnrollment = errors.New("enrollment code is invalid, expired or used")
+	// ErrNotPending is returned when approving a node that is not pending.
+	ErrNotPending = errors.New("node is not pending approval")
+	// ErrNodeExists is returned when a node enrolls under the name of an
+	// existing node with a code that was not created for it.
+	ErrNodeExists = errors.New("node is already enrolled")
+)
+
+// Enrollment is a one-time code an admin hands to a new node. The node
+// trades it for its sensor ID and device token, and then waits as a
+// pending node until an admin approves it. Only the hash of the code is
+// stored.
+type Enrollment struct {
+	ID        string     `json:"id" gorm:"primaryKey"`
+	CodeHash  string     `json:"-" gorm:"uniqueIndex;not null"`
+	CreatedBy string     `json:"created_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	// SensorID is the node that used the code, or, set when the code is
+	// created, the existing node it re-enrolls; no other node can use it
+	// then.
+	SensorID *int `json:"sensor_id,omitempty"`
+}
+
+// Enrolled is what a node gets for its enrollment code.
+type Enrolled struct {
+	SensorID int    `json:"sensor_id"`
+	NodeID   string `json:"node_id"`
+	Status   string `json:"status"`
+	Token    string `json:"token"`
+}
+
+func (ss *SensorStore) loadEnrollments() error {
+	if err := ss.db.AutoMigrate(&Enrollment{}); err != nil {
+		return fmt.Errorf("migrate enrollments: %v", err)
+	}
+	return nil
+}
+
+// CreateEnrollment issues an enrollment code valid for the configured
+// time. The code is only returned here. With a sensorID, the code only
+// re-enrolls that node, which must push over HTTP.
+func (ss *SensorStore) CreateEnrollment(createdBy string, sensorID *int) (Enrollment, string, error) {
+	if sensorID != nil {
+		ss.Lock()
+		s, err := ss.nodeByIDLocked(*sensorID)
+		if err == nil && s.node.Source != SourceHTTP {
+			err = fmt.Errorf("sensor with id=%d: %w", *sensorID, ErrNotNode)
+		}
+		ss.Unlock()
+		if err != nil {
+			return Enrollment{}, "", err
+		}
+	}
+	code, err := newEnrollmentCode()
+	if err != nil {
+		return Enrollment{}, "", err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Enrollment{}, "", fmt.Errorf("generate enrollment id: %v", err)
+	}
+	now := time.Now().UTC()
+	e := Enrollment{
+		ID:        hex.EncodeToString(id),
+		CodeHash:  hashToken(normalizeCode(code)),
+		CreatedBy: createdBy,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ss.enrollmentTTL),
+		SensorID:  sensorID,
+	}
+	if err := ss.db.Create(&e).Error; err != nil {
+		return Enrollment{}, "", fmt.Errorf("save enrollment: %v", err)
+	}
+	return e, code, nil
+}
+
+// Enrollments lists the enrollment codes issued in the last day and those
+// still valid, newest first.
+func (ss *SensorStore) Enrollments() ([]Enrollment, error) {
+	enrollments := []Enrollment{}
+	err := ss.db.Where("created_at >= ? OR expires_at >= ?", time.Now().Add(-24*time.Hour), time.Now()).
+		Order("created_at desc").Find(&enrollments).Error
+	if err != nil {
+		return nil, fmt.Errorf("load enrollments: %v", err)
+	}
+	return enrollments, nil
+}
+
+// LookupEnrollment finds the enrollment of code, used or not.
+func (ss *SensorStore) LookupEnrollment(code string) (Enrollment, error) {
+	var e Enrollment
+	err := ss.db.First(&e, "code_hash = ?", hashToken(normalizeCode(code))).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return e, ErrBadEnrollment
+	} else if err != nil {
+		return e, fmt.Errorf("load enrollment: %v", err)
+	}
+	return e, nil
+}
+
+// Enroll uses up code and gives node nodeID, as it calls itself, a sensor
+// ID and a device token. The node is pending until approved. A node that
+// enrolls again, after a factory reset say, needs a code created for its
+// sensor ID; it keeps the ID, gets a new token and has to be approved
+// again. Using the code, saving the node and its token is one
+// transaction.
+func (ss *SensorStore) Enroll(code, nodeID string, quantities QuantityList) (Enrolled, error) {
+	for _, q := range quantities {
+		if _, ok := plausible[q]; !ok {
+			return Enrolled{}, fmt.Errorf("%w: unknown quantity %q", ErrInvalidReading, q)
+		}
+	}
+	if strings.TrimSpace(nodeID) == "" {
+		return Enrolled{}, fmt.Errorf("%w: node_id is required", ErrInvalidReading)
+	}
+	token, err := newDeviceToken()
+	if err != nil {
+		return Enrolled{}, err
+	}
+
+	ss.Lock()
+	defer ss.Unlock()
+
+	var existing *Sensor
+	for _, s := range ss.sensors {
+		if s.node != nil && s.node.Source == SourceHTTP && s.node.NodeID == nodeID {
+			existing = s
+		}
+	}
+	n := &Node{Source: SourceHTTP, NodeID: nodeID}
+	if existing != nil {
+		*n = *existing.node
+	} else if n.SensorID, err = ss.freeNodeIDLocked(); err != nil {
+		return Enrolled{}, err
+	}
+	n.Status, n.Quantities, n.TokenHash = NodePending, quantities, hashToken(token)
+	n.ApprovedBy, n.ApprovedAt, n.RevokedAt = "", nil, nil
+
+	now := time.Now().UTC()
+	err = ss.db.Transaction(func(tx *gorm.DB) error {
+		var e Enrollment
+		err := tx.First(&e, "code_hash = ? AND used_at IS NULL AND expires_at > ?",
+			hashToken(normalizeCode(code)), now).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrBadEnrollment
+		} else if err != nil {
+			return fmt.Errorf("load enrollment: %v", err)
+		}
+		switch {
+		case e.SensorID != nil && (existing == nil || *e.SensorID != n.SensorID):
+			return fmt.Errorf("%w: it is for another node", ErrBadEnrollment)
+		case e.SensorID == nil && existing != nil:
+			return fmt.Errorf("node %q: %w; enrolling it again needs a code created for sensor %d",
+				nodeID, ErrNodeExists, n.SensorID)
+		}
+		used := tx.Model(&Enrollment{}).Where("id = ? AND used_at IS NULL", e.ID).
+			Updates(map[string]interface{}{"used_at": now, "sensor_id": n.SensorID})
+		if used.Error != nil {
+			return fmt.Errorf("use enrollment: %v", used.Error)
+		}
+		if used.RowsAffected == 0 {
+			return ErrBadEnrollment
+		}
+		if existing == nil {
+			if err := tx.Create(n).Error; err != nil {
+				return fmt.Errorf("register node %q: %v", nodeID, err)
+			}
+			return nil
+		}
+		err = tx.Model(n).Select("status", "quantities", "token_hash", "approved_by", "approved_at", "revoked_at").
+			Updates(n).Error
+		if err != nil {
+			return fmt.Errorf("save node: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return Enrolled{}, err
+	}
+
+	if existing != nil {
+		*existing.node = *n
+	} else if _, err := ss.addNodeLocked(n); err != nil {
+		return Enrolled{}, err
+	}
+	logger.Info("node enrolled", "sensor_id", n.SensorID, "node", nodeID)
+	return Enrolled{SensorID: n.SensorID, NodeID: nodeID, Status: n.Status, Token: token}, nil
+}
+
+// ApproveNode lets the pending node of sensor id send readings, under the
+// given name and room.
+func (ss *SensorStore) ApproveNode(id int, name, room, approvedBy string) (Node, error) {
+	if strings.TrimSpace(name) == "" {
+		return Node{}, fmt.Errorf("%w: name is required", ErrInvalidReading)
+	}
+	ss.Lock()
+	defer ss.Unlock()
+
+	s, err := ss.nodeByIDLocked(id)
+	if err != nil {
+		return Node{}, err
+	}
+	n := s.node
+	if n.Status != NodePending {
+		return Node{}, fmt.Errorf("sensor with id=%d: %w", id, ErrNotPending)
+	}
+	now := time.Now().UTC()
+	n.Status, n.Name, n.Room, n.ApprovedBy, n.ApprovedAt = NodeApproved, name, room, approvedBy, &now
+	err = ss.db.Model(n).Select("status", "name", "room", "approved_by", "approved_at").Updates(n).Error
+	if err != nil {
+		return Node{}, fmt.Errorf("save node: %v", err)
+	}
+	s.Name, s.Room = name, room
+	return *n, nil
+}
+
+// RevokeNode stops the node of sensor id from sending readings and
+// invalidates its device token and, through the revoke handlers, its
+// certificates. Its sensor ID and history are kept; it can
+// only come back by enrolling again.
+func (ss *SensorStore) RevokeNode(id int) (Node, error) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	s, err := ss.nodeByIDLocked(id)
+	if err != nil {
+		return Node{}, err
+	}
+	n := s.node
+	now := time.Now().UTC()
+	n.Status, n.TokenHash, n.RevokedAt = NodeRevoked, "", &now
+	err = ss.db.Model(n).Select("status", "token_hash", "revoked_at").Updates(n).Error
+	if err != nil {
+		return Node{}, fmt.Errorf("save node: %v", err)
+	}
+	ss.setOnline(id, false, fmt.Errorf("node %q: %w", n.NodeID, ErrNodeRevoked))
+	for _, fn := range ss.revokeHandlers {
+		fn(id)
+	}
+	return *n, nil
+}
+
+func (ss *SensorStore) nodeByIDLocked(id int) (*Sensor, error) {
+	s, ok := ss.sensors[id]
+	if !ok {
+		return nil, fmt.Errorf("sensor with id=%d: %w", id, ErrNotFound)
+	}
+	if s.node == nil {
+		return nil, fmt.Errorf("sensor with id=%d: %w", id, ErrNotNode)
+	}
+	return s, nil
+}
+
+// newEnrollmentCode returns eight random characters of codeAlphabet as
+// XXXX-XXXX, about 39 bits: plenty for a code that expires in minutes and
+// works once.
+func newEnrollmentCode() (string, error) {
+	// Bytes past the largest multiple of the alphabet are skipped so every
+	// character is equally likely.
+	limit := byte(256 - 256%len(codeAlphabet))
+	code := make([]byte, 0, 9)
+	b := make([]byte, 1)
+	for len(code) < 9 {
+		if _, err := rand.Read(b); err != nil {
+			return "", fmt.Errorf("generate enrollment code: %v", err)
+		}
+		if b[0] >= limit {
+			continue
+		}
+		if len(code) == 4 {
+			code = append(code, '-')
+		}
+		code = append(code, codeAlphabet[int(b[0])%len(codeAlphabet)])
+	}
+	return string(code), nil
+}
+
+// normalizeCode accepts codes typed in lower case or without the dash.
+func normalizeCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(code))
+}
@@ -0,0 +1,173 @@
+package sensor
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/filter"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Filters is the saved filter config of a sensor, overriding the
+// configured sensor.filters defaults.
+type Filters struct {
+	SensorID  int           `gorm:"primaryKey"`
+	Config    filter.Config `gorm:"type:text"`
+	UpdatedAt time.Time
+}
+
+// FilterStatus shows a sensor's filter config and what it has rejected
+// since the config was last set or the server started.
+type FilterStatus struct {
+	SensorID int           `json:"sensor_id"`
+	Config   filter.Config `json:"config"`
+	// Source is "config" for the configured defaults or "saved" for a
+	// config set through the API.
+	Source    string                  `json:"source"`
+	UpdatedAt *time.Time              `json:"updated_at,omitempty"`
+	Stats     map[string]filter.Stats `json:"stats"`
+}
+
+// sensorFilters runs one chain per quantity.
+type sensorFilters struct {
+	config filter.Config
+	chains map[string]*filter.Chain
+}
+
+func newSensorFilters(c filter.Config) *sensorFilters {
+	return &sensorFilters{config: c, chains: map[string]*filter.Chain{
+		QuantityTemperature: filter.NewChain(c.Temperature),
+		QuantityHumidity:    filter.NewChain(c.Humidity),
+		QuantityPressure:    filter.NewChain(c.Pressure),
+	}}
+}
+
+// apply filters raw taken at t. Rejected quantities keep their previous
+// filtered value and are listed with the reason.
+func (f *sensorFilters) apply(raw Raw, t time.Time) (Raw, map[string]filter.Reason) {
+	if f == nil {
+		return raw, nil
+	}
+	var out Raw
+	var rejected map[string]filter.Reason
+	for _, q := range []struct {
+		name string
+		in   *float32
+		out  **float32
+	}{
+		{QuantityTemperature, raw.Temperature, &out.Temperature},
+		{QuantityHumidity, raw.Humidity, &out.Humidity},
+		{QuantityPressure, raw.Pressure, &out.Pressure},
+	} {
+		if q.in == nil {
+			continue
+		}
+		res := f.chains[q.name].Apply(float64(*q.in), t)
+		if res.Rejected != "" {
+			if rejected == nil {
+				rejected = make(map[string]filter.Reason)
+			}
+			rejected[q.name] = res.Rejected
+		}
+		if res.Valid {
+			v := float32(res.Value)
+			*q.out = &v
+		}
+	}
+	return out, rejected
+}
+
+func (f *sensorFilters) stats() map[string]filter.Stats {
+	out := make(map[string]filter.Stats, len(f.chains))
+	for name, c := range f.chains {
+		out[name] = c.Stats()
+	}
+	return out
+}
+
+func (ss *SensorStore) loadFilters() error {
+	if err := ss.db.AutoMigrate(&Filters{}); err != nil {
+		return fmt.Errorf("migrate sensor filters: %v", err)
+	}
+	for _, s := range ss.sensors {
+		s.filters = newSensorFilters(ss.filterDefaults)
+	}
+	var saved []Filters
+	if err := ss.db.Find(&saved).Error; err != nil {
+		return fmt.Errorf("load sensor filters: %v", err)
+	}
+	for _, f := range saved {
+		s, ok := ss.sensors[f.SensorID]
+		if !ok {
+			continue
+		}
+		if err := f.Config.Validate(); err != nil {
+			logger.Error("apply saved filters", "sensor_id", f.SensorID, "err", err)
+			continue
+		}
+		s.filters = newSensorFilters(f.Config)
+	}
+	return nil
+}
+
+// FilterStatus returns the filter config and counters of sensor id.
+func (ss *SensorStore) FilterStatus(id int) (FilterStatus, error) {
+	ss.Lock()
+	defer ss.Unlock()
+	return ss.filterStatusLocked(id)
+}
+
+func (ss *SensorStore) filterStatusLocked(id int) (FilterStatus, error) {
+	s, ok := ss.sensors[id]
+	if !ok {
+		return FilterStatus{}, fmt.Errorf("sensor with id=%d: %w", id, ErrNotFound)
+	}
+	st := FilterStatus{SensorID: id, Config: s.filters.config, Source: "config", Stats: s.filters.stats()}
+	var saved Filters
+	err := ss.db.First(&saved, "sensor_id = ?", id).Error
+	if err == nil {
+		st.Source, st.UpdatedAt = "saved", &saved.UpdatedAt
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return FilterStatus{}, fmt.Errorf("load sensor filters: %v", err)
+	}
+	return st, nil
+}
+
+// SetFilters saves c for sensor id and restarts its filters with it.
+func (ss *SensorStore) SetFilters(id int, c filter.Config) (FilterStatus, error) {
+	if err := c.Validate(); err != nil {
+		return FilterStatus{}, err
+	}
+	ss.Lock()
+	defer ss.Unlock()
+
+	s, ok := ss.sensors[id]
+	if !ok {
+		return FilterStatus{}, fmt.Errorf("sensor with id=%d: %w", id, ErrNotFound)
+	}
+	f := Filters{SensorID: id, Config: c, UpdatedAt: time.Now().UTC()}
+	if err := ss.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&f).Error; err != nil {
+		return FilterStatus{}, fmt.Errorf("save sensor filters: %v", err)
+	}
+	s.filters = newSensorFilters(c)
+	return ss.filterStatusLocked(id)
+}
+
+// ResetFilters forgets the saved config of sensor id and restarts its
+// filters with the configured defaults.
+func (ss *SensorStore) ResetFilters(id int) (FilterStatus, error) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	s, ok := ss.sensors[id]
+	if !ok {
+		return FilterStatus{}, fmt.Errorf("sensor with id=%d: %w", id, ErrNotFound)
+	}
+	if err := ss.db.Delete(&Filters{}, "sensor_id = ?", id).Error; err != nil {
+		return FilterStatus{}, fmt.Errorf("delete sensor filters: %v", err)
+	}
+	s.filters = newSensorFilters(ss.filterDefaults)
+	return ss.filterStatusLocked(id)
+}
@@ -0,0 +1,173 @@
+package sensor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/baro"
+	"github.com/maskarb/skarbek-dev/internal/forecast"
+	"github.com/maskarb/skarbek-dev/internal/units"
+)
+
+// ErrNoPressure is returned for forecasts of sensors that have never
+// reported a pressure.
+var ErrNoPressure = errors.New("no pressure readings")
+
+// pressureHistory is how long pressure samples are kept. The forecast
+// looks back 12 hours; the rest is slack for clients and restarts.
+const pressureHistory = 24 * time.Hour
+
+// PressureSample is a station pressure in Pa, recorded for the tendency.
+type PressureSample struct {
+	ID       uint      `gorm:"primaryKey"`
+	SensorID int       `gorm:"index:idx_pressure_samples_sensor_at"`
+	At       time.Time `gorm:"index:idx_pressure_samples_sensor_at"`
+	Pressure float64
+}
+
+// Forecast is the pressure tendency and Zambretti forecast of a sensor.
+type Forecast struct {
+	SensorID    int       `json:"sensor_id"`
+	GeneratedAt time.Time `json:"generated_at"`
+	// Pressure is the sea-level pressure (QNH) the forecast is based on.
+	// SeaLevel is false when the station elevation is unknown and station
+	// pressure had to be used instead, which skews the Zambretti dial.
+	Pressure float64 `json:"pressure"`
+	SeaLevel bool    `json:"sea_level"`
+	// Tendency3h and Tendency12h are missing until enough history has
+	// been recorded.
+	Tendency3h  *forecast.Tendency `json:"tendency_3h,omitempty"`
+	Tendency12h *forecast.Tendency `json:"tendency_12h,omitempty"`
+	Zambretti   forecast.Zambretti `json:"zambretti"`
+	// StormWarning is set when pressure fell by at least the configured
+	// storm drop over the last 3 hours.
+	StormWarning bool `json:"storm_warning"`
+	// HistoryHours is how far back recorded samples go.
+	HistoryHours float64 `json:"history_hours"`
+	// Notes explains what limited the forecast.
+	Notes []string `json:"notes,omitempty"`
+
+	Units map[string]units.Unit `json:"units"`
+}
+
+// In converts the pressures of f to sys.
+func (f Forecast) In(sys units.System) Forecast {
+	unit := sys.Pressure
+	convert := func(v float64) float64 {
+		return units.Round(sys.Pascal(v), units.Decimals(unit))
+	}
+	f.Pressure = convert(f.Pressure)
+	for _, t := range []**forecast.Tendency{&f.Tendency3h, &f.Tendency12h} {
+		if *t != nil {
+			c := **t
+			c.Change = convert(c.Change)
+			*t = &c
+		}
+	}
+	f.Units = map[string]units.Unit{"pressure": unit, "change": unit}
+	return f
+}
+
+func (ss *SensorStore) loadPressureHistory() error {
+	if err := ss.db.AutoMigrate(&PressureSample{}); err != nil {
+		return fmt.Errorf("migrate pressure samples: %v", err)
+	}
+	return nil
+}
+
+// RecordPressure reads every sensor each interval and stores its pressure
+// for the forecast, until ctx is done. Samples older than a day are
+// dropped as it goes.
+func (ss *SensorStore) RecordPressure(ctx context.Context, interval time.Duration) {
+	ss.recordPressure()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			ss.recordPressure()
+		}
+	}
+}
+
+func (ss *SensorStore) recordPressure() {
+	ss.Lock()
+	defer ss.Unlock()
+
+	now := time.Now().UTC()
+	for id, s := range ss.sensors {
+		if err := ss.read(id, s); err != nil {
+			logger.Error("pressure sample failed", "sensor_id", id, "err", err)
+			continue
+		}
+		if s.Pressue == nil || !s.Online || s.Rejected[QuantityPressure] != "" {
+			continue
+		}
+		sample := PressureSample{SensorID: id, At: now, Pressure: float64(*s.Pressue)}
+		if err := ss.db.Create(&sample).Error; err != nil {
+			logger.Error("save pressure sample", "sensor_id", id, "err", err)
+		}
+	}
+	err := ss.db.Where("at < ?", now.Add(-pressureHistory)).Delete(&PressureSample{}).Error
+	if err != nil {
+		logger.Error("prune pressure samples", "err", err)
+	}
+}
+
+// Forecast computes the forecast of sensor id from its recorded pressure
+// and its latest reading.
+func (ss *SensorStore) Forecast(id int) (Forecast, error) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	s, ok := ss.sensors[id]
+	if !ok {
+		return Forecast{}, fmt.Errorf("sensor with id=%d: %w", id, ErrNotFound)
+	}
+	now := time.Now().UTC()
+	var saved []PressureSample
+	err := ss.db.Where("sensor_id = ? AND at >= ?", id, now.Add(-13*time.Hour)).
+		Order("at").Find(&saved).Error
+	if err != nil {
+		return Forecast{}, fmt.Errorf("load pressure samples: %v", err)
+	}
+	samples := make([]forecast.Sample, 0, len(saved)+1)
+	for _, p := range saved {
+		samples = append(samples, forecast.Sample{At: p.At, Pressure: p.Pressure})
+	}
+	if s.Pressue != nil && s.Rejected[QuantityPressure] == "" {
+		samples = append(samples, forecast.Sample{At: now, Pressure: float64(*s.Pressue)})
+	}
+	if len(samples) == 0 {
+		return Forecast{}, fmt.Errorf("sensor with id=%d: %w", id, ErrNoPressure)
+	}
+
+	f := Forecast{SensorID: id, GeneratedAt: now}
+	if e := s.Site.StationElevation; e != nil {
+		f.SeaLevel = true
+		for i := range samples {
+			samples[i].Pressure = baro.QNH(samples[i].Pressure, *e)
+		}
+	} else {
+		f.Notes = append(f.Notes, "station elevation is unknown; station pressure is used in place of sea-level pressure")
+	}
+	latest := samples[len(samples)-1]
+	f.Pressure = latest.Pressure
+	f.HistoryHours = units.Round(now.Sub(samples[0].At).Hours(), 2)
+
+	f.Tendency3h = forecast.At3h(samples)
+	f.Tendency12h = forecast.At(samples, 12*time.Hour)
+	if f.Tendency3h == nil {
+		f.Notes = append(f.Notes, "less than 3 hours of pressure history; the forecast assumes steady pressure")
+	} else {
+		f.StormWarning = -f.Tendency3h.Change >= ss.forecast.StormDrop
+	}
+	f.Zambretti = forecast.Forecast(f.Pressure, forecast.ZambrettiTrend(f.Tendency3h), now,
+		ss.forecast.Hemisphere == "south")
+	return f, nil
+}
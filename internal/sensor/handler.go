@@ -1,46 +1,143 @@
 package sensor
 
 import (
+	"bytes"
 	"context"
-	"log"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
 	"net/http"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
+	"github.com/maskarb/skarbek-dev/internal/apierror"
+	"github.com/maskarb/skarbek-dev/internal/bme280"
 	"github.com/maskarb/skarbek-dev/internal/constants"
+	"github.com/maskarb/skarbek-dev/internal/filter"
+	"github.com/maskarb/skarbek-dev/internal/pki"
+	"github.com/maskarb/skarbek-dev/internal/session"
+	"github.com/maskarb/skarbek-dev/internal/units"
+	qrcode "github.com/skip2/go-qrcode"
 )
 
+// UnitsPreference returns the units the caller of r has chosen, if any.
+type UnitsPreference func(r *http.Request) (units.System, bool)
+
 type sensorServer struct {
 	store *SensorStore
+
+	// Preferred, if set, supplies the caller's units when there is no
+	// ?units= parameter.
+	Preferred UnitsPreference
+	// Protect, if set, guards the endpoints that change sensor settings.
+	Protect func(http.Handler) http.Handler
+	// Admin guards the endpoints that change driver settings or filters,
+	// and those that add, enroll, approve and revoke nodes or rotate their
+	// tokens. They are only served when it is set.
+	Admin func(http.Handler) http.Handler
+	// Templates is the directory of the HTML templates, for the enrollment
+	// page.
+	Templates string
 }
 
-func NewSensorServer() *sensorServer {
-	store := NewSensorStore()
+// NewSensorServer serves readings in SI units unless the caller asks for
+// others with ?units= or has a preference.
+func NewSensorServer(store *SensorStore) *sensorServer {
 	return &sensorServer{store: store}
 }
 
 func (ss *sensorServer) Routes() *chi.Mux {
 	router := chi.NewRouter()
 	router.Get("/", ss.getAllSensorsHandler)
+	router.Get("/nodes", ss.getNodesHandler)
+	// Node credentials are only handed out to admins, so without Admin
+	// nodes can neither be added nor enroll.
+	if ss.Admin != nil {
+		router.With(ss.Admin).Post("/nodes", ss.postNodeHandler)
+		router.Route("/enrollments", func(r chi.Router) {
+			r.Use(ss.Admin)
+			r.Get("/", ss.getEnrollmentsHandler)
+			r.Post("/", ss.postEnrollmentHandler)
+		})
+		// The enrollment code is the node's only credential here.
+		router.Post("/enroll", ss.postEnrollHandler)
+	}
 	router.Route("/{sensorID}", func(r chi.Router) {
 		r.Use(ss.sensorCtx)
 		r.Get("/", ss.getSensorHandler)
+		// Nodes authenticate pushes with their device token, not a session.
+		r.Post("/readings", ss.postReadingsHandler)
+		r.Get("/readings", ss.getReadingsHandler)
+		if ss.Admin != nil {
+			r.With(ss.Admin).Post("/token", ss.postTokenHandler)
+			r.With(ss.Admin).Post("/approve", ss.postApproveHandler)
+			r.With(ss.Admin).Post("/revoke", ss.postRevokeHandler)
+		}
+		r.Get("/site", ss.getSiteHandler)
+		r.With(ss.protect).Put("/site", ss.putSiteHandler)
+		r.Route("/calibration", func(r chi.Router) {
+			r.Get("/", ss.getCalibrationHandler)
+			r.Get("/history", ss.getCalibrationHistoryHandler)
+			r.Get("/points", ss.getCalibrationPointsHandler)
+			r.Group(func(r chi.Router) {
+				r.Use(ss.protect)
+				r.Put("/", ss.putCalibrationHandler)
+				r.Post("/points", ss.postCalibrationPointHandler)
+				r.Post("/two-point", ss.postTwoPointHandler)
+			})
+		})
+		r.Get("/driver", ss.getDriverHandler)
+		r.Get("/filters", ss.getFiltersHandler)
+		// Driver settings change the chip's power and self-heating, and
+		// filters can reject every sample, which silences alerts.
+		if ss.Admin != nil {
+			r.With(ss.Admin).Put("/driver", ss.putDriverHandler)
+			r.With(ss.Admin).Delete("/driver", ss.deleteDriverHandler)
+			r.With(ss.Admin).Put("/filters", ss.putFiltersHandler)
+			r.With(ss.Admin).Delete("/filters", ss.deleteFiltersHandler)
+		}
+		r.Get("/forecast", ss.getForecastHandler)
 	})
 	return router
 }
 
+// NodeRoutes adds the endpoints of the mutual TLS listener, under
+// /api/v1/node, to r. Requests must have passed through the CA's
+// middleware, which names the node.
+func (ss *sensorServer) NodeRoutes(r chi.Router) {
+	r.Post("/readings", ss.postNodeReadingsHandler)
+}
+
+func (ss *sensorServer) protect(next http.Handler) http.Handler {
+	if ss.Protect == nil {
+		return next
+	}
+	return ss.Protect(next)
+}
+
 func (ss *sensorServer) sensorCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		sensorID, err := strconv.Atoi(chi.URLParam(r, "sensorID"))
+		param := chi.URLParam(r, "sensorID")
+		sensorID, err := strconv.Atoi(param)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			apierror.Write(w, r, apierror.BadRequest("invalid_sensor_id",
+				"sensor id must be an integer").WithDetails(map[string]string{"sensor_id": param}))
 			return
 		}
 
 		sensor, err := ss.store.GetSensor(sensorID)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
+		if errors.Is(err, ErrNotFound) {
+			apierror.Write(w, r, apierror.NotFound("sensor_not_found", err.Error()))
+			return
+		} else if err != nil {
+			apierror.Write(w, r, sensorUnavailable(err))
 			return
 		}
 
@@ -50,22 +147,768 @@ func (ss *sensorServer) sensorCtx(next http.Handler) http.Handler {
 }
 
 func (ss *sensorServer) getSensorHandler(w http.ResponseWriter, req *http.Request) {
-	log.Printf("handling get task at %s\n", req.URL.Path)
+	logger.Ctx(req.Context()).Debug("handling get sensor", "path", req.URL.Path)
 
 	// Assume if we've reach this far, we can access the article
 	// context because this handler is a child of the TaskCtx
 	// middleware. The worst case, the recoverer middleware will save us.
 	sensor := req.Context().Value(constants.SensorContextID).(Sensor)
-	render.JSON(w, req, sensor)
+	sys, err := ss.unitsFor(req)
+	if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	metrics, err := ParseMetrics(req.URL.Query().Get("derived"))
+	if err != nil {
+		apierror.Write(w, req, apierror.BadRequest("invalid_derived", err.Error()).
+			WithDetails(map[string][]string{"available": allMetrics}))
+		return
+	}
+	reading := NewReading(sensor, sys)
+	reading.AddDerived(sensor, sys, metrics)
+	render.JSON(w, req, reading)
 }
 
 func (ss *sensorServer) getAllSensorsHandler(w http.ResponseWriter, req *http.Request) {
-	log.Printf("handling get all sensors at %s\n", req.URL.Path)
+	logger.Ctx(req.Context()).Debug("handling get all sensors", "path", req.URL.Path)
 
+	sys, err := ss.unitsFor(req)
+	if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
 	allSensors, err := ss.store.GetAllSensors()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apierror.Write(w, req, sensorUnavailable(err))
+		return
+	}
+	readings := make([]Reading, 0, len(allSensors))
+	for _, s := range allSensors {
+		readings = append(readings, NewReading(s, sys))
+	}
+	render.JSON(w, req, readings)
+}
+
+func (ss *sensorServer) getSiteHandler(w http.ResponseWriter, req *http.Request) {
+	sensor := req.Context().Value(constants.SensorContextID).(Sensor)
+	render.JSON(w, req, sensor.Site)
+}
+
+// putSiteHandler replaces the site of a sensor. Values are metres and
+// pascal; null or missing clears a value.
+func (ss *sensorServer) putSiteHandler(w http.ResponseWriter, req *http.Request) {
+	sensor := req.Context().Value(constants.SensorContextID).(Sensor)
+	var site Site
+	if !apierror.DecodeStrict(w, req, &site) {
+		return
+	}
+	if err := site.Validate(); err != nil {
+		apierror.Write(w, req, apierror.BadRequest("invalid_site", err.Error()))
+		return
+	}
+	site, err := ss.store.SetSite(int(*sensor.SensorID), site)
+	if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	logger.Ctx(req.Context()).Info("sensor site updated", "sensor_id", *sensor.SensorID,
+		"station_elevation", site.StationElevation, "sea_level_pressure", site.SeaLevelPressure)
+	render.JSON(w, req, site)
+}
+
+func (ss *sensorServer) getCalibrationHandler(w http.ResponseWriter, req *http.Request) {
+	sensor := req.Context().Value(constants.SensorContextID).(Sensor)
+	render.JSON(w, req, sensor.Calibration)
+}
+
+func (ss *sensorServer) getCalibrationHistoryHandler(w http.ResponseWriter, req *http.Request) {
+	sensor := req.Context().Value(constants.SensorContextID).(Sensor)
+	history, err := ss.store.CalibrationHistory(int(*sensor.SensorID))
+	if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	render.JSON(w, req, history)
+}
+
+// putCalibrationHandler stores manually entered coefficients as a new
+// version. Quantities left out are uncorrected.
+func (ss *sensorServer) putCalibrationHandler(w http.ResponseWriter, req *http.Request) {
+	sensor := req.Context().Value(constants.SensorContextID).(Sensor)
+	body := struct {
+		Temperature *Linear `json:"temperature"`
+		Humidity    *Linear `json:"humidity"`
+		Pressure    *Linear `json:"pressure"`
+		Note        string  `json:"note"`
+	}{}
+	if !apierror.DecodeStrict(w, req, &body) {
+		return
+	}
+	c := uncalibrated(int(*sensor.SensorID))
+	for _, q := range []struct {
+		in  *Linear
+		out *Linear
+	}{{body.Temperature, &c.Temperature}, {body.Humidity, &c.Humidity}, {body.Pressure, &c.Pressure}} {
+		if q.in != nil {
+			*q.out = *q.in
+		}
+	}
+	c.Method = "manual"
+	c.Note = body.Note
+	c.CreatedBy = callerEmail(req)
+	c, err := ss.store.AddCalibration(c)
+	if err != nil {
+		apierror.Write(w, req, calibrationError(err))
+		return
+	}
+	logger.Ctx(req.Context()).Info("sensor calibrated", "sensor_id", c.SensorID,
+		"version", c.Version, "method", c.Method)
+	render.JSON(w, req, c)
+}
+
+func (ss *sensorServer) getCalibrationPointsHandler(w http.ResponseWriter, req *http.Request) {
+	sensor := req.Context().Value(constants.SensorContextID).(Sensor)
+	points, err := ss.store.CalibrationPoints(int(*sensor.SensorID))
+	if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	render.JSON(w, req, points)
+}
+
+// postCalibrationPointHandler records a reference value in °C, %RH or Pa.
+// Without raw, the sensor's latest uncalibrated value is paired with it,
+// so the reference should be read at the same time.
+func (ss *sensorServer) postCalibrationPointHandler(w http.ResponseWriter, req *http.Request) {
+	sensor := req.Context().Value(constants.SensorContextID).(Sensor)
+	body := struct {
+		Quantity  string   `json:"quantity"`
+		Reference *float64 `json:"reference"`
+		Raw       *float64 `json:"raw"`
+	}{}
+	if !apierror.DecodeStrict(w, req, &body) {
+		return
+	}
+	if body.Reference == nil {
+		apierror.Write(w, req, apierror.BadRequest("invalid_calibration", "reference is required"))
+		return
+	}
+	p := CalibrationPoint{SensorID: int(*sensor.SensorID), Quantity: body.Quantity, Reference: *body.Reference}
+	if body.Raw != nil {
+		p.Raw = *body.Raw
+	} else if _, ok := offsetLimits[body.Quantity]; ok {
+		current := sensor.Raw.quantity(body.Quantity)
+		if current == nil {
+			apierror.Write(w, req, apierror.BadRequest("invalid_calibration",
+				"the sensor has no raw "+body.Quantity+" value; pass raw"))
+			return
+		}
+		p.Raw = float64(*current)
+	}
+	p, err := ss.store.AddCalibrationPoint(p)
+	if err != nil {
+		apierror.Write(w, req, calibrationError(err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	render.JSON(w, req, p)
+}
+
+// postTwoPointHandler fits a quantity through its last two points.
+func (ss *sensorServer) postTwoPointHandler(w http.ResponseWriter, req *http.Request) {
+	sensor := req.Context().Value(constants.SensorContextID).(Sensor)
+	body := struct {
+		Quantity string `json:"quantity"`
+		Note     string `json:"note"`
+	}{}
+	if !apierror.DecodeStrict(w, req, &body) {
+		return
+	}
+	if _, ok := offsetLimits[body.Quantity]; !ok {
+		apierror.Write(w, req, apierror.BadRequest("invalid_calibration",
+			"quantity must be temperature, humidity or pressure"))
+		return
+	}
+	c, err := ss.store.CalibrateTwoPoint(int(*sensor.SensorID), body.Quantity, body.Note, callerEmail(req))
+	if err != nil {
+		apierror.Write(w, req, calibrationError(err))
+		return
+	}
+	logger.Ctx(req.Context()).Info("sensor calibrated", "sensor_id", c.SensorID,
+		"version", c.Version, "method", c.Method, "quantity", body.Quantity)
+	render.JSON(w, req, c)
+}
+
+func (ss *sensorServer) getDriverHandler(w http.ResponseWriter, req *http.Request) {
+	sensor := req.Context().Value(constants.SensorContextID).(Sensor)
+	st, err := ss.store.DriverStatus(int(*sensor.SensorID))
+	if err != nil {
+		apierror.Write(w, req, sensorUnavailable(err))
+		return
+	}
+	render.JSON(w, req, st)
+}
+
+// putDriverHandler reconfigures the chip. The body replaces all settings;
+// start from the settings returned by GET.
+func (ss *sensorServer) putDriverHandler(w http.ResponseWriter, req *http.Request) {
+	sensor := req.Context().Value(constants.SensorContextID).(Sensor)
+	var settings bme280.Settings
+	if !apierror.DecodeStrict(w, req, &settings) {
+		return
+	}
+	if err := settings.Validate(); err != nil {
+		apierror.Write(w, req, apierror.BadRequest("invalid_driver_settings", err.Error()))
+		return
+	}
+	st, err := ss.store.SetDriver(int(*sensor.SensorID), settings)
+	if err != nil {
+		apierror.Write(w, req, sensorUnavailable(err))
+		return
+	}
+	logger.Ctx(req.Context()).Info("sensor driver settings changed", "sensor_id", st.SensorID,
+		"mode", settings.Mode, "iir_filter", settings.Filter)
+	render.JSON(w, req, st)
+}
+
+func (ss *sensorServer) deleteDriverHandler(w http.ResponseWriter, req *http.Request) {
+	sensor := req.Context().Value(constants.SensorContextID).(Sensor)
+	st, err := ss.store.ResetDriver(int(*sensor.SensorID))
+	if err != nil {
+		apierror.Write(w, req, sensorUnavailable(err))
+		return
+	}
+	logger.Ctx(req.Context()).Info("sensor driver settings reset", "sensor_id", st.SensorID)
+	render.JSON(w, req, st)
+}
+
+func (ss *sensorServer) getFiltersHandler(w http.ResponseWriter, req *http.Request) {
+	sensor := req.Context().Value(constants.SensorContextID).(Sensor)
+	st, err := ss.store.FilterStatus(int(*sensor.SensorID))
+	if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	render.JSON(w, req, st)
+}
+
+// putFiltersHandler replaces the filter config of a sensor and restarts
+// its filters, clearing their history and counters.
+func (ss *sensorServer) putFiltersHandler(w http.ResponseWriter, req *http.Request) {
+	sensor := req.Context().Value(constants.SensorContextID).(Sensor)
+	var c filter.Config
+	if !apierror.DecodeStrict(w, req, &c) {
+		return
+	}
+	if err := c.Validate(); err != nil {
+		apierror.Write(w, req, apierror.BadRequest("invalid_filters", err.Error()))
+		return
+	}
+	st, err := ss.store.SetFilters(int(*sensor.SensorID), c)
+	if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	logger.Ctx(req.Context()).Info("sensor filters changed", "sensor_id", st.SensorID)
+	render.JSON(w, req, st)
+}
+
+func (ss *sensorServer) deleteFiltersHandler(w http.ResponseWriter, req *http.Request) {
+	sensor := req.Context().Value(constants.SensorContextID).(Sensor)
+	st, err := ss.store.ResetFilters(int(*sensor.SensorID))
+	if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	logger.Ctx(req.Context()).Info("sensor filters reset", "sensor_id", st.SensorID)
+	render.JSON(w, req, st)
+}
+
+// getForecastHandler reports the pressure tendency and the Zambretti
+// forecast. Pressures follow ?units= like readings do.
+func (ss *sensorServer) getForecastHandler(w http.ResponseWriter, req *http.Request) {
+	sensor := req.Context().Value(constants.SensorContextID).(Sensor)
+	sys, err := ss.unitsFor(req)
+	if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	f, err := ss.store.Forecast(int(*sensor.SensorID))
+	if errors.Is(err, ErrNoPressure) {
+		apierror.Write(w, req, apierror.New(http.StatusServiceUnavailable, apierror.CodeUnavailable, err.Error()))
+		return
+	} else if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	render.JSON(w, req, f.In(sys))
+}
+
+// pushedSample is one reading as a node pushes it. Values are in °C, %RH
+// and Pa unless the push names other units.
+type pushedSample struct {
+	At          time.Time `json:"at"`
+	Temperature *float64  `json:"temperature"`
+	Humidity    *float64  `json:"humidity"`
+	Pressure    *float64  `json:"pressure"`
+}
+
+// pushBody is either one reading or a batch of them under "readings".
+type pushBody struct {
+	pushedSample
+	Readings []pushedSample    `json:"readings"`
+	Units    map[string]string `json:"units"`
+}
+
+// maxPushBytes bounds the body of a push; a full batch fits easily.
+const maxPushBytes = 1 << 20
+
+// baseUnits are the units samples are stored in.
+var baseUnits = map[string]units.Unit{
+	QuantityTemperature: units.Celsius,
+	QuantityHumidity:    units.Percent,
+	QuantityPressure:    units.Pascal,
+}
+
+// samples converts the push to node samples in °C, %RH and Pa.
+func (b pushBody) samples() ([]NodeSample, error) {
+	pushed := b.Readings
+	single := b.pushedSample != (pushedSample{})
+	switch {
+	case single && pushed != nil:
+		return nil, errors.New("send one reading or readings, not both")
+	case single:
+		pushed = []pushedSample{b.pushedSample}
+	}
+	conv := make(map[string]units.Unit, len(b.Units))
+	for q, name := range b.Units {
+		base, ok := baseUnits[q]
+		if !ok {
+			return nil, fmt.Errorf("units: unknown quantity %q", q)
+		}
+		u, err := units.Parse(name)
+		if err != nil {
+			return nil, fmt.Errorf("units: %v", err)
+		}
+		if u == base {
+			continue
+		}
+		if _, err := units.Convert(0, u, base); err != nil {
+			return nil, fmt.Errorf("units: %s is not a unit of %s", name, q)
+		}
+		conv[q] = u
+	}
+
+	samples := make([]NodeSample, len(pushed))
+	for i, p := range pushed {
+		smp := NodeSample{At: p.At}
+		for _, q := range []struct {
+			name string
+			in   *float64
+			out  **float64
+		}{
+			{QuantityTemperature, p.Temperature, &smp.Temperature},
+			{QuantityHumidity, p.Humidity, &smp.Humidity},
+			{QuantityPressure, p.Pressure, &smp.Pressure},
+		} {
+			if q.in == nil {
+				continue
+			}
+			v := *q.in
+			if u, ok := conv[q.name]; ok {
+				v, _ = units.Convert(v, u, baseUnits[q.name])
+			}
+			*q.out = &v
+		}
+		samples[i] = smp
+	}
+	return samples, nil
+}
+
+// postReadingsHandler takes readings a node pushes, authenticated with its
+// device token. A retry with the same Idempotency-Key and body gets the
+// first response back without the readings being applied again.
+func (ss *sensorServer) postReadingsHandler(w http.ResponseWriter, req *http.Request) {
+	sensor := req.Context().Value(constants.SensorContextID).(Sensor)
+	id := int(*sensor.SensorID)
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if err := ss.store.Authenticate(id, token); errors.Is(err, ErrNodePending) {
+		apierror.Write(w, req, apierror.New(http.StatusForbidden, "node_pending", err.Error()))
+		return
+	} else if err != nil {
+		apierror.Write(w, req, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, err.Error()))
+		return
+	}
+	ss.push(w, req, id)
+}
+
+// postNodeReadingsHandler takes readings pushed over the mutual TLS
+// listener, from the node its client certificate names.
+func (ss *sensorServer) postNodeReadingsHandler(w http.ResponseWriter, req *http.Request) {
+	id, ok := pki.SensorFromContext(req.Context())
+	if !ok {
+		apierror.Write(w, req, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized,
+			"client certificate required"))
+		return
+	}
+	ss.push(w, req, id)
+}
+
+// push ingests the readings in the body for the node of sensor id, which
+// the caller has authenticated.
+func (ss *sensorServer) push(w http.ResponseWriter, req *http.Request, id int) {
+	// One byte over the limit tells a body that is too large from one
+	// that fits exactly.
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxPushBytes+1))
+	if err != nil {
+		apierror.Write(w, req, apierror.BadRequest(apierror.CodeBadRequest, "could not read request body").WithCause(err))
+		return
+	}
+	if len(body) > maxPushBytes {
+		apierror.Write(w, req, apierror.Newf(http.StatusRequestEntityTooLarge, "payload_too_large",
+			"request body is larger than %d bytes", maxPushBytes))
+		return
+	}
+	key := req.Header.Get("Idempotency-Key")
+	requestHash := hashToken(string(body))
+	if key != "" {
+		result, err := ss.store.IdempotentResult(id, key, requestHash)
+		if errors.Is(err, ErrIdempotencyConflict) {
+			apierror.Write(w, req, apierror.New(http.StatusUnprocessableEntity, "idempotency_key_reused", err.Error()))
+			return
+		} else if err != nil {
+			apierror.Write(w, req, err)
+			return
+		}
+		if result != nil {
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(result)
+			return
+		}
+	}
+
+	var push pushBody
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&push); err != nil {
+		apierror.Write(w, req, apierror.BadRequest(apierror.CodeBadRequest, "invalid JSON body").WithCause(err))
+		return
+	}
+	samples, err := push.samples()
+	if err != nil {
+		apierror.Write(w, req, apierror.BadRequest("invalid_reading", err.Error()))
 		return
 	}
-	render.JSON(w, req, allSensors)
+	if err := ss.store.ValidateSamples(id, samples, time.Now()); err != nil {
+		apierror.Write(w, req, ingestError(err))
+		return
+	}
+	res, err := ss.store.IngestSamples(id, samples)
+	if err != nil {
+		apierror.Write(w, req, ingestError(err))
+		return
+	}
+	logger.Ctx(req.Context()).Debug("node readings pushed", "sensor_id", id,
+		"accepted", res.Accepted, "late", res.Late, "duplicates", res.Duplicates)
+	if key != "" {
+		result, err := json.Marshal(res)
+		if err == nil {
+			err = ss.store.SaveIdempotentResult(id, key, requestHash, result)
+		}
+		if err != nil {
+			logger.Ctx(req.Context()).Error("save idempotent push", "sensor_id", id, "err", err)
+		}
+	}
+	render.JSON(w, req, res)
+}
+
+// getReadingsHandler lists the stored samples of a node in the order they
+// were taken, by default those of the last day.
+func (ss *sensorServer) getReadingsHandler(w http.ResponseWriter, req *http.Request) {
+	sensor := req.Context().Value(constants.SensorContextID).(Sensor)
+	q := req.URL.Query()
+	since := time.Now().Add(-24 * time.Hour)
+	if v := q.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			apierror.Write(w, req, apierror.BadRequest("invalid_since", "since must be an RFC 3339 time"))
+			return
+		}
+		since = t
+	}
+	limit := MaxBatch
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 10*MaxBatch {
+			apierror.Write(w, req, apierror.BadRequest("invalid_limit",
+				fmt.Sprintf("limit must be between 1 and %d", 10*MaxBatch)))
+			return
+		}
+		limit = n
+	}
+	samples, err := ss.store.Samples(int(*sensor.SensorID), since, limit)
+	if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	render.JSON(w, req, samples)
+}
+
+// getNodesHandler lists the remote nodes, only those with the given
+// ?status= if set.
+func (ss *sensorServer) getNodesHandler(w http.ResponseWriter, req *http.Request) {
+	status := req.URL.Query().Get("status")
+	nodes := ss.store.Nodes()
+	if status != "" {
+		kept := nodes[:0]
+		for _, n := range nodes {
+			if n.Status == status {
+				kept = append(kept, n)
+			}
+		}
+		nodes = kept
+	}
+	render.JSON(w, req, nodes)
+}
+
+// postNodeHandler registers a node that pushes over HTTP. The device token
+// is in the response only.
+func (ss *sensorServer) postNodeHandler(w http.ResponseWriter, req *http.Request) {
+	body := struct {
+		NodeID     string       `json:"node_id"`
+		Quantities QuantityList `json:"quantities"`
+	}{}
+	if !apierror.DecodeStrict(w, req, &body) {
+		return
+	}
+	n, token, err := ss.store.RegisterNode(body.NodeID, body.Quantities)
+	if err != nil {
+		apierror.Write(w, req, ingestError(err))
+		return
+	}
+	logger.Ctx(req.Context()).Info("node registered for push", "sensor_id", n.SensorID, "node", n.NodeID)
+	w.WriteHeader(http.StatusCreated)
+	render.JSON(w, req, map[string]interface{}{"node": n, "token": token})
+}
+
+// postTokenHandler replaces the device token of a node.
+func (ss *sensorServer) postTokenHandler(w http.ResponseWriter, req *http.Request) {
+	sensor := req.Context().Value(constants.SensorContextID).(Sensor)
+	token, err := ss.store.RotateToken(int(*sensor.SensorID))
+	if err != nil {
+		apierror.Write(w, req, ingestError(err))
+		return
+	}
+	logger.Ctx(req.Context()).Info("device token rotated", "sensor_id", *sensor.SensorID)
+	render.JSON(w, req, map[string]interface{}{"sensor_id": *sensor.SensorID, "token": token})
+}
+
+func (ss *sensorServer) getEnrollmentsHandler(w http.ResponseWriter, req *http.Request) {
+	enrollments, err := ss.store.Enrollments()
+	if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	render.JSON(w, req, enrollments)
+}
+
+// postEnrollmentHandler issues an enrollment code, optionally only for
+// re-enrolling the node of {"sensor_id": ...}. The code is in the response
+// only.
+func (ss *sensorServer) postEnrollmentHandler(w http.ResponseWriter, req *http.Request) {
+	body := struct {
+		SensorID *int `json:"sensor_id"`
+	}{}
+	dec := json.NewDecoder(req.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		apierror.Write(w, req, apierror.BadRequest(apierror.CodeBadRequest, "invalid JSON body").WithCause(err))
+		return
+	}
+	e, code, err := ss.store.CreateEnrollment(callerEmail(req), body.SensorID)
+	if errors.Is(err, ErrNotFound) {
+		apierror.Write(w, req, apierror.NotFound("sensor_not_found", err.Error()))
+		return
+	} else if err != nil {
+		apierror.Write(w, req, ingestError(err))
+		return
+	}
+	logger.Ctx(req.Context()).Info("enrollment code created", "enrollment_id", e.ID, "expires_at", e.ExpiresAt)
+	w.WriteHeader(http.StatusCreated)
+	render.JSON(w, req, map[string]interface{}{"enrollment": e, "code": code})
+}
+
+// postEnrollHandler trades an enrollment code for a sensor ID and device
+// token. The node cannot send readings until an admin approves it.
+func (ss *sensorServer) postEnrollHandler(w http.ResponseWriter, req *http.Request) {
+	body := struct {
+		Code       string       `json:"code"`
+		NodeID     string       `json:"node_id"`
+		Quantities QuantityList `json:"quantities"`
+	}{}
+	if !apierror.DecodeStrict(w, req, &body) {
+		return
+	}
+	enrolled, err := ss.store.Enroll(body.Code, body.NodeID, body.Quantities)
+	if errors.Is(err, ErrBadEnrollment) {
+		logger.Ctx(req.Context()).Warn("enrollment refused", "node", body.NodeID)
+		apierror.Write(w, req, apierror.New(http.StatusForbidden, "invalid_enrollment_code", err.Error()))
+		return
+	} else if err != nil {
+		apierror.Write(w, req, ingestError(err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	render.JSON(w, req, enrolled)
+}
+
+// postApproveHandler lets a pending node send readings and names it.
+func (ss *sensorServer) postApproveHandler(w http.ResponseWriter, req *http.Request) {
+	sensor := req.Context().Value(constants.SensorContextID).(Sensor)
+	body := struct {
+		Name string `json:"name"`
+		Room string `json:"room"`
+	}{}
+	if !apierror.DecodeStrict(w, req, &body) {
+		return
+	}
+	n, err := ss.store.ApproveNode(int(*sensor.SensorID), body.Name, body.Room, callerEmail(req))
+	if err != nil {
+		apierror.Write(w, req, ingestError(err))
+		return
+	}
+	logger.Ctx(req.Context()).Info("node approved", "sensor_id", n.SensorID, "node", n.NodeID,
+		"name", n.Name, "room", n.Room)
+	render.JSON(w, req, n)
+}
+
+// postRevokeHandler stops a node for good; it has to enroll again to come
+// back.
+func (ss *sensorServer) postRevokeHandler(w http.ResponseWriter, req *http.Request) {
+	sensor := req.Context().Value(constants.SensorContextID).(Sensor)
+	n, err := ss.store.RevokeNode(int(*sensor.SensorID))
+	if err != nil {
+		apierror.Write(w, req, ingestError(err))
+		return
+	}
+	logger.Ctx(req.Context()).Info("node revoked", "sensor_id", n.SensorID, "node", n.NodeID)
+	render.JSON(w, req, n)
+}
+
+// EnrollPageHandler shows the nodes waiting for approval and, on POST, a
+// new enrollment code with its QR code. Creating codes on POST keeps them
+// out of URLs and logs. The QR code holds {"server":...,"code":...}.
+func (ss *sensorServer) EnrollPageHandler(w http.ResponseWriter, req *http.Request) {
+	data := map[string]interface{}{}
+	pending := []Node{}
+	for _, n := range ss.store.Nodes() {
+		if n.Status == NodePending {
+			pending = append(pending, n)
+		}
+	}
+	data["Pending"] = pending
+
+	if req.Method == http.MethodPost {
+		e, code, err := ss.store.CreateEnrollment(callerEmail(req), nil)
+		if err != nil {
+			apierror.Write(w, req, err)
+			return
+		}
+		server := origin(req)
+		payload, _ := json.Marshal(map[string]string{"server": server, "code": code})
+		png, err := qrcode.Encode(string(payload), qrcode.Medium, 256)
+		if err != nil {
+			apierror.Write(w, req, err)
+			return
+		}
+		logger.Ctx(req.Context()).Info("enrollment code created", "enrollment_id", e.ID, "expires_at", e.ExpiresAt)
+		data["Enrollment"], data["Code"], data["Server"] = e, code, server
+		data["QR"] = base64.StdEncoding.EncodeToString(png)
+	}
+
+	tmpl, err := template.ParseFiles(
+		filepath.Join(ss.Templates, "layout.html"),
+		filepath.Join(ss.Templates, "enroll.html"),
+	)
+	if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := tmpl.ExecuteTemplate(w, "layout", data); err != nil {
+		logger.Ctx(req.Context()).Error("error rendering enrollment page", "err", err)
+	}
+}
+
+// origin is the scheme and host the caller reached the server at.
+func origin(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host
+}
+
+func ingestError(err error) error {
+	switch {
+	case errors.Is(err, ErrNodePending):
+		return apierror.New(http.StatusForbidden, "node_pending", err.Error())
+	case errors.Is(err, ErrNodeRevoked):
+		return apierror.New(http.StatusForbidden, "node_revoked", err.Error())
+	case errors.Is(err, ErrNotPending):
+		return apierror.New(http.StatusConflict, apierror.CodeConflict, err.Error())
+	case errors.Is(err, ErrInvalidReading):
+		return apierror.BadRequest("invalid_reading", err.Error())
+	case errors.Is(err, ErrNotNode):
+		return apierror.New(http.StatusConflict, apierror.CodeConflict, err.Error())
+	case errors.Is(err, ErrNoNodeIDs):
+		return apierror.New(http.StatusConflict, apierror.CodeConflict, err.Error())
+	case errors.Is(err, ErrNodeExists):
+		return apierror.New(http.StatusConflict, "node_exists", err.Error())
+	}
+	return err
+}
+
+// callerEmail is who is logged in, or empty when auth is off.
+func callerEmail(req *http.Request) string {
+	if s := session.FromContext(req.Context()); s != nil {
+		return s.Email
+	}
+	return ""
+}
+
+func calibrationError(err error) error {
+	if errors.Is(err, ErrCalibration) {
+		return apierror.BadRequest("invalid_calibration", err.Error())
+	}
+	return err
+}
+
+// unitsFor applies ?units= on top of the caller's preference, or SI.
+func (ss *sensorServer) unitsFor(r *http.Request) (units.System, error) {
+	sys := units.SI
+	if ss.Preferred != nil {
+		if p, ok := ss.Preferred(r); ok {
+			sys = p
+		}
+	}
+	spec := r.URL.Query().Get("units")
+	if spec == "" {
+		return sys, nil
+	}
+	sys, err := sys.Apply(spec)
+	if err != nil {
+		return sys, apierror.BadRequest("invalid_units", err.Error()).
+			WithDetails(map[string]string{"units": spec})
+	}
+	return sys, nil
+}
+
+// sensorUnavailable reports a failed hardware read. The bus error is logged
+// rather than returned.
+func sensorUnavailable(err error) *apierror.Error {
+	return apierror.New(http.StatusServiceUnavailable, apierror.CodeUnavailable,
+		"sensor read failed").WithCause(err)
 }
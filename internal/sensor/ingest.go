@@ -0,0 +1,464 @@
+package sensor
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SourceHTTP is the Source of nodes that push readings over HTTP.
+const SourceHTTP = "http"
+
+const (
+	// MaxBatch bounds the readings in one push.
+	MaxBatch = 1000
+	// maxClockSkew is how far in the future a node's timestamp may be.
+	maxClockSkew = 5 * time.Minute
+	// sampleRetention is how long node samples are kept, and so how late a
+	// sample may arrive and still be stored.
+	sampleRetention = 7 * 24 * time.Hour
+	// idempotencyTTL is how long a push can be replayed by its key.
+	idempotencyTTL = 24 * time.Hour
+)
+
+var (
+	// ErrInvalidReading is wrapped by errors caused by pushed readings that
+	// do not fit the sensor.
+	ErrInvalidReading = errors.New("invalid reading")
+	// ErrBadToken is returned for device tokens that do not belong to the
+	// sensor.
+	ErrBadToken = errors.New("invalid device token")
+	// ErrIdempotencyConflict is returned when an idempotency key is reused
+	// for a different request.
+	ErrIdempotencyConflict = errors.New("idempotency key was used for a different request")
+	// ErrNotNode is returned for operations only remote nodes support.
+	ErrNotNode = errors.New("sensor is not a remote node")
+)
+
+// plausible bounds every pushed value, in °C, %RH and Pa, to what a
+// working sensor can report.
+var plausible = map[string][2]float64{
+	QuantityTemperature: {-80, 100},
+	QuantityHumidity:    {0, 100},
+	QuantityPressure:    {30000, 120000},
+}
+
+// QuantityList is the quantities a node reports; empty allows all. It is
+// stored as a comma separated column.
+type QuantityList []string
+
+// Value stores l as a comma separated string.
+func (l QuantityList) Value() (driver.Value, error) {
+	return strings.Join(l, ","), nil
+}
+
+// Scan reads l back from its column.
+func (l *QuantityList) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into sensor.QuantityList", src)
+	}
+	*l = nil
+	if s != "" {
+		*l = strings.Split(s, ",")
+	}
+	return nil
+}
+
+func (l QuantityList) allows(q string) bool {
+	return len(l) == 0 || contains(l, q)
+}
+
+// NodeSample is one reading a remote node sent, as sent, in °C, %RH and
+// Pa. Samples are kept for sampleRetention in the order they were taken,
+// whenever they arrived.
+type NodeSample struct {
+	ID          uint      `json:"-" gorm:"primaryKey"`
+	SensorID    int       `json:"-" gorm:"uniqueIndex:idx_node_sample;not null"`
+	At          time.Time `json:"at" gorm:"uniqueIndex:idx_node_sample;not null"`
+	Temperature *float64  `json:"temperature,omitempty"`
+	Humidity    *float64  `json:"humidity,omitempty"`
+	Pressure    *float64  `json:"pressure,omitempty"`
+	ReceivedAt  time.Time `json:"received_at"`
+}
+
+func (n NodeSample) raw() Raw {
+	to32 := func(v *float64) *float32 {
+		if v == nil {
+			return nil
+		}
+		f := float32(*v)
+		return &f
+	}
+	return Raw{Temperature: to32(n.Temperature), Humidity: to32(n.Humidity), Pressure: to32(n.Pressure)}
+}
+
+func (n NodeSample) quantity(name string) *float64 {
+	switch name {
+	case QuantityTemperature:
+		return n.Temperature
+	case QuantityHumidity:
+		return n.Humidity
+	case QuantityPressure:
+		return n.Pressure
+	}
+	return nil
+}
+
+// IngestResult counts what became of the samples of one push.
+type IngestResult struct {
+	SensorID int `json:"sensor_id"`
+	// Accepted samples were newer than the sensor's reading and became it,
+	// in the order they were taken.
+	Accepted int `json:"accepted"`
+	// Late samples were older than the sensor's reading; they are only
+	// stored, in their place in the history.
+	Late int `json:"late"`
+	// Duplicates had the timestamp of a sample already stored.
+	Duplicates int `json:"duplicates"`
+}
+
+// IdempotentPush is the stored response to a push with an
+// Idempotency-Key, replayed when the node retries.
+type IdempotentPush struct {
+	SensorID    int    `gorm:"primaryKey;autoIncrement:false"`
+	Key         string `gorm:"primaryKey"`
+	RequestHash string
+	Result      []byte
+	CreatedAt   time.Time `gorm:"index"`
+}
+
+func (ss *SensorStore) loadSamples() error {
+	if err := ss.db.AutoMigrate(&NodeSample{}, &IdempotentPush{}); err != nil {
+		return fmt.Errorf("migrate node samples: %v", err)
+	}
+	return nil
+}
+
+// ValidateSamples checks pushed samples against the quantities sensor id
+// reports and the range a working sensor can read. Samples without a time
+// are given now.
+func (ss *SensorStore) ValidateSamples(id int, samples []NodeSample, now time.Time) error {
+	ss.Lock()
+	s, ok := ss.sensors[id]
+	ss.Unlock()
+	if !ok {
+		return fmt.Errorf("sensor with id=%d: %w", id, ErrNotFound)
+	}
+	if s.node == nil {
+		return fmt.Errorf("sensor with id=%d: %w", id, ErrNotNode)
+	}
+	if len(samples) == 0 || len(samples) > MaxBatch {
+		return fmt.Errorf("%w: send between 1 and %d readings", ErrInvalidReading, MaxBatch)
+	}
+	for i := range samples {
+		smp := &samples[i]
+		if smp.At.IsZero() {
+			smp.At = now
+		}
+		if smp.At.After(now.Add(maxClockSkew)) {
+			return fmt.Errorf("%w: readings[%d].at %s is in the future", ErrInvalidReading, i, smp.At.Format(time.RFC3339))
+		}
+		if smp.At.Before(now.Add(-sampleRetention)) {
+			return fmt.Errorf("%w: readings[%d].at %s is older than %v", ErrInvalidReading, i, smp.At.Format(time.RFC3339), sampleRetention)
+		}
+		values := 0
+		for _, q := range []string{QuantityTemperature, QuantityHumidity, QuantityPressure} {
+			v := smp.quantity(q)
+			if v == nil {
+				continue
+			}
+			if !s.node.Quantities.allows(q) {
+				return fmt.Errorf("%w: readings[%d]: sensor %d does not report %s", ErrInvalidReading, i, id, q)
+			}
+			if r := plausible[q]; *v < r[0] || *v > r[1] {
+				return fmt.Errorf("%w: readings[%d].%s %v is outside %v..%v", ErrInvalidReading, i, q, *v, r[0], r[1])
+			}
+			values++
+		}
+		if values == 0 {
+			return fmt.Errorf("%w: readings[%d] has no values", ErrInvalidReading, i)
+		}
+	}
+	return nil
+}
+
+// IngestSamples records samples pushed by the node of sensor id. Call
+// ValidateSamples first.
+func (ss *SensorStore) IngestSamples(id int, samples []NodeSample) (IngestResult, error) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	s, ok := ss.sensors[id]
+	if !ok {
+		return IngestResult{}, fmt.Errorf("sensor with id=%d: %w", id, ErrNotFound)
+	}
+	if s.node == nil {
+		return IngestResult{}, fmt.Errorf("sensor with id=%d: %w", id, ErrNotNode)
+	}
+	if err := s.node.active(); err != nil {
+		return IngestResult{}, fmt.Errorf("sensor with id=%d: %w", id, err)
+	}
+	return ss.ingestLocked(id, s, samples)
+}
+
+// ingestLocked stores samples in the order they were taken, keeping their
+// timestamps; callers reject those more than maxClockSkew ahead. Once they
+// are committed, the node is seen and those newer than the sensor's
+// reading become it, one after the other, so filters and observers see
+// them in order; older ones are only stored.
+func (ss *SensorStore) ingestLocked(id int, s *Sensor, samples []NodeSample) (IngestResult, error) {
+	res := IngestResult{SensorID: id}
+	now := time.Now().UTC()
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].At.Before(samples[j].At) })
+
+	var accepted []NodeSample
+	err := ss.db.Transaction(func(tx *gorm.DB) error {
+		res, accepted = IngestResult{SensorID: id}, nil
+		readAt := s.ReadAt
+		for i := range samples {
+			smp := samples[i]
+			if smp.At.IsZero() {
+				smp.At = now
+			}
+			smp.ID, smp.SensorID, smp.At, smp.ReceivedAt = 0, id, smp.At.UTC(), now
+			created := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&smp)
+			if created.Error != nil {
+				return fmt.Errorf("save node sample: %v", created.Error)
+			}
+			switch {
+			case created.RowsAffected == 0:
+				res.Duplicates++
+			case readAt != nil && !smp.At.After(*readAt):
+				res.Late++
+			default:
+				accepted = append(accepted, smp)
+				readAt = &smp.At
+				res.Accepted++
+			}
+		}
+		if err := tx.Model(&Node{}).Where("sensor_id = ?", id).Update("last_seen_at", now).Error; err != nil {
+			return fmt.Errorf("save node last seen: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return IngestResult{SensorID: id}, err
+	}
+
+	s.node.LastSeenAt = &now
+	s.LastSeen = &now
+	ss.setOnline(id, true, nil)
+	for _, smp := range accepted {
+		s.update(smp.raw(), smp.At)
+		ss.observe(id, s)
+	}
+	return res, nil
+}
+
+// Samples returns the stored samples of sensor id taken since since, in
+// the order they were taken.
+func (ss *SensorStore) Samples(id int, since time.Time, limit int) ([]NodeSample, error) {
+	ss.Lock()
+	_, ok := ss.sensors[id]
+	ss.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("sensor with id=%d: %w", id, ErrNotFound)
+	}
+	samples := []NodeSample{}
+	err := ss.db.Where("sensor_id = ? AND at >= ?", id, since.UTC()).Order("at").Limit(limit).Find(&samples).Error
+	if err != nil {
+		return nil, fmt.Errorf("load node samples: %v", err)
+	}
+	return samples, nil
+}
+
+// pruneSamples drops samples and idempotency keys that have expired.
+func (ss *SensorStore) pruneSamples(now time.Time) {
+	if err := ss.db.Where("at < ?", now.Add(-sampleRetention)).Delete(&NodeSample{}).Error; err != nil {
+		logger.Error("prune node samples", "err", err)
+	}
+	if err := ss.db.Where("created_at < ?", now.Add(-idempotencyTTL)).Delete(&IdempotentPush{}).Error; err != nil {
+		logger.Error("prune idempotency keys", "err", err)
+	}
+}
+
+// IdempotentResult returns the stored response to the push of sensor id
+// with key, or nil when there is none. A key reused with a different
+// request hash is ErrIdempotencyConflict.
+func (ss *SensorStore) IdempotentResult(id int, key, requestHash string) ([]byte, error) {
+	var p IdempotentPush
+	err := ss.db.Where("sensor_id = ? AND key = ? AND created_at >= ?", id, key, time.Now().Add(-idempotencyTTL)).First(&p).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("load idempotency key: %v", err)
+	}
+	if p.RequestHash != requestHash {
+		return nil, ErrIdempotencyConflict
+	}
+	return p.Result, nil
+}
+
+// SaveIdempotentResult stores the response to the push of sensor id with
+// key.
+func (ss *SensorStore) SaveIdempotentResult(id int, key, requestHash string, result []byte) error {
+	p := IdempotentPush{SensorID: id, Key: key, RequestHash: requestHash, Result: result, CreatedAt: time.Now().UTC()}
+	if err := ss.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&p).Error; err != nil {
+		return fmt.Errorf("save idempotency key: %v", err)
+	}
+	return nil
+}
+
+// RegisterNode adds a node that pushes its readings over HTTP and returns
+// it with its device token. The token is only shown here.
+func (ss *SensorStore) RegisterNode(nodeID string, quantities QuantityList) (Node, string, error) {
+	for _, q := range quantities {
+		if _, ok := plausible[q]; !ok {
+			return Node{}, "", fmt.Errorf("%w: unknown quantity %q", ErrInvalidReading, q)
+		}
+	}
+	if strings.TrimSpace(nodeID) == "" {
+		return Node{}, "", fmt.Errorf("%w: node_id is required", ErrInvalidReading)
+	}
+	ss.Lock()
+	defer ss.Unlock()
+
+	for _, s := range ss.sensors {
+		if s.node != nil && s.node.Source == SourceHTTP && s.node.NodeID == nodeID {
+			return Node{}, "", fmt.Errorf("%w: node %q already exists", ErrInvalidReading, nodeID)
+		}
+	}
+	_, s, err := ss.nodeLocked(SourceHTTP, nodeID)
+	if err != nil {
+		return Node{}, "", err
+	}
+	s.node.Quantities = quantities
+	token, err := ss.setTokenLocked(s)
+	if err != nil {
+		return Node{}, "", err
+	}
+	return *s.node, token, nil
+}
+
+// RotateToken gives the node of sensor id a new device token, replacing
+// the old one.
+func (ss *SensorStore) RotateToken(id int) (string, error) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	s, ok := ss.sensors[id]
+	if !ok {
+		return "", fmt.Errorf("sensor with id=%d: %w", id, ErrNotFound)
+	}
+	if s.node == nil {
+		return "", fmt.Errorf("sensor with id=%d: %w", id, ErrNotNode)
+	}
+	return ss.setTokenLocked(s)
+}
+
+func (ss *SensorStore) setTokenLocked(s *Sensor) (string, error) {
+	token, err := newDeviceToken()
+	if err != nil {
+		return "", err
+	}
+	s.node.TokenHash = hashToken(token)
+	err = ss.db.Model(s.node).Select("token_hash", "quantities").Updates(s.node).Error
+	if err != nil {
+		return "", fmt.Errorf("save device token: %v", err)
+	}
+	return token, nil
+}
+
+func newDeviceToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate device token: %v", err)
+	}
+	return "skd_" + hex.EncodeToString(b), nil
+}
+
+// Authenticate checks that token is the device token of sensor id and
+// that the node is approved.
+func (ss *SensorStore) Authenticate(id int, token string) error {
+	ss.Lock()
+	defer ss.Unlock()
+	return ss.authenticateLocked(id, token)
+}
+
+// RedeemToken checks the device token of sensor id like Authenticate and
+// uses it up: the token is cleared before fn runs and only restored if fn
+// fails, so it works for one fn and no longer for pushes. Nodes trade
+// their token for a client certificate this way. fn runs under the store
+// lock.
+func (ss *SensorStore) RedeemToken(id int, token string, fn func() error) error {
+	ss.Lock()
+	defer ss.Unlock()
+
+	if err := ss.authenticateLocked(id, token); err != nil {
+		return err
+	}
+	n := ss.sensors[id].node
+	hash := n.TokenHash
+	if err := ss.db.Model(n).Update("token_hash", "").Error; err != nil {
+		return fmt.Errorf("redeem device token: %v", err)
+	}
+	n.TokenHash = ""
+	if err := fn(); err != nil {
+		if rerr := ss.db.Model(n).Update("token_hash", hash).Error; rerr != nil {
+			logger.Error("restore device token", "sensor_id", id, "err", rerr)
+		} else {
+			n.TokenHash = hash
+		}
+		return err
+	}
+	logger.Info("device token redeemed", "sensor_id", id)
+	return nil
+}
+
+func (ss *SensorStore) authenticateLocked(id int, token string) error {
+	s, ok := ss.sensors[id]
+	if !ok || s.node == nil || s.node.TokenHash == "" || token == "" {
+		return ErrBadToken
+	}
+	if subtle.ConstantTimeCompare([]byte(s.node.TokenHash), []byte(hashToken(token))) != 1 {
+		return ErrBadToken
+	}
+	return s.node.active()
+}
+
+// Nodes lists every remote node by sensor ID.
+func (ss *SensorStore) Nodes() []Node {
+	ss.Lock()
+	defer ss.Unlock()
+
+	nodes := []Node{}
+	for _, s := range ss.sensors {
+		if s.node != nil {
+			nodes = append(nodes, *s.node)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].SensorID < nodes[j].SensorID })
+	return nodes
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
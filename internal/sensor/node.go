@@ -0,0 +1,255 @@
+package sensor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SourceLocal is the Source of the BME280 read over I2C.
+const SourceLocal = "local"
+
+// Remote nodes get sensor IDs from firstNodeID up, clear of the chip IDs
+// local sensors are known by (0x60 for a BME280).
+const (
+	firstNodeID = 128
+	lastNodeID  = 255
+	// nodeCheckInterval is how often WatchNodes looks for silent nodes,
+	// and samplePruneInterval how often it drops expired samples.
+	nodeCheckInterval   = 15 * time.Second
+	samplePruneInterval = time.Hour
+)
+
+// Nodes are approved when they are registered by an admin or heard over
+// MQTT. Enrolled nodes are pending until an admin approves them, and any
+// node can be revoked. Only approved nodes are read and take readings.
+const (
+	NodePending  = "pending"
+	NodeApproved = "approved"
+	NodeRevoked  = "revoked"
+)
+
+var (
+	// ErrNoNodeIDs is returned when every sensor ID for nodes is taken.
+	ErrNoNodeIDs = errors.New("no sensor IDs left for remote nodes")
+	// ErrNodePending is returned for readings of nodes not yet approved.
+	ErrNodePending = errors.New("node is pending approval")
+	// ErrNodeRevoked is returned for readings of revoked nodes.
+	ErrNodeRevoked = errors.New("node is revoked")
+)
+
+// Node is a remote sensor: a board that sends its readings, over MQTT for
+// example, instead of being read over I2C. Nodes are registered the first
+// time they are heard from and keep their sensor ID across restarts.
+type Node struct {
+	SensorID int `json:"sensor_id" gorm:"primaryKey;autoIncrement:false"`
+	// Source is the transport the node sends over, e.g. "mqtt", and
+	// NodeID what it calls itself there.
+	Source     string     `json:"source" gorm:"uniqueIndex:idx_node;not null"`
+	NodeID     string     `json:"node_id" gorm:"uniqueIndex:idx_node;not null"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	// Quantities limits what a node pushing over HTTP may report, and
+	// TokenHash is the SHA-256 of its device token.
+	Quantities QuantityList `json:"quantities,omitempty" gorm:"type:text"`
+	TokenHash  string       `json:"-"`
+	// Status is NodePending, NodeApproved or NodeRevoked. Name and Room
+	// are set when an admin approves an enrolled node.
+	Status     string     `json:"status" gorm:"not null;default:approved"`
+	Name       string     `json:"name,omitempty"`
+	Room       string     `json:"room,omitempty"`
+	ApprovedBy string     `json:"approved_by,omitempty"`
+	ApprovedAt *time.Time `json:"approved_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (ss *SensorStore) loadNodes() error {
+	if err := ss.db.AutoMigrate(&Node{}); err != nil {
+		return fmt.Errorf("migrate sensor nodes: %v", err)
+	}
+	var nodes []Node
+	if err := ss.db.Find(&nodes).Error; err != nil {
+		return fmt.Errorf("load sensor nodes: %v", err)
+	}
+	for i := range nodes {
+		ss.sensors[nodes[i].SensorID] = newNodeSensor(&nodes[i])
+	}
+	return nil
+}
+
+func newNodeSensor(n *Node) *Sensor {
+	id := uint8(n.SensorID)
+	return &Sensor{SensorID: &id, Source: n.Source, NodeID: n.NodeID, Name: n.Name, Room: n.Room,
+		LastSeen: n.LastSeenAt, node: n}
+}
+
+// Ingest records a reading in °C, %RH and Pa that node nodeID sent over
+// source, taken at t, or when it arrived if t is zero; t may be at most
+// maxClockSkew ahead. A node heard for the first time is registered as a
+// new sensor. Readings no newer than the node's latest are stored but do
+// not replace it; the result says which it was.
+func (ss *SensorStore) Ingest(source, nodeID string, t time.Time, raw Raw) (IngestResult, error) {
+	if t.After(time.Now().Add(maxClockSkew)) {
+		return IngestResult{}, fmt.Errorf("%w: reading at %s is in the future", ErrInvalidReading, t.Format(time.RFC3339))
+	}
+	ss.Lock()
+	defer ss.Unlock()
+
+	id, s, err := ss.nodeLocked(source, nodeID)
+	if err != nil {
+		return IngestResult{}, err
+	}
+	if err := s.node.active(); err != nil {
+		return IngestResult{SensorID: id}, fmt.Errorf("node %q: %w", nodeID, err)
+	}
+	sample := NodeSample{At: t}
+	for _, q := range []string{QuantityTemperature, QuantityHumidity, QuantityPressure} {
+		if v := raw.quantity(q); v != nil {
+			f := float64(*v)
+			switch q {
+			case QuantityTemperature:
+				sample.Temperature = &f
+			case QuantityHumidity:
+				sample.Humidity = &f
+			case QuantityPressure:
+				sample.Pressure = &f
+			}
+		}
+	}
+	res, err := ss.ingestLocked(id, s, []NodeSample{sample})
+	if err != nil {
+		return res, err
+	}
+	logger.Debug("node reading", "sensor_id", id, "source", source, "node", nodeID,
+		"temperature_c", raw.Temperature, "pressure_pa", raw.Pressure, "humidity_rh", raw.Humidity)
+	return res, nil
+}
+
+// nodeLocked finds the sensor of a node, registering the node when it is
+// new.
+func (ss *SensorStore) nodeLocked(source, nodeID string) (int, *Sensor, error) {
+	for id, s := range ss.sensors {
+		if s.node != nil && s.node.Source == source && s.node.NodeID == nodeID {
+			return id, s, nil
+		}
+	}
+	id, err := ss.freeNodeIDLocked()
+	if err != nil {
+		return 0, nil, err
+	}
+	n := &Node{SensorID: id, Source: source, NodeID: nodeID, Status: NodeApproved}
+	if err := ss.db.Create(n).Error; err != nil {
+		return 0, nil, fmt.Errorf("register node %q: %v", nodeID, err)
+	}
+	s, err := ss.addNodeLocked(n)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, s, nil
+}
+
+// freeNodeIDLocked returns the lowest sensor ID for nodes not yet taken.
+func (ss *SensorStore) freeNodeIDLocked() (int, error) {
+	for id := firstNodeID; id <= lastNodeID; id++ {
+		if _, taken := ss.sensors[id]; !taken {
+			return id, nil
+		}
+	}
+	return 0, ErrNoNodeIDs
+}
+
+// addNodeLocked makes the stored node n a sensor, with the calibration
+// and site its sensor ID may have from an earlier node.
+func (ss *SensorStore) addNodeLocked(n *Node) (*Sensor, error) {
+	id := n.SensorID
+	s := newNodeSensor(n)
+	s.filters = newSensorFilters(ss.filterDefaults)
+	c, err := ss.currentCalibration(id)
+	if err != nil {
+		return nil, err
+	}
+	s.Calibration = c
+	var site Site
+	if err := ss.db.First(&site, "sensor_id = ?", id).Error; err == nil {
+		s.Site = site
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("load sensor site: %v", err)
+	}
+	ss.sensors[id] = s
+	logger.Info("node registered", "sensor_id", id, "source", n.Source, "node", n.NodeID)
+	return s, nil
+}
+
+// active returns why n may not send readings, or nil when it may.
+func (n *Node) active() error {
+	switch n.Status {
+	case NodePending:
+		return ErrNodePending
+	case NodeRevoked:
+		return ErrNodeRevoked
+	}
+	return nil
+}
+
+// checkNode marks a node offline once it has been silent for longer than
+// the node timeout. Ingest brings it back. A node that has not sent
+// anything yet gets the timeout from when it was created or approved.
+func (ss *SensorStore) checkNode(id int, s *Sensor, now time.Time) {
+	seen := s.node.LastSeenAt
+	switch {
+	case seen == nil:
+		since := s.node.CreatedAt
+		if a := s.node.ApprovedAt; a != nil && a.After(since) {
+			since = *a
+		}
+		if now.Sub(since) > ss.nodeTimeout {
+			ss.setOnline(id, false, fmt.Errorf("node %q has not sent a reading", s.node.NodeID))
+		}
+	case now.Sub(*seen) > ss.nodeTimeout:
+		ss.setOnline(id, false, fmt.Errorf("no reading from node %q since %s", s.node.NodeID, seen.Format(time.RFC3339)))
+	default:
+		ss.setOnline(id, true, nil)
+	}
+}
+
+// WatchNodes marks nodes that stop sending offline and drops expired
+// samples, until ctx is done.
+func (ss *SensorStore) WatchNodes(ctx context.Context) {
+	t := time.NewTicker(nodeCheckInterval)
+	defer t.Stop()
+	prune := time.NewTicker(samplePruneInterval)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-prune.C:
+			ss.pruneSamples(now)
+		case now := <-t.C:
+			ss.Lock()
+			for id, s := range ss.sensors {
+				if s.node != nil && s.node.Status == NodeApproved {
+					ss.checkNode(id, s, now)
+				}
+			}
+			ss.Unlock()
+		}
+	}
+}
+
+// Source returns how sensor id reports: SourceLocal, or the transport of
+// a remote node with the node's ID there.
+func (ss *SensorStore) Source(id int) (source, nodeID string, err error) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	s, ok := ss.sensors[id]
+	if !ok {
+		return "", "", fmt.Errorf("sensor with id=%d: %w", id, ErrNotFound)
+	}
+	return s.Source, s.NodeID, nil
+}
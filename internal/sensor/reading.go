@@ -0,0 +1,233 @@
+package sensor
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/baro"
+	"github.com/maskarb/skarbek-dev/internal/filter"
+	"github.com/maskarb/skarbek-dev/internal/psychro"
+	"github.com/maskarb/skarbek-dev/internal/units"
+)
+
+// Reading is how a Sensor is shown in the API: values converted to the
+// caller's units, with the unit of every value spelled out in Units.
+type Reading struct {
+	SensorID *uint8 `json:"sensor_id,omitempty"`
+	// Source is "local" for the BME280 on the server, or the transport a
+	// remote node sends over, e.g. "mqtt"; NodeID is the node's name there.
+	Source string `json:"source"`
+	NodeID string `json:"node_id,omitempty"`
+	// Name and Room are set for enrolled nodes once approved.
+	Name string `json:"name,omitempty"`
+	Room string `json:"room,omitempty"`
+	// ReadAt is when the values were taken. A node that has been silent for
+	// longer than sensor.node_timeout is not Online; its values are the
+	// last it sent, and LastSeen is when that was.
+	ReadAt   *time.Time `json:"read_at,omitempty"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	Online   bool       `json:"online"`
+
+	Temperature *float64 `json:"temperature,omitempty"`
+	Humidity    *float64 `json:"humidity,omitempty"`
+	Pressure    *float64 `json:"pressure,omitempty"`
+	Altitude    *float64 `json:"altitude,omitempty"`
+
+	// AltitudeReference is the sea-level pressure Altitude was computed
+	// against: the site's QNH if set, else the standard 101325 Pa.
+	AltitudeReference *float64 `json:"altitude_reference_pressure,omitempty"`
+	// StationElevation, QNH and QFF are only present for sensors with a
+	// known elevation. QNH reduces Pressure to sea level through the
+	// standard atmosphere, QFF through the measured temperature.
+	StationElevation *float64 `json:"station_elevation,omitempty"`
+	QNH              *float64 `json:"qnh,omitempty"`
+	QFF              *float64 `json:"qff,omitempty"`
+
+	// Units maps each value field above to its unit symbol.
+	Units map[string]units.Unit `json:"units"`
+
+	// CalibrationVersion identifies the coefficients applied to the values
+	// above; 0 means none. Raw has the values as read from the chip,
+	// before filters and calibration, in the same units.
+	CalibrationVersion int         `json:"calibration_version"`
+	Raw                *RawReading `json:"raw,omitempty"`
+	// Rejected maps quantities whose latest sample the filters rejected to
+	// the reason. Their values above are the last accepted ones.
+	Rejected map[string]filter.Reason `json:"rejected,omitempty"`
+
+	// Derived is only filled in when asked for with ?derived=.
+	Derived *Derived `json:"derived,omitempty"`
+}
+
+// RawReading are values as read from the chip.
+type RawReading struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	Humidity    *float64 `json:"humidity,omitempty"`
+	Pressure    *float64 `json:"pressure,omitempty"`
+}
+
+// NewReading converts s to sys.
+func NewReading(s Sensor, sys units.System) Reading {
+	r := Reading{SensorID: s.SensorID, Units: make(map[string]units.Unit)}
+	r.Source, r.NodeID, r.Online = s.Source, s.NodeID, s.Online
+	r.Name, r.Room = s.Name, s.Room
+	r.ReadAt, r.LastSeen = s.ReadAt, s.LastSeen
+	r.CalibrationVersion = s.Calibration.Version
+	r.Rejected = s.Rejected
+	if s.Raw != (Raw{}) {
+		round := func(v *float32, unit units.Unit, fn func(float64) float64) *float64 {
+			if v == nil {
+				return nil
+			}
+			out := float64(*v)
+			if fn != nil {
+				out = fn(out)
+			}
+			out = units.Round(out, units.Decimals(unit))
+			return &out
+		}
+		r.Raw = &RawReading{
+			Temperature: round(s.Raw.Temperature, sys.Temperature, sys.Celsius),
+			Humidity:    round(s.Raw.Humidity, units.Percent, nil),
+			Pressure:    round(s.Raw.Pressure, sys.Pressure, sys.Pascal),
+		}
+	}
+	r.Temperature = r.convert("temperature", s.Temperature, sys.Temperature, sys.Celsius)
+	r.Humidity = r.convert("humidity", s.Humidity, units.Percent, nil)
+	r.Pressure = r.convert("pressure", s.Pressue, sys.Pressure, sys.Pascal)
+	r.Altitude = r.convert("altitude", s.Altitude, sys.Length, sys.Metres)
+	if s.Altitude != nil {
+		r.AltitudeReference = r.convert64("altitude_reference_pressure", s.Site.referencePressure(), sys.Pressure, sys.Pascal)
+	}
+
+	if e := s.Site.StationElevation; e != nil {
+		r.StationElevation = r.convert64("station_elevation", *e, sys.Length, sys.Metres)
+		if s.Pressue != nil {
+			p := float64(*s.Pressue)
+			r.QNH = r.convert64("qnh", baro.QNH(p, *e), sys.Pressure, sys.Pascal)
+			if s.Temperature != nil {
+				r.QFF = r.convert64("qff", baro.QFF(p, *e, float64(*s.Temperature)), sys.Pressure, sys.Pascal)
+			}
+		}
+	}
+	return r
+}
+
+// convert records unit for field and returns the converted value, or nil
+// when the sensor did not provide one.
+func (r *Reading) convert(field string, v *float32, unit units.Unit, fn func(float64) float64) *float64 {
+	if v == nil {
+		return nil
+	}
+	return r.convert64(field, float64(*v), unit, fn)
+}
+
+func (r *Reading) convert64(field string, v float64, unit units.Unit, fn func(float64) float64) *float64 {
+	if fn != nil {
+		v = fn(v)
+	}
+	v = units.Round(v, units.Decimals(unit))
+	r.Units[field] = unit
+	return &v
+}
+
+// Derived metrics that can be requested with ?derived=.
+const (
+	MetricDewPoint         = "dew_point"
+	MetricAbsoluteHumidity = "absolute_humidity"
+	MetricMixingRatio      = "mixing_ratio"
+	MetricHeatIndex        = "heat_index"
+	MetricHumidex          = "humidex"
+	MetricVPD              = "vpd"
+)
+
+var allMetrics = []string{
+	MetricDewPoint, MetricAbsoluteHumidity, MetricMixingRatio,
+	MetricHeatIndex, MetricHumidex, MetricVPD,
+}
+
+// ParseMetrics reads a comma separated list of derived metric names, or
+// "all".
+func ParseMetrics(s string) ([]string, error) {
+	var out []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch {
+		case name == "":
+		case name == "all":
+			return allMetrics, nil
+		case contains(allMetrics, name):
+			out = append(out, name)
+		default:
+			return nil, fmt.Errorf("unknown derived metric %q", name)
+		}
+	}
+	return out, nil
+}
+
+// Derived holds metrics computed from a reading. Dew point and heat index
+// follow the requested temperature unit; humidex is a °C scale index and
+// VPD is always kPa, as greenhouse tables use.
+type Derived struct {
+	DewPoint         *float64 `json:"dew_point,omitempty"`
+	AbsoluteHumidity *float64 `json:"absolute_humidity,omitempty"`
+	MixingRatio      *float64 `json:"mixing_ratio,omitempty"`
+	HeatIndex        *float64 `json:"heat_index,omitempty"`
+	Humidex          *float64 `json:"humidex,omitempty"`
+	VPD              *float64 `json:"vpd,omitempty"`
+
+	Units map[string]units.Unit `json:"units"`
+}
+
+// AddDerived computes metrics for s. Sensors without a humidity element get
+// no derived metrics; mixing ratio also needs the pressure.
+func (r *Reading) AddDerived(s Sensor, sys units.System, metrics []string) {
+	if len(metrics) == 0 || s.Temperature == nil || s.Humidity == nil {
+		return
+	}
+	t, rh := float64(*s.Temperature), float64(*s.Humidity)
+	var p float64
+	if s.Pressue != nil {
+		p = float64(*s.Pressue)
+	}
+
+	d := &Derived{Units: make(map[string]units.Unit)}
+	set := func(field string, v float64, unit units.Unit) *float64 {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil
+		}
+		v = units.Round(v, units.Decimals(unit))
+		d.Units[field] = unit
+		return &v
+	}
+	for _, m := range metrics {
+		switch m {
+		case MetricDewPoint:
+			d.DewPoint = set(m, sys.Celsius(psychro.DewPoint(t, rh)), sys.Temperature)
+		case MetricAbsoluteHumidity:
+			d.AbsoluteHumidity = set(m, psychro.AbsoluteHumidity(t, rh, p), units.GramPerCubicMetre)
+		case MetricMixingRatio:
+			if p > 0 {
+				d.MixingRatio = set(m, psychro.MixingRatio(t, rh, p), units.GramPerKilogram)
+			}
+		case MetricHeatIndex:
+			d.HeatIndex = set(m, sys.Celsius(psychro.HeatIndex(t, rh)), sys.Temperature)
+		case MetricHumidex:
+			d.Humidex = set(m, psychro.Humidex(t, rh), units.Celsius)
+		case MetricVPD:
+			d.VPD = set(m, psychro.VapourPressureDeficit(t, rh)/1000, units.Kilopascal)
+		}
+	}
+	r.Derived = d
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
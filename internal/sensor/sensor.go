@@ -1,43 +1,305 @@
 package sensor
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"sync"
+	"time"
 
-	"github.com/d2r2/go-bsbmp"
 	"github.com/d2r2/go-i2c"
-	"github.com/d2r2/go-logger"
+	"github.com/maskarb/skarbek-dev/internal/baro"
+	"github.com/maskarb/skarbek-dev/internal/bme280"
+	"github.com/maskarb/skarbek-dev/internal/config"
+	"github.com/maskarb/skarbek-dev/internal/filter"
+	"github.com/maskarb/skarbek-dev/internal/logging"
+	"github.com/maskarb/skarbek-dev/internal/notify"
+	"gorm.io/gorm"
 )
 
+var logger = logging.For("sensor")
+
 var PiSensor *Sensor
 
+// ErrNotFound is returned for sensor IDs the store does not know.
+var ErrNotFound = errors.New("sensor not found")
+
 // SensorStore is a simple in-memory database of tasks; SensorStore methods are
-// safe to call concurrently.
+// safe to call concurrently. Per-sensor settings are kept in SQLite.
 type SensorStore struct {
 	sync.Mutex
 
+	db      *gorm.DB
 	sensors map[int]*Sensor
+	// driverDefaults and filterDefaults apply to sensors without saved
+	// driver settings or filters.
+	driverDefaults bme280.Settings
+	filterDefaults filter.Config
+	// forecast sets the storm threshold and hemisphere of forecasts.
+	forecast config.ForecastConfig
+	// nodeTimeout is how long a remote node may stay silent before it is
+	// offline.
+	nodeTimeout time.Duration
+	// enrollmentTTL is how long enrollment codes are valid.
+	enrollmentTTL time.Duration
+	// observers are called with every sample of a local sensor and every
+	// reading a node sends.
+	observers []func(Observation)
+	// offline holds the sensors whose last read failed; statusHandlers
+	// are told when that changes.
+	offline        map[int]bool
+	statusHandlers []func(StatusChange)
+	// revokeHandlers are told the sensor ID of every node revoked.
+	revokeHandlers []func(int)
+	// health tracks reads of the local sensor for Check.
+	health readHealth
+}
+
+// stuckRead is how long a read of the local sensor may take before Check
+// considers the bus wedged.
+const stuckRead = 10 * time.Second
+
+// readHealth is what Check looks at. It has its own lock because a read
+// wedged on the I2C bus holds the store's.
+type readHealth struct {
+	sync.Mutex
+	// since is when the read in progress started, zero when idle.
+	since   time.Time
+	lastErr error
+}
+
+func (h *readHealth) start() {
+	h.Lock()
+	h.since = time.Now()
+	h.Unlock()
+}
+
+func (h *readHealth) done(err error) {
+	h.Lock()
+	h.since, h.lastErr = time.Time{}, err
+	h.Unlock()
+}
+
+// Observation is one reading of a sensor in °C, %RH and Pa. Quantities the
+// sensor lacks, or whose sample the filters rejected, are left out.
+type Observation struct {
+	SensorID int
+	At       time.Time
+	Values   map[string]float64
+}
+
+// Observe calls fn with every sample Sample takes of a local sensor and
+// every reading a node sends from now on, but not with the reads API
+// requests cause. fn runs with the store locked, so it must return quickly
+// and must not call back into the store. Register observers before the
+// store is shared.
+func (ss *SensorStore) Observe(fn func(Observation)) {
+	ss.observers = append(ss.observers, fn)
+}
+
+// StatusChange is a sensor going offline after a failed read, or coming
+// back with a good one.
+type StatusChange struct {
+	SensorID int
+	Online   bool
+	At       time.Time
+	// Err is the failed read, when going offline.
+	Err error
+}
+
+// Event describes c for notification channels.
+func (c StatusChange) Event() notify.Event {
+	e := notify.Event{Kind: "sensor", SensorID: c.SensorID, At: c.At}
+	if c.Online {
+		e.Status = "online"
+		e.Title = fmt.Sprintf("[ONLINE] sensor %d", c.SensorID)
+		e.Message = fmt.Sprintf("Sensor %d is reading again.", c.SensorID)
+	} else {
+		e.Status = "offline"
+		e.Title = fmt.Sprintf("[OFFLINE] sensor %d", c.SensorID)
+		e.Message = fmt.Sprintf("Sensor %d stopped answering: %v.", c.SensorID, c.Err)
+	}
+	return e
 }
 
-func NewSensorStore() *SensorStore {
-	initializePiSensor()
-	ss := &SensorStore{}
+// OnStatus calls fn when a sensor goes offline or comes back. Like an
+// observer, fn runs with the store locked; register it before the store
+// is shared.
+func (ss *SensorStore) OnStatus(fn func(StatusChange)) {
+	ss.statusHandlers = append(ss.statusHandlers, fn)
+}
+
+// OnRevoke calls fn with the sensor ID of a node when it is revoked, so
+// credentials kept elsewhere can be revoked with it. fn runs with the store
+// locked; register it before the store is shared.
+func (ss *SensorStore) OnRevoke(fn func(id int)) {
+	ss.revokeHandlers = append(ss.revokeHandlers, fn)
+}
+
+// setOnline records the outcome of a read of sensor id and tells the
+// status handlers when it differs from the previous one.
+func (ss *SensorStore) setOnline(id int, online bool, err error) {
+	if s, ok := ss.sensors[id]; ok {
+		s.Online = online
+	}
+	if ss.offline[id] == !online {
+		return
+	}
+	ss.offline[id] = !online
+	if online {
+		logger.Info("sensor back online", "sensor_id", id)
+	} else {
+		logger.Warn("sensor offline", "sensor_id", id, "err", err)
+	}
+	c := StatusChange{SensorID: id, Online: online, At: time.Now().UTC(), Err: err}
+	for _, fn := range ss.statusHandlers {
+		fn(c)
+	}
+}
+
+// read refreshes s. Remote nodes are not read; approved ones only have
+// their last-seen time checked. The observers are not told: API requests
+// read too, and must not drive alerts and deliveries at their own rate.
+func (ss *SensorStore) read(id int, s *Sensor) error {
+	if s.node != nil {
+		if s.node.Status == NodeApproved {
+			ss.checkNode(id, s, time.Now())
+		}
+		return nil
+	}
+	ss.health.start()
+	err := s.getEnvironment()
+	ss.health.done(err)
+	if err != nil {
+		ss.setOnline(id, false, err)
+		return err
+	}
+	ss.setOnline(id, true, nil)
+	return nil
+}
+
+// Sample reads the local sensors every interval until ctx is done, so the
+// observers get readings at a steady rate whether or not anyone calls the
+// API. Remote nodes are left out: they push their own readings.
+func (ss *SensorStore) Sample(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			ss.sampleLocal()
+		}
+	}
+}
+
+func (ss *SensorStore) sampleLocal() {
+	ss.Lock()
+	defer ss.Unlock()
+	for id, s := range ss.sensors {
+		if s.node != nil {
+			continue
+		}
+		// Failures reach the status handlers.
+		if err := ss.read(id, s); err != nil {
+			logger.Debug("sample failed", "sensor_id", id, "err", err)
+			continue
+		}
+		ss.observe(id, s)
+	}
+}
+
+// observe passes the latest values of s to the observers.
+func (ss *SensorStore) observe(id int, s *Sensor) {
+	if len(ss.observers) == 0 {
+		return
+	}
+	o := Observation{SensorID: id, At: time.Now().UTC(), Values: make(map[string]float64, 3)}
+	if s.ReadAt != nil {
+		o.At = *s.ReadAt
+	}
+	current := Raw{Temperature: s.Temperature, Humidity: s.Humidity, Pressure: s.Pressue}
+	for _, q := range []string{QuantityTemperature, QuantityHumidity, QuantityPressure} {
+		if v := current.quantity(q); v != nil && s.Rejected[q] == "" {
+			o.Values[q] = float64(*v)
+		}
+	}
+	for _, fn := range ss.observers {
+		fn(o)
+	}
+}
+
+func NewSensorStore(cfg config.SensorConfig, db *gorm.DB) (*SensorStore, error) {
+	if cfg.Enabled {
+		initializePiSensor(uint8(cfg.Address), cfg.Bus, cfg.Driver)
+	}
+	ss := &SensorStore{db: db, driverDefaults: cfg.Driver, filterDefaults: cfg.Filters,
+		forecast: cfg.Forecast, nodeTimeout: cfg.NodeTimeout.Duration,
+		enrollmentTTL: cfg.EnrollmentTTL.Duration, offline: make(map[int]bool)}
 	ss.sensors = make(map[int]*Sensor)
 	if PiSensor != nil {
 		ss.sensors[int(*PiSensor.SensorID)] = PiSensor
 	}
-	return ss
+	if err := ss.loadNodes(); err != nil {
+		return nil, err
+	}
+	if err := ss.loadSamples(); err != nil {
+		return nil, err
+	}
+	if err := ss.loadEnrollments(); err != nil {
+		return nil, err
+	}
+	if err := ss.loadSites(); err != nil {
+		return nil, err
+	}
+	if err := ss.loadCalibrations(); err != nil {
+		return nil, err
+	}
+	if err := ss.loadDrivers(); err != nil {
+		return nil, err
+	}
+	if err := ss.loadFilters(); err != nil {
+		return nil, err
+	}
+	if err := ss.loadPressureHistory(); err != nil {
+		return nil, err
+	}
+	return ss, nil
 }
 
 // Sensor is the retreived environment properties.
 type Sensor struct {
-	*bsbmp.BMP
+	dev         *bme280.Device
+	bus         *i2c.I2C
 	SensorID    *uint8   `json:"sensor_id,omitempty"`
 	Temperature *float32 `json:"temperature,omitempty"`
 	Humidity    *float32 `json:"humidity,omitempty"`
 	Pressue     *float32 `json:"pressure,omitempty"`
 	Altitude    *float32 `json:"altitude,omitempty"`
+
+	Site        Site        `json:"-"`
+	Calibration Calibration `json:"-"`
+	// Raw holds the values as read, before filters and Calibration were
+	// applied. Rejected lists the quantities whose latest sample the
+	// filters rejected; their values are the last accepted ones.
+	Raw      Raw                      `json:"-"`
+	Rejected map[string]filter.Reason `json:"-"`
+	filters  *sensorFilters
+
+	// Source is SourceLocal for the BME280, or the transport a remote
+	// node sends over; NodeID and node are only set for nodes. ReadAt is
+	// when the values were taken and LastSeen when a node last sent any.
+	// Online is false after a failed read or while a node is silent. Name
+	// and Room are what an admin called an enrolled node.
+	Source   string     `json:"-"`
+	NodeID   string     `json:"-"`
+	Name     string     `json:"-"`
+	Room     string     `json:"-"`
+	ReadAt   *time.Time `json:"-"`
+	LastSeen *time.Time `json:"-"`
+	Online   bool       `json:"-"`
+	node     *Node
 }
 
 // SensorStore retrieves a task from the store, by id. If no such id exists, an
@@ -48,9 +310,9 @@ func (ss *SensorStore) GetSensor(id int) (*Sensor, error) {
 
 	s, ok := ss.sensors[id]
 	if ok {
-		return s, s.getEnvironment()
+		return s, ss.read(id, s)
 	} else {
-		return nil, fmt.Errorf("sensor with id=%d not found", id)
+		return nil, fmt.Errorf("sensor with id=%d: %w", id, ErrNotFound)
 	}
 }
 
@@ -60,8 +322,11 @@ func (ss *SensorStore) GetAllSensors() ([]Sensor, error) {
 	defer ss.Unlock()
 
 	allSensors := make([]Sensor, 0, len(ss.sensors))
-	for _, sensor := range ss.sensors {
-		if err := sensor.getEnvironment(); err != nil {
+	for id, sensor := range ss.sensors {
+		if sensor.node != nil && sensor.node.Status != NodeApproved {
+			continue
+		}
+		if err := ss.read(id, sensor); err != nil {
 			return nil, fmt.Errorf("error with sensor %v: %v", sensor.SensorID, err)
 		}
 		allSensors = append(allSensors, *sensor)
@@ -69,78 +334,106 @@ func (ss *SensorStore) GetAllSensors() ([]Sensor, error) {
 	return allSensors, nil
 }
 
-func (s *Sensor) getEnvironment() error {
+// Check reports whether the local sensor is healthy without reading it: a
+// read in progress for longer than stuckRead means the I2C bus is wedged,
+// holding the store lock and with it every sensor request, and otherwise
+// the outcome of the last read counts.
+func (ss *SensorStore) Check(ctx context.Context) error {
+	ss.health.Lock()
+	defer ss.health.Unlock()
+	if !ss.health.since.IsZero() {
+		if d := time.Since(ss.health.since); d > stuckRead {
+			return fmt.Errorf("sensor read stuck for %v", d.Round(time.Second))
+		}
+	}
+	if ss.health.lastErr != nil {
+		return fmt.Errorf("last sensor read failed: %v", ss.health.lastErr)
+	}
+	return ctx.Err()
+}
 
-	id, err := s.ReadSensorID()
-	if err != nil {
-		return fmt.Errorf("read sensor id error: %v", err)
+// Close closes every sensor's I2C connection. The store must not be used
+// afterwards.
+func (ss *SensorStore) Close() error {
+	ss.Lock()
+	defer ss.Unlock()
+
+	var firstErr error
+	for id, sensor := range ss.sensors {
+		if sensor.bus == nil {
+			continue
+		}
+		if err := sensor.bus.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("close sensor %d: %v", id, err)
+		}
+		sensor.bus = nil
 	}
+	return firstErr
+}
+
+func (s *Sensor) getEnvironment() error {
+	id := s.dev.ChipID()
 	s.SensorID = &id
-	log.Printf("Sensor ID = %v\n", id)
 
-	// Read temperature in celsius degree
-	t, err := s.ReadTemperatureC(bsbmp.ACCURACY_HIGH)
-	if err != nil {
-		return fmt.Errorf("read temperature error: %v", err)
-	}
-	s.Temperature = &t
-	log.Printf("Temprature = %v*C\n", t)
-	// Read atmospheric pressure in pascal
-	p, err := s.ReadPressurePa(bsbmp.ACCURACY_HIGH)
+	m, err := s.dev.Read()
 	if err != nil {
-		return fmt.Errorf("read pressure (pascal) error: %v", err)
-	}
-	s.Pressue = &p
-	log.Printf("Pressure = %v Pa\n", p)
-	// Read relative humidity in %RH
-	supported, rh, err := s.ReadHumidityRH(bsbmp.ACCURACY_HIGH)
-	if err != nil {
-		return fmt.Errorf("read humidity (%%rh) error: %v", err)
-	}
-	s.Humidity = &rh
-	if !supported {
-		log.Printf("Sensor does not support relative humidity")
-		s.Humidity = nil
+		return fmt.Errorf("read sensor: %v", err)
 	}
-	log.Printf("Relative Humidity = %v %%RH\n", rh)
-	// Read atmospheric altitude in meters above sea level, if we assume
-	// that pressure at see level is equal to 101325 Pa.
-	a, err := s.ReadAltitude(bsbmp.ACCURACY_HIGH)
-	if err != nil {
-		return fmt.Errorf("read altitude error: %v", err)
-	}
-	s.Altitude = &a
-	log.Printf("Altitude = %v m\n", a)
+	s.update(Raw{Temperature: m.Temperature, Pressure: m.Pressure, Humidity: m.Humidity}, time.Now().UTC())
 
+	logger.Debug("read environment",
+		"sensor_id", id,
+		"temperature_c", m.Temperature,
+		"pressure_pa", m.Pressure,
+		"humidity_rh", m.Humidity,
+		"altitude_m", s.Altitude,
+		"calibration_version", s.Calibration.Version)
 	return nil
 }
 
-func initializePiSensor() {
-	// Create new connection to i2c-bus on 1 line with address 0x77.
-	// Use i2cdetect utility to find device address over the i2c-bus
-	i2c, err := i2c.NewI2C(0x77, 1)
-	if err != nil {
-		log.Printf("new_i2c error: %v", err)
-		return
+// update sets the sensor's values from raw, taken at t, through its
+// filters and calibration.
+func (s *Sensor) update(raw Raw, t time.Time) {
+	s.Raw = raw
+	filtered, rejected := s.filters.apply(raw, t)
+	s.Rejected = rejected
+	s.calibrate(filtered)
+	for q, reason := range rejected {
+		logger.Warn("sample rejected", "sensor_id", *s.SensorID, "quantity", q,
+			"reason", reason, "value", s.Raw.quantity(q))
 	}
-	if err := logger.ChangePackageLogLevel("i2c", logger.InfoLevel); err != nil {
-		log.Printf("error changing package logging: %v", err)
-		return
+	s.ReadAt = &t
+
+	// Altitude from the calibrated pressure, against the site's reference
+	// sea-level pressure rather than a fixed 101325 Pa.
+	s.Altitude = nil
+	if s.Pressue != nil {
+		a := float32(baro.Altitude(float64(*s.Pressue), s.Site.referencePressure()))
+		s.Altitude = &a
 	}
+}
 
-	sense, err := bsbmp.NewBMP(bsbmp.BME280, i2c)
+func initializePiSensor(addr uint8, bus int, settings bme280.Settings) {
+	// Create new connection to i2c-bus on the configured line and address.
+	// Use i2cdetect utility to find device address over the i2c-bus
+	i2c, err := i2c.NewI2C(addr, bus)
 	if err != nil {
-		log.Printf("new_bmp error: %v", err)
+		logger.Error("open i2c bus", "bus", bus, "address", fmt.Sprintf("0x%02x", addr), "err", err)
 		return
 	}
-	if err := logger.ChangePackageLogLevel("bsbmp", logger.InfoLevel); err != nil {
-		log.Printf("error changing package logging: %v", err)
+
+	dev, err := bme280.Open(i2c, settings)
+	if err != nil {
+		logger.Error("open bme280", "err", err)
+		if err := i2c.Close(); err != nil {
+			logger.Error("close i2c bus", "bus", bus, "err", err)
+		}
 		return
 	}
 
-	PiSensor = &Sensor{sense, nil, nil, nil, nil, nil}
+	PiSensor = &Sensor{dev: dev, bus: i2c, Source: SourceLocal}
 	if err := PiSensor.getEnvironment(); err != nil {
-		log.Printf("failed to initialize PiSensor: %v", err)
+		logger.Error("failed to initialize PiSensor", "err", err)
 		return
 	}
 }
@@ -0,0 +1,624 @@
+package sensor
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/apierror"
+	"github.com/maskarb/skarbek-dev/internal/bme280"
+	"github.com/maskarb/skarbek-dev/internal/config"
+	"github.com/maskarb/skarbek-dev/internal/database"
+	"github.com/maskarb/skarbek-dev/internal/units"
+)
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	ss := &SensorStore{}
+	if err := ss.Check(ctx); err != nil {
+		t.Fatalf("idle store: %v", err)
+	}
+
+	ss.health.start()
+	if err := ss.Check(ctx); err != nil {
+		t.Errorf("read just started: %v", err)
+	}
+	ss.health.since = time.Now().Add(-2 * stuckRead)
+	if err := ss.Check(ctx); err == nil || !strings.Contains(err.Error(), "stuck") {
+		t.Errorf("wedged read: got %v, want stuck", err)
+	}
+
+	ss.health.done(errors.New("remote I/O error"))
+	if err := ss.Check(ctx); err == nil || !strings.Contains(err.Error(), "remote I/O error") {
+		t.Errorf("failed read: got %v", err)
+	}
+	ss.health.done(nil)
+	if err := ss.Check(ctx); err != nil {
+		t.Errorf("after a good read: %v", err)
+	}
+}
+
+// TestCheckDoesNotRead makes sure the health check neither reads the
+// sensors nor waits for the store lock a wedged read would hold.
+func TestCheckDoesNotRead(t *testing.T) {
+	ss := &SensorStore{}
+	ss.observers = append(ss.observers, func(Observation) { t.Error("Check produced an observation") })
+	ss.Lock()
+	defer ss.Unlock()
+
+	done := make(chan error, 1)
+	go func() { done <- ss.Check(context.Background()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Check waited for the store lock")
+	}
+}
+
+func newTestStore(t *testing.T) *SensorStore {
+	t.Helper()
+	db, err := database.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close(db) })
+	cfg := config.Default().Sensor
+	cfg.Enabled = false
+	ss, err := NewSensorStore(cfg, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ss
+}
+
+func float64p(f float64) *float64 { return &f }
+
+// TestIngestKeepsTimestamps makes sure samples slightly ahead of the
+// server's clock keep their own times instead of colliding at now.
+func TestIngestKeepsTimestamps(t *testing.T) {
+	ss := newTestStore(t)
+	n, _, err := ss.RegisterNode("attic", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Second).UTC()
+	samples := []NodeSample{
+		{At: now.Add(time.Minute), Temperature: float64p(20)},
+		{At: now.Add(2 * time.Minute), Temperature: float64p(21)},
+		{At: now.Add(3 * time.Minute), Temperature: float64p(22)},
+	}
+	if err := ss.ValidateSamples(n.SensorID, samples, now); err != nil {
+		t.Fatal(err)
+	}
+	res, err := ss.IngestSamples(n.SensorID, samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Accepted != 3 || res.Duplicates != 0 || res.Late != 0 {
+		t.Errorf("result = %+v, want 3 accepted", res)
+	}
+	stored, err := ss.Samples(n.SensorID, now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, smp := range stored {
+		if !smp.At.Equal(samples[i].At) {
+			t.Errorf("sample %d at %v, want %v", i, smp.At, samples[i].At)
+		}
+	}
+
+	if err := ss.ValidateSamples(n.SensorID, []NodeSample{{At: now.Add(maxClockSkew + time.Minute),
+		Temperature: float64p(20)}}, now); !errors.Is(err, ErrInvalidReading) {
+		t.Errorf("sample beyond the skew: err = %v, want ErrInvalidReading", err)
+	}
+	if _, err := ss.Ingest("mqtt", "cellar", time.Now().Add(maxClockSkew+time.Minute),
+		Raw{Temperature: new(float32)}); !errors.Is(err, ErrInvalidReading) {
+		t.Errorf("reading beyond the skew: err = %v, want ErrInvalidReading", err)
+	}
+}
+
+// TestIngestFailureLeavesNodeUnseen makes sure a push that could not be
+// stored neither marks the node seen nor changes its reading.
+func TestIngestFailureLeavesNodeUnseen(t *testing.T) {
+	ss := newTestStore(t)
+	var changes []StatusChange
+	ss.OnStatus(func(c StatusChange) { changes = append(changes, c) })
+	ss.Observe(func(Observation) { t.Error("failed push was observed") })
+	n, _, err := ss.RegisterNode("attic", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.db.Migrator().DropTable(&NodeSample{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ss.IngestSamples(n.SensorID, []NodeSample{{At: time.Now(), Temperature: float64p(20)}}); err == nil {
+		t.Fatal("push without a sample table succeeded")
+	}
+	s, err := ss.GetSensor(n.SensorID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.LastSeen != nil || s.Online || s.ReadAt != nil || len(changes) != 0 {
+		t.Errorf("after a failed push: last seen %v, online %v, read at %v, status changes %v",
+			s.LastSeen, s.Online, s.ReadAt, changes)
+	}
+	var stored Node
+	if err := ss.db.First(&stored, "sensor_id = ?", n.SensorID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.LastSeenAt != nil {
+		t.Errorf("stored last seen = %v, want none", stored.LastSeenAt)
+	}
+}
+
+func enroll(t *testing.T, ss *SensorStore, sensorID *int, nodeID string) (Enrolled, error) {
+	t.Helper()
+	_, code, err := ss.CreateEnrollment("admin@example.com", sensorID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ss.Enroll(code, nodeID, nil)
+}
+
+func TestEnroll(t *testing.T) {
+	ss := newTestStore(t)
+	e, code, err := ss.CreateEnrollment("admin@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ss.Enroll(strings.ToLower(code), "aa:bb:cc", QuantityList{QuantityTemperature})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != NodePending || got.Token == "" {
+		t.Errorf("enrolled = %+v, want pending with a token", got)
+	}
+	var n Node
+	if err := ss.db.First(&n, "sensor_id = ?", got.SensorID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n.Status != NodePending || n.TokenHash != hashToken(got.Token) || len(n.Quantities) != 1 {
+		t.Errorf("stored node = %+v", n)
+	}
+	if err := ss.db.First(&e, "id = ?", e.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if e.UsedAt == nil || e.SensorID == nil || *e.SensorID != got.SensorID {
+		t.Errorf("enrollment = %+v, want used by sensor %d", e, got.SensorID)
+	}
+	if _, err := ss.Enroll(code, "dd:ee:ff", nil); !errors.Is(err, ErrBadEnrollment) {
+		t.Errorf("code used twice: err = %v, want ErrBadEnrollment", err)
+	}
+}
+
+// TestEnrollRefusesTakeover makes sure a code only re-enrolls an existing
+// node when an admin created it for that node.
+func TestEnrollRefusesTakeover(t *testing.T) {
+	ss := newTestStore(t)
+	first, err := enroll(t, ss, nil, "aa:bb:cc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.ApproveNode(first.SensorID, "Attic", "", "admin@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, code, err := ss.CreateEnrollment("admin@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.Enroll(code, "aa:bb:cc", nil); !errors.Is(err, ErrNodeExists) {
+		t.Fatalf("takeover with a new code: err = %v, want ErrNodeExists", err)
+	}
+	if err := ss.Authenticate(first.SensorID, first.Token); err != nil {
+		t.Errorf("node lost its token to a refused enrollment: %v", err)
+	}
+	// The refused attempt did not use up the code.
+	if _, err := ss.Enroll(code, "11:22:33", nil); err != nil {
+		t.Errorf("code after a refused enrollment: %v", err)
+	}
+
+	id := first.SensorID
+	if _, err := enroll(t, ss, &id, "dd:ee:ff"); !errors.Is(err, ErrBadEnrollment) {
+		t.Errorf("code for sensor %d used by another node: err = %v, want ErrBadEnrollment", id, err)
+	}
+	again, err := enroll(t, ss, &id, "aa:bb:cc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.SensorID != id || again.Status != NodePending || again.Token == first.Token {
+		t.Errorf("re-enrolled = %+v, want sensor %d pending with a new token", again, id)
+	}
+	if err := ss.Authenticate(id, first.Token); err == nil {
+		t.Error("old token still works after enrolling again")
+	}
+
+	if _, _, err := ss.CreateEnrollment("admin@example.com", func() *int { i := 1; return &i }()); err == nil {
+		t.Error("code created for a sensor that is not a node")
+	}
+}
+
+func TestRedeemToken(t *testing.T) {
+	ss := newTestStore(t)
+	node, err := enroll(t, ss, nil, "aa:bb:cc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := node.SensorID
+	if _, err := ss.ApproveNode(id, "Attic", "", "admin@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := errors.New("invalid csr")
+	if err := ss.RedeemToken(id, node.Token, func() error { return failed }); err != failed {
+		t.Fatalf("err = %v, want the error of fn", err)
+	}
+	if err := ss.Authenticate(id, node.Token); err != nil {
+		t.Errorf("token lost to a failed redemption: %v", err)
+	}
+
+	calls := 0
+	issue := func() error { calls++; return nil }
+	if err := ss.RedeemToken(id, "skd_wrong", issue); !errors.Is(err, ErrBadToken) {
+		t.Errorf("wrong token: err = %v, want ErrBadToken", err)
+	}
+	if err := ss.RedeemToken(id, node.Token, issue); err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.RedeemToken(id, node.Token, issue); !errors.Is(err, ErrBadToken) {
+		t.Errorf("token redeemed twice: err = %v, want ErrBadToken", err)
+	}
+	if calls != 1 {
+		t.Errorf("fn called %d times, want 1", calls)
+	}
+	if err := ss.Authenticate(id, node.Token); !errors.Is(err, ErrBadToken) {
+		t.Errorf("pushing with a redeemed token: err = %v, want ErrBadToken", err)
+	}
+	var n Node
+	if err := ss.db.First(&n, "sensor_id = ?", id).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n.TokenHash != "" {
+		t.Error("redeemed token is still stored")
+	}
+}
+
+// chip is a BMP280 on a fake bus, with the trimming parameters and raw
+// readings of the worked example in the BMP280 datasheet (section 3.12).
+type chip struct{ regs [256]byte }
+
+func newChip() *chip {
+	c := &chip{}
+	c.regs[0xD0] = 0x58
+	for i, v := range []uint16{27504, 26435, 0xFC18, 36477, 0xD643, 3024, 2855, 140, 0xFFF9, 15500, 0xC6F8, 6000} {
+		binary.LittleEndian.PutUint16(c.regs[0x88+2*i:], v)
+	}
+	// adc_P = 415148 and adc_T = 519888, 20 bits each.
+	copy(c.regs[0xF7:], []byte{0x65, 0x5A, 0xC0, 0x7E, 0xED, 0x00})
+	return c
+}
+
+func (c *chip) ReadRegU8(reg byte) (byte, error) { return c.regs[reg], nil }
+
+func (c *chip) WriteRegU8(reg byte, value byte) error {
+	c.regs[reg] = value
+	return nil
+}
+
+func (c *chip) ReadRegBytes(reg byte, n int) ([]byte, int, error) {
+	b := make([]byte, n)
+	copy(b, c.regs[reg:])
+	return b, n, nil
+}
+
+// addLocal adds a local sensor on a fake chip to ss and returns its ID.
+func addLocal(t *testing.T, ss *SensorStore) int {
+	t.Helper()
+	settings := bme280.DefaultSettings
+	settings.Mode = bme280.ModeNormal
+	dev, err := bme280.Open(newChip(), settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := int(dev.ChipID())
+	ss.sensors[id] = &Sensor{dev: dev, Source: SourceLocal, filters: newSensorFilters(ss.filterDefaults)}
+	return id
+}
+
+// TestOnlySamplesAreObserved makes sure API reads do not reach the
+// observers, which would let request traffic drive alerts and deliveries.
+func TestOnlySamplesAreObserved(t *testing.T) {
+	ss := newTestStore(t)
+	id := addLocal(t, ss)
+	var got []Observation
+	ss.Observe(func(o Observation) { got = append(got, o) })
+
+	if _, err := ss.GetSensor(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.GetAllSensors(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("API reads made %d observations, want none", len(got))
+	}
+
+	ss.sampleLocal()
+	if len(got) != 1 {
+		t.Fatalf("sampling made %d observations, want 1", len(got))
+	}
+	if v := got[0].Values[QuantityTemperature]; math.Abs(v-25.08) > 0.01 {
+		t.Errorf("observed temperature %v, want 25.08", v)
+	}
+}
+
+// TestAdminRoutes makes sure the endpoints that change how readings are
+// taken are only served behind Admin, since auth is off without it.
+func TestAdminRoutes(t *testing.T) {
+	ss := newTestStore(t)
+	n, _, err := ss.RegisterNode("attic", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := []struct{ method, path, body string }{
+		{http.MethodPut, "/driver", `{"mode": "normal", "temperature_oversampling": 1, "pressure_oversampling": 1,
+			"humidity_oversampling": 1, "iir_filter": 16, "standby_ms": 0.5}`},
+		{http.MethodDelete, "/driver", ""},
+		{http.MethodPut, "/filters", `{"temperature": {"min": -40, "max": 85}}`},
+		{http.MethodDelete, "/filters", ""},
+	}
+	serve := func(h http.Handler, method, path, body string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/"+strconv.Itoa(n.SensorID)+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	open := NewSensorServer(ss).Routes()
+	for _, c := range changes {
+		if code := serve(open, c.method, c.path, c.body); code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s without Admin: status %d, want 405", c.method, c.path, code)
+		}
+	}
+
+	srv := NewSensorServer(ss)
+	srv.Admin = func(next http.Handler) http.Handler { return next }
+	guarded := srv.Routes()
+	for _, c := range changes {
+		if code := serve(guarded, c.method, c.path, c.body); code != http.StatusOK {
+			t.Errorf("%s %s with Admin: status %d, want 200", c.method, c.path, code)
+		}
+	}
+}
+
+func float32p(f float32) *float32 { return &f }
+
+func TestTwoPoint(t *testing.T) {
+	// A thermometer reading 0.5 °C high at 20 °C and 0.9 °C high at 30 °C.
+	p1 := CalibrationPoint{Quantity: QuantityTemperature, Reference: 20, Raw: 20.5}
+	p2 := CalibrationPoint{Quantity: QuantityTemperature, Reference: 30, Raw: 30.9}
+	fit, err := TwoPoint(p1, p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(fit.Gain-10/10.4) > 1e-9 {
+		t.Errorf("gain = %v, want %v", fit.Gain, 10/10.4)
+	}
+	for _, p := range []CalibrationPoint{p1, p2} {
+		if got := fit.apply(float32(p.Raw)); math.Abs(float64(got)-p.Reference) > 1e-4 {
+			t.Errorf("fit(%v) = %v, want %v", p.Raw, got, p.Reference)
+		}
+	}
+	if _, err := TwoPoint(p1, CalibrationPoint{Reference: 25, Raw: 20.5}); !errors.Is(err, ErrCalibration) {
+		t.Errorf("points at the same raw value: err = %v, want ErrCalibration", err)
+	}
+}
+
+func TestCalibrationValidate(t *testing.T) {
+	for _, c := range []Calibration{
+		{Temperature: Linear{Gain: 1.6}, Humidity: identity, Pressure: identity},
+		{Temperature: identity, Humidity: Linear{Gain: 1, Offset: -21}, Pressure: identity},
+		{Temperature: identity, Humidity: identity, Pressure: Linear{Gain: 1, Offset: math.NaN()}},
+		// Zero gains are not uncalibrated.
+		{},
+	} {
+		if err := c.Validate(); !errors.Is(err, ErrCalibration) {
+			t.Errorf("%+v: err = %v, want ErrCalibration", c, err)
+		}
+	}
+	if err := uncalibrated(1).Validate(); err != nil {
+		t.Errorf("uncalibrated: %v", err)
+	}
+}
+
+func TestCalibrationHistory(t *testing.T) {
+	ss := newTestStore(t)
+	res, err := ss.Ingest("mqtt", "cellar", time.Now(), Raw{Temperature: float32p(20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := res.SensorID
+	if c, err := ss.Calibration(id); err != nil || c.Version != 0 || c.Temperature != identity {
+		t.Fatalf("before calibrating: %+v, %v, want uncalibrated", c, err)
+	}
+
+	first := uncalibrated(id)
+	first.Temperature.Offset, first.Method = -0.5, "manual"
+	if _, err := ss.AddCalibration(first); err != nil {
+		t.Fatal(err)
+	}
+	second := first
+	second.Humidity.Offset = 3
+	if _, err := ss.AddCalibration(second); err != nil {
+		t.Fatal(err)
+	}
+	bad := second
+	bad.Pressure.Gain = 2
+	if _, err := ss.AddCalibration(bad); !errors.Is(err, ErrCalibration) {
+		t.Errorf("invalid calibration: err = %v, want ErrCalibration", err)
+	}
+
+	history, err := ss.CalibrationHistory(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Version != 2 || history[1].Version != 1 {
+		t.Fatalf("history = %+v, want versions 2 and 1", history)
+	}
+	if history[0].ValidUntil != nil {
+		t.Errorf("current version valid until %v", history[0].ValidUntil)
+	}
+	if history[1].ValidUntil == nil || !history[1].ValidUntil.Equal(history[0].ValidFrom) {
+		t.Errorf("version 1 valid until %v, want %v", history[1].ValidUntil, history[0].ValidFrom)
+	}
+
+	// The current version survives a restart.
+	cfg := config.Default().Sensor
+	cfg.Enabled = false
+	restarted, err := NewSensorStore(cfg, ss.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := restarted.Calibration(id)
+	if err != nil || c.Version != 2 || c.Humidity.Offset != 3 || c.Temperature.Offset != -0.5 {
+		t.Errorf("after restart: %+v, %v, want version 2", c, err)
+	}
+}
+
+func TestCalibratedValues(t *testing.T) {
+	ss := newTestStore(t)
+	raw := Raw{Temperature: float32p(21), Humidity: float32p(98), Pressure: float32p(100000)}
+	res, err := ss.Ingest("mqtt", "cellar", time.Now(), raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := uncalibrated(res.SensorID)
+	c.Temperature = Linear{Gain: 1.1, Offset: -1}
+	c.Humidity.Offset = 5
+	c.Pressure.Offset = 120
+	if _, err := ss.AddCalibration(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.Ingest("mqtt", "cellar", time.Now().Add(time.Second), raw); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := ss.GetSensor(res.SensorID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *s.Raw.Temperature != 21 || *s.Raw.Humidity != 98 || *s.Raw.Pressure != 100000 {
+		t.Errorf("raw = %v %v %v, want the values sent", *s.Raw.Temperature, *s.Raw.Humidity, *s.Raw.Pressure)
+	}
+	if math.Abs(float64(*s.Temperature)-22.1) > 1e-4 {
+		t.Errorf("temperature = %v, want 1.1*21 - 1", *s.Temperature)
+	}
+	// 98 + 5 is clamped to saturation.
+	if *s.Humidity != 100 {
+		t.Errorf("humidity = %v, want 100", *s.Humidity)
+	}
+	if *s.Pressue != 100120 {
+		t.Errorf("pressure = %v, want 100120", *s.Pressue)
+	}
+}
+
+func TestCalibrateTwoPoint(t *testing.T) {
+	ss := newTestStore(t)
+	res, err := ss.Ingest("mqtt", "cellar", time.Now(), Raw{Temperature: float32p(20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := res.SensorID
+	manual := uncalibrated(id)
+	manual.Humidity.Offset = 2
+	if _, err := ss.AddCalibration(manual); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ss.AddCalibrationPoint(CalibrationPoint{SensorID: id, Quantity: "wind"}); !errors.Is(err, ErrCalibration) {
+		t.Errorf("point of an unknown quantity: err = %v, want ErrCalibration", err)
+	}
+	for _, p := range []CalibrationPoint{
+		// Superseded by the two newer points.
+		{SensorID: id, Quantity: QuantityTemperature, Reference: 5, Raw: 7},
+		{SensorID: id, Quantity: QuantityTemperature, Reference: 20, Raw: 20.5},
+		{SensorID: id, Quantity: QuantityTemperature, Reference: 30, Raw: 30.9},
+	} {
+		if _, err := ss.AddCalibrationPoint(p); err != nil {
+			t.Fatal(err)
+		}
+		// Points are picked by when they were added.
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := ss.CalibrateTwoPoint(id, QuantityHumidity, "", "admin@example.com"); !errors.Is(err, ErrCalibration) {
+		t.Errorf("without points: err = %v, want ErrCalibration", err)
+	}
+
+	c, err := ss.CalibrateTwoPoint(id, QuantityTemperature, "ice bath and warm room", "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Version != 2 || c.Method != "two-point" || c.CreatedBy != "admin@example.com" {
+		t.Errorf("calibration = %+v, want two-point version 2", c)
+	}
+	if math.Abs(c.Temperature.Gain-10/10.4) > 1e-9 {
+		t.Errorf("temperature gain = %v, want the fit through the newest points", c.Temperature.Gain)
+	}
+	if c.Humidity.Offset != 2 {
+		t.Errorf("humidity offset = %v, want the 2 of the previous version", c.Humidity.Offset)
+	}
+	points, err := ss.CalibrationPoints(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 0 {
+		t.Errorf("%d points left after calibrating, want none", len(points))
+	}
+}
+
+// TestUnitsFor makes sure ?units= is applied on top of the caller's
+// preference rather than replacing it.
+func TestUnitsFor(t *testing.T) {
+	srv := NewSensorServer(nil)
+	for _, c := range []struct {
+		preferred *units.System
+		query     string
+		want      units.System
+	}{
+		{nil, "", units.SI},
+		{nil, "?units=imperial", units.Imperial},
+		{&units.Imperial, "", units.Imperial},
+		{&units.Imperial, "?units=hPa", units.System{Temperature: units.Fahrenheit, Pressure: units.Hectopascal, Length: units.Foot}},
+		{&units.Imperial, "?units=si", units.SI},
+	} {
+		srv.Preferred = func(*http.Request) (units.System, bool) {
+			if c.preferred == nil {
+				return units.System{}, false
+			}
+			return *c.preferred, true
+		}
+		got, err := srv.unitsFor(httptest.NewRequest(http.MethodGet, "/1"+c.query, nil))
+		if err != nil || got != c.want {
+			t.Errorf("preferred %v, %q: %s, %v; want %s", c.preferred, c.query, got, err, c.want)
+		}
+	}
+
+	_, err := srv.unitsFor(httptest.NewRequest(http.MethodGet, "/1?units=psi", nil))
+	var apiErr *apierror.Error
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusBadRequest || apiErr.Code != "invalid_units" {
+		t.Errorf("?units=psi: %v, want 400 invalid_units", err)
+	}
+}
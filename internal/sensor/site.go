@@ -0,0 +1,75 @@
+package sensor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/baro"
+	"gorm.io/gorm/clause"
+)
+
+// Site describes where a sensor is. With the station elevation known the
+// API reports sea-level pressure; with a reference sea-level pressure (the
+// local QNH) it reports a true altitude instead of the pressure altitude.
+type Site struct {
+	SensorID int `json:"-" gorm:"primaryKey;autoIncrement:false"`
+	// StationElevation is metres above sea level.
+	StationElevation *float64 `json:"station_elevation"`
+	// SeaLevelPressure is the reference for Altitude, in Pa.
+	SeaLevelPressure *float64  `json:"sea_level_pressure"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// referencePressure is the sea-level pressure used for altitude.
+func (s Site) referencePressure() float64 {
+	if s.SeaLevelPressure != nil {
+		return *s.SeaLevelPressure
+	}
+	return baro.StandardPressure
+}
+
+// Validate rejects values no sensor on Earth would have.
+func (s Site) Validate() error {
+	if e := s.StationElevation; e != nil && (*e < -500 || *e > 9000) {
+		return fmt.Errorf("station_elevation %v m is outside -500..9000", *e)
+	}
+	if p := s.SeaLevelPressure; p != nil && (*p < 85000 || *p > 110000) {
+		return fmt.Errorf("sea_level_pressure %v Pa is outside 85000..110000", *p)
+	}
+	return nil
+}
+
+func (ss *SensorStore) loadSites() error {
+	if err := ss.db.AutoMigrate(&Site{}); err != nil {
+		return fmt.Errorf("migrate sensor sites: %v", err)
+	}
+	var sites []Site
+	if err := ss.db.Find(&sites).Error; err != nil {
+		return fmt.Errorf("load sensor sites: %v", err)
+	}
+	for _, site := range sites {
+		if s, ok := ss.sensors[site.SensorID]; ok {
+			s.Site = site
+		}
+	}
+	return nil
+}
+
+// SetSite saves the site of sensor id; it applies from the next reading.
+func (ss *SensorStore) SetSite(id int, site Site) (Site, error) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	s, ok := ss.sensors[id]
+	if !ok {
+		return Site{}, fmt.Errorf("sensor with id=%d: %w", id, ErrNotFound)
+	}
+	site.SensorID = id
+	site.UpdatedAt = time.Now().UTC()
+	err := ss.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&site).Error
+	if err != nil {
+		return Site{}, fmt.Errorf("save sensor site: %v", err)
+	}
+	s.Site = site
+	return site, nil
+}
@@ -0,0 +1,244 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/maskarb/skarbek-dev/internal/apierror"
+	"github.com/maskarb/skarbek-dev/internal/constants"
+	"github.com/maskarb/skarbek-dev/internal/logging"
+)
+
+// CookieName is the browser cookie carrying the session token.
+const CookieName = "skarbek_session"
+
+type sessionServer struct {
+	store     *SessionStore
+	templates string
+}
+
+// NewSessionServer serves the session API and the "my sessions" page.
+// templates is the directory holding layout.html and sessions.html.
+func NewSessionServer(store *SessionStore, templates string) *sessionServer {
+	return &sessionServer{store: store, templates: templates}
+}
+
+// Routes is mounted under /api/v1/sessions.
+func (ss *sessionServer) Routes() *chi.Mux {
+	router := chi.NewRouter()
+	router.Use(RequireSession)
+	router.Get("/", ss.listSessionsHandler)
+	router.Delete("/", ss.revokeAllSessionsHandler)
+	router.Delete("/{sessionID}", ss.revokeSessionHandler)
+	return router
+}
+
+// Middleware attaches the caller's session, if any, to the request context.
+// Requests without a valid session pass through untouched.
+func (ss *sessionServer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(CookieName)
+		if err != nil || cookie.Value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		s, err := ss.store.Lookup(cookie.Value, clientIP(r))
+		if err != nil {
+			if !errors.Is(err, ErrNotFound) {
+				logger.Ctx(r.Context()).Error("error loading session", "err", err)
+			}
+			clearCookie(w)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), constants.SessionContextID, s)
+		logging.SetUser(ctx, s.Email)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireSession rejects requests that did not pass through Middleware with a
+// valid session.
+func RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if FromContext(r.Context()) == nil {
+			apierror.Write(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "not logged in"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireAdmin rejects requests without a session for one of the admins
+// emails, compared case-insensitively.
+func RequireAdmin(admins []string) func(http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(admins))
+	for _, email := range admins {
+		allowed[strings.ToLower(email)] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return RequireSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !allowed[strings.ToLower(FromContext(r.Context()).Email)] {
+				apierror.Write(w, r, apierror.New(http.StatusForbidden, apierror.CodeForbidden, "admin access required"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		}))
+	}
+}
+
+// FromContext returns the session attached by Middleware, or nil.
+func FromContext(ctx context.Context) *Session {
+	s, _ := ctx.Value(constants.SessionContextID).(*Session)
+	return s
+}
+
+// Login creates a session for email and sets the session cookie on w.
+func (ss *sessionServer) Login(w http.ResponseWriter, r *http.Request, email, name string) error {
+	s, token, err := ss.store.Create(email, name, r.UserAgent(), clientIP(r))
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  s.ExpiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	logger.Ctx(r.Context()).Info("session started", "session", s.ID, "user", s.Email, "device", s.Device)
+	return nil
+}
+
+// LogoutHandler revokes the current session, clears the cookie and sends the
+// browser back to the index page. It is only routed for POST: with the
+// SameSite=Lax cookie a cross-site form carries no session, and then the
+// cookie is left alone.
+func (ss *sessionServer) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if s := FromContext(r.Context()); s != nil {
+		if err := ss.store.Revoke(s.Email, s.ID); err != nil && !errors.Is(err, ErrNotFound) {
+			apierror.Write(w, r, err)
+			return
+		}
+		logger.Ctx(r.Context()).Info("session logged out", "session", s.ID)
+		clearCookie(w)
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// PageHandler renders the "my sessions" page.
+func (ss *sessionServer) PageHandler(w http.ResponseWriter, r *http.Request) {
+	current := FromContext(r.Context())
+	if current == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	sessions, err := ss.sessionsFor(current)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+
+	tmpl, err := template.ParseFiles(
+		filepath.Join(ss.templates, "layout.html"),
+		filepath.Join(ss.templates, "sessions.html"),
+	)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tmpl.ExecuteTemplate(w, "layout", map[string]interface{}{
+		"Current":  current,
+		"Sessions": sessions,
+	}); err != nil {
+		logger.Ctx(r.Context()).Error("error rendering sessions page", "err", err)
+	}
+}
+
+func (ss *sessionServer) listSessionsHandler(w http.ResponseWriter, req *http.Request) {
+	sessions, err := ss.sessionsFor(FromContext(req.Context()))
+	if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	render.JSON(w, req, sessions)
+}
+
+func (ss *sessionServer) revokeSessionHandler(w http.ResponseWriter, req *http.Request) {
+	current := FromContext(req.Context())
+	id := chi.URLParam(req, "sessionID")
+
+	if err := ss.store.Revoke(current.Email, id); errors.Is(err, ErrNotFound) {
+		apierror.Write(w, req, apierror.NotFound("session_not_found", "no such session"))
+		return
+	} else if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	if id == current.ID {
+		clearCookie(w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeAllSessionsHandler ends every other session of the caller. With
+// ?include_current=true the caller's own session is ended too.
+func (ss *sessionServer) revokeAllSessionsHandler(w http.ResponseWriter, req *http.Request) {
+	current := FromContext(req.Context())
+	keep := current.ID
+	if req.URL.Query().Get("include_current") == "true" {
+		keep = ""
+	}
+
+	n, err := ss.store.RevokeAll(current.Email, keep)
+	if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	if keep == "" {
+		clearCookie(w)
+	}
+	render.JSON(w, req, map[string]int64{"revoked": n})
+}
+
+func (ss *sessionServer) sessionsFor(current *Session) ([]Session, error) {
+	sessions, err := ss.store.ListForUser(current.Email)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current.ID
+	}
+	return sessions, nil
+}
+
+func clearCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
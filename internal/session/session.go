@@ -0,0 +1,302 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/logging"
+	"gorm.io/gorm"
+)
+
+var logger = logging.For("auth")
+
+const (
+	// DefaultIdleTimeout is how long a session survives without a request.
+	DefaultIdleTimeout = 7 * 24 * time.Hour
+	// DefaultAbsoluteTimeout is the hard cap on a session's lifetime,
+	// regardless of activity.
+	DefaultAbsoluteTimeout = 30 * 24 * time.Hour
+
+	// lastSeenResolution throttles last-seen tracking; activity is buffered
+	// in memory and written at most this often.
+	lastSeenResolution = time.Minute
+)
+
+// ErrNotFound is returned when a session does not exist, has expired, or has
+// been revoked.
+var ErrNotFound = errors.New("session not found")
+
+// Session is a logged in browser. The token handed to the browser is never
+// stored; only its SHA-256 hash is.
+type Session struct {
+	ID         string     `json:"id" gorm:"primaryKey"`
+	TokenHash  string     `json:"-" gorm:"uniqueIndex;not null"`
+	Email      string     `json:"email" gorm:"index;not null"`
+	Name       string     `json:"name,omitempty"`
+	UserAgent  string     `json:"user_agent"`
+	Device     string     `json:"device"`
+	IPAddress  string     `json:"ip_address"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	Current    bool       `json:"current" gorm:"-"`
+}
+
+// SessionStore persists sessions in SQLite; SessionStore methods are safe to
+// call concurrently.
+type SessionStore struct {
+	db *gorm.DB
+
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+
+	mu      sync.Mutex
+	pending map[string]activity
+}
+
+// activity is a last-seen update waiting to be written by Flush.
+type activity struct {
+	lastSeen time.Time
+	ip       string
+}
+
+func NewSessionStore(db *gorm.DB) (*SessionStore, error) {
+	if err := db.AutoMigrate(&Session{}); err != nil {
+		return nil, fmt.Errorf("migrate sessions: %v", err)
+	}
+	return &SessionStore{
+		db:              db,
+		IdleTimeout:     DefaultIdleTimeout,
+		AbsoluteTimeout: DefaultAbsoluteTimeout,
+		pending:         make(map[string]activity),
+	}, nil
+}
+
+// Create starts a new session for email and returns it together with the
+// opaque token that should be handed to the client.
+func (ss *SessionStore) Create(email, name, userAgent, ip string) (*Session, string, error) {
+	token, err := randomString(32)
+	if err != nil {
+		return nil, "", err
+	}
+	id, err := randomString(12)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now().UTC()
+	s := &Session{
+		ID:         id,
+		TokenHash:  hashToken(token),
+		Email:      email,
+		Name:       name,
+		UserAgent:  userAgent,
+		Device:     describeUserAgent(userAgent),
+		IPAddress:  ip,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(ss.AbsoluteTimeout),
+	}
+	if err := ss.db.Create(s).Error; err != nil {
+		return nil, "", fmt.Errorf("create session: %v", err)
+	}
+	return s, token, nil
+}
+
+// Lookup returns the live session for token and records the request as
+// activity. Expired or revoked sessions return ErrNotFound.
+func (ss *SessionStore) Lookup(token, ip string) (*Session, error) {
+	var s Session
+	err := ss.db.Where("token_hash = ? AND revoked_at IS NULL", hashToken(token)).First(&s).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("lookup session: %v", err)
+	}
+
+	now := time.Now().UTC()
+	if ss.expired(&s, now) {
+		return nil, ErrNotFound
+	}
+
+	if now.Sub(s.LastSeenAt) >= lastSeenResolution || s.IPAddress != ip {
+		s.LastSeenAt = now
+		s.IPAddress = ip
+		ss.mu.Lock()
+		ss.pending[s.ID] = activity{lastSeen: now, ip: ip}
+		ss.mu.Unlock()
+	}
+	return &s, nil
+}
+
+// Flush writes buffered last-seen updates to the database and returns how
+// many sessions were updated.
+func (ss *SessionStore) Flush() (int, error) {
+	ss.mu.Lock()
+	pending := ss.pending
+	ss.pending = make(map[string]activity)
+	ss.mu.Unlock()
+
+	var firstErr error
+	for id, a := range pending {
+		if err := ss.db.Model(&Session{}).Where("id = ?", id).Updates(map[string]interface{}{
+			"last_seen_at": a.lastSeen,
+			"ip_address":   a.ip,
+		}).Error; err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("update session last seen: %v", err)
+		}
+	}
+	return len(pending), firstErr
+}
+
+// Run flushes last-seen updates every minute and deletes expired and revoked
+// sessions every cleanupInterval, until ctx is cancelled. Anything still
+// buffered at that point is left for a final Flush.
+func (ss *SessionStore) Run(ctx context.Context, cleanupInterval time.Duration) {
+	flush := time.NewTicker(lastSeenResolution)
+	defer flush.Stop()
+	cleanup := time.NewTicker(cleanupInterval)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flush.C:
+			if _, err := ss.Flush(); err != nil {
+				logger.Error("session flush failed", "err", err)
+			}
+		case <-cleanup.C:
+			n, err := ss.DeleteExpired()
+			if err != nil {
+				logger.Error("session cleanup failed", "err", err)
+			} else if n > 0 {
+				logger.Info("session cleanup", "removed", n)
+			}
+		}
+	}
+}
+
+// ListForUser returns the live sessions of email, most recently used first.
+func (ss *SessionStore) ListForUser(email string) ([]Session, error) {
+	var all []Session
+	if err := ss.db.Where("email = ? AND revoked_at IS NULL", email).
+		Order("last_seen_at DESC").Find(&all).Error; err != nil {
+		return nil, fmt.Errorf("list sessions: %v", err)
+	}
+
+	now := time.Now().UTC()
+	live := make([]Session, 0, len(all))
+	for _, s := range all {
+		if !ss.expired(&s, now) {
+			live = append(live, s)
+		}
+	}
+	return live, nil
+}
+
+// Revoke ends one of email's sessions. Sessions belonging to someone else are
+// reported as not found.
+func (ss *SessionStore) Revoke(email, id string) error {
+	res := ss.db.Model(&Session{}).
+		Where("id = ? AND email = ? AND revoked_at IS NULL", id, email).
+		Update("revoked_at", time.Now().UTC())
+	if res.Error != nil {
+		return fmt.Errorf("revoke session: %v", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RevokeAll ends every session of email except the one with id keep (pass ""
+// to end them all). It returns the number of sessions revoked.
+func (ss *SessionStore) RevokeAll(email, keep string) (int64, error) {
+	res := ss.db.Model(&Session{}).
+		Where("email = ? AND id <> ? AND revoked_at IS NULL", email, keep).
+		Update("revoked_at", time.Now().UTC())
+	if res.Error != nil {
+		return 0, fmt.Errorf("revoke sessions: %v", res.Error)
+	}
+	return res.RowsAffected, nil
+}
+
+// DeleteExpired removes sessions that are revoked, idle for too long or past
+// their absolute lifetime. It returns the number of rows removed.
+func (ss *SessionStore) DeleteExpired() (int64, error) {
+	now := time.Now().UTC()
+	res := ss.db.Where("revoked_at IS NOT NULL OR expires_at <= ? OR last_seen_at <= ?",
+		now, now.Add(-ss.IdleTimeout)).Delete(&Session{})
+	if res.Error != nil {
+		return 0, fmt.Errorf("delete expired sessions: %v", res.Error)
+	}
+	return res.RowsAffected, nil
+}
+
+func (ss *SessionStore) expired(s *Session, now time.Time) bool {
+	return !now.Before(s.ExpiresAt) || now.Sub(s.LastSeenAt) >= ss.IdleTimeout
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate random bytes: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// describeUserAgent reduces a User-Agent header to a short "Browser on OS"
+// label for the session list. It is deliberately coarse.
+func describeUserAgent(ua string) string {
+	browser := "Unknown browser"
+	switch {
+	case strings.Contains(ua, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(ua, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		browser = "Safari"
+	case strings.HasPrefix(ua, "curl/"):
+		browser = "curl"
+	}
+
+	os := ""
+	switch {
+	case strings.Contains(ua, "Android"):
+		os = "Android"
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"):
+		os = "iOS"
+	case strings.Contains(ua, "Windows"):
+		os = "Windows"
+	case strings.Contains(ua, "Mac OS X"):
+		os = "macOS"
+	case strings.Contains(ua, "CrOS"):
+		os = "ChromeOS"
+	case strings.Contains(ua, "Linux"):
+		os = "Linux"
+	}
+
+	if os == "" {
+		return browser
+	}
+	return browser + " on " + os
+}
@@ -0,0 +1,274 @@
+package session
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/maskarb/skarbek-dev/internal/database"
+)
+
+func newTestStore(t *testing.T) *SessionStore {
+	t.Helper()
+	db, err := database.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close(db) })
+	ss, err := NewSessionStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ss
+}
+
+func create(t *testing.T, ss *SessionStore, email string) (*Session, string) {
+	t.Helper()
+	s, token, err := ss.Create(email, "", "curl/8.0", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, token
+}
+
+// age moves a session's timestamps back by d.
+func age(t *testing.T, ss *SessionStore, id string, d time.Duration) {
+	t.Helper()
+	var s Session
+	if err := ss.db.First(&s, "id = ?", id).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.db.Model(&s).Updates(map[string]interface{}{
+		"created_at":   s.CreatedAt.Add(-d),
+		"last_seen_at": s.LastSeenAt.Add(-d),
+		"expires_at":   s.ExpiresAt.Add(-d),
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	ss := newTestStore(t)
+	s, token := create(t, ss, "ada@example.com")
+
+	got, err := ss.Lookup(token, "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != s.ID || got.Email != "ada@example.com" || got.Device != "curl" {
+		t.Errorf("Lookup = %+v", got)
+	}
+	if _, err := ss.Lookup(s.TokenHash, "192.0.2.1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("lookup by the stored hash: err = %v, want ErrNotFound", err)
+	}
+	var stored Session
+	if err := ss.db.First(&stored, "id = ?", s.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stored.TokenHash, token) || stored.TokenHash != hashToken(token) {
+		t.Errorf("stored token hash %q", stored.TokenHash)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	ss := newTestStore(t)
+	ss.IdleTimeout = time.Hour
+	ss.AbsoluteTimeout = 3 * time.Hour
+
+	idle, idleToken := create(t, ss, "ada@example.com")
+	age(t, ss, idle.ID, time.Hour)
+	if _, err := ss.Lookup(idleToken, "192.0.2.1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("idle session: err = %v, want ErrNotFound", err)
+	}
+
+	// Kept busy, but past its absolute lifetime.
+	busy, busyToken := create(t, ss, "ada@example.com")
+	age(t, ss, busy.ID, 3*time.Hour)
+	if err := ss.db.Model(&Session{}).Where("id = ?", busy.ID).
+		Update("last_seen_at", time.Now().UTC()).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.Lookup(busyToken, "192.0.2.1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("session past its lifetime: err = %v, want ErrNotFound", err)
+	}
+
+	live, _ := create(t, ss, "ada@example.com")
+	list, err := ss.ListForUser("ada@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != live.ID {
+		t.Errorf("ListForUser = %+v, want only the live session", list)
+	}
+
+	if err := ss.Revoke("ada@example.com", live.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ss.DeleteExpired(); err != nil || n != 3 {
+		t.Errorf("DeleteExpired = %d, %v; want 3", n, err)
+	}
+}
+
+// TestLastSeen makes sure activity is buffered until Flush and written at
+// most once a minute, unless the address changes.
+func TestLastSeen(t *testing.T) {
+	ss := newTestStore(t)
+	s, token := create(t, ss, "ada@example.com")
+
+	if _, err := ss.Lookup(token, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ss.Flush(); err != nil || n != 0 {
+		t.Errorf("Flush after a fresh lookup = %d, %v; want 0", n, err)
+	}
+
+	if _, err := ss.Lookup(token, "198.51.100.7"); err != nil {
+		t.Fatal(err)
+	}
+	age(t, ss, s.ID, 2*time.Minute)
+	if n, err := ss.Flush(); err != nil || n != 1 {
+		t.Errorf("Flush after a new address = %d, %v; want 1", n, err)
+	}
+	var stored Session
+	if err := ss.db.First(&stored, "id = ?", s.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.IPAddress != "198.51.100.7" || time.Since(stored.LastSeenAt) > time.Minute {
+		t.Errorf("stored %s at %v, want the new address just now", stored.IPAddress, stored.LastSeenAt)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	ss := newTestStore(t)
+	a1, token := create(t, ss, "ada@example.com")
+	a2, _ := create(t, ss, "ada@example.com")
+	a3, _ := create(t, ss, "ada@example.com")
+	b, _ := create(t, ss, "bob@example.com")
+
+	if err := ss.Revoke("ada@example.com", b.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("revoking someone else's session: err = %v, want ErrNotFound", err)
+	}
+	if err := ss.Revoke("ada@example.com", a2.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Revoke("ada@example.com", a2.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("revoking twice: err = %v, want ErrNotFound", err)
+	}
+	if n, err := ss.RevokeAll("ada@example.com", a1.ID); err != nil || n != 1 {
+		t.Errorf("RevokeAll = %d, %v; want 1", n, err)
+	}
+	list, err := ss.ListForUser("ada@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != a1.ID {
+		t.Errorf("ada's sessions = %+v, want only %s (not %s)", list, a1.ID, a3.ID)
+	}
+	if _, err := ss.Lookup(token, "192.0.2.1"); err != nil {
+		t.Errorf("kept session: %v", err)
+	}
+	if list, _ := ss.ListForUser("bob@example.com"); len(list) != 1 {
+		t.Errorf("bob has %d sessions, want 1", len(list))
+	}
+}
+
+func TestDescribeUserAgent(t *testing.T) {
+	for ua, want := range map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0": "Edge on Windows",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15":         "Safari on macOS",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/604.1":     "Safari on iOS",
+		"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36":         "Chrome on Android",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0":                                                        "Firefox on Linux",
+		"curl/8.4.0": "curl",
+		"":           "Unknown browser",
+	} {
+		if got := describeUserAgent(ua); got != want {
+			t.Errorf("describeUserAgent(%q) = %q, want %q", ua, got, want)
+		}
+	}
+}
+
+// router serves the session API and logout behind Middleware, as main does.
+func router(srv *sessionServer) http.Handler {
+	r := chi.NewRouter()
+	r.Use(srv.Middleware)
+	r.Mount("/api/v1/sessions", srv.Routes())
+	r.Post("/logout", srv.LogoutHandler)
+	r.With(RequireAdmin([]string{"Ada@example.com"})).Get("/admin", func(w http.ResponseWriter, r *http.Request) {})
+	return r
+}
+
+func serve(h http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.AddCookie(&http.Cookie{Name: CookieName, Value: token})
+	}
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// cleared reports whether w clears the session cookie.
+func cleared(w *httptest.ResponseRecorder) bool {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == CookieName && c.MaxAge < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHandlers(t *testing.T) {
+	ss := newTestStore(t)
+	h := router(NewSessionServer(ss, ""))
+	_, ada := create(t, ss, "ada@example.com")
+	other, _ := create(t, ss, "ada@example.com")
+	_, bob := create(t, ss, "bob@example.com")
+
+	if w := serve(h, http.MethodGet, "/api/v1/sessions/", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("without a session: status %d, want 401", w.Code)
+	}
+	if w := serve(h, http.MethodGet, "/api/v1/sessions/", "bogus"); w.Code != http.StatusUnauthorized || !cleared(w) {
+		t.Errorf("unknown token: status %d, cleared %v; want 401 and a cleared cookie", w.Code, cleared(w))
+	}
+	w := serve(h, http.MethodGet, "/api/v1/sessions/", ada)
+	if w.Code != http.StatusOK || strings.Count(w.Body.String(), `"current":true`) != 1 {
+		t.Errorf("list: status %d, %s", w.Code, w.Body)
+	}
+
+	if w := serve(h, http.MethodGet, "/admin", ada); w.Code != http.StatusOK {
+		t.Errorf("admin as ada: status %d, want 200", w.Code)
+	}
+	if w := serve(h, http.MethodGet, "/admin", bob); w.Code != http.StatusForbidden {
+		t.Errorf("admin as bob: status %d, want 403", w.Code)
+	}
+
+	if w := serve(h, http.MethodDelete, "/api/v1/sessions/"+other.ID, bob); w.Code != http.StatusNotFound {
+		t.Errorf("bob revoking ada's session: status %d, want 404", w.Code)
+	}
+	if w := serve(h, http.MethodDelete, "/api/v1/sessions/"+other.ID, ada); w.Code != http.StatusNoContent || cleared(w) {
+		t.Errorf("revoking another session: status %d, cleared %v; want 204 and the cookie kept", w.Code, cleared(w))
+	}
+
+	// Logout is only routed for POST.
+	if w := serve(h, http.MethodGet, "/logout", ada); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /logout: status %d, want 405", w.Code)
+	}
+	w = serve(h, http.MethodPost, "/logout", ada)
+	if w.Code != http.StatusSeeOther || !cleared(w) {
+		t.Errorf("logout: status %d, cleared %v; want 303 and a cleared cookie", w.Code, cleared(w))
+	}
+	if _, err := ss.Lookup(ada, "192.0.2.1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("session after logout: err = %v, want ErrNotFound", err)
+	}
+
+	w = serve(h, http.MethodDelete, "/api/v1/sessions/?include_current=true", bob)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"revoked":1`) || !cleared(w) {
+		t.Errorf("revoking all: status %d, %s, cleared %v", w.Code, w.Body, cleared(w))
+	}
+}
@@ -0,0 +1,115 @@
+package shutdown
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/logging"
+)
+
+var logger = logging.For("shutdown")
+
+// Group runs long-lived background goroutines that all stop when the group
+// is stopped.
+type Group struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	running map[string]int
+}
+
+func NewGroup() *Group {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Group{ctx: ctx, cancel: cancel, running: make(map[string]int)}
+}
+
+// Go runs fn in a new goroutine. fn must return once ctx is cancelled.
+func (g *Group) Go(name string, fn func(ctx context.Context)) {
+	g.mu.Lock()
+	g.running[name]++
+	g.mu.Unlock()
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer func() {
+			g.mu.Lock()
+			g.running[name]--
+			if g.running[name] == 0 {
+				delete(g.running, name)
+			}
+			g.mu.Unlock()
+		}()
+		fn(g.ctx)
+	}()
+}
+
+// Stop cancels every goroutine and waits for them to return, or for ctx to
+// expire. The error names the goroutines that did not stop in time.
+func (g *Group) Stop(ctx context.Context) error {
+	g.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		names := make([]string, 0, len(g.running))
+		for name := range g.running {
+			names = append(names, name)
+		}
+		return fmt.Errorf("still running: %s", strings.Join(names, ", "))
+	}
+}
+
+// Sequence is an ordered list of cleanup steps run at shutdown.
+type Sequence struct {
+	steps []step
+}
+
+type step struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// Add appends a step. Steps run in the order they were added.
+func (s *Sequence) Add(name string, fn func(ctx context.Context) error) {
+	s.steps = append(s.steps, step{name, fn})
+}
+
+// Run executes every step, even after one fails, sharing ctx's deadline,
+// and logs how each one went followed by a one line summary.
+func (s *Sequence) Run(ctx context.Context) error {
+	start := time.Now()
+	var failed []string
+	for _, st := range s.steps {
+		stepStart := time.Now()
+		if err := st.fn(ctx); err != nil {
+			failed = append(failed, st.name)
+			logger.Error("step failed", "step", st.name, "duration", time.Since(stepStart).Round(time.Millisecond), "err", err)
+			continue
+		}
+		logger.Info("step done", "step", st.name, "duration", time.Since(stepStart).Round(time.Millisecond))
+	}
+
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if len(failed) > 0 {
+		logger.Error("shutdown finished with failures",
+			"duration", elapsed, "failed", len(failed), "steps", len(s.steps), "failing", strings.Join(failed, ","))
+		return fmt.Errorf("shutdown steps failed: %s", strings.Join(failed, ", "))
+	}
+	logger.Info("clean shutdown", "duration", elapsed, "steps", len(s.steps))
+	return nil
+}
@@ -0,0 +1,150 @@
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSequence(t *testing.T) {
+	var ran []string
+	var seq Sequence
+	for _, name := range []string{"drain http", "stop background jobs", "close sensors", "close database"} {
+		name := name
+		seq.Add(name, func(context.Context) error {
+			ran = append(ran, name)
+			if name == "close sensors" {
+				return errors.New("i2c bus busy")
+			}
+			return nil
+		})
+	}
+
+	err := seq.Run(context.Background())
+	// A failed step does not stop the later ones.
+	if want := []string{"drain http", "stop background jobs", "close sensors", "close database"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("ran %q, want %q", ran, want)
+	}
+	if err == nil || !strings.Contains(err.Error(), "close sensors") || strings.Contains(err.Error(), "close database") {
+		t.Errorf("err = %v, want only close sensors named", err)
+	}
+}
+
+// TestSequenceDeadline makes sure steps share one deadline, so a slow step
+// leaves the later ones less time rather than extending the shutdown.
+func TestSequenceDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	var later error
+	var seq Sequence
+	seq.Add("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	seq.Add("later", func(ctx context.Context) error {
+		later = ctx.Err()
+		return nil
+	})
+	start := time.Now()
+	if err := seq.Run(ctx); err == nil || !strings.Contains(err.Error(), "slow") {
+		t.Errorf("err = %v, want slow named", err)
+	}
+	if !errors.Is(later, context.DeadlineExceeded) {
+		t.Errorf("later step ran with %v, want the expired deadline", later)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("sequence took %v", d)
+	}
+}
+
+func TestGroupStop(t *testing.T) {
+	g := NewGroup()
+	var mu sync.Mutex
+	var stopped []string
+	for _, name := range []string{"session cleanup", "alert engine"} {
+		name := name
+		g.Go(name, func(ctx context.Context) {
+			<-ctx.Done()
+			mu.Lock()
+			stopped = append(stopped, name)
+			mu.Unlock()
+		})
+	}
+	if err := g.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(stopped) != 2 {
+		t.Errorf("Stop returned with %q stopped, want both", stopped)
+	}
+}
+
+func TestGroupStopTimeout(t *testing.T) {
+	g := NewGroup()
+	release := make(chan struct{})
+	defer close(release)
+	g.Go("well behaved", func(ctx context.Context) { <-ctx.Done() })
+	g.Go("stuck", func(context.Context) { <-release })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := g.Stop(ctx)
+	if err == nil || err.Error() != "still running: stuck" {
+		t.Errorf("err = %v, want only stuck named", err)
+	}
+}
+
+// TestDrainFirst runs the steps in main's order and makes sure a request
+// in flight at shutdown still finds the background jobs and the database
+// it needs.
+func TestDrainFirst(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	record := func(e string) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}
+
+	g := NewGroup()
+	g.Go("flush", func(ctx context.Context) {
+		<-ctx.Done()
+		record("background jobs stopped")
+	})
+
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		record("request done")
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	go http.Get("http://" + ln.Addr().String())
+	<-started
+
+	var seq Sequence
+	seq.Add("drain http", srv.Shutdown)
+	seq.Add("stop background jobs", g.Stop)
+	seq.Add("close database", func(context.Context) error {
+		record("database closed")
+		return nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := seq.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"request done", "background jobs stopped", "database closed"}; !reflect.DeepEqual(events, want) {
+		t.Errorf("events %q, want %q", events, want)
+	}
+}
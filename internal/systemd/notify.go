@@ -0,0 +1,99 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/logging"
+)
+
+var logger = logging.For("systemd")
+
+// Notify sends state (e.g. "READY=1") to the service manager over
+// $NOTIFY_SOCKET. It returns false, without error, when the process was not
+// started by systemd with Type=notify.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// A leading @ denotes a socket in the abstract namespace.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("dial notify socket: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("write notify socket: %v", err)
+	}
+	return true, nil
+}
+
+// Ready tells systemd that startup is complete.
+func Ready() error {
+	_, err := Notify("READY=1\nSTATUS=serving")
+	return err
+}
+
+// Stopping tells systemd that shutdown has begun.
+func Stopping() error {
+	_, err := Notify("STOPPING=1\nSTATUS=shutting down")
+	return err
+}
+
+// WatchdogInterval returns the configured WatchdogSec, or false if the
+// watchdog is not enabled for this process.
+func WatchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+	return time.Duration(usec) * time.Microsecond, true
+}
+
+// Watchdog pings the systemd watchdog at half the configured interval for as
+// long as healthy succeeds, until ctx is cancelled. A failing or hanging
+// check skips the ping, so systemd restarts the service once WatchdogSec
+// passes without one. Each check gets a deadline of half the interval.
+func Watchdog(ctx context.Context, healthy func(ctx context.Context) error) {
+	interval, ok := WatchdogInterval()
+	if !ok {
+		return
+	}
+	period := interval / 2
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkCtx, cancel := context.WithTimeout(ctx, period)
+			err := healthy(checkCtx)
+			cancel()
+			if err != nil {
+				logger.Warn("health check failed, withholding watchdog ping", "err", err)
+				if _, err := Notify("STATUS=unhealthy: " + err.Error()); err != nil {
+					logger.Error("notify failed", "err", err)
+				}
+				continue
+			}
+			if _, err := Notify("WATCHDOG=1\nSTATUS=serving"); err != nil {
+				logger.Error("watchdog ping failed", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package systemd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNotifySocket listens where NOTIFY_SOCKET points for the duration of
+// the test and returns the messages it receives.
+func fakeNotifySocket(t *testing.T) <-chan string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	msgs := make(chan string, 16)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				close(msgs)
+				return
+			}
+			msgs <- string(buf[:n])
+		}
+	}()
+	return msgs
+}
+
+func receive(t *testing.T, msgs <-chan string) string {
+	t.Helper()
+	select {
+	case m := <-msgs:
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message on the notify socket")
+		return ""
+	}
+}
+
+func TestNotifyWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	sent, err := Notify("READY=1")
+	if sent || err != nil {
+		t.Fatalf("Notify() = %v, %v; want false, nil", sent, err)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	msgs := fakeNotifySocket(t)
+
+	sent, err := Notify("STATUS=testing")
+	if !sent || err != nil {
+		t.Fatalf("Notify() = %v, %v; want true, nil", sent, err)
+	}
+	if got := receive(t, msgs); got != "STATUS=testing" {
+		t.Errorf("got %q, want STATUS=testing", got)
+	}
+
+	if err := Ready(); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, msgs); !strings.HasPrefix(got, "READY=1\n") {
+		t.Errorf("Ready sent %q", got)
+	}
+	if err := Stopping(); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, msgs); !strings.HasPrefix(got, "STOPPING=1\n") {
+		t.Errorf("Stopping sent %q", got)
+	}
+}
+
+func TestNotifyUnreachableSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing"))
+	if _, err := Notify("READY=1"); err == nil {
+		t.Fatal("Notify to a missing socket succeeded")
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		usec, pid string
+		want      time.Duration
+		ok        bool
+	}{
+		{"", "", 0, false},
+		{"0", "", 0, false},
+		{"junk", "", 0, false},
+		{"2000000", "", 2 * time.Second, true},
+		{"2000000", "1", 0, false},
+	}
+	for _, tt := range tests {
+		t.Setenv("WATCHDOG_USEC", tt.usec)
+		t.Setenv("WATCHDOG_PID", tt.pid)
+		got, ok := WatchdogInterval()
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: got %v, %v; want %v, %v",
+				tt.usec, tt.pid, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	msgs := fakeNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "40000")
+	t.Setenv("WATCHDOG_PID", "")
+
+	healthy := make(chan error, 1)
+	healthy <- nil
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Watchdog(ctx, func(ctx context.Context) error {
+			if _, ok := ctx.Deadline(); !ok {
+				t.Error("health check has no deadline")
+			}
+			select {
+			case err := <-healthy:
+				healthy <- err
+				return err
+			default:
+				return nil
+			}
+		})
+	}()
+
+	if got := receive(t, msgs); !strings.HasPrefix(got, "WATCHDOG=1\n") {
+		t.Errorf("healthy check sent %q, want a watchdog ping", got)
+	}
+	<-healthy
+	healthy <- errors.New("bus wedged")
+	// Drain pings sent before the check started failing.
+	for {
+		got := receive(t, msgs)
+		if strings.HasPrefix(got, "WATCHDOG=1") {
+			continue
+		}
+		if got != "STATUS=unhealthy: bus wedged" {
+			t.Errorf("failing check sent %q", got)
+		}
+		break
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Watchdog did not return after cancel")
+	}
+}
+
+func TestWatchdogDisabled(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	done := make(chan struct{})
+	go func() {
+		Watchdog(context.Background(), func(context.Context) error {
+			t.Error("health check ran without a watchdog")
+			return nil
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Watchdog without WATCHDOG_USEC did not return")
+	}
+}
@@ -0,0 +1,101 @@
+package units
+
+import (
+	"fmt"
+	"strings"
+)
+
+// System picks one unit per dimension.
+type System struct {
+	Temperature Unit `json:"temperature"`
+	Pressure    Unit `json:"pressure"`
+	Length      Unit `json:"length"`
+}
+
+var (
+	// SI is what the sensors report and the API default.
+	SI = System{Temperature: Celsius, Pressure: Pascal, Length: Metre}
+	// Metric is SI with pressure in hPa, as weather services report it.
+	Metric = System{Temperature: Celsius, Pressure: Hectopascal, Length: Metre}
+	// Imperial is °F, inHg and feet.
+	Imperial = System{Temperature: Fahrenheit, Pressure: InchHg, Length: Foot}
+)
+
+var presets = map[string]System{
+	"si":       SI,
+	"metric":   Metric,
+	"imperial": Imperial,
+	"us":       Imperial,
+}
+
+// ParseSystem reads a comma separated list of presets (si, metric,
+// imperial) and units, applied left to right on top of SI, so
+// "imperial,hPa" is °F, hPa and feet. The empty string is SI.
+func ParseSystem(spec string) (System, error) {
+	return SI.Apply(spec)
+}
+
+// Apply is ParseSystem starting from s instead of SI, so a user who prefers
+// imperial units can ask for "hPa" alone.
+func (s System) Apply(spec string) (System, error) {
+	sys := s
+	for _, tok := range strings.Split(spec, ",") {
+		tok = strings.TrimSpace(tok)
+		if tok == "" {
+			continue
+		}
+		if p, ok := presets[strings.ToLower(tok)]; ok {
+			sys = p
+			continue
+		}
+		u, err := Parse(tok)
+		if err != nil {
+			return System{}, err
+		}
+		if err := sys.set(u); err != nil {
+			return System{}, err
+		}
+	}
+	return sys, nil
+}
+
+func (s *System) set(u Unit) error {
+	d, ok := u.Dimension()
+	if !ok {
+		return fmt.Errorf("unit %s cannot be chosen", u)
+	}
+	switch d {
+	case Temperature:
+		s.Temperature = u
+	case Pressure:
+		s.Pressure = u
+	case Length:
+		s.Length = u
+	}
+	return nil
+}
+
+// String is the canonical form accepted by ParseSystem, e.g. "F,inHg,ft".
+func (s System) String() string {
+	return string(s.Temperature) + "," + string(s.Pressure) + "," + string(s.Length)
+}
+
+// Celsius converts a temperature in °C to the system's unit.
+func (s System) Celsius(v float64) float64 { return fromBase(v, s.Temperature) }
+
+// Pascal converts a pressure in Pa to the system's unit.
+func (s System) Pascal(v float64) float64 { return fromBase(v, s.Pressure) }
+
+// Metres converts a length in metres to the system's unit.
+func (s System) Metres(v float64) float64 { return fromBase(v, s.Length) }
+
+// Decimals is how many decimals are worth showing for values in u.
+func Decimals(u Unit) int {
+	switch u {
+	case Pascal:
+		return 1
+	case InchHg, Kilopascal:
+		return 3
+	}
+	return 2
+}
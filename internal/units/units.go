@@ -0,0 +1,155 @@
+// Package units converts sensor values between units. The sensors report
+// °C, Pa and metres; everything shown to people (API, dashboard, exports)
+// goes through a System picking the unit for each dimension.
+package units
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Unit is the symbol used in API responses and in ?units=.
+type Unit string
+
+const (
+	Celsius    Unit = "C"
+	Fahrenheit Unit = "F"
+	Kelvin     Unit = "K"
+
+	Pascal       Unit = "Pa"
+	Hectopascal  Unit = "hPa"
+	Kilopascal   Unit = "kPa"
+	InchHg       Unit = "inHg"
+	MillimetreHg Unit = "mmHg"
+
+	Metre Unit = "m"
+	Foot  Unit = "ft"
+
+	// Percent is relative humidity; it has no alternatives.
+	Percent Unit = "%"
+	// GramPerCubicMetre is absolute humidity.
+	GramPerCubicMetre Unit = "g/m3"
+	// GramPerKilogram is the mixing ratio.
+	GramPerKilogram Unit = "g/kg"
+)
+
+// Dimension is what a unit measures.
+type Dimension int
+
+const (
+	Temperature Dimension = iota
+	Pressure
+	Length
+)
+
+func (d Dimension) String() string {
+	switch d {
+	case Temperature:
+		return "temperature"
+	case Pressure:
+		return "pressure"
+	case Length:
+		return "length"
+	}
+	return fmt.Sprintf("dimension(%d)", int(d))
+}
+
+var dimensions = map[Unit]Dimension{
+	Celsius: Temperature, Fahrenheit: Temperature, Kelvin: Temperature,
+	Pascal: Pressure, Hectopascal: Pressure, Kilopascal: Pressure, InchHg: Pressure, MillimetreHg: Pressure,
+	Metre: Length, Foot: Length,
+}
+
+// aliases are the spellings accepted by Parse besides the symbols.
+var aliases = map[string]Unit{
+	"c": Celsius, "celsius": Celsius,
+	"f": Fahrenheit, "fahrenheit": Fahrenheit,
+	"k": Kelvin, "kelvin": Kelvin,
+	"pa": Pascal, "pascal": Pascal,
+	"hpa": Hectopascal, "mbar": Hectopascal, "millibar": Hectopascal,
+	"kpa":  Kilopascal,
+	"inhg": InchHg,
+	"mmhg": MillimetreHg, "torr": MillimetreHg,
+	"m": Metre, "metre": Metre, "metres": Metre, "meter": Metre, "meters": Metre,
+	"ft": Foot, "foot": Foot, "feet": Foot,
+}
+
+// Parse accepts a unit symbol or name, case-insensitively.
+func Parse(s string) (Unit, error) {
+	if u, ok := aliases[strings.ToLower(strings.TrimSpace(s))]; ok {
+		return u, nil
+	}
+	return "", fmt.Errorf("unknown unit %q", s)
+}
+
+// Dimension returns what u measures.
+func (u Unit) Dimension() (Dimension, bool) {
+	d, ok := dimensions[u]
+	return d, ok
+}
+
+const (
+	pascalPerInchHg     = 3386.389
+	pascalPerMillimetre = 133.322387415
+	metrePerFoot        = 0.3048
+)
+
+// toBase converts v in u to °C, Pa or m.
+func toBase(v float64, u Unit) float64 {
+	switch u {
+	case Fahrenheit:
+		return (v - 32) * 5 / 9
+	case Kelvin:
+		return v - 273.15
+	case Hectopascal:
+		return v * 100
+	case Kilopascal:
+		return v * 1000
+	case InchHg:
+		return v * pascalPerInchHg
+	case MillimetreHg:
+		return v * pascalPerMillimetre
+	case Foot:
+		return v * metrePerFoot
+	}
+	return v
+}
+
+// fromBase converts v in °C, Pa or m to u.
+func fromBase(v float64, u Unit) float64 {
+	switch u {
+	case Fahrenheit:
+		return v*9/5 + 32
+	case Kelvin:
+		return v + 273.15
+	case Hectopascal:
+		return v / 100
+	case Kilopascal:
+		return v / 1000
+	case InchHg:
+		return v / pascalPerInchHg
+	case MillimetreHg:
+		return v / pascalPerMillimetre
+	case Foot:
+		return v / metrePerFoot
+	}
+	return v
+}
+
+// Convert converts v from one unit to another of the same dimension.
+func Convert(v float64, from, to Unit) (float64, error) {
+	df, ok1 := from.Dimension()
+	dt, ok2 := to.Dimension()
+	if !ok1 || !ok2 || df != dt {
+		return 0, fmt.Errorf("cannot convert %s to %s", from, to)
+	}
+	return fromBase(toBase(v, from), to), nil
+}
+
+// Round rounds v to the given number of decimals, enough to hide float32
+// noise from the sensor without losing its resolution.
+func Round(v float64, decimals int) float64 {
+	p := math.Pow(10, float64(decimals))
+	return math.Round(v*p) / p
+}
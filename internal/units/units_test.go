@@ -0,0 +1,166 @@
+package units
+
+import (
+	"math"
+	"testing"
+)
+
+var conversions = []struct {
+	v        float64
+	from, to Unit
+	want     float64
+}{
+	{20, Celsius, Fahrenheit, 68},
+	{-40, Celsius, Fahrenheit, -40},
+	{212, Fahrenheit, Celsius, 100},
+	{0, Celsius, Kelvin, 273.15},
+	{32, Fahrenheit, Kelvin, 273.15},
+	{101325, Pascal, Hectopascal, 1013.25},
+	{1013.25, Hectopascal, Kilopascal, 101.325},
+	{101325, Pascal, InchHg, 29.921252},
+	{29.92, InchHg, Hectopascal, 1013.207589},
+	{1013.25, Hectopascal, MillimetreHg, 759.999892},
+	{1000, Metre, Foot, 3280.839895},
+	{1, Foot, Metre, 0.3048},
+	{15, Celsius, Celsius, 15},
+}
+
+func TestConvert(t *testing.T) {
+	for _, c := range conversions {
+		got, err := Convert(c.v, c.from, c.to)
+		if err != nil {
+			t.Errorf("Convert(%v, %s, %s): %v", c.v, c.from, c.to, err)
+			continue
+		}
+		if math.Abs(got-c.want) > 1e-6 {
+			t.Errorf("Convert(%v, %s, %s) = %v, want %v", c.v, c.from, c.to, got, c.want)
+		}
+		// And back again.
+		if back, _ := Convert(got, c.to, c.from); math.Abs(back-c.v) > 1e-9 {
+			t.Errorf("Convert(%v, %s, %s) = %v, want %v", got, c.to, c.from, back, c.v)
+		}
+	}
+	for _, c := range []struct{ from, to Unit }{
+		{Celsius, Pascal},
+		{Metre, Hectopascal},
+		{Percent, Percent},
+		{"furlong", Metre},
+	} {
+		if _, err := Convert(1, c.from, c.to); err == nil {
+			t.Errorf("Convert(1, %s, %s) did not fail", c.from, c.to)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for in, want := range map[string]Unit{
+		"C": Celsius, "celsius": Celsius,
+		"F": Fahrenheit, "Fahrenheit": Fahrenheit,
+		"K":  Kelvin,
+		"Pa": Pascal, "hPa": Hectopascal, "HPA": Hectopascal, "mbar": Hectopascal, "millibar": Hectopascal,
+		"kPa": Kilopascal, "inHg": InchHg, "mmHg": MillimetreHg, "torr": MillimetreHg,
+		"m": Metre, "metres": Metre, "meters": Metre,
+		"ft": Foot, "feet": Foot, " foot ": Foot,
+	} {
+		if got, err := Parse(in); err != nil || got != want {
+			t.Errorf("Parse(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "%", "°C", "psi", "inches"} {
+		if got, err := Parse(in); err == nil {
+			t.Errorf("Parse(%q) = %q, want an error", in, got)
+		}
+	}
+}
+
+func TestRound(t *testing.T) {
+	for _, c := range []struct {
+		v        float64
+		decimals int
+		want     float64
+	}{
+		// float32 noise from the sensor.
+		{float64(float32(21.37)), 2, 21.37},
+		{101325.00390625, 1, 101325},
+		{29.921252, 3, 29.921},
+		{-3.456, 2, -3.46},
+		{2.5, 0, 3},
+	} {
+		if got := Round(c.v, c.decimals); got != c.want {
+			t.Errorf("Round(%v, %d) = %v, want %v", c.v, c.decimals, got, c.want)
+		}
+	}
+	for u, want := range map[Unit]int{
+		Celsius: 2, Fahrenheit: 2, Pascal: 1, Hectopascal: 2, Kilopascal: 3, InchHg: 3, MillimetreHg: 2, Foot: 2,
+	} {
+		if got := Decimals(u); got != want {
+			t.Errorf("Decimals(%s) = %d, want %d", u, got, want)
+		}
+	}
+}
+
+func TestParseSystem(t *testing.T) {
+	for _, c := range []struct {
+		spec string
+		want System
+	}{
+		{"", SI},
+		{"si", SI},
+		{"metric", Metric},
+		{"Imperial", Imperial},
+		{"us", Imperial},
+		// Applied left to right on top of SI.
+		{"imperial,hPa", System{Temperature: Fahrenheit, Pressure: Hectopascal, Length: Foot}},
+		{"hPa,imperial", Imperial},
+		{"F", System{Temperature: Fahrenheit, Pressure: Pascal, Length: Metre}},
+		{" F , mmHg ,", System{Temperature: Fahrenheit, Pressure: MillimetreHg, Length: Metre}},
+		{"F,inHg,ft", Imperial},
+	} {
+		got, err := ParseSystem(c.spec)
+		if err != nil || got != c.want {
+			t.Errorf("ParseSystem(%q) = %s, %v; want %s", c.spec, got, err, c.want)
+		}
+	}
+	for _, spec := range []string{"psi", "F,psi", "%", "imperial,g/kg"} {
+		if got, err := ParseSystem(spec); err == nil {
+			t.Errorf("ParseSystem(%q) = %s, want an error", spec, got)
+		}
+	}
+	// String round-trips.
+	for _, sys := range []System{SI, Metric, Imperial} {
+		if got, err := ParseSystem(sys.String()); err != nil || got != sys {
+			t.Errorf("ParseSystem(%q) = %s, %v", sys.String(), got, err)
+		}
+	}
+}
+
+// TestApply makes sure ?units= only changes what it names of the caller's
+// preferred system.
+func TestApply(t *testing.T) {
+	got, err := Imperial.Apply("hPa")
+	if want := (System{Temperature: Fahrenheit, Pressure: Hectopascal, Length: Foot}); err != nil || got != want {
+		t.Errorf("Imperial.Apply(hPa) = %s, %v; want %s", got, err, want)
+	}
+	if got, err := Imperial.Apply(""); err != nil || got != Imperial {
+		t.Errorf("Imperial.Apply(\"\") = %s, %v", got, err)
+	}
+	if got, err := Imperial.Apply("si"); err != nil || got != SI {
+		t.Errorf("Imperial.Apply(si) = %s, %v", got, err)
+	}
+}
+
+func TestSystemConversions(t *testing.T) {
+	sys := Imperial
+	if got := sys.Celsius(100); got != 212 {
+		t.Errorf("Celsius(100) = %v", got)
+	}
+	if got := Round(sys.Pascal(101325), Decimals(sys.Pressure)); got != 29.921 {
+		t.Errorf("Pascal(101325) = %v", got)
+	}
+	if got := Round(sys.Metres(100), Decimals(sys.Length)); got != 328.08 {
+		t.Errorf("Metres(100) = %v", got)
+	}
+	if got := SI.Pascal(101325); got != 101325 {
+		t.Errorf("SI.Pascal(101325) = %v", got)
+	}
+}
@@ -0,0 +1,166 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status is where a delivery is in the queue.
+type Status string
+
+const (
+	// Pending deliveries wait for their next attempt.
+	Pending   Status = "pending"
+	Succeeded Status = "succeeded"
+	// Failed deliveries used up their attempts; they can be redelivered.
+	Failed Status = "failed"
+)
+
+// Delivery is one event queued for one subscription.
+type Delivery struct {
+	ID             uint   `json:"id" gorm:"primaryKey"`
+	SubscriptionID uint   `json:"subscription_id" gorm:"index"`
+	EventID        string `json:"event_id"`
+	Event          string `json:"event"`
+	// Payload is the exact body sent, so redeliveries carry the same
+	// bytes and signatures can be checked against the log.
+	Payload Payload `json:"payload" gorm:"type:text"`
+	Status  Status  `json:"status" gorm:"index:idx_webhook_due"`
+	// Attempts counts the requests made so far.
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty" gorm:"index:idx_webhook_due"`
+	// LastStatusCode is the response to the last attempt, if there was
+	// one; LastError says why it failed.
+	LastStatusCode *int       `json:"last_status_code,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+	// RedeliveryOf is the delivery this one repeats.
+	RedeliveryOf *uint     `json:"redelivery_of,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Payload is a JSON document, shown as such by the API.
+type Payload []byte
+
+func (p Payload) MarshalJSON() ([]byte, error) {
+	if len(p) == 0 {
+		return []byte("null"), nil
+	}
+	return p, nil
+}
+
+// Value stores p as text in the database.
+func (p Payload) Value() (driver.Value, error) {
+	return string(p), nil
+}
+
+// Scan reads p back from its text column.
+func (p *Payload) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case string:
+		*p = Payload(v)
+	case []byte:
+		*p = append(Payload(nil), v...)
+	default:
+		return fmt.Errorf("cannot scan %T into webhook.Payload", src)
+	}
+	return nil
+}
+
+// TableName keeps the tables of this package together.
+func (Delivery) TableName() string { return "webhook_deliveries" }
+
+// Attempt is one request of a delivery.
+type Attempt struct {
+	ID         uint      `json:"-" gorm:"primaryKey"`
+	DeliveryID uint      `json:"-" gorm:"index"`
+	At         time.Time `json:"at"`
+	StatusCode *int      `json:"status_code,omitempty"`
+	// Response is the start of the response body.
+	Response   string  `json:"response,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// TableName keeps the tables of this package together.
+func (Attempt) TableName() string { return "webhook_attempts" }
+
+// DeliveryLog is a delivery with all of its attempts, oldest first.
+type DeliveryLog struct {
+	Delivery
+	Log []Attempt `json:"log"`
+}
+
+// envelope is the body of every delivery.
+type envelope struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// Headers sent with every delivery.
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// responseLimit is how much of a response body the log keeps.
+const responseLimit = 1024
+
+// Sign returns the signature header for body sent at t:
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<unix seconds>.<body>">".
+// Receivers recompute it with their secret and should reject old
+// timestamps to prevent replays.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// send makes one attempt at d and reports how it went.
+func send(ctx context.Context, client *http.Client, s Subscription, d Delivery) (a Attempt) {
+	now := time.Now().UTC()
+	a = Attempt{DeliveryID: d.ID, At: now}
+	defer func() { a.DurationMS = float64(time.Since(now).Microseconds()) / 1000 }()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		a.Error = err.Error()
+		return a
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "skarbek-dev-webhooks/1")
+	req.Header.Set(HeaderEvent, d.Event)
+	req.Header.Set(HeaderDelivery, strconv.FormatUint(uint64(d.ID), 10))
+	req.Header.Set(HeaderSignature, Sign(s.Secret, now, d.Payload))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		a.Error = err.Error()
+		return a
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, responseLimit))
+	a.StatusCode = &resp.StatusCode
+	a.Response = strings.TrimSpace(string(body))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		a.Error = fmt.Sprintf("unexpected status %s", resp.Status)
+	}
+	return a
+}
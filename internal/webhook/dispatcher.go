@@ -0,0 +1,550 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/alert"
+	"github.com/maskarb/skarbek-dev/internal/config"
+	"github.com/maskarb/skarbek-dev/internal/sensor"
+	"gorm.io/gorm"
+)
+
+const (
+	// queueSize is how many events may wait to be stored before new ones
+	// are dropped.
+	queueSize = 256
+	// batchSize bounds the deliveries sent per pass; workers of them are
+	// in flight at a time.
+	batchSize = 50
+	workers   = 4
+	// idle is the longest Run sleeps without looking for due deliveries.
+	idle       = time.Minute
+	maxBackoff = time.Hour
+)
+
+// event is something that happened, before it is matched against the
+// subscriptions.
+type event struct {
+	typ      string
+	sensorID int
+	// values are the readings of a reading event.
+	values map[string]float64
+	at     time.Time
+	// alert is set for alert events.
+	alert *alertData
+}
+
+type readingData struct {
+	SensorID int                `json:"sensor_id"`
+	At       time.Time          `json:"at"`
+	Values   map[string]float64 `json:"values"`
+}
+
+type alertData struct {
+	RuleID    uint            `json:"rule_id"`
+	Rule      string          `json:"rule"`
+	SensorID  int             `json:"sensor_id"`
+	Quantity  string          `json:"quantity"`
+	Condition alert.Condition `json:"condition"`
+	Threshold float64         `json:"threshold"`
+	From      alert.Phase     `json:"from"`
+	To        alert.Phase     `json:"to"`
+	Value     float64         `json:"value"`
+	At        time.Time       `json:"at"`
+	Message   string          `json:"message"`
+}
+
+// Dispatcher matches events against the subscriptions and delivers them.
+// Observe and Transition only queue events, so neither sampling nor alert
+// evaluation waits on the database. Run stores their deliveries apart
+// from sending them, so a slow receiver does not hold them up either, and
+// stores what is still queued before it returns; stored deliveries are
+// sent after a restart.
+type Dispatcher struct {
+	db     *gorm.DB
+	cfg    config.WebhookConfig
+	client *http.Client
+	in     chan event
+	// wake makes Run look for due deliveries right away.
+	wake chan struct{}
+
+	mu      sync.Mutex
+	subs    map[uint]*Subscription
+	dropped int
+}
+
+// NewDispatcher loads the subscriptions from db.
+func NewDispatcher(db *gorm.DB, cfg config.WebhookConfig) (*Dispatcher, error) {
+	if err := db.AutoMigrate(&Subscription{}, &Delivery{}, &Attempt{}); err != nil {
+		return nil, fmt.Errorf("migrate webhooks: %v", err)
+	}
+	d := &Dispatcher{
+		db:     db,
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout.Duration},
+		in:     make(chan event, queueSize),
+		wake:   make(chan struct{}, 1),
+		subs:   make(map[uint]*Subscription),
+	}
+	var subs []Subscription
+	if err := db.Find(&subs).Error; err != nil {
+		return nil, fmt.Errorf("load webhook subscriptions: %v", err)
+	}
+	for i := range subs {
+		d.subs[subs[i].ID] = &subs[i]
+	}
+	return d, nil
+}
+
+// Observe queues a reading event. It matches sensor.SensorStore.Observe.
+func (d *Dispatcher) Observe(o sensor.Observation) {
+	d.queue(event{typ: EventReading, sensorID: o.SensorID, values: o.Values, at: o.At})
+}
+
+// Transition queues an alert event for alerts that fire or resolve. It
+// matches alert.Engine.OnTransition.
+func (d *Dispatcher) Transition(t alert.Transition) {
+	var typ string
+	switch t.To {
+	case alert.Firing:
+		typ = EventAlertFiring
+	case alert.Resolved:
+		typ = EventAlertResolved
+	default:
+		return
+	}
+	r := t.Rule
+	d.queue(event{typ: typ, sensorID: r.SensorID, at: t.At, alert: &alertData{
+		RuleID:    r.ID,
+		Rule:      r.Name,
+		SensorID:  r.SensorID,
+		Quantity:  r.Quantity,
+		Condition: r.Condition,
+		Threshold: r.Threshold,
+		From:      t.From,
+		To:        t.To,
+		Value:     t.Value,
+		At:        t.At,
+		Message:   t.Event().Message,
+	}})
+}
+
+// queue never blocks: when the queue is full the event is dropped and
+// counted.
+func (d *Dispatcher) queue(e event) {
+	select {
+	case d.in <- e:
+	default:
+		d.mu.Lock()
+		d.dropped++
+		d.mu.Unlock()
+	}
+}
+
+// poke wakes Run without blocking.
+func (d *Dispatcher) poke() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run stores queued events and sends due deliveries until ctx is done,
+// when woken by new ones and when the next retry is due. Deliveries still
+// pending at shutdown are sent after restart. Finished deliveries older
+// than the retention are pruned every hour.
+func (d *Dispatcher) Run(ctx context.Context) {
+	stored := make(chan struct{})
+	go func() {
+		d.store(ctx)
+		close(stored)
+	}()
+	defer func() { <-stored }()
+
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+	d.prune(time.Now())
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-timer.C:
+		case now := <-prune.C:
+			d.prune(now)
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		timer.Reset(d.deliverDue(ctx))
+	}
+}
+
+// store writes the deliveries of queued events until ctx is done, then
+// those of the events still queued.
+func (d *Dispatcher) store(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			d.drain()
+			return
+		case e := <-d.in:
+			if d.enqueue(e) {
+				d.poke()
+			}
+		}
+		d.mu.Lock()
+		if d.dropped > 0 {
+			logger.Warn("webhook queue full, events dropped", "dropped", d.dropped)
+			d.dropped = 0
+		}
+		d.mu.Unlock()
+	}
+}
+
+// drain writes the deliveries of the events queued so far.
+func (d *Dispatcher) drain() {
+	for {
+		select {
+		case e := <-d.in:
+			d.enqueue(e)
+		default:
+			return
+		}
+	}
+}
+
+// enqueue stores one delivery of e for every subscription that wants it
+// and reports whether there were any.
+func (d *Dispatcher) enqueue(e event) bool {
+	id := newEventID()
+	now := time.Now().UTC()
+	var out []Delivery
+	for _, s := range d.Subscriptions() {
+		f := s.Filter
+		if s.Disabled || !f.event(e.typ) || !f.sensor(e.sensorID) {
+			continue
+		}
+		var data interface{}
+		if e.alert != nil {
+			if !f.quantity(e.alert.Quantity) {
+				continue
+			}
+			data = e.alert
+		} else {
+			values := make(map[string]float64, len(e.values))
+			for q, v := range e.values {
+				if f.quantity(q) {
+					values[q] = v
+				}
+			}
+			if len(values) == 0 {
+				continue
+			}
+			data = readingData{SensorID: e.sensorID, At: e.at, Values: values}
+		}
+		payload, err := json.Marshal(envelope{ID: id, Type: e.typ, CreatedAt: now, Data: data})
+		if err != nil {
+			logger.Error("encode webhook payload", "event", e.typ, "err", err)
+			return false
+		}
+		out = append(out, Delivery{
+			SubscriptionID: s.ID,
+			EventID:        id,
+			Event:          e.typ,
+			Payload:        payload,
+			Status:         Pending,
+			NextAttemptAt:  &now,
+		})
+	}
+	if len(out) == 0 {
+		return false
+	}
+	if err := d.db.Create(&out).Error; err != nil {
+		logger.Error("queue webhook deliveries", "event", e.typ, "err", err)
+		return false
+	}
+	return true
+}
+
+// deliverDue sends the deliveries whose next attempt is due and returns
+// how long to wait before the next one.
+func (d *Dispatcher) deliverDue(ctx context.Context) time.Duration {
+	now := time.Now().UTC()
+	enabled := d.db.Model(&Subscription{}).Select("id").Where("disabled = ?", false)
+
+	var due []Delivery
+	if err := d.db.Where("status = ? AND subscription_id IN (?) AND next_attempt_at <= ?", Pending, enabled, now).
+		Order("next_attempt_at").Limit(batchSize).Find(&due).Error; err != nil {
+		logger.Error("load due webhook deliveries", "err", err)
+		return idle
+	}
+
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for _, dl := range due {
+		s, err := d.Subscription(dl.SubscriptionID)
+		if err != nil {
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(s Subscription, dl Delivery) {
+			defer wg.Done()
+			d.attempt(ctx, s, dl)
+			<-sem
+		}(s, dl)
+	}
+	wg.Wait()
+	if len(due) == batchSize {
+		return 0
+	}
+
+	var next []Delivery
+	if err := d.db.Where("status = ? AND subscription_id IN (?)", Pending, enabled).
+		Order("next_attempt_at").Limit(1).Find(&next).Error; err != nil || len(next) == 0 || next[0].NextAttemptAt == nil {
+		return idle
+	}
+	if wait := time.Until(*next[0].NextAttemptAt); wait < idle {
+		return wait
+	}
+	return idle
+}
+
+// attempt sends dl once and records the outcome.
+func (d *Dispatcher) attempt(ctx context.Context, s Subscription, dl Delivery) {
+	a := send(ctx, d.client, s, dl)
+	if ctx.Err() != nil {
+		// Shutting down: the delivery stays due and is sent after restart.
+		return
+	}
+	log := logger.With("subscription_id", s.ID, "delivery_id", dl.ID, "event", dl.Event)
+
+	dl.Attempts++
+	dl.LastStatusCode = a.StatusCode
+	dl.LastError = a.Error
+	switch {
+	case a.Error == "":
+		dl.Status = Succeeded
+		dl.NextAttemptAt = nil
+		dl.DeliveredAt = &a.At
+		log.Debug("webhook delivered", "attempt", dl.Attempts)
+	case dl.Attempts >= d.cfg.Attempts:
+		dl.Status = Failed
+		dl.NextAttemptAt = nil
+		log.Warn("webhook delivery failed", "attempt", dl.Attempts, "err", a.Error)
+	default:
+		wait := backoff(d.cfg.Backoff.Duration, dl.Attempts)
+		next := a.At.Add(wait)
+		dl.NextAttemptAt = &next
+		log.Info("webhook delivery failed, retrying", "attempt", dl.Attempts, "in", wait, "err", a.Error)
+	}
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&a).Error; err != nil {
+			return err
+		}
+		return tx.Save(&dl).Error
+	})
+	if err != nil {
+		log.Error("record webhook attempt", "err", err)
+	}
+}
+
+// backoff is the wait after the nth failed attempt: base, doubling with
+// every further failure, capped at maxBackoff.
+func backoff(base time.Duration, n int) time.Duration {
+	wait := base
+	for i := 1; i < n && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		return maxBackoff
+	}
+	return wait
+}
+
+// prune deletes finished deliveries, and their attempts, that are older
+// than the retention.
+func (d *Dispatcher) prune(now time.Time) {
+	cutoff := now.Add(-d.cfg.Retention.Duration).UTC()
+	old := d.db.Model(&Delivery{}).Select("id").Where("status <> ? AND created_at < ?", Pending, cutoff)
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("delivery_id IN (?)", old).Delete(&Attempt{}).Error; err != nil {
+			return err
+		}
+		res := tx.Where("status <> ? AND created_at < ?", Pending, cutoff).Delete(&Delivery{})
+		if res.RowsAffected > 0 {
+			logger.Info("pruned webhook deliveries", "deliveries", res.RowsAffected)
+		}
+		return res.Error
+	})
+	if err != nil {
+		logger.Error("prune webhook deliveries", "err", err)
+	}
+}
+
+// Subscriptions lists every subscription by ID.
+func (d *Dispatcher) Subscriptions() []Subscription {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]Subscription, 0, len(d.subs))
+	for _, s := range d.subs {
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Subscription returns one subscription.
+func (d *Dispatcher) Subscription(id uint) (Subscription, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.subs[id]
+	if !ok {
+		return Subscription{}, fmt.Errorf("subscription %d: %w", id, ErrNotFound)
+	}
+	return *s, nil
+}
+
+// Create stores a new subscription. Without a secret, one is generated;
+// the result is the only place it is shown.
+func (d *Dispatcher) Create(s Subscription) (Subscription, error) {
+	if err := s.Validate(); err != nil {
+		return Subscription{}, err
+	}
+	if s.Secret == "" {
+		var err error
+		if s.Secret, err = newSecret(); err != nil {
+			return Subscription{}, fmt.Errorf("generate secret: %v", err)
+		}
+	}
+	s.ID, s.CreatedAt, s.UpdatedAt = 0, time.Time{}, time.Time{}
+	if err := d.db.Create(&s).Error; err != nil {
+		return Subscription{}, fmt.Errorf("create subscription: %v", err)
+	}
+	d.mu.Lock()
+	d.subs[s.ID] = &s
+	d.mu.Unlock()
+	return s, nil
+}
+
+// Update replaces a subscription. An empty secret keeps the current one.
+func (d *Dispatcher) Update(id uint, s Subscription) (Subscription, error) {
+	if err := s.Validate(); err != nil {
+		return Subscription{}, err
+	}
+	old, err := d.Subscription(id)
+	if err != nil {
+		return Subscription{}, err
+	}
+	if s.Secret == "" {
+		s.Secret = old.Secret
+	}
+	s.ID, s.CreatedAt = id, old.CreatedAt
+	if err := d.db.Save(&s).Error; err != nil {
+		return Subscription{}, fmt.Errorf("update subscription %d: %v", id, err)
+	}
+	d.mu.Lock()
+	d.subs[id] = &s
+	d.mu.Unlock()
+	if !s.Disabled {
+		d.poke()
+	}
+	return s, nil
+}
+
+// Delete removes a subscription with its deliveries.
+func (d *Dispatcher) Delete(id uint) error {
+	if _, err := d.Subscription(id); err != nil {
+		return err
+	}
+	deliveries := d.db.Model(&Delivery{}).Select("id").Where("subscription_id = ?", id)
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("delivery_id IN (?)", deliveries).Delete(&Attempt{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("subscription_id = ?", id).Delete(&Delivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Subscription{}, id).Error
+	})
+	if err != nil {
+		return fmt.Errorf("delete subscription %d: %v", id, err)
+	}
+	d.mu.Lock()
+	delete(d.subs, id)
+	d.mu.Unlock()
+	return nil
+}
+
+// Deliveries lists the newest deliveries of a subscription, optionally
+// only those with status.
+func (d *Dispatcher) Deliveries(id uint, status Status, limit int) ([]Delivery, error) {
+	if _, err := d.Subscription(id); err != nil {
+		return nil, err
+	}
+	q := d.db.Where("subscription_id = ?", id)
+	if status != "" {
+		q = q.Where("status = ?", status)
+	}
+	deliveries := []Delivery{}
+	if err := q.Order("id DESC").Limit(limit).Find(&deliveries).Error; err != nil {
+		return nil, fmt.Errorf("list deliveries: %v", err)
+	}
+	return deliveries, nil
+}
+
+// Delivery returns one delivery of a subscription with its attempts.
+func (d *Dispatcher) Delivery(id, deliveryID uint) (DeliveryLog, error) {
+	var l DeliveryLog
+	err := d.db.Where("subscription_id = ?", id).First(&l.Delivery, deliveryID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return DeliveryLog{}, fmt.Errorf("delivery %d of subscription %d: %w", deliveryID, id, ErrNotFound)
+	} else if err != nil {
+		return DeliveryLog{}, fmt.Errorf("load delivery %d: %v", deliveryID, err)
+	}
+	l.Log = []Attempt{}
+	if err := d.db.Where("delivery_id = ?", deliveryID).Order("id").Find(&l.Log).Error; err != nil {
+		return DeliveryLog{}, fmt.Errorf("load attempts of delivery %d: %v", deliveryID, err)
+	}
+	return l, nil
+}
+
+// Redeliver queues a new delivery with the same event and payload as an
+// earlier one, whatever became of it, and sends it right away.
+func (d *Dispatcher) Redeliver(id, deliveryID uint) (Delivery, error) {
+	l, err := d.Delivery(id, deliveryID)
+	if err != nil {
+		return Delivery{}, err
+	}
+	now := time.Now().UTC()
+	orig := l.ID
+	dl := Delivery{
+		SubscriptionID: id,
+		EventID:        l.EventID,
+		Event:          l.Event,
+		Payload:        l.Payload,
+		Status:         Pending,
+		NextAttemptAt:  &now,
+		RedeliveryOf:   &orig,
+	}
+	if err := d.db.Create(&dl).Error; err != nil {
+		return Delivery{}, fmt.Errorf("queue redelivery: %v", err)
+	}
+	d.poke()
+	return dl, nil
+}
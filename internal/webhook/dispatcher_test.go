@@ -0,0 +1,275 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/alert"
+	"github.com/maskarb/skarbek-dev/internal/config"
+	"github.com/maskarb/skarbek-dev/internal/database"
+	"github.com/maskarb/skarbek-dev/internal/sensor"
+	"gorm.io/gorm"
+)
+
+const testSecret = "0123456789abcdef0123"
+
+func openDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := database.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close(db) })
+	return db
+}
+
+func newDispatcher(t *testing.T, db *gorm.DB) *Dispatcher {
+	t.Helper()
+	cfg := config.Default().Webhooks
+	cfg.Backoff = config.Duration{Duration: 10 * time.Millisecond}
+	cfg.Attempts = 3
+	d, err := NewDispatcher(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// run runs d until the test ends.
+func run(t *testing.T, d *Dispatcher) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// receiver records the deliveries it gets and answers with status.
+type receiver struct {
+	*httptest.Server
+	got chan *http.Request
+	// bodies holds the body of each request on got.
+	bodies chan []byte
+}
+
+func newReceiver(t *testing.T, status ...int) *receiver {
+	r := &receiver{got: make(chan *http.Request, 16), bodies: make(chan []byte, 16)}
+	n := 0
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		code := http.StatusNoContent
+		if n < len(status) {
+			code = status[n]
+		}
+		n++
+		w.WriteHeader(code)
+		r.got <- req
+		r.bodies <- body
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) next(t *testing.T) (*http.Request, []byte) {
+	t.Helper()
+	select {
+	case req := <-r.got:
+		return req, <-r.bodies
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery")
+		return nil, nil
+	}
+}
+
+func subscribe(t *testing.T, d *Dispatcher, url string, f Filter) Subscription {
+	t.Helper()
+	s, err := d.Create(Subscription{URL: url, Secret: testSecret, Filter: f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func deliveries(t *testing.T, d *Dispatcher, id uint) []Delivery {
+	t.Helper()
+	out, err := d.Deliveries(id, "", maxLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// waitStatus waits until the only delivery of subscription id has status.
+func waitStatus(t *testing.T, d *Dispatcher, id uint, status Status) Delivery {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		out := deliveries(t, d, id)
+		if len(out) == 1 && out[0].Status == status {
+			return out[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("deliveries = %+v, want one %s", out, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestObserveStoresDeliveries(t *testing.T) {
+	d := newDispatcher(t, openDB(t))
+	all := subscribe(t, d, "http://example.com/all", Filter{})
+	humidity := subscribe(t, d, "http://example.com/humidity", Filter{Quantities: []string{"humidity"}})
+	other := subscribe(t, d, "http://example.com/other", Filter{SensorIDs: []int{2}})
+	alerts := subscribe(t, d, "http://example.com/alerts", Filter{Events: []string{EventAlertFiring}})
+
+	// Run is not running: drain stores the queued event as Run would.
+	at := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	d.Observe(sensor.Observation{SensorID: 1, At: at, Values: map[string]float64{"temperature": 21.5, "humidity": 40}})
+	d.drain()
+
+	got := deliveries(t, d, all.ID)
+	if len(got) != 1 || got[0].Status != Pending || got[0].Event != EventReading {
+		t.Fatalf("deliveries = %+v, want one pending reading", got)
+	}
+	var env struct {
+		Type string      `json:"type"`
+		Data readingData `json:"data"`
+	}
+	if err := json.Unmarshal(got[0].Payload, &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.Type != EventReading || env.Data.SensorID != 1 || !env.Data.At.Equal(at) || len(env.Data.Values) != 2 {
+		t.Errorf("payload = %s", got[0].Payload)
+	}
+
+	got = deliveries(t, d, humidity.ID)
+	if len(got) != 1 {
+		t.Fatalf("humidity deliveries = %d, want 1", len(got))
+	}
+	env.Data = readingData{}
+	if err := json.Unmarshal(got[0].Payload, &env); err != nil {
+		t.Fatal(err)
+	}
+	if len(env.Data.Values) != 1 || env.Data.Values["humidity"] != 40 {
+		t.Errorf("filtered values = %v, want only humidity", env.Data.Values)
+	}
+	for _, s := range []Subscription{other, alerts} {
+		if got := deliveries(t, d, s.ID); len(got) != 0 {
+			t.Errorf("subscription %s got %d deliveries, want none", s.URL, len(got))
+		}
+	}
+
+	d.Transition(alert.Transition{Rule: alert.Rule{ID: 3, SensorID: 1, Quantity: "temperature"},
+		From: alert.Pending, To: alert.Firing, At: at, Value: 30})
+	d.drain()
+	got = deliveries(t, d, alerts.ID)
+	if len(got) != 1 || got[0].Event != EventAlertFiring {
+		t.Fatalf("alert deliveries = %+v, want one %s", got, EventAlertFiring)
+	}
+}
+
+// TestObserveDoesNotWait makes sure Observe, which runs with the sensor
+// store locked, neither touches the database nor blocks on a full queue.
+func TestObserveDoesNotWait(t *testing.T) {
+	d := newDispatcher(t, openDB(t))
+	s := subscribe(t, d, "http://example.com/all", Filter{})
+
+	for i := 0; i < queueSize+1; i++ {
+		d.Observe(sensor.Observation{SensorID: 1, At: time.Now(), Values: map[string]float64{"temperature": 20}})
+	}
+	if got := deliveries(t, d, s.ID); len(got) != 0 {
+		t.Fatalf("%d deliveries stored by Observe, want none", len(got))
+	}
+	if d.dropped != 1 {
+		t.Errorf("dropped = %d, want 1", d.dropped)
+	}
+	d.drain()
+	if got, err := d.Deliveries(s.ID, "", queueSize+1); err != nil || len(got) != queueSize {
+		t.Errorf("%d deliveries after drain, %v, want %d", len(got), err, queueSize)
+	}
+}
+
+func TestRunDelivers(t *testing.T) {
+	d := newDispatcher(t, openDB(t))
+	r := newReceiver(t)
+	s := subscribe(t, d, r.URL, Filter{})
+	run(t, d)
+
+	d.Observe(sensor.Observation{SensorID: 1, At: time.Now(), Values: map[string]float64{"temperature": 20}})
+	req, body := r.next(t)
+	dl := waitStatus(t, d, s.ID, Succeeded)
+
+	if got := req.Header.Get(HeaderEvent); got != EventReading {
+		t.Errorf("%s = %q, want %q", HeaderEvent, got, EventReading)
+	}
+	if got := req.Header.Get(HeaderDelivery); got != strconv.FormatUint(uint64(dl.ID), 10) {
+		t.Errorf("%s = %q, want %d", HeaderDelivery, got, dl.ID)
+	}
+	sig := req.Header.Get(HeaderSignature)
+	var ts int64
+	if _, err := fmt.Sscanf(sig, "t=%d,", &ts); err != nil {
+		t.Fatalf("%s = %q: %v", HeaderSignature, sig, err)
+	}
+	if want := Sign(testSecret, time.Unix(ts, 0), body); sig != want {
+		t.Errorf("%s = %q, want %q", HeaderSignature, sig, want)
+	}
+	if string(body) != string(dl.Payload) {
+		t.Errorf("body = %s, want the stored payload %s", body, dl.Payload)
+	}
+}
+
+func TestRunRetries(t *testing.T) {
+	d := newDispatcher(t, openDB(t))
+	r := newReceiver(t, http.StatusServiceUnavailable, http.StatusInternalServerError)
+	s := subscribe(t, d, r.URL, Filter{})
+	run(t, d)
+
+	d.Observe(sensor.Observation{SensorID: 1, At: time.Now(), Values: map[string]float64{"temperature": 20}})
+	for i := 0; i < 3; i++ {
+		r.next(t)
+	}
+	dl := waitStatus(t, d, s.ID, Succeeded)
+	if dl.Attempts != 3 {
+		t.Errorf("attempts = %d, want 3", dl.Attempts)
+	}
+	l, err := d.Delivery(s.ID, dl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Log) != 3 || l.Log[0].Error == "" || l.Log[2].Error != "" {
+		t.Errorf("log = %+v, want two failures and a success", l.Log)
+	}
+}
+
+func TestPendingDeliveriesSurviveRestart(t *testing.T) {
+	db := openDB(t)
+	r := newReceiver(t)
+	before := newDispatcher(t, db)
+	s := subscribe(t, before, r.URL, Filter{})
+	// The server stops before the delivery is sent: Run still stores it.
+	before.Observe(sensor.Observation{SensorID: 1, At: time.Now(), Values: map[string]float64{"temperature": 20}})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	before.Run(ctx)
+	if got := deliveries(t, before, s.ID); len(got) != 1 || got[0].Status != Pending {
+		t.Fatalf("deliveries at shutdown = %+v, want one pending", got)
+	}
+
+	after := newDispatcher(t, db)
+	run(t, after)
+	r.next(t)
+	waitStatus(t, after, s.ID, Succeeded)
+}
@@ -0,0 +1,224 @@
+package webhook
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/maskarb/skarbek-dev/internal/apierror"
+)
+
+const (
+	defaultLimit = 50
+	maxLimit     = 500
+)
+
+type webhookServer struct {
+	dispatcher *Dispatcher
+
+	// Protect, if set, guards every endpoint: subscriptions make the
+	// server send requests and carry secrets.
+	Protect func(http.Handler) http.Handler
+}
+
+// NewWebhookServer serves the subscriptions and deliveries of d.
+func NewWebhookServer(d *Dispatcher) *webhookServer {
+	return &webhookServer{dispatcher: d}
+}
+
+// Routes is mounted under /api/v1/webhooks.
+func (ws *webhookServer) Routes() *chi.Mux {
+	router := chi.NewRouter()
+	if ws.Protect != nil {
+		router.Use(ws.Protect)
+	}
+	router.Get("/", ws.listHandler)
+	router.Post("/", ws.postHandler)
+	router.Route("/{subscriptionID}", func(r chi.Router) {
+		r.Get("/", ws.getHandler)
+		r.Put("/", ws.putHandler)
+		r.Delete("/", ws.deleteHandler)
+		r.Get("/deliveries", ws.listDeliveriesHandler)
+		r.Get("/deliveries/{deliveryID}", ws.getDeliveryHandler)
+		r.Post("/deliveries/{deliveryID}/redeliver", ws.redeliverHandler)
+	})
+	return router
+}
+
+func (ws *webhookServer) listHandler(w http.ResponseWriter, req *http.Request) {
+	subs := ws.dispatcher.Subscriptions()
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+	render.JSON(w, req, subs)
+}
+
+func (ws *webhookServer) getHandler(w http.ResponseWriter, req *http.Request) {
+	id, ok := urlID(w, req, "subscriptionID")
+	if !ok {
+		return
+	}
+	s, err := ws.dispatcher.Subscription(id)
+	if err != nil {
+		apierror.Write(w, req, webhookError(err))
+		return
+	}
+	s.Secret = ""
+	render.JSON(w, req, s)
+}
+
+// postHandler creates a subscription. The response is the only one that
+// shows the secret.
+func (ws *webhookServer) postHandler(w http.ResponseWriter, req *http.Request) {
+	var s Subscription
+	if !apierror.DecodeStrict(w, req, &s) {
+		return
+	}
+	s, err := ws.dispatcher.Create(s)
+	if err != nil {
+		apierror.Write(w, req, webhookError(err))
+		return
+	}
+	logger.Ctx(req.Context()).Info("webhook subscription created", "subscription_id", s.ID, "url", s.URL)
+	w.WriteHeader(http.StatusCreated)
+	render.JSON(w, req, s)
+}
+
+// putHandler replaces a subscription. A secret in the body replaces the
+// current one and is echoed back; without one the secret is kept.
+func (ws *webhookServer) putHandler(w http.ResponseWriter, req *http.Request) {
+	id, ok := urlID(w, req, "subscriptionID")
+	if !ok {
+		return
+	}
+	var s Subscription
+	if !apierror.DecodeStrict(w, req, &s) {
+		return
+	}
+	rotated := s.Secret != ""
+	s, err := ws.dispatcher.Update(id, s)
+	if err != nil {
+		apierror.Write(w, req, webhookError(err))
+		return
+	}
+	logger.Ctx(req.Context()).Info("webhook subscription updated", "subscription_id", s.ID,
+		"url", s.URL, "secret_rotated", rotated)
+	if !rotated {
+		s.Secret = ""
+	}
+	render.JSON(w, req, s)
+}
+
+func (ws *webhookServer) deleteHandler(w http.ResponseWriter, req *http.Request) {
+	id, ok := urlID(w, req, "subscriptionID")
+	if !ok {
+		return
+	}
+	if err := ws.dispatcher.Delete(id); err != nil {
+		apierror.Write(w, req, webhookError(err))
+		return
+	}
+	logger.Ctx(req.Context()).Info("webhook subscription deleted", "subscription_id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listDeliveriesHandler lists the newest deliveries, optionally filtered
+// with ?status= and bounded with ?limit=.
+func (ws *webhookServer) listDeliveriesHandler(w http.ResponseWriter, req *http.Request) {
+	id, ok := urlID(w, req, "subscriptionID")
+	if !ok {
+		return
+	}
+	q := req.URL.Query()
+	status := Status(q.Get("status"))
+	switch status {
+	case "", Pending, Succeeded, Failed:
+	default:
+		apierror.Write(w, req, apierror.BadRequest("invalid_status",
+			"status must be pending, succeeded or failed"))
+		return
+	}
+	limit := defaultLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLimit {
+			apierror.Write(w, req, apierror.BadRequest("invalid_limit",
+				"limit must be between 1 and "+strconv.Itoa(maxLimit)).WithDetails(map[string]string{"limit": v}))
+			return
+		}
+		limit = n
+	}
+	deliveries, err := ws.dispatcher.Deliveries(id, status, limit)
+	if err != nil {
+		apierror.Write(w, req, webhookError(err))
+		return
+	}
+	render.JSON(w, req, deliveries)
+}
+
+func (ws *webhookServer) getDeliveryHandler(w http.ResponseWriter, req *http.Request) {
+	id, ok := urlID(w, req, "subscriptionID")
+	if !ok {
+		return
+	}
+	deliveryID, ok := urlID(w, req, "deliveryID")
+	if !ok {
+		return
+	}
+	l, err := ws.dispatcher.Delivery(id, deliveryID)
+	if err != nil {
+		apierror.Write(w, req, webhookError(err))
+		return
+	}
+	render.JSON(w, req, l)
+}
+
+// redeliverHandler queues the delivery's payload again as a new delivery.
+func (ws *webhookServer) redeliverHandler(w http.ResponseWriter, req *http.Request) {
+	id, ok := urlID(w, req, "subscriptionID")
+	if !ok {
+		return
+	}
+	deliveryID, ok := urlID(w, req, "deliveryID")
+	if !ok {
+		return
+	}
+	dl, err := ws.dispatcher.Redeliver(id, deliveryID)
+	if err != nil {
+		apierror.Write(w, req, webhookError(err))
+		return
+	}
+	logger.Ctx(req.Context()).Info("webhook redelivery queued", "subscription_id", id,
+		"delivery_id", dl.ID, "redelivery_of", deliveryID)
+	w.WriteHeader(http.StatusAccepted)
+	render.JSON(w, req, dl)
+}
+
+// urlID parses a numeric URL parameter, writing the error response when it
+// is not a number.
+func urlID(w http.ResponseWriter, req *http.Request, name string) (uint, bool) {
+	param := chi.URLParam(req, name)
+	id, err := strconv.ParseUint(param, 10, 32)
+	if err != nil {
+		code, field := "invalid_subscription_id", "subscription_id"
+		if name == "deliveryID" {
+			code, field = "invalid_delivery_id", "delivery_id"
+		}
+		apierror.Write(w, req, apierror.BadRequest(code,
+			field+" must be a positive integer").WithDetails(map[string]string{field: param}))
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func webhookError(err error) error {
+	switch {
+	case errors.Is(err, ErrInvalidSubscription):
+		return apierror.BadRequest("invalid_subscription", err.Error())
+	case errors.Is(err, ErrNotFound):
+		return apierror.NotFound("webhook_not_found", err.Error())
+	}
+	return err
+}
@@ -0,0 +1,163 @@
+// Package webhook delivers readings and alerts to URLs other services
+// register. Deliveries are signed with the subscription's secret, queued
+// in SQLite so they survive restarts, retried with exponential backoff and
+// kept in a log that shows how every attempt went.
+package webhook
+
+import (
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/logging"
+	"github.com/maskarb/skarbek-dev/internal/sensor"
+)
+
+var logger = logging.For("webhook")
+
+var (
+	// ErrNotFound is returned for subscriptions and deliveries that do not
+	// exist.
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidSubscription is wrapped by errors caused by bad input.
+	ErrInvalidSubscription = errors.New("invalid webhook subscription")
+)
+
+// Event types a subscription can filter on.
+const (
+	EventReading       = "reading"
+	EventAlertFiring   = "alert.firing"
+	EventAlertResolved = "alert.resolved"
+)
+
+// minSecret is the shortest secret accepted from clients.
+const minSecret = 16
+
+// Filter selects the events a subscription receives. Empty lists match
+// everything.
+type Filter struct {
+	Events     []string `json:"events"`
+	SensorIDs  []int    `json:"sensor_ids"`
+	Quantities []string `json:"quantities"`
+}
+
+// Value stores f as JSON in the database.
+func (f Filter) Value() (driver.Value, error) {
+	b, err := json.Marshal(f)
+	return string(b), err
+}
+
+// Scan reads f back from its JSON column.
+func (f *Filter) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), f)
+	case []byte:
+		return json.Unmarshal(v, f)
+	}
+	return fmt.Errorf("cannot scan %T into webhook.Filter", src)
+}
+
+// event reports whether the filter lets events of type t through.
+func (f Filter) event(t string) bool {
+	return len(f.Events) == 0 || contains(f.Events, t)
+}
+
+func (f Filter) sensor(id int) bool {
+	if len(f.SensorIDs) == 0 {
+		return true
+	}
+	for _, s := range f.SensorIDs {
+		if s == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (f Filter) quantity(q string) bool {
+	return len(f.Quantities) == 0 || contains(f.Quantities, q)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription is a URL that receives the events its filter matches.
+type Subscription struct {
+	ID          uint   `json:"id" gorm:"primaryKey"`
+	URL         string `json:"url"`
+	Description string `json:"description"`
+	// Secret signs every delivery. It is only shown when it is set, on
+	// creation or when a PUT replaces it.
+	Secret    string    `json:"secret,omitempty"`
+	Filter    Filter    `json:"filter" gorm:"type:text"`
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName keeps the tables of this package together.
+func (Subscription) TableName() string { return "webhook_subscriptions" }
+
+// Validate reports subscriptions that cannot be delivered to.
+func (s Subscription) Validate() error {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s", ErrInvalidSubscription, fmt.Sprintf(format, args...))
+	}
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return invalid("url %q must be an absolute http(s) URL", s.URL)
+	}
+	if s.Secret != "" && len(s.Secret) < minSecret {
+		return invalid("secret must be at least %d characters", minSecret)
+	}
+	for _, e := range s.Filter.Events {
+		switch e {
+		case EventReading, EventAlertFiring, EventAlertResolved:
+		default:
+			return invalid("event %q must be %s, %s or %s", e, EventReading, EventAlertFiring, EventAlertResolved)
+		}
+	}
+	for _, id := range s.Filter.SensorIDs {
+		if id <= 0 {
+			return invalid("sensor_ids must be positive")
+		}
+	}
+	for _, q := range s.Filter.Quantities {
+		switch q {
+		case sensor.QuantityTemperature, sensor.QuantityHumidity, sensor.QuantityPressure:
+		default:
+			return invalid("quantity %q must be temperature, humidity or pressure", q)
+		}
+	}
+	return nil
+}
+
+// newSecret returns a random signing secret.
+func newSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// newEventID returns a random ID shared by every delivery of one event.
+func newEventID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("evt_%x", time.Now().UnixNano())
+	}
+	return "evt_" + hex.EncodeToString(b)
+}
@@ -0,0 +1,81 @@
+package webpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// recordSize is the aes128gcm record size; the whole message is one
+	// record.
+	recordSize = 4096
+	// headerSize is the salt, record size, key ID length and the 65 byte
+	// key ID that precede the record.
+	headerSize = 16 + 4 + 1 + 65
+	// maxPayload is the most plaintext that fits in the 4096 bytes every
+	// push service accepts, after the header, the padding delimiter and
+	// the 16 byte tag.
+	maxPayload = 4096 - headerSize - 1 - 16
+)
+
+// encrypt seals plaintext for a user agent as RFC 8291 describes: an ECDH
+// secret between the ephemeral key as and the subscription's uaPublic,
+// mixed with its auth secret, keys a single aes128gcm record (RFC 8188).
+func encrypt(plaintext, uaPublic, authSecret []byte, as *ecdsa.PrivateKey, salt []byte) ([]byte, error) {
+	if len(plaintext) > maxPayload {
+		return nil, errors.New("payload too large")
+	}
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, uaPublic)
+	if x == nil {
+		return nil, errors.New("p256dh is not an uncompressed P-256 point")
+	}
+	d := make([]byte, 32)
+	as.D.FillBytes(d)
+	sx, _ := curve.ScalarMult(x, y, d)
+	secret := make([]byte, 32)
+	sx.FillBytes(secret)
+	asPublic := publicBytes(as)
+
+	// HKDF with SHA-256, each expand producing at most one block.
+	prkKey := hmacSHA256(authSecret, secret)
+	keyInfo := concat([]byte("WebPush: info\x00"), uaPublic, asPublic, []byte{1})
+	ikm := hmacSHA256(prkKey, keyInfo)
+	prk := hmacSHA256(salt, ikm)
+	cek := hmacSHA256(prk, []byte("Content-Encoding: aes128gcm\x00\x01"))[:16]
+	nonce := hmacSHA256(prk, []byte("Content-Encoding: nonce\x00\x01"))[:12]
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	rs := make([]byte, 4)
+	binary.BigEndian.PutUint32(rs, recordSize)
+	header := concat(salt, rs, []byte{byte(len(asPublic))}, asPublic)
+	// 0x02 marks the last record; no further padding.
+	return gcm.Seal(header, nonce, concat(plaintext, []byte{2}), nil), nil
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
@@ -0,0 +1,163 @@
+package webpush
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/maskarb/skarbek-dev/internal/apierror"
+	"github.com/maskarb/skarbek-dev/internal/notify"
+	"github.com/maskarb/skarbek-dev/internal/session"
+)
+
+type pushServer struct {
+	service *Service
+}
+
+// NewPushServer serves the push subscriptions of the logged in caller.
+func NewPushServer(s *Service) *pushServer {
+	return &pushServer{service: s}
+}
+
+// Routes is mounted under /api/v1/push. Everything but the public key
+// needs a session.
+func (ps *pushServer) Routes() *chi.Mux {
+	router := chi.NewRouter()
+	router.Get("/key", ps.getKeyHandler)
+	router.Group(func(r chi.Router) {
+		r.Use(session.RequireSession)
+		r.Get("/subscriptions", ps.listHandler)
+		r.Post("/subscriptions", ps.subscribeHandler)
+		r.Delete("/subscriptions/{pushSubscriptionID}", ps.deleteHandler)
+		r.Post("/unsubscribe", ps.unsubscribeHandler)
+		r.Post("/test", ps.testHandler)
+	})
+	return router
+}
+
+// getKeyHandler returns the applicationServerKey for pushManager.subscribe.
+func (ps *pushServer) getKeyHandler(w http.ResponseWriter, req *http.Request) {
+	render.JSON(w, req, map[string]string{"public_key": ps.service.PublicKey()})
+}
+
+func (ps *pushServer) listHandler(w http.ResponseWriter, req *http.Request) {
+	subs, err := ps.service.Subscriptions(session.FromContext(req.Context()).Email)
+	if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	render.JSON(w, req, subs)
+}
+
+// subscribeHandler stores the body of PushSubscription.toJSON() for the
+// caller: 201 for a new browser, 200 when it subscribed before.
+func (ps *pushServer) subscribeHandler(w http.ResponseWriter, req *http.Request) {
+	var p PushSubscription
+	if !apierror.DecodeStrict(w, req, &p) {
+		return
+	}
+	email := session.FromContext(req.Context()).Email
+	sub, created, err := ps.service.Subscribe(email, req.UserAgent(), p)
+	if err != nil {
+		apierror.Write(w, req, pushError(err))
+		return
+	}
+	if created {
+		logger.Ctx(req.Context()).Info("push subscription created", "subscription_id", sub.ID)
+		w.WriteHeader(http.StatusCreated)
+	}
+	render.JSON(w, req, sub)
+}
+
+func (ps *pushServer) deleteHandler(w http.ResponseWriter, req *http.Request) {
+	param := chi.URLParam(req, "pushSubscriptionID")
+	id, err := strconv.ParseUint(param, 10, 32)
+	if err != nil || id == 0 {
+		apierror.Write(w, req, apierror.BadRequest("invalid_subscription_id",
+			"subscription id must be a positive integer").WithDetails(map[string]string{"subscription_id": param}))
+		return
+	}
+	ps.unsubscribe(w, req, uint(id), "")
+}
+
+// unsubscribeHandler deletes the caller's subscription by endpoint, which
+// is what a browser knows after PushSubscription.unsubscribe().
+func (ps *pushServer) unsubscribeHandler(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Endpoint string `json:"endpoint"`
+	}
+	if !apierror.DecodeStrict(w, req, &body) {
+		return
+	}
+	if body.Endpoint == "" {
+		apierror.Write(w, req, apierror.BadRequest("invalid_subscription", "endpoint is required"))
+		return
+	}
+	ps.unsubscribe(w, req, 0, body.Endpoint)
+}
+
+func (ps *pushServer) unsubscribe(w http.ResponseWriter, req *http.Request, id uint, endpoint string) {
+	if err := ps.service.Unsubscribe(session.FromContext(req.Context()).Email, id, endpoint); err != nil {
+		apierror.Write(w, req, pushError(err))
+		return
+	}
+	if id != 0 {
+		logger.Ctx(req.Context()).Info("push subscription deleted", "subscription_id", id)
+	} else {
+		logger.Ctx(req.Context()).Info("push subscription deleted", "endpoint", endpoint)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// testHandler pushes a message to every browser of the caller and reports
+// how each push went. An empty body is allowed.
+func (ps *pushServer) testHandler(w http.ResponseWriter, req *http.Request) {
+	body := struct {
+		Title   string `json:"title"`
+		Message string `json:"message"`
+	}{}
+	dec := json.NewDecoder(req.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		apierror.Write(w, req, apierror.BadRequest(apierror.CodeBadRequest, "invalid JSON body").WithCause(err))
+		return
+	}
+	e := notify.Event{
+		Kind:    "test",
+		Status:  "test",
+		Title:   body.Title,
+		Message: body.Message,
+		At:      time.Now().UTC(),
+	}
+	if e.Title == "" {
+		e.Title = "Test notification from skarbek.dev"
+	}
+	if e.Message == "" {
+		e.Message = "Push notifications work on this device."
+	}
+	results, err := ps.service.Test(req.Context(), session.FromContext(req.Context()).Email, e)
+	if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	for _, r := range results {
+		logger.Ctx(req.Context()).Info("test push", "subscription_id", r.SubscriptionID,
+			"delivered", r.Delivered, "status", r.StatusCode, "err", r.Error)
+	}
+	render.JSON(w, req, results)
+}
+
+func pushError(err error) error {
+	switch {
+	case errors.Is(err, ErrInvalidSubscription):
+		return apierror.BadRequest("invalid_subscription", err.Error())
+	case errors.Is(err, ErrNotFound):
+		return apierror.NotFound("subscription_not_found", err.Error())
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package webpush
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// tokenLifetime is how long a VAPID token is valid; RFC 8292 allows up to
+// 24 hours.
+const tokenLifetime = 12 * time.Hour
+
+var b64 = base64.RawURLEncoding
+
+// vapidKey is the application server key pair, generated once so browser
+// subscriptions stay valid across restarts.
+type vapidKey struct {
+	ID uint `gorm:"primaryKey"`
+	// PrivateKey is the base64url P-256 scalar.
+	PrivateKey string
+	CreatedAt  time.Time
+}
+
+// TableName keeps the tables of this package together.
+func (vapidKey) TableName() string { return "webpush_vapid_keys" }
+
+// loadKey returns the stored key pair, generating it on first use.
+func loadKey(db *gorm.DB) (*ecdsa.PrivateKey, error) {
+	var k vapidKey
+	err := db.First(&k).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("generate vapid key: %v", err)
+		}
+		d := make([]byte, 32)
+		priv.D.FillBytes(d)
+		if err := db.Create(&vapidKey{PrivateKey: b64.EncodeToString(d)}).Error; err != nil {
+			return nil, fmt.Errorf("save vapid key: %v", err)
+		}
+		logger.Info("generated vapid key")
+		return priv, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("load vapid key: %v", err)
+	}
+	d, err := b64.DecodeString(k.PrivateKey)
+	if err != nil || len(d) != 32 {
+		return nil, errors.New("stored vapid key is corrupt")
+	}
+	return privateKey(d), nil
+}
+
+// privateKey builds the P-256 key with scalar d.
+func privateKey(d []byte) *ecdsa.PrivateKey {
+	curve := elliptic.P256()
+	priv := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	priv.Curve = curve
+	priv.X, priv.Y = curve.ScalarBaseMult(d)
+	return priv
+}
+
+// publicBytes is the uncompressed form of the public half of k.
+func publicBytes(k *ecdsa.PrivateKey) []byte {
+	return elliptic.Marshal(elliptic.P256(), k.X, k.Y)
+}
+
+// authorization returns the RFC 8292 Authorization header for a push to
+// endpoint.
+func authorization(k *ecdsa.PrivateKey, endpoint, subject string, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	claims := map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": now.Add(tokenLifetime).Unix(),
+	}
+	if subject != "" {
+		claims["sub"] = subject
+	}
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := b64.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`)) + "." + b64.EncodeToString(body)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return "vapid t=" + unsigned + "." + b64.EncodeToString(sig) + ", k=" + b64.EncodeToString(publicBytes(k)), nil
+}
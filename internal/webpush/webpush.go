@@ -0,0 +1,394 @@
+// Package webpush sends alerts to browsers that installed the dashboard,
+// using the Web Push protocol: messages are encrypted for each
+// subscription (RFC 8291) and authorised with the server's VAPID key
+// (RFC 8292). Subscriptions belong to the user who created them.
+package webpush
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/config"
+	"github.com/maskarb/skarbek-dev/internal/logging"
+	"github.com/maskarb/skarbek-dev/internal/notify"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var logger = logging.For("push")
+
+var (
+	// ErrNotFound is returned for subscriptions that do not exist or
+	// belong to someone else.
+	ErrNotFound = errors.New("push subscription not found")
+	// ErrInvalidSubscription is wrapped by errors caused by bad input.
+	ErrInvalidSubscription = errors.New("invalid push subscription")
+)
+
+const (
+	// queueSize is how many events may wait to be pushed before new ones
+	// are dropped.
+	queueSize   = 32
+	sendTimeout = 15 * time.Second
+	// cleanupInterval is how often subscriptions past their expiration
+	// time are deleted.
+	cleanupInterval = time.Hour
+)
+
+// Subscription is one browser's push endpoint with the keys its messages
+// are encrypted for.
+type Subscription struct {
+	ID       uint   `json:"id" gorm:"primaryKey"`
+	Email    string `json:"-" gorm:"index"`
+	Endpoint string `json:"endpoint" gorm:"uniqueIndex"`
+	// P256DH and Auth are the base64url keys from the browser.
+	P256DH    string `json:"-" gorm:"column:p256dh"`
+	Auth      string `json:"-"`
+	UserAgent string `json:"user_agent"`
+	// ExpiresAt is when the browser said the subscription ends, if it did.
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastSentAt *time.Time `json:"last_sent_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// TableName keeps the tables of this package together.
+func (Subscription) TableName() string { return "webpush_subscriptions" }
+
+// PushSubscription is what PushSubscription.toJSON() gives in the browser.
+type PushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	// ExpirationTime is in milliseconds since the epoch.
+	ExpirationTime *int64 `json:"expirationTime"`
+	Keys           struct {
+		P256DH string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// Result is how one push went.
+type Result struct {
+	SubscriptionID uint `json:"subscription_id"`
+	Delivered      bool `json:"delivered"`
+	StatusCode     int  `json:"status_code,omitempty"`
+	// Removed is set when the push service said the subscription is gone
+	// and it was deleted.
+	Removed bool   `json:"removed,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// payload is the decrypted message the dashboard's service worker gets;
+// the fields follow the Notification constructor's options.
+type payload struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	// Tag makes a newer notification about the same thing replace the
+	// older one on the device.
+	Tag       string       `json:"tag"`
+	Timestamp int64        `json:"timestamp"`
+	Data      notify.Event `json:"data"`
+}
+
+// Service stores subscriptions and pushes events to them. Notify only
+// queues an event; Run sends it, so a slow push service never holds up
+// alert evaluation.
+type Service struct {
+	db     *gorm.DB
+	cfg    config.PushConfig
+	key    *ecdsa.PrivateKey
+	client *http.Client
+	queue  chan notify.Event
+}
+
+// NewService loads the VAPID key from db, generating it on first start.
+func NewService(db *gorm.DB, cfg config.PushConfig) (*Service, error) {
+	if err := db.AutoMigrate(&vapidKey{}, &Subscription{}); err != nil {
+		return nil, fmt.Errorf("migrate push subscriptions: %v", err)
+	}
+	key, err := loadKey(db)
+	if err != nil {
+		return nil, err
+	}
+	return &Service{
+		db:     db,
+		cfg:    cfg,
+		key:    key,
+		client: &http.Client{Timeout: sendTimeout},
+		queue:  make(chan notify.Event, queueSize),
+	}, nil
+}
+
+// PublicKey is the applicationServerKey browsers subscribe with.
+func (s *Service) PublicKey() string {
+	return b64.EncodeToString(publicBytes(s.key))
+}
+
+// Subscribe stores p for email. A browser subscribing again, possibly
+// for another user after a new login, replaces its earlier subscription;
+// created is false then.
+func (s *Service) Subscribe(email, userAgent string, p PushSubscription) (sub Subscription, created bool, err error) {
+	if err := s.validate(p); err != nil {
+		return Subscription{}, false, err
+	}
+	sub = Subscription{
+		Email:     email,
+		Endpoint:  p.Endpoint,
+		P256DH:    p.Keys.P256DH,
+		Auth:      p.Keys.Auth,
+		UserAgent: userAgent,
+	}
+	if p.ExpirationTime != nil {
+		t := time.Unix(0, *p.ExpirationTime*int64(time.Millisecond)).UTC()
+		sub.ExpiresAt = &t
+	}
+	var existing int64
+	if err := s.db.Model(&Subscription{}).Where("endpoint = ?", p.Endpoint).Count(&existing).Error; err != nil {
+		return Subscription{}, false, fmt.Errorf("load push subscription: %v", err)
+	}
+	err = s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "endpoint"}},
+		DoUpdates: clause.AssignmentColumns([]string{"email", "p256dh", "auth", "user_agent", "expires_at", "updated_at"}),
+	}).Create(&sub).Error
+	if err != nil {
+		return Subscription{}, false, fmt.Errorf("save push subscription: %v", err)
+	}
+	if err := s.db.Where("endpoint = ?", p.Endpoint).First(&sub).Error; err != nil {
+		return Subscription{}, false, fmt.Errorf("load push subscription: %v", err)
+	}
+	return sub, existing == 0, nil
+}
+
+func (s *Service) validate(p PushSubscription) error {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s", ErrInvalidSubscription, fmt.Sprintf(format, args...))
+	}
+	u, err := url.Parse(p.Endpoint)
+	if err != nil || u.Host == "" || !(u.Scheme == "https" || u.Scheme == "http" && s.cfg.AllowHTTP) {
+		return invalid("endpoint must be an https URL")
+	}
+	key, err := decodeKey(p.Keys.P256DH)
+	if x, _ := elliptic.Unmarshal(elliptic.P256(), key); err != nil || x == nil {
+		return invalid("keys.p256dh must be a base64url uncompressed P-256 point")
+	}
+	if auth, err := decodeKey(p.Keys.Auth); err != nil || len(auth) != 16 {
+		return invalid("keys.auth must be 16 base64url bytes")
+	}
+	return nil
+}
+
+// decodeKey accepts base64url with or without padding, as browsers differ.
+func decodeKey(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// Subscriptions lists the subscriptions of email.
+func (s *Service) Subscriptions(email string) ([]Subscription, error) {
+	subs := []Subscription{}
+	if err := s.db.Where("email = ?", email).Order("id").Find(&subs).Error; err != nil {
+		return nil, fmt.Errorf("list push subscriptions: %v", err)
+	}
+	return subs, nil
+}
+
+// Unsubscribe deletes the subscription of email with id, or with endpoint
+// when id is 0.
+func (s *Service) Unsubscribe(email string, id uint, endpoint string) error {
+	q := s.db.Where("email = ?", email)
+	if id != 0 {
+		q = q.Where("id = ?", id)
+	} else {
+		q = q.Where("endpoint = ?", endpoint)
+	}
+	res := q.Delete(&Subscription{})
+	if res.Error != nil {
+		return fmt.Errorf("delete push subscription: %v", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Notify queues e for every subscription. It never blocks; when the queue
+// is full the event is dropped.
+func (s *Service) Notify(e notify.Event) {
+	select {
+	case s.queue <- e:
+	default:
+		logger.Warn("push queue full, event dropped", "title", e.Title)
+	}
+}
+
+// Run pushes queued events until ctx is done, and deletes expired
+// subscriptions every hour.
+func (s *Service) Run(ctx context.Context) {
+	t := time.NewTicker(cleanupInterval)
+	defer t.Stop()
+	s.deleteExpired(time.Now())
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-s.queue:
+			var subs []Subscription
+			err := s.db.Where("expires_at IS NULL OR expires_at > ?", time.Now().UTC()).Order("id").Find(&subs).Error
+			if err != nil {
+				logger.Error("load push subscriptions", "err", err)
+				continue
+			}
+			for _, sub := range subs {
+				r := s.Send(ctx, sub, e)
+				if r.Error != "" && !r.Removed {
+					logger.Warn("push failed", "subscription_id", sub.ID, "title", e.Title, "err", r.Error)
+				}
+			}
+		case now := <-t.C:
+			s.deleteExpired(now)
+		}
+	}
+}
+
+// Test pushes e right away to every subscription of email.
+func (s *Service) Test(ctx context.Context, email string, e notify.Event) ([]Result, error) {
+	subs, err := s.Subscriptions(email)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Result, 0, len(subs))
+	for _, sub := range subs {
+		results = append(results, s.Send(ctx, sub, e))
+	}
+	return results, nil
+}
+
+// Send encrypts e for sub and hands it to sub's push service. Endpoints
+// the service reports as gone are deleted.
+func (s *Service) Send(ctx context.Context, sub Subscription, e notify.Event) Result {
+	r := Result{SubscriptionID: sub.ID}
+	fail := func(err error) Result {
+		r.Error = err.Error()
+		return r
+	}
+	body, err := json.Marshal(payload{
+		Title:     e.Title,
+		Body:      e.Message,
+		Tag:       tag(e),
+		Timestamp: e.At.UnixNano() / int64(time.Millisecond),
+		Data:      e,
+	})
+	if err != nil {
+		return fail(err)
+	}
+	uaPublic, err := decodeKey(sub.P256DH)
+	if err != nil {
+		return fail(fmt.Errorf("p256dh: %v", err))
+	}
+	auth, err := decodeKey(sub.Auth)
+	if err != nil {
+		return fail(fmt.Errorf("auth: %v", err))
+	}
+	// Every message gets a fresh key pair and salt.
+	as, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fail(err)
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return fail(err)
+	}
+	sealed, err := encrypt(body, uaPublic, auth, as, salt)
+	if err != nil {
+		return fail(err)
+	}
+	authz, err := authorization(s.key, sub.Endpoint, s.cfg.Subject, time.Now())
+	if err != nil {
+		return fail(fmt.Errorf("vapid: %v", err))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(sealed))
+	if err != nil {
+		return fail(err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(int(s.cfg.TTL.Seconds())))
+	req.Header.Set("Urgency", urgency(e))
+	req.Header.Set("Authorization", authz)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	r.StatusCode = resp.StatusCode
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		r.Delivered = true
+		now := time.Now().UTC()
+		if err := s.db.Model(&sub).Update("last_sent_at", now).Error; err != nil {
+			logger.Error("save push time", "subscription_id", sub.ID, "err", err)
+		}
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		// The browser unsubscribed or the subscription expired.
+		r.Error = "subscription expired: " + resp.Status
+		if err := s.db.Delete(&sub).Error; err != nil {
+			logger.Error("delete expired push subscription", "subscription_id", sub.ID, "err", err)
+		} else {
+			r.Removed = true
+			logger.Info("push subscription expired, removed", "subscription_id", sub.ID, "status", resp.StatusCode)
+		}
+	default:
+		r.Error = strings.TrimSpace(resp.Status + ": " + string(snippet))
+	}
+	return r
+}
+
+// deleteExpired removes subscriptions past the expiration time their
+// browser gave.
+func (s *Service) deleteExpired(now time.Time) {
+	res := s.db.Where("expires_at IS NOT NULL AND expires_at < ?", now.UTC()).Delete(&Subscription{})
+	if res.Error != nil {
+		logger.Error("delete expired push subscriptions", "err", res.Error)
+	} else if res.RowsAffected > 0 {
+		logger.Info("deleted expired push subscriptions", "subscriptions", res.RowsAffected)
+	}
+}
+
+// urgency tells push services how soon to wake the device: right away for
+// problems, normally for the all clear.
+func urgency(e notify.Event) string {
+	switch e.Status {
+	case "firing", "offline":
+		return "high"
+	}
+	return "normal"
+}
+
+// tag groups notifications about the same rule or sensor, so a resolved
+// alert replaces its firing one on the device.
+func tag(e notify.Event) string {
+	switch {
+	case e.Kind == "alert":
+		return "alert:" + e.Rule
+	case e.Kind == "sensor":
+		return "sensor:" + strconv.Itoa(e.SensorID)
+	}
+	return e.Kind
+}
@@ -0,0 +1,519 @@
+package webpush
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maskarb/skarbek-dev/internal/config"
+	"github.com/maskarb/skarbek-dev/internal/database"
+	"github.com/maskarb/skarbek-dev/internal/notify"
+)
+
+// userAgent is the browser side of a subscription: the key pair and auth
+// secret it gives the server, and what it needs to decrypt messages.
+type userAgent struct {
+	key  *ecdsa.PrivateKey
+	auth []byte
+}
+
+func newUserAgent(t *testing.T) userAgent {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	if _, err := rand.Read(auth); err != nil {
+		t.Fatal(err)
+	}
+	return userAgent{key: key, auth: auth}
+}
+
+func (ua userAgent) subscription(endpoint string) PushSubscription {
+	var p PushSubscription
+	p.Endpoint = endpoint
+	p.Keys.P256DH = b64.EncodeToString(publicBytes(ua.key))
+	p.Keys.Auth = b64.EncodeToString(ua.auth)
+	return p
+}
+
+// hkdf is RFC 5869 HKDF-SHA256, for lengths up to one block.
+func hkdf(salt, ikm, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:length]
+}
+
+// decrypt opens an aes128gcm body (RFC 8188) the way a user agent does
+// for Web Push (RFC 8291), taking the sender's key from the header.
+func (ua userAgent) decrypt(body []byte) ([]byte, error) {
+	if len(body) < 21 {
+		return nil, errors.New("short header")
+	}
+	salt, rs, idlen := body[:16], binary.BigEndian.Uint32(body[16:20]), int(body[20])
+	if len(body) < 21+idlen {
+		return nil, errors.New("short key id")
+	}
+	asPublic, record := body[21:21+idlen], body[21+idlen:]
+	if uint32(len(record)) > rs {
+		return nil, fmt.Errorf("record of %d bytes exceeds record size %d", len(record), rs)
+	}
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, asPublic)
+	if x == nil {
+		return nil, errors.New("key id is not a P-256 point")
+	}
+	sx, _ := curve.ScalarMult(x, y, ua.key.D.Bytes())
+	secret := make([]byte, 32)
+	sx.FillBytes(secret)
+
+	uaPublic := publicBytes(ua.key)
+	info := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm := hkdf(ua.auth, secret, info, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, nonce, record, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Strip the padding: zeros after the 0x02 delimiter of the last
+	// record.
+	plain = bytes.TrimRight(plain, "\x00")
+	if len(plain) == 0 || plain[len(plain)-1] != 2 {
+		return nil, errors.New("missing last record delimiter")
+	}
+	return plain[:len(plain)-1], nil
+}
+
+func mustDecode(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := b64.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestEncryptRFC8291 checks encrypt against the example of RFC 8291
+// appendix A.
+func TestEncryptRFC8291(t *testing.T) {
+	plaintext := []byte("When I grow up, I want to be a watermelon")
+	as := privateKey(mustDecode(t, "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"))
+	ua := userAgent{
+		key:  privateKey(mustDecode(t, "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94")),
+		auth: mustDecode(t, "BTBZMqHH6r4Tts7J_aSIgg"),
+	}
+	uaPublic := mustDecode(t, "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4")
+	if !bytes.Equal(publicBytes(ua.key), uaPublic) {
+		t.Fatal("user agent public key does not match the example")
+	}
+	salt := mustDecode(t, "DGv6ra1nlYgDCS1FRnbzlw")
+	want := "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+
+	got, err := encrypt(plaintext, uaPublic, ua.auth, as, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b64.EncodeToString(got) != want {
+		t.Errorf("encrypt = %s\nwant      %s", b64.EncodeToString(got), want)
+	}
+	plain, err := ua.decrypt(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, plaintext) {
+		t.Errorf("decrypt = %q, want %q", plain, plaintext)
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	ua := newUserAgent(t)
+	for _, n := range []int{0, 1, 100, maxPayload} {
+		plaintext := make([]byte, n)
+		rand.Read(plaintext)
+		as, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		salt := make([]byte, 16)
+		rand.Read(salt)
+		sealed, err := encrypt(plaintext, publicBytes(ua.key), ua.auth, as, salt)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if len(sealed) > recordSize {
+			t.Errorf("%d bytes: message of %d bytes exceeds %d", n, len(sealed), recordSize)
+		}
+		plain, err := ua.decrypt(sealed)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if !bytes.Equal(plain, plaintext) {
+			t.Errorf("%d bytes: round trip changed the payload", n)
+		}
+		// Another user agent's keys cannot open it.
+		if _, err := newUserAgent(t).decrypt(sealed); err == nil {
+			t.Errorf("%d bytes: decrypted with the wrong keys", n)
+		}
+	}
+	if _, err := encrypt(make([]byte, maxPayload+1), publicBytes(ua.key), ua.auth, ua.key, make([]byte, 16)); err == nil {
+		t.Error("encrypt accepted a payload over maxPayload")
+	}
+}
+
+// vapidToken is a verified RFC 8292 Authorization header.
+type vapidToken struct {
+	Aud string `json:"aud"`
+	Exp int64  `json:"exp"`
+	Sub string `json:"sub"`
+	// Key is the k parameter, the application server key.
+	Key string `json:"-"`
+}
+
+// verifyVAPID checks the header the way a push service does: the JWT must
+// be signed with ES256 by the key in k.
+func verifyVAPID(header string) (vapidToken, error) {
+	var tok vapidToken
+	if !strings.HasPrefix(header, "vapid ") {
+		return tok, fmt.Errorf("scheme of %q is not vapid", header)
+	}
+	params := map[string]string{}
+	for _, p := range strings.Split(strings.TrimPrefix(header, "vapid "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) != 2 {
+			return tok, fmt.Errorf("bad parameter %q", p)
+		}
+		params[kv[0]] = kv[1]
+	}
+	tok.Key = params["k"]
+	key, err := b64.DecodeString(tok.Key)
+	if err != nil {
+		return tok, fmt.Errorf("k: %v", err)
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), key)
+	if x == nil {
+		return tok, errors.New("k is not a P-256 point")
+	}
+	parts := strings.Split(params["t"], ".")
+	if len(parts) != 3 {
+		return tok, fmt.Errorf("t has %d parts, want 3", len(parts))
+	}
+	var head struct {
+		Typ string `json:"typ"`
+		Alg string `json:"alg"`
+	}
+	if h, err := b64.DecodeString(parts[0]); err != nil || json.Unmarshal(h, &head) != nil || head.Alg != "ES256" {
+		return tok, fmt.Errorf("header %q is not ES256", parts[0])
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		return tok, errors.New("signature is not 64 bytes of base64url")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	if !ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return tok, errors.New("bad signature")
+	}
+	claims, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return tok, fmt.Errorf("claims: %v", err)
+	}
+	if err := json.Unmarshal(claims, &tok); err != nil {
+		return tok, fmt.Errorf("claims: %v", err)
+	}
+	return tok, nil
+}
+
+func TestAuthorization(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	now := time.Now()
+	header, err := authorization(key, "https://push.example.net:8443/wpush/v2/abc?x=1", "mailto:ops@example.com", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := verifyVAPID(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.Aud != "https://push.example.net:8443" {
+		t.Errorf("aud = %q, want the endpoint's origin", tok.Aud)
+	}
+	if tok.Exp != now.Add(tokenLifetime).Unix() || tokenLifetime > 24*time.Hour {
+		t.Errorf("exp = %d, want %d, at most 24 hours ahead", tok.Exp, now.Add(tokenLifetime).Unix())
+	}
+	if tok.Sub != "mailto:ops@example.com" {
+		t.Errorf("sub = %q", tok.Sub)
+	}
+	if tok.Key != b64.EncodeToString(publicBytes(key)) {
+		t.Errorf("k = %q, want the public key", tok.Key)
+	}
+
+	// A token signed by another key does not verify.
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	forged := strings.Replace(header, tok.Key, b64.EncodeToString(publicBytes(other)), 1)
+	if _, err := verifyVAPID(forged); err == nil {
+		t.Error("token verified against another key")
+	}
+}
+
+// pushService is a local stand-in for a push service: it checks the VAPID
+// token and hands the message to the user agent of the endpoint.
+type pushService struct {
+	*httptest.Server
+	svc *Service
+	ua  map[string]userAgent
+	// status is what the next requests are answered with, defaulting to
+	// 201 Created.
+	status []int
+	got    chan pushed
+}
+
+// pushed is a message as a user agent received it.
+type pushed struct {
+	header  http.Header
+	payload payload
+	err     error
+}
+
+func newPushService(t *testing.T, svc *Service) *pushService {
+	ps := &pushService{svc: svc, ua: map[string]userAgent{}, got: make(chan pushed, 16)}
+	ps.Server = httptest.NewServer(http.HandlerFunc(ps.serve))
+	t.Cleanup(ps.Close)
+	return ps
+}
+
+func (ps *pushService) serve(w http.ResponseWriter, req *http.Request) {
+	status := http.StatusCreated
+	if len(ps.status) > 0 {
+		status, ps.status = ps.status[0], ps.status[1:]
+	}
+	p := pushed{header: req.Header}
+	defer func() { ps.got <- p }()
+
+	tok, err := verifyVAPID(req.Header.Get("Authorization"))
+	switch {
+	case err != nil:
+		p.err = err
+	case tok.Key != ps.svc.PublicKey():
+		p.err = errors.New("token is not from the subscribed application server key")
+	case tok.Aud != ps.URL:
+		p.err = fmt.Errorf("aud = %q, want %q", tok.Aud, ps.URL)
+	case time.Unix(tok.Exp, 0).Before(time.Now()) || time.Until(time.Unix(tok.Exp, 0)) > 24*time.Hour:
+		p.err = fmt.Errorf("exp %d is not within 24 hours", tok.Exp)
+	}
+	if p.err != nil {
+		http.Error(w, p.err.Error(), http.StatusUnauthorized)
+		return
+	}
+	ua, ok := ps.ua[req.URL.Path]
+	if !ok {
+		p.err = fmt.Errorf("no subscription at %s", req.URL.Path)
+		http.NotFound(w, req)
+		return
+	}
+	body, _ := io.ReadAll(req.Body)
+	plain, err := ua.decrypt(body)
+	if err == nil {
+		err = json.Unmarshal(plain, &p.payload)
+	}
+	if err != nil {
+		p.err = err
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// subscribe registers a new user agent at path for email.
+func (ps *pushService) subscribe(t *testing.T, email, path string) Subscription {
+	t.Helper()
+	ua := newUserAgent(t)
+	ps.ua[path] = ua
+	sub, _, err := ps.svc.Subscribe(email, "test", ua.subscription(ps.URL+path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+func (ps *pushService) next(t *testing.T) pushed {
+	t.Helper()
+	select {
+	case p := <-ps.got:
+		if p.err != nil {
+			t.Fatalf("push service rejected the message: %v", p.err)
+		}
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("no push")
+		return pushed{}
+	}
+}
+
+func newService(t *testing.T) *Service {
+	t.Helper()
+	db, err := database.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close(db) })
+	cfg := config.Default().Push
+	cfg.Subject = "mailto:ops@example.com"
+	cfg.AllowHTTP = true
+	svc, err := NewService(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc
+}
+
+func TestSend(t *testing.T) {
+	svc := newService(t)
+	ps := newPushService(t, svc)
+	sub := ps.subscribe(t, "a@example.com", "/push/a")
+
+	v := 31.5
+	at := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	e := notify.Event{Kind: "alert", Status: "firing", Title: "Too warm", Message: "31.5 °C",
+		SensorID: 1, Rule: "warm", Quantity: "temperature", Value: &v, At: at}
+	r := svc.Send(context.Background(), sub, e)
+	p := ps.next(t)
+	if !r.Delivered || r.StatusCode != http.StatusCreated || r.Error != "" {
+		t.Errorf("result = %+v, want delivered", r)
+	}
+
+	if p.payload.Title != e.Title || p.payload.Body != e.Message || p.payload.Tag != "alert:warm" ||
+		p.payload.Timestamp != at.UnixNano()/int64(time.Millisecond) || p.payload.Data.Rule != "warm" {
+		t.Errorf("payload = %+v", p.payload)
+	}
+	for name, want := range map[string]string{
+		"Content-Encoding": "aes128gcm",
+		"TTL":              "21600",
+		"Urgency":          "high",
+	} {
+		if got := p.header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	subs, err := svc.Subscriptions("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 1 || subs[0].LastSentAt == nil {
+		t.Errorf("subscriptions = %+v, want last_sent_at set", subs)
+	}
+}
+
+func TestSendRemovesGoneSubscriptions(t *testing.T) {
+	svc := newService(t)
+	ps := newPushService(t, svc)
+	gone := ps.subscribe(t, "a@example.com", "/push/gone")
+	failing := ps.subscribe(t, "a@example.com", "/push/failing")
+	e := notify.Event{Kind: "sensor", Status: "resolved", Title: "Back", SensorID: 2, At: time.Now()}
+
+	ps.status = []int{http.StatusGone}
+	r := svc.Send(context.Background(), gone, e)
+	ps.next(t)
+	if r.Delivered || !r.Removed || r.StatusCode != http.StatusGone {
+		t.Errorf("gone: result = %+v, want removed", r)
+	}
+
+	ps.status = []int{http.StatusTooManyRequests}
+	r = svc.Send(context.Background(), failing, e)
+	if p := ps.next(t); p.header.Get("Urgency") != "normal" {
+		t.Errorf("Urgency = %q, want normal", p.header.Get("Urgency"))
+	}
+	if r.Delivered || r.Removed || r.Error == "" {
+		t.Errorf("failing: result = %+v, want an error and kept", r)
+	}
+
+	subs, err := svc.Subscriptions("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 1 || subs[0].ID != failing.ID {
+		t.Errorf("subscriptions = %+v, want only the failing one", subs)
+	}
+}
+
+func TestRunPushesToEverySubscription(t *testing.T) {
+	svc := newService(t)
+	ps := newPushService(t, svc)
+	ps.subscribe(t, "a@example.com", "/push/a")
+	ps.subscribe(t, "b@example.com", "/push/b")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		svc.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	svc.Notify(notify.Event{Kind: "test", Title: "Hello", At: time.Now()})
+	for i := 0; i < 2; i++ {
+		if p := ps.next(t); p.payload.Title != "Hello" {
+			t.Errorf("title = %q, want Hello", p.payload.Title)
+		}
+	}
+}
+
+func TestSubscribeValidates(t *testing.T) {
+	svc := newService(t)
+	ua := newUserAgent(t)
+	for name, mutate := range map[string]func(*PushSubscription){
+		"relative endpoint": func(p *PushSubscription) { p.Endpoint = "/push" },
+		"ftp endpoint":      func(p *PushSubscription) { p.Endpoint = "ftp://push.example.net/x" },
+		"bad p256dh":        func(p *PushSubscription) { p.Keys.P256DH = b64.EncodeToString(make([]byte, 65)) },
+		"short auth":        func(p *PushSubscription) { p.Keys.Auth = b64.EncodeToString(make([]byte, 8)) },
+	} {
+		p := ua.subscription("https://push.example.net/x")
+		mutate(&p)
+		if _, _, err := svc.Subscribe("a@example.com", "test", p); !errors.Is(err, ErrInvalidSubscription) {
+			t.Errorf("%s: err = %v, want ErrInvalidSubscription", name, err)
+		}
+	}
+
+	// Padded keys, as some browsers send them, are accepted.
+	p := ua.subscription("https://push.example.net/x")
+	p.Keys.Auth += "=="
+	if _, created, err := svc.Subscribe("a@example.com", "test", p); err != nil || !created {
+		t.Fatalf("padded keys: created = %v, err = %v", created, err)
+	}
+	// The same browser subscribing again replaces it.
+	if _, created, err := svc.Subscribe("b@example.com", "test", p); err != nil || created {
+		t.Errorf("resubscribe: created = %v, err = %v", created, err)
+	}
+}
@@ -3,13 +3,16 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -18,7 +21,22 @@ import (
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 
+	"github.com/maskarb/skarbek-dev/internal/alert"
+	"github.com/maskarb/skarbek-dev/internal/apierror"
+	"github.com/maskarb/skarbek-dev/internal/config"
+	"github.com/maskarb/skarbek-dev/internal/database"
+	"github.com/maskarb/skarbek-dev/internal/logging"
+	"github.com/maskarb/skarbek-dev/internal/mqtt"
+	"github.com/maskarb/skarbek-dev/internal/notify"
+	"github.com/maskarb/skarbek-dev/internal/openapi"
+	"github.com/maskarb/skarbek-dev/internal/pki"
+	"github.com/maskarb/skarbek-dev/internal/preferences"
 	"github.com/maskarb/skarbek-dev/internal/sensor"
+	"github.com/maskarb/skarbek-dev/internal/session"
+	"github.com/maskarb/skarbek-dev/internal/shutdown"
+	"github.com/maskarb/skarbek-dev/internal/systemd"
+	"github.com/maskarb/skarbek-dev/internal/webhook"
+	"github.com/maskarb/skarbek-dev/internal/webpush"
 )
 
 const (
@@ -28,21 +46,30 @@ const (
 	letterIdxMax  = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
 )
 
-// Credentials which stores google ids.
-type Credentials struct {
-	Cid     string `json:"client_id"`
-	Csecret string `json:"client_secret"`
+// sessionManager is the part of the session server that the login flow and
+// router need.
+type sessionManager interface {
+	Middleware(http.Handler) http.Handler
+	Routes() *chi.Mux
+	Login(w http.ResponseWriter, r *http.Request, email, name string) error
+	LogoutHandler(w http.ResponseWriter, r *http.Request)
+	PageHandler(w http.ResponseWriter, r *http.Request)
 }
 
-type Web struct {
-	Creds Credentials `json:"web"`
+// UserInfo is the subset of the Google userinfo response we keep.
+type UserInfo struct {
+	Email string `json:"email"`
+	Name  string `json:"name"`
 }
 
 var (
-	web_creds Web
-	conf      *oauth2.Config
-	state     string
-	src       = rand.NewSource(time.Now().UnixNano())
+	conf     *oauth2.Config
+	state    string
+	sessions sessionManager
+	src      = rand.NewSource(time.Now().UnixNano())
+
+	logger     = logging.For("server")
+	authLogger = logging.For("auth")
 )
 
 func RandStringBytesMaskImprSrcSB(n int) string {
@@ -68,92 +95,158 @@ func getLoginURL(state string) string {
 	return conf.AuthCodeURL(state)
 }
 
-func abortWithError(w http.ResponseWriter, r *http.Request, status int, err error) {
-	w.WriteHeader(status)
-	if status >= 400 {
-		fmt.Fprintf(w, "error: %v\n", err)
-	}
-}
-
 func authHandler(w http.ResponseWriter, r *http.Request) {
 	// Handle the exchange code to initiate a transport.
 	if state != r.FormValue("state") {
-		abortWithError(w, r, http.StatusUnauthorized, fmt.Errorf("invalid session state: %s", state))
+		apierror.Write(w, r, apierror.New(http.StatusUnauthorized, "invalid_oauth_state", "login state does not match, start again at /login"))
 		return
 	}
 
 	tok, err := conf.Exchange(context.Background(), r.FormValue("code"))
 	if err != nil {
-		abortWithError(w, r, http.StatusBadRequest, err)
+		apierror.Write(w, r, apierror.BadRequest("oauth_exchange_failed", "could not exchange the authorization code").WithCause(err))
 		return
 	}
 
 	client := conf.Client(context.Background(), tok)
 	email, err := client.Get("https://www.googleapis.com/oauth2/v3/userinfo")
 	if err != nil {
-		abortWithError(w, r, http.StatusBadRequest, err)
+		apierror.Write(w, r, apierror.New(http.StatusBadGateway, apierror.CodeBadGateway, "could not fetch user info").WithCause(err))
 		return
 	}
 	defer email.Body.Close()
 	data, _ := ioutil.ReadAll(email.Body)
-	log.Println("Email body: ", string(data))
-	if _, err := w.Write([]byte("Hello authenticated user: " + string(data))); err != nil {
-		abortWithError(w, r, http.StatusBadRequest, err)
+	authLogger.Ctx(r.Context()).Debug("userinfo response", "body", string(data))
+
+	var user UserInfo
+	if err := json.Unmarshal(data, &user); err != nil || user.Email == "" {
+		apierror.Write(w, r, apierror.New(http.StatusBadGateway, apierror.CodeBadGateway, "invalid user info response").WithCause(err))
 		return
 	}
+	if err := sessions.Login(w, r, user.Email, user.Name); err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+	if _, err := w.Write([]byte("Hello authenticated user: " + string(data))); err != nil {
+		authLogger.Ctx(r.Context()).Debug("write response", "err", err)
+	}
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	state = RandStringBytesMaskImprSrcSB(10)
 	if _, err := w.Write([]byte("<html><title>Golang Google</title> <body> <a href='" + getLoginURL(state) + "'><button>Login with Google!</button> </a> </body></html>")); err != nil {
-		abortWithError(w, r, http.StatusBadRequest, err)
+		authLogger.Ctx(r.Context()).Debug("write response", "err", err)
 	}
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
 	if _, err := w.Write([]byte("Hello World")); err != nil {
-		abortWithError(w, r, http.StatusBadRequest, err)
+		logger.Ctx(r.Context()).Debug("write response", "err", err)
 	}
 }
 
-func Routes() *chi.Mux {
+// services are the stores and documents the router serves. Stores of
+// disabled features are nil.
+type services struct {
+	spec        *openapi.Spec
+	sensors     *sensor.SensorStore
+	alerts      *alert.Engine
+	notifier    *notify.Dispatcher
+	webhooks    *webhook.Dispatcher
+	push        *webpush.Service
+	preferences *preferences.PreferenceStore
+	ca          *pki.CA
+}
+
+func Routes(cfg *config.Config, svc services) *chi.Mux {
+	spec := svc.spec
 	router := chi.NewRouter()
+	// Set before Use: chi wraps these in the middlewares registered so far,
+	// which would otherwise run twice.
+	router.NotFound(apierror.NotFoundHandler)
+	router.MethodNotAllowed(apierror.MethodNotAllowedHandler)
 	router.Use(
 		render.SetContentType(render.ContentTypeJSON), // Set content-Type headers as application/json
-		middleware.Logger,
 		middleware.RedirectSlashes,
 		middleware.RequestID,
-		middleware.Recoverer,
+		logging.Middleware,
+		apierror.Recoverer,
 		middleware.Timeout(60*time.Second),
-		// SetDBMiddleware,
 	)
+	if cfg.Features.ValidateAPI {
+		router.Use(spec.Middleware)
+	}
+	if cfg.Features.Auth {
+		router.Use(sessions.Middleware)
+	}
 
+	router.Get("/api/openapi.json", spec.ServeJSON)
+	router.Get("/api/docs", spec.ServeExplorer)
+	sensors := sensor.NewSensorServer(svc.sensors)
+	sensors.Templates = cfg.Server.TemplatesDir
+	if cfg.Features.Auth {
+		sensors.Preferred = svc.preferences.Units
+		sensors.Protect = session.RequireSession
+		sensors.Admin = session.RequireAdmin(cfg.Session.Admins)
+	}
 	router.Route("/api/v1", func(r chi.Router) {
-		r.Mount("/sensor", sensor.NewSensorServer().Routes())
+		r.Mount("/sensor", sensors.Routes())
+		alerts := alert.NewAlertServer(svc.alerts)
+		if cfg.Features.Auth {
+			alerts.Protect = session.RequireSession
+		}
+		r.Mount("/alerts", alerts.Routes())
+		if cfg.Features.Auth {
+			// Test messages and webhooks make the server send requests to
+			// any URL, so they are only served to admins.
+			notifications := notify.NewNotifyServer(svc.notifier)
+			notifications.Protect = session.RequireAdmin(cfg.Session.Admins)
+			r.Mount("/notify", notifications.Routes())
+			webhooks := webhook.NewWebhookServer(svc.webhooks)
+			webhooks.Protect = session.RequireAdmin(cfg.Session.Admins)
+			r.Mount("/webhooks", webhooks.Routes())
+		}
+		if svc.ca != nil {
+			certificates := pki.NewPKIServer(svc.ca)
+			certificates.Redeem = svc.sensors.RedeemToken
+			if cfg.Features.Auth {
+				certificates.Admin = session.RequireAdmin(cfg.Session.Admins)
+			}
+			r.Mount("/pki", certificates.Routes())
+		}
+		if cfg.Features.Auth {
+			r.Mount("/sessions", sessions.Routes())
+			r.Mount("/preferences", preferences.NewPreferenceServer(svc.preferences).Routes())
+			r.Mount("/push", webpush.NewPushServer(svc.push).Routes())
+		}
 	})
-	router.HandleFunc("/", indexHandler)
-	router.HandleFunc("/login", loginHandler)
-	router.HandleFunc("/auth", authHandler)
-	router.HandleFunc("/hello/{name}", func(w http.ResponseWriter, r *http.Request) {
+	router.Get("/", indexHandler)
+	if cfg.Features.Auth {
+		router.Group(func(r chi.Router) {
+			r.Use(session.RequireAdmin(cfg.Session.Admins))
+			r.Get("/enroll", sensors.EnrollPageHandler)
+			r.Post("/enroll", sensors.EnrollPageHandler)
+		})
+		router.Get("/login", loginHandler)
+		router.Get("/auth", authHandler)
+		router.Post("/logout", sessions.LogoutHandler)
+		router.Get("/sessions", sessions.PageHandler)
+	}
+	if cfg.Features.Profiler {
+		router.Mount("/debug", middleware.Profiler())
+	}
+	router.Get("/hello/{name}", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "hello, %s!\n", chi.URLParam(r, "name"))
 	})
 
 	return router
 }
 
-func init() {
-	file, err := os.ReadFile("/etc/oauth/creds.json")
-	if err != nil {
-		log.Fatalf("File error: %v\n", err)
-	}
-	if err := json.Unmarshal(file, &web_creds); err != nil {
-		log.Fatalf("json unmarshal err: %v", err)
-	}
-
-	conf = &oauth2.Config{
-		ClientID:     web_creds.Creds.Cid,
-		ClientSecret: web_creds.Creds.Csecret,
-		RedirectURL:  "https://skarbek.dev/auth",
+func newOAuthConfig(cfg config.OAuthConfig) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		RedirectURL:  cfg.RedirectURL,
 		Scopes: []string{
 			"https://www.googleapis.com/auth/userinfo.email", // You have to select your own scope from here -> https://developers.google.com/identity/protocols/googlescopes#google_sign-in
 			"https://www.googleapis.com/auth/userinfo.profile",
@@ -163,15 +256,241 @@ func init() {
 	}
 }
 
+// NodeRoutes is the router of the mutual TLS listener nodes push readings
+// to. Every request is from a node its client certificate names; there are
+// no sessions.
+func NodeRoutes(cfg *config.Config, svc services) *chi.Mux {
+	router := chi.NewRouter()
+	router.NotFound(apierror.NotFoundHandler)
+	router.MethodNotAllowed(apierror.MethodNotAllowedHandler)
+	router.Use(
+		render.SetContentType(render.ContentTypeJSON),
+		middleware.RequestID,
+		logging.Middleware,
+		apierror.Recoverer,
+		middleware.Timeout(60*time.Second),
+	)
+	if cfg.Features.ValidateAPI {
+		router.Use(svc.spec.Middleware)
+	}
+	router.Use(svc.ca.Middleware)
+	router.Route("/api/v1/node", func(r chi.Router) {
+		sensor.NewSensorServer(svc.sensors).NodeRoutes(r)
+		pki.NewPKIServer(svc.ca).NodeRoutes(r)
+	})
+	return router
+}
+
 func main() {
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		logging.For("config").Fatal("config error", "err", err)
+	}
+	logOptions, _ := cfg.Log.Options() // checked by Validate
+	logging.Setup(os.Stderr, logOptions)
+	for _, w := range cfg.Warnings {
+		logging.For("config").Warn(w)
+	}
 
-	router := Routes()
+	bg := shutdown.NewGroup()
+	db, err := database.Open(cfg.Database.Path)
+	if err != nil {
+		logger.Fatal("database error", "err", err)
+	}
+	sensorStore, err := sensor.NewSensorStore(cfg.Sensor, db)
+	if err != nil {
+		logger.Fatal("sensor store error", "err", err)
+	}
+	alerts, err := alert.NewEngine(db)
+	if err != nil {
+		logger.Fatal("alert engine error", "err", err)
+	}
+	sensorStore.Observe(alerts.Observe)
+	notifier, err := notify.NewDispatcher(cfg.Notify)
+	if err != nil {
+		logger.Fatal("notify error", "err", err)
+	}
+	webhooks, err := webhook.NewDispatcher(db, cfg.Webhooks)
+	if err != nil {
+		logger.Fatal("webhook error", "err", err)
+	}
+	sensorStore.Observe(webhooks.Observe)
+	var mqttClient *mqtt.Client
+	var publisher *mqtt.Publisher
+	if cfg.MQTT.Broker != "" {
+		mqttClient, err = mqtt.NewClient(cfg.MQTT)
+		if err != nil {
+			logger.Fatal("mqtt error", "err", err)
+		}
+		publisher = mqtt.NewPublisher(mqttClient, sensorStore)
+		sensorStore.Observe(publisher.Observe)
+		sensorStore.OnStatus(publisher.Status)
+		if _, err := mqtt.NewSubscriber(mqttClient, sensorStore); err != nil {
+			logger.Fatal("mqtt error", "err", err)
+		}
+	}
+	// Push subscriptions belong to logged in users, so they need auth.
+	var push *webpush.Service
+	if cfg.Features.Auth {
+		push, err = webpush.NewService(db, cfg.Push)
+		if err != nil {
+			logger.Fatal("push error", "err", err)
+		}
+	}
+	notifyAll := func(e notify.Event) {
+		notifier.Notify(e)
+		if push != nil {
+			push.Notify(e)
+		}
+	}
+	alerts.OnTransition(func(t alert.Transition) {
+		if t.To == alert.Firing || t.To == alert.Resolved {
+			notifyAll(t.Event())
+		}
+	})
+	alerts.OnTransition(webhooks.Transition)
+	sensorStore.OnStatus(func(c sensor.StatusChange) {
+		notifyAll(c.Event())
+	})
+	bg.Go("notifications", notifier.Run)
+	bg.Go("webhooks", webhooks.Run)
+	if push != nil {
+		bg.Go("push notifications", push.Run)
+	}
+	if mqttClient != nil {
+		bg.Go("mqtt connection", mqttClient.Run)
+		bg.Go("mqtt publisher", publisher.Run)
+	}
+	bg.Go("remote node watch", sensorStore.WatchNodes)
+	bg.Go("sensor sampling", func(ctx context.Context) {
+		sensorStore.Sample(ctx, cfg.Alerts.SampleInterval.Duration)
+	})
+	bg.Go("alert evaluation", func(ctx context.Context) {
+		alerts.Run(ctx, cfg.Alerts.Interval.Duration)
+	})
+	svc := services{sensors: sensorStore, alerts: alerts, notifier: notifier, webhooks: webhooks, push: push}
+	if cfg.NodeTLS.Enabled {
+		svc.ca, err = pki.New(db, cfg.NodeTLS)
+		if err != nil {
+			logger.Fatal("node ca error", "err", err)
+		}
+		sensorStore.OnRevoke(func(id int) {
+			if _, err := svc.ca.RevokeSensor(id, "node revoked"); err != nil {
+				logger.Error("revoke node certificates", "sensor_id", id, "err", err)
+			}
+		})
+	}
+	bg.Go("pressure history", func(ctx context.Context) {
+		sensorStore.RecordPressure(ctx, cfg.Sensor.Forecast.Interval.Duration)
+	})
+
+	var sessionStore *session.SessionStore
+	if cfg.Features.Auth {
+		conf = newOAuthConfig(cfg.OAuth)
+
+		sessionStore, err = session.NewSessionStore(db)
+		if err != nil {
+			logger.Fatal("session store error", "err", err)
+		}
+		sessionStore.IdleTimeout = cfg.Session.IdleTimeout.Duration
+		sessionStore.AbsoluteTimeout = cfg.Session.AbsoluteTimeout.Duration
+		bg.Go("session cleanup", func(ctx context.Context) {
+			sessionStore.Run(ctx, cfg.Session.CleanupInterval.Duration)
+		})
+		sessions = session.NewSessionServer(sessionStore, cfg.Server.TemplatesDir)
+
+		svc.preferences, err = preferences.NewPreferenceStore(db)
+		if err != nil {
+			logger.Fatal("preference store error", "err", err)
+		}
+	}
+
+	svc.spec, err = openapi.Load()
+	if err != nil {
+		logger.Fatal("openapi error", "err", err)
+	}
+	router := Routes(cfg, svc)
+	servers, err := newServers(cfg, router, bg)
+	if err != nil {
+		logger.Fatal("server error", "err", err)
+	}
+	if svc.ca != nil {
+		servers = append(servers, newNodeServer(cfg, NodeRoutes(cfg, svc), svc.ca))
+	}
+
+	if err := listen(servers); err != nil {
+		logger.Fatal("listen error", "err", err)
+	}
 
-	server := &http.Server{
-		Addr:    ":8080",
-		Handler: router,
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, len(servers))
+	for _, s := range servers {
+		logger.Info("starting server", "server", s.name, "addr", s.listener.Addr())
+		go func(s *server) {
+			if err := s.serve(); err != nil {
+				errc <- fmt.Errorf("%s server: %v", s.name, err)
+			}
+		}(s)
 	}
 
-	log.Printf("starting server: %s", server.Addr)
-	log.Fatal(server.ListenAndServe())
+	if err := systemd.Ready(); err != nil {
+		logger.Error("systemd notify failed", "err", err)
+	}
+	bg.Go("systemd watchdog", func(ctx context.Context) {
+		systemd.Watchdog(ctx, func(ctx context.Context) error {
+			if err := database.Ping(ctx, db); err != nil {
+				return err
+			}
+			return sensorStore.Check(ctx)
+		})
+	})
+
+	exitCode := 0
+	select {
+	case <-ctx.Done():
+		logger.Info("shutdown signal received, draining requests")
+	case err := <-errc:
+		logger.Error("shutting down", "err", err)
+		exitCode = 1
+	}
+	stop()
+	if err := systemd.Stopping(); err != nil {
+		logger.Error("systemd notify failed", "err", err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout.Duration)
+	defer cancel()
+
+	var seq shutdown.Sequence
+	seq.Add("drain http", func(ctx context.Context) error {
+		var firstErr error
+		for _, s := range servers {
+			if err := s.Shutdown(ctx); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("%s server: %v", s.name, err)
+			}
+		}
+		return firstErr
+	})
+	seq.Add("stop background jobs", bg.Stop)
+	if sessionStore != nil {
+		seq.Add("flush session activity", func(context.Context) error {
+			n, err := sessionStore.Flush()
+			logger.Info("flushed session activity", "updates", n)
+			return err
+		})
+	}
+	seq.Add("close sensors", func(context.Context) error {
+		return sensorStore.Close()
+	})
+	seq.Add("close database", func(context.Context) error {
+		return database.Close(db)
+	})
+	if err := seq.Run(shutdownCtx); err != nil {
+		exitCode = 1
+	}
+	os.Exit(exitCode)
 }
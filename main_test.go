@@ -0,0 +1,572 @@
+package main
+
+import (
+	"context"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"github.com/maskarb/skarbek-dev/internal/alert"
+	"github.com/maskarb/skarbek-dev/internal/config"
+	"github.com/maskarb/skarbek-dev/internal/database"
+	"github.com/maskarb/skarbek-dev/internal/notify"
+	"github.com/maskarb/skarbek-dev/internal/openapi"
+	"github.com/maskarb/skarbek-dev/internal/pki"
+	"github.com/maskarb/skarbek-dev/internal/preferences"
+	"github.com/maskarb/skarbek-dev/internal/sensor"
+	"github.com/maskarb/skarbek-dev/internal/session"
+	"github.com/maskarb/skarbek-dev/internal/webhook"
+	"github.com/maskarb/skarbek-dev/internal/webpush"
+)
+
+// The contract tests check the routers of main against the OpenAPI
+// document: every route must be in the document and every operation in
+// the document routed, and a scenario drives every route through
+// httptest, failing on any request or response the document does not
+// allow.
+
+const (
+	adminEmail = "admin@example.com"
+	userEmail  = "user@example.com"
+	// remoteAddr is the client address of every request.
+	remoteAddr = "192.0.2.1"
+)
+
+// route is a method and chi pattern, with the pattern compiled to match
+// request paths.
+type route struct {
+	method  string
+	pattern string
+	re      *regexp.Regexp
+}
+
+var routeParam = regexp.MustCompile(`\{[^}]*\}`)
+
+// template is the pattern with its parameters unnamed, to compare with
+// the document's paths.
+func (r route) template() string {
+	return routeParam.ReplaceAllString(r.pattern, "{}")
+}
+
+// walk lists the routes of routers, literal patterns before those with
+// parameters like the routers match them.
+func walk(t *testing.T, routers ...chi.Routes) []route {
+	t.Helper()
+	var routes []route
+	for _, router := range routers {
+		err := chi.Walk(router, func(method, pattern string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+			if pattern != "/" {
+				pattern = strings.TrimSuffix(pattern, "/")
+			}
+			var expr strings.Builder
+			expr.WriteString("^")
+			for i, literal := range routeParam.Split(pattern, -1) {
+				if i > 0 {
+					expr.WriteString("[^/]+")
+				}
+				expr.WriteString(regexp.QuoteMeta(literal))
+			}
+			expr.WriteString("$")
+			routes = append(routes, route{method: method, pattern: pattern, re: regexp.MustCompile(expr.String())})
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return strings.Count(routes[i].pattern, "{") < strings.Count(routes[j].pattern, "{")
+	})
+	return routes
+}
+
+// operations lists the operations of the document as "METHOD template".
+func operations(t *testing.T, spec *openapi.Spec) map[string]bool {
+	t.Helper()
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(spec.JSON(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	ops := map[string]bool{}
+	for path, item := range doc.Paths {
+		for method := range item {
+			if method == "parameters" || method == "summary" || method == "description" {
+				continue
+			}
+			ops[strings.ToUpper(method)+" "+routeParam.ReplaceAllString(path, "{}")] = true
+		}
+	}
+	return ops
+}
+
+// harness is the server of main with every feature on, over a fresh
+// database.
+type harness struct {
+	spec   *openapi.Spec
+	router *chi.Mux
+	nodes  *chi.Mux
+	routes []route
+	// hit counts the requests served by each route.
+	hit map[string]int
+	// vars are the values steps use, as $name, and save.
+	vars map[string]string
+	// cookies are the session tokens steps make requests as.
+	cookies map[string]string
+}
+
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+	// receiver stands in for push services, webhook and notification
+	// endpoints.
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(receiver.Close)
+
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.Database.Path = filepath.Join(dir, "test.db")
+	cfg.Sensor.Enabled = false
+	cfg.NodeTLS.Enabled = true
+	cfg.NodeTLS.KeyFile = filepath.Join(dir, "node-ca.key")
+	cfg.Session.Admins = []string{adminEmail}
+	cfg.Push.AllowHTTP = true
+	cfg.Notify.Channels = []config.ChannelConfig{{Name: "test", Type: "webhook", URL: receiver.URL}}
+
+	db, err := database.Open(cfg.Database.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close(db) })
+	svc := services{}
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	svc.sensors, err = sensor.NewSensorStore(cfg.Sensor, db)
+	must(err)
+	svc.alerts, err = alert.NewEngine(db)
+	must(err)
+	svc.sensors.Observe(svc.alerts.Observe)
+	svc.notifier, err = notify.NewDispatcher(cfg.Notify)
+	must(err)
+	svc.webhooks, err = webhook.NewDispatcher(db, cfg.Webhooks)
+	must(err)
+	svc.sensors.Observe(svc.webhooks.Observe)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		svc.webhooks.Run(ctx)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	svc.push, err = webpush.NewService(db, cfg.Push)
+	must(err)
+	svc.preferences, err = preferences.NewPreferenceStore(db)
+	must(err)
+	svc.ca, err = pki.New(db, cfg.NodeTLS)
+	must(err)
+	svc.spec, err = openapi.Load()
+	must(err)
+	store, err := session.NewSessionStore(db)
+	must(err)
+	sessions = session.NewSessionServer(store, cfg.Server.TemplatesDir)
+	conf = newOAuthConfig(cfg.OAuth)
+
+	h := &harness{
+		spec:    svc.spec,
+		router:  Routes(cfg, svc),
+		nodes:   NodeRoutes(cfg, svc),
+		hit:     map[string]int{},
+		cookies: map[string]string{},
+		vars:    map[string]string{"receiver": receiver.URL},
+	}
+	h.routes = walk(t, h.router, h.nodes)
+
+	for name, email := range map[string]string{"admin": adminEmail, "user": userEmail, "other": adminEmail} {
+		s, token, err := store.Create(email, name, "test", remoteAddr)
+		must(err)
+		h.cookies[name], h.vars[name+"_session"] = token, s.ID
+	}
+	key, _, _, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	must(err)
+	x, y := elliptic.P256().ScalarBaseMult(key)
+	h.vars["p256dh"] = base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), x, y))
+	auth := make([]byte, 16)
+	_, err = rand.Read(auth)
+	must(err)
+	h.vars["auth"] = base64.RawURLEncoding.EncodeToString(auth)
+	return h
+}
+
+// step is one request of the scenario. Path, body and header values may
+// use $vars; in the body they are JSON escaped.
+type step struct {
+	method, path string
+	body         string
+	header       map[string]string
+	// as is the session the request is made with: admin by default, none
+	// for "-".
+	as string
+	// cert names the var holding the PEM client certificate requests to
+	// the node listener are made with.
+	cert   string
+	status int
+	// save sets vars to fields of the JSON response, given as paths like
+	// "node.sensor_id" or "0.id".
+	save map[string]string
+	// wait repeats the request until the fields of save are there, for
+	// what background work adds.
+	wait bool
+}
+
+func (h *harness) expand(t *testing.T, s string, escape bool) string {
+	t.Helper()
+	return os.Expand(s, func(name string) string {
+		v, ok := h.vars[name]
+		if !ok {
+			t.Fatalf("$%s is not set", name)
+		}
+		if escape {
+			b, _ := json.Marshal(v)
+			return string(b[1 : len(b)-1])
+		}
+		return v
+	})
+}
+
+func (h *harness) do(t *testing.T, s step) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		err := h.try(t, s)
+		if err == nil {
+			return
+		}
+		if !s.wait || time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+	}
+}
+
+// try makes the request of s once. Errors in the response fields save
+// wants are returned; the rest fail t.
+func (h *harness) try(t *testing.T, s step) error {
+	t.Helper()
+	path := h.expand(t, s.path, false)
+	name := s.method + " " + path
+	var body io.Reader
+	if s.body != "" {
+		body = strings.NewReader(h.expand(t, s.body, true))
+	}
+	req := httptest.NewRequest(s.method, path, body)
+	req.RemoteAddr = remoteAddr + ":1234"
+	if s.body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range s.header {
+		req.Header.Set(k, h.expand(t, v, false))
+	}
+
+	var handler http.Handler = h.router
+	if strings.HasPrefix(path, "/api/v1/node/") {
+		handler = h.nodes
+		if s.cert != "" {
+			block, _ := pem.Decode([]byte(h.vars[s.cert]))
+			if block == nil {
+				t.Fatalf("%s: $%s is not a PEM certificate", name, s.cert)
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		}
+	} else if s.as != "-" {
+		as := s.as
+		if as == "" {
+			as = "admin"
+		}
+		req.AddCookie(&http.Cookie{Name: session.CookieName, Value: h.cookies[as]})
+	}
+
+	h.cover(t, s.method, req.URL.Path)
+	rec, err := h.spec.Check(handler, req)
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+	}
+	if rec.Code != s.status {
+		t.Errorf("%s: status %d, want %d: %s", name, rec.Code, s.status, rec.Body.String())
+		return nil
+	}
+	if len(s.save) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(rec.Body)
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	saved := make(map[string]string, len(s.save))
+	for key, field := range s.save {
+		value, err := lookup(v, field)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		saved[key] = value
+	}
+	for key, value := range saved {
+		h.vars[key] = value
+	}
+	return nil
+}
+
+// cover records which route serves method and path.
+func (h *harness) cover(t *testing.T, method, path string) {
+	t.Helper()
+	for _, r := range h.routes {
+		if r.method == method && r.re.MatchString(path) {
+			h.hit[r.method+" "+r.pattern]++
+			return
+		}
+	}
+	t.Errorf("%s %s: no route", method, path)
+}
+
+// lookup returns the value at field, a dotted path of object keys and
+// array indexes, in v.
+func lookup(v interface{}, field string) (string, error) {
+	for _, key := range strings.Split(field, ".") {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			v = x[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i >= len(x) {
+				return "", fmt.Errorf("%s: no element %s in %v", field, key, x)
+			}
+			v = x[i]
+		default:
+			return "", fmt.Errorf("%s: %s of %v", field, key, v)
+		}
+	}
+	switch x := v.(type) {
+	case string:
+		return x, nil
+	case json.Number:
+		return x.String(), nil
+	case nil:
+		return "", fmt.Errorf("%s is not set", field)
+	}
+	return fmt.Sprint(v), nil
+}
+
+func TestRoutesMatchSpec(t *testing.T) {
+	h := newHarness(t)
+	ops := operations(t, h.spec)
+	routed := map[string]bool{}
+	for _, r := range h.routes {
+		op := r.method + " " + r.template()
+		routed[op] = true
+		if !ops[op] {
+			t.Errorf("%s %s is not in the spec", r.method, r.pattern)
+		}
+	}
+	for op := range ops {
+		if !routed[op] {
+			t.Errorf("%s is in the spec but not routed", op)
+		}
+	}
+}
+
+const (
+	reading  = `{"temperature": 21.5, "humidity": 40, "pressure": 101325}`
+	rule     = `{"name": "Attic heat", "sensor_id": $node, "quantity": "temperature", "condition": "above", "threshold": 30, "for": "5m"}`
+	hook     = `{"url": "$receiver/hook", "secret": "0123456789abcdef0123", "filter": {"events": ["reading"]}}`
+	driver   = `{"mode": "forced", "temperature_oversampling": 1, "pressure_oversampling": 1, "humidity_oversampling": 1, "iir_filter": 0, "standby_ms": 1000}`
+	pushSub  = `{"endpoint": "$receiver/push/%d", "keys": {"p256dh": "$p256dh", "auth": "$auth"}}`
+	bearer   = "Bearer $token"
+	contract = "skarbek contract test"
+)
+
+// oversized is a reading padded past the 1 MiB push limit.
+var oversized = reading + strings.Repeat(" ", 1<<20)
+
+// scenario walks through the API as an admin setting up a node, its
+// certificate, alerts, webhooks and push notifications would, in an order
+// where every request has what it needs.
+var scenario = []step{
+	{method: "GET", path: "/", status: 200},
+	{method: "GET", path: "/hello/world", status: 200},
+	{method: "GET", path: "/api/openapi.json", status: 200},
+	{method: "GET", path: "/api/docs", status: 200},
+	{method: "GET", path: "/login", as: "-", status: 200},
+	{method: "GET", path: "/auth?state=forged&code=x", as: "-", status: 401},
+	{method: "GET", path: "/sessions", status: 200},
+	{method: "GET", path: "/sessions", as: "-", status: 303},
+	{method: "GET", path: "/enroll", status: 200},
+	{method: "POST", path: "/enroll", status: 200},
+	{method: "GET", path: "/enroll", as: "user", status: 403},
+
+	// A node registered by an admin, and one that enrolls with a code.
+	{method: "POST", path: "/api/v1/sensor/nodes", status: 201,
+		body: `{"node_id": "aa:bb:cc:00:00:01", "quantities": ["temperature", "humidity", "pressure"]}`,
+		save: map[string]string{"node": "node.sensor_id", "token": "token"}},
+	{method: "POST", path: "/api/v1/sensor/nodes", as: "user", status: 403, body: `{"node_id": "aa:bb:cc:00:00:09"}`},
+	{method: "POST", path: "/api/v1/sensor/enrollments", status: 201, save: map[string]string{"code": "code"}},
+	{method: "POST", path: "/api/v1/sensor/enrollments", status: 404, body: `{"sensor_id": 9999}`},
+	{method: "GET", path: "/api/v1/sensor/enrollments", status: 200},
+	{method: "POST", path: "/api/v1/sensor/enroll", as: "-", status: 201,
+		body: `{"code": "$code", "node_id": "aa:bb:cc:00:00:02"}`, save: map[string]string{"spare": "sensor_id"}},
+	{method: "POST", path: "/api/v1/sensor/enroll", as: "-", status: 403,
+		body: `{"code": "$code", "node_id": "aa:bb:cc:00:00:03"}`},
+	{method: "POST", path: "/api/v1/sensor/$node/approve", status: 409, body: `{"name": "Attic"}`},
+	{method: "POST", path: "/api/v1/sensor/$spare/approve", status: 200, body: `{"name": "Attic", "room": "Loft"}`},
+	{method: "POST", path: "/api/v1/sensor/$spare/revoke", status: 200},
+
+	// Webhooks and alerts before the readings that trigger them.
+	{method: "POST", path: "/api/v1/webhooks", status: 201, body: hook, save: map[string]string{"hook": "id"}},
+	{method: "GET", path: "/api/v1/webhooks", as: "-", status: 401},
+	{method: "POST", path: "/api/v1/alerts/rules", status: 201, body: rule, save: map[string]string{"rule": "id"}},
+	{method: "POST", path: "/api/v1/alerts/rules", status: 400,
+		body: `{"name": "Nothing", "sensor_id": $node, "quantity": "humidity", "condition": "above", "threshold": 60, "window": "1h"}`},
+
+	{method: "POST", path: "/api/v1/sensor/$node/readings", as: "-", status: 200, body: reading,
+		header: map[string]string{"Authorization": bearer, "Idempotency-Key": "first"}},
+	{method: "POST", path: "/api/v1/sensor/$node/readings", as: "-", status: 200, body: reading,
+		header: map[string]string{"Authorization": bearer, "Idempotency-Key": "first"}},
+	{method: "POST", path: "/api/v1/sensor/$node/readings", as: "-", status: 401, body: reading,
+		header: map[string]string{"Authorization": "Bearer skd_wrong"}},
+	{method: "POST", path: "/api/v1/sensor/$node/readings", as: "-", status: 413, body: oversized,
+		header: map[string]string{"Authorization": bearer}},
+
+	{method: "GET", path: "/api/v1/sensor", status: 200},
+	{method: "GET", path: "/api/v1/sensor?units=imperial", status: 200},
+	{method: "GET", path: "/api/v1/sensor/nodes", status: 200},
+	{method: "GET", path: "/api/v1/sensor/$node", status: 200},
+	{method: "GET", path: "/api/v1/sensor/$node?derived=all", status: 200},
+	{method: "GET", path: "/api/v1/sensor/9999", status: 404},
+	{method: "GET", path: "/api/v1/sensor/$node/readings", status: 200},
+	{method: "GET", path: "/api/v1/sensor/$node/site", status: 200},
+	{method: "PUT", path: "/api/v1/sensor/$node/site", status: 200, body: `{"station_elevation": 120}`},
+	{method: "GET", path: "/api/v1/sensor/$node/forecast", status: 200},
+	{method: "GET", path: "/api/v1/sensor/$node/filters", status: 200},
+	{method: "PUT", path: "/api/v1/sensor/$node/filters", status: 200,
+		body: `{"temperature": {"min": -40, "max": 85, "median": 3, "smoothing": "ema", "alpha": 0.3}}`},
+	{method: "DELETE", path: "/api/v1/sensor/$node/filters", status: 200},
+	{method: "GET", path: "/api/v1/sensor/$node/driver", status: 200},
+	{method: "PUT", path: "/api/v1/sensor/$node/driver", status: 200, body: driver},
+	{method: "DELETE", path: "/api/v1/sensor/$node/driver", status: 200},
+
+	{method: "GET", path: "/api/v1/sensor/$node/calibration", status: 200},
+	{method: "PUT", path: "/api/v1/sensor/$node/calibration", status: 200,
+		body: `{"humidity": {"gain": 1, "offset": -2}, "note": "salt test"}`},
+	{method: "GET", path: "/api/v1/sensor/$node/calibration/history", status: 200},
+	{method: "POST", path: "/api/v1/sensor/$node/calibration/points", status: 201,
+		body: `{"quantity": "temperature", "reference": 20, "raw": 20.5}`},
+	{method: "POST", path: "/api/v1/sensor/$node/calibration/points", status: 201,
+		body: `{"quantity": "temperature", "reference": 30, "raw": 30.9}`},
+	{method: "GET", path: "/api/v1/sensor/$node/calibration/points", status: 200},
+	{method: "POST", path: "/api/v1/sensor/$node/calibration/two-point", status: 200, body: `{"quantity": "temperature"}`},
+	{method: "POST", path: "/api/v1/sensor/$node/token", status: 200, save: map[string]string{"token": "token"}},
+
+	// The node trades its token for a certificate and moves to the mutual
+	// TLS listener.
+	{method: "GET", path: "/api/v1/pki/ca.pem", as: "-", status: 200},
+	{method: "GET", path: "/api/v1/pki/crl", as: "-", status: 200},
+	{method: "POST", path: "/api/v1/pki/certificates", as: "-", status: 201, body: `{"sensor_id": $node}`,
+		header: map[string]string{"Authorization": bearer}, save: map[string]string{"cert": "certificate", "serial": "serial"}},
+	{method: "POST", path: "/api/v1/pki/certificates", as: "-", status: 401, body: `{"sensor_id": $node}`,
+		header: map[string]string{"Authorization": bearer}},
+	{method: "POST", path: "/api/v1/sensor/$node/readings", as: "-", status: 401, body: reading,
+		header: map[string]string{"Authorization": bearer}},
+	{method: "POST", path: "/api/v1/node/readings", cert: "cert", status: 200, body: reading},
+	{method: "GET", path: "/api/v1/node/ca.pem", cert: "cert", status: 200},
+	{method: "GET", path: "/api/v1/node/ca.pem", status: 401},
+	{method: "POST", path: "/api/v1/node/certificate", cert: "cert", status: 201, body: `{}`},
+	{method: "GET", path: "/api/v1/pki/certificates?sensor_id=$node", status: 200},
+	{method: "GET", path: "/api/v1/pki/certificates", as: "user", status: 403},
+	{method: "POST", path: "/api/v1/pki/certificates/$serial/revoke", status: 200, body: `{"reason": "superseded"}`},
+	{method: "POST", path: "/api/v1/pki/certificates/ffff/revoke", status: 404},
+	{method: "POST", path: "/api/v1/node/readings", cert: "cert", status: 401, body: reading},
+
+	{method: "GET", path: "/api/v1/alerts/rules", as: "-", status: 200},
+	{method: "GET", path: "/api/v1/alerts/rules/$rule", as: "-", status: 200},
+	{method: "PUT", path: "/api/v1/alerts/rules/$rule", status: 200, body: rule},
+	{method: "PUT", path: "/api/v1/alerts/rules/$rule", as: "-", status: 401, body: rule},
+	{method: "DELETE", path: "/api/v1/alerts/rules/$rule", status: 204},
+	{method: "GET", path: "/api/v1/alerts/rules/$rule", status: 404},
+
+	{method: "POST", path: "/api/v1/notify/test", status: 200, body: `{"channel": "test", "title": "` + contract + `"}`},
+	{method: "POST", path: "/api/v1/notify/test", status: 404, body: `{"channel": "none"}`},
+
+	{method: "GET", path: "/api/v1/webhooks", status: 200},
+	{method: "GET", path: "/api/v1/webhooks/$hook", status: 200},
+	{method: "PUT", path: "/api/v1/webhooks/$hook", status: 200, body: hook},
+	{method: "GET", path: "/api/v1/webhooks/$hook/deliveries", status: 200, save: map[string]string{"delivery": "0.id"}, wait: true},
+	{method: "GET", path: "/api/v1/webhooks/$hook/deliveries/$delivery", status: 200},
+	{method: "POST", path: "/api/v1/webhooks/$hook/deliveries/$delivery/redeliver", status: 202},
+	{method: "DELETE", path: "/api/v1/webhooks/$hook", status: 204},
+	{method: "GET", path: "/api/v1/webhooks/$hook", status: 404},
+
+	{method: "GET", path: "/api/v1/preferences", status: 200},
+	{method: "PUT", path: "/api/v1/preferences", status: 200, body: `{"units": "imperial,hPa"}`},
+	{method: "PUT", path: "/api/v1/preferences", status: 400, body: `{"units": "furlongs"}`},
+	{method: "GET", path: "/api/v1/preferences", as: "-", status: 401},
+
+	{method: "GET", path: "/api/v1/push/key", as: "-", status: 200},
+	{method: "POST", path: "/api/v1/push/subscriptions", status: 201, body: fmt.Sprintf(pushSub, 1)},
+	{method: "POST", path: "/api/v1/push/subscriptions", status: 200, body: fmt.Sprintf(pushSub, 1)},
+	{method: "POST", path: "/api/v1/push/subscriptions", status: 201, body: fmt.Sprintf(pushSub, 2), save: map[string]string{"push": "id"}},
+	{method: "POST", path: "/api/v1/push/subscriptions", status: 400, body: `{"endpoint": "ftp://push", "keys": {"p256dh": "x", "auth": "y"}}`},
+	{method: "GET", path: "/api/v1/push/subscriptions", status: 200},
+	{method: "POST", path: "/api/v1/push/test", status: 200, body: `{"title": "` + contract + `"}`},
+	{method: "POST", path: "/api/v1/push/unsubscribe", status: 204, body: `{"endpoint": "$receiver/push/1"}`},
+	{method: "DELETE", path: "/api/v1/push/subscriptions/$push", status: 204},
+	{method: "DELETE", path: "/api/v1/push/subscriptions/$push", status: 404},
+
+	{method: "GET", path: "/api/v1/sessions", status: 200},
+	{method: "DELETE", path: "/api/v1/sessions/$user_session", status: 404},
+	{method: "DELETE", path: "/api/v1/sessions/$other_session", status: 204},
+	{method: "DELETE", path: "/api/v1/sessions", status: 200},
+	{method: "POST", path: "/logout", status: 303},
+	{method: "GET", path: "/api/v1/sessions", status: 401},
+}
+
+func TestContract(t *testing.T) {
+	h := newHarness(t)
+	for _, s := range scenario {
+		h.do(t, s)
+	}
+	for _, r := range h.routes {
+		if h.hit[r.method+" "+r.pattern] == 0 {
+			t.Errorf("%s %s is not in the scenario", r.method, r.pattern)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/maskarb/skarbek-dev/internal/certs"
+	"github.com/maskarb/skarbek-dev/internal/config"
+	"github.com/maskarb/skarbek-dev/internal/logging"
+	"github.com/maskarb/skarbek-dev/internal/pki"
+	"github.com/maskarb/skarbek-dev/internal/shutdown"
+	"github.com/maskarb/skarbek-dev/internal/systemd"
+)
+
+// server is one listener run by main.
+type server struct {
+	*http.Server
+	name     string
+	tls      bool
+	listener net.Listener
+}
+
+// serve blocks until the server stops. A server stopped by Shutdown returns
+// nil.
+func (s *server) serve() error {
+	s.ErrorLog = logging.For("http").With("server", s.name).StdLogger(logging.LevelWarn)
+	var err error
+	if s.tls {
+		err = s.ServeTLS(s.listener, "", "")
+	} else {
+		err = s.Serve(s.listener)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// listen binds every server, preferring sockets passed in by systemd socket
+// activation. Activated sockets are matched to servers by their
+// FileDescriptorName= (http, https, redirect or nodes); unnamed sockets are
+// handed out in server order. Servers left without one bind their own address.
+func listen(servers []*server) error {
+	activated, err := systemd.Listeners()
+	if err != nil {
+		return err
+	}
+	named := make(map[string]net.Listener)
+	var unnamed []net.Listener
+	for _, l := range activated {
+		if l.Name == "unknown" {
+			unnamed = append(unnamed, l.Listener)
+		} else {
+			named[l.Name] = l.Listener
+		}
+	}
+
+	for _, s := range servers {
+		if l, ok := named[s.name]; ok {
+			delete(named, s.name)
+			s.listener = l
+		} else if len(unnamed) > 0 {
+			s.listener, unnamed = unnamed[0], unnamed[1:]
+		} else {
+			l, err := net.Listen("tcp", s.Addr)
+			if err != nil {
+				return fmt.Errorf("%s server: %v", s.name, err)
+			}
+			s.listener = l
+			continue
+		}
+		logger.Info("using socket activated listener", "server", s.name, "addr", s.listener.Addr())
+	}
+
+	for name, l := range named {
+		logger.Warn("ignoring unused socket activated listener", "name", name, "addr", l.Addr())
+		l.Close()
+	}
+	for _, l := range unnamed {
+		logger.Warn("ignoring unused socket activated listener", "addr", l.Addr())
+		l.Close()
+	}
+	return nil
+}
+
+// newServers builds the plain HTTP server and, when TLS is enabled, the
+// HTTPS server plus the redirect/ACME challenge listener. Certificate
+// renewal runs in bg.
+func newServers(cfg *config.Config, router http.Handler, bg *shutdown.Group) ([]*server, error) {
+	if !cfg.TLS.Enabled {
+		return []*server{{
+			Server: &http.Server{Addr: cfg.Server.Addr, Handler: router},
+			name:   "http",
+		}}, nil
+	}
+
+	var (
+		tlsConfig *tls.Config
+		challenge http.Handler
+	)
+	if cfg.TLS.ACME.Enabled {
+		manager, err := certs.NewACME(cfg.TLS.ACME)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = manager.TLSConfig()
+		challenge = manager.HTTPHandler()
+	} else {
+		reloader, err := certs.NewReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		bg.Go("certificate reload", func(ctx context.Context) {
+			reloader.Watch(ctx, cfg.TLS.ReloadInterval.Duration)
+		})
+		tlsConfig = certs.ServerConfig(reloader.GetCertificate)
+		if cfg.TLS.ChallengeDir != "" {
+			challenge = certs.WebrootChallenge(cfg.TLS.ChallengeDir)
+		}
+	}
+
+	var handler = router
+	if cfg.TLS.HSTSMaxAge.Duration > 0 {
+		handler = certs.HSTS(cfg.TLS.HSTSMaxAge.Duration, cfg.TLS.HSTSIncludeSubdomains)(router)
+	}
+	servers := []*server{{
+		Server: &http.Server{Addr: cfg.TLS.Addr, Handler: handler, TLSConfig: tlsConfig},
+		name:   "https",
+		tls:    true,
+	}}
+
+	// The plain listener stays up without the redirect when ACME needs it
+	// for HTTP-01 challenges.
+	if cfg.TLS.Redirect || cfg.TLS.ACME.Enabled {
+		plain := challenge
+		if cfg.TLS.Redirect {
+			plain = certs.RedirectHandler(cfg.TLS.RedirectPort, challenge)
+		}
+		servers = append(servers, &server{
+			Server: &http.Server{Addr: cfg.Server.Addr, Handler: plain},
+			name:   "redirect",
+		})
+	}
+	return servers, nil
+}
+
+// newNodeServer builds the mutual TLS listener of the nodes. It presents a
+// certificate of the node CA and only completes handshakes with clients
+// holding a valid certificate from it.
+func newNodeServer(cfg *config.Config, router http.Handler, ca *pki.CA) *server {
+	return &server{
+		Server: &http.Server{Addr: cfg.NodeTLS.Addr, Handler: router, TLSConfig: ca.ServerTLSConfig()},
+		name:   "nodes",
+		tls:    true,
+	}
+}